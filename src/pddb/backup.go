@@ -0,0 +1,684 @@
+package pddb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// 页日志文件的后缀, 记录每次提交写入的page
+const pagelogSuffix = ".pagelog"
+
+// 页日志和增量备份的魔法数
+const (
+	pagelogMagic     uint32 = 0x50474C31
+	incrementalMagic uint32 = 0x50444931
+)
+
+// 页日志头: 魔法数 + 保留 + 开始记录时的事务id
+const pagelogHeaderSize = 16
+
+// 增量备份头: 魔法数 + page大小 + page数量 + 保留 + 起始事务id + 事务id
+const incrementalHeaderSize = 32
+
+// 增量备份允许的最大page大小
+const maxPageSize = 1 << 16
+
+// 读写暂存的完整快照时的缓冲区大小
+const incrementalSpoolBufferSize = 1 << 20
+
+// 页日志
+// 每次提交追加一条记录: 事务id + page数量 + page id... + 校验和
+// 记录在元数据之前同步到磁盘, 保证已经提交的事务一定有记录
+type pagelog struct {
+	file dbFile
+	// 日志文件路径和权限, 内存数据库为空
+	path string
+	mode os.FileMode
+	// 开始记录时的事务id, 之前写入的page没有记录
+	start txid
+	size  int64
+	lock  sync.Mutex
+}
+
+// 打开页日志, 丢弃没有提交的事务的记录
+// 日志与数据库不连续时(例如中间有提交没有开启记录)从当前事务重新开始记录
+func openPagelog(path string, mode os.FileMode, current txid, readOnly bool) (*pagelog, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, mode)
+	if os.IsNotExist(err) && readOnly {
+		return &pagelog{start: current}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	l := &pagelog{file: f, path: path, mode: mode}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	start, last, size, ok, err := replayPagelog(f, info.Size(), current, nil)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	} else if ok && start <= current && last == current {
+		l.start, l.size = start, size
+		return l, nil
+	}
+
+	// 重新开始记录
+	if readOnly {
+		return &pagelog{start: current}, f.Close()
+	}
+	if l, err = newPagelog(f, current); err != nil {
+		return nil, err
+	}
+	l.path, l.mode = path, mode
+	return l, nil
+}
+
+// 清空日志文件并从current开始记录, 失败时关闭文件
+func newPagelog(f dbFile, current txid) (*pagelog, error) {
+	l := &pagelog{file: f, start: current}
+	header := make([]byte, pagelogHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], pagelogMagic)
+	binary.LittleEndian.PutUint64(header[8:16], uint64(current))
+	if err := f.Truncate(0); err != nil {
+		_ = f.Close()
+		return nil, err
+	} else if _, err := f.WriteAt(header, 0); err != nil {
+		_ = f.Close()
+		return nil, err
+	} else if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	l.size = pagelogHeaderSize
+	return l, nil
+}
+
+// 按顺序读取日志文件的前size字节, 对事务id不大于current的记录调用fn, 每次只读取一条记录
+// 返回开始记录的事务id, 最后一条有效记录的事务id和有效数据的长度, 日志头无效时返回false
+func replayPagelog(f io.ReaderAt, size int64, current txid, fn func(id txid, ids []pgid)) (start, last txid, off int64, ok bool, err error) {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	header := make([]byte, pagelogHeaderSize)
+	if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, 0, false, err
+	} else if binary.LittleEndian.Uint32(header[0:4]) != pagelogMagic {
+		return 0, 0, 0, false, nil
+	}
+	start = txid(binary.LittleEndian.Uint64(header[8:16]))
+	last = start
+
+	off = pagelogHeaderSize
+	head := make([]byte, 12)
+	for size-off >= 12 {
+		if _, err := io.ReadFull(r, head); err != nil {
+			return 0, 0, 0, false, err
+		}
+		id := txid(binary.LittleEndian.Uint64(head[0:8]))
+		count := int64(binary.LittleEndian.Uint32(head[8:12]))
+		end := 12 + count*8
+		if off+end+8 > size {
+			break
+		}
+		buf := make([]byte, end+8)
+		copy(buf, head)
+		if _, err := io.ReadFull(r, buf[12:]); err != nil {
+			return 0, 0, 0, false, err
+		} else if binary.LittleEndian.Uint64(buf[end:end+8]) != walChecksum(buf[:end]) {
+			break
+		}
+		// 没有提交的事务的记录之后的数据都无效
+		if id > current {
+			break
+		}
+		if fn != nil {
+			ids := make([]pgid, count)
+			for i := range ids {
+				ids[i] = pgid(binary.LittleEndian.Uint64(buf[12+i*8:]))
+			}
+			fn(id, ids)
+		}
+		last = id
+		off += end + 8
+	}
+	return start, last, off, true, nil
+}
+
+// 编码一条日志记录
+func encodePagelogRecord(id txid, ids []pgid) []byte {
+	buf := make([]byte, 12, 12+len(ids)*8+8)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(id))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(ids)))
+	for _, pid := range ids {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(pid))
+	}
+	return binary.LittleEndian.AppendUint64(buf, walChecksum(buf))
+}
+
+// 追加一条记录并同步到磁盘
+func (l *pagelog) append(id txid, ids []pgid) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	buf := encodePagelogRecord(id, ids)
+	if _, err := l.file.WriteAt(buf, l.size); err != nil {
+		_ = l.file.Truncate(l.size)
+		return err
+	} else if err := l.file.Sync(); err != nil {
+		_ = l.file.Truncate(l.size)
+		return err
+	}
+	l.size += int64(len(buf))
+	return nil
+}
+
+// 返回事务id在(since, current]之间的提交写入过的page
+func (l *pagelog) written(since, current txid) (map[pgid]bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if since < l.start || l.file == nil {
+		return nil, ErrPagelogIncomplete
+	}
+
+	ids := make(map[pgid]bool)
+	if _, _, _, _, err := replayPagelog(l.file, l.size, current, func(id txid, written []pgid) {
+		if id > since {
+			for _, pgid := range written {
+				ids[pgid] = true
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// 删除事务id不大于before的记录, 之后增量备份的since不能早于before
+// 保留的记录先写入新文件, 同步后替换原文件, 出错时原文件不受影响
+func (l *pagelog) prune(before txid) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return ErrPagelogIncomplete
+	} else if before <= l.start {
+		return nil
+	}
+
+	var f dbFile = &memFile{}
+	tmp := l.path + ".tmp"
+	if l.path != "" {
+		file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, l.mode)
+		if err != nil {
+			return err
+		}
+		f = file
+	}
+	pruned, err := newPagelog(f, before)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		_ = f.Close()
+		if l.path != "" {
+			_ = os.Remove(tmp)
+		}
+		return err
+	}
+
+	var werr error
+	if _, _, _, _, err := replayPagelog(l.file, l.size, ^txid(0), func(id txid, ids []pgid) {
+		if id <= before || werr != nil {
+			return
+		}
+		buf := encodePagelogRecord(id, ids)
+		if _, werr = f.WriteAt(buf, pruned.size); werr == nil {
+			pruned.size += int64(len(buf))
+		}
+	}); err != nil {
+		return fail(err)
+	} else if werr != nil {
+		return fail(werr)
+	} else if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if l.path != "" {
+		if err := os.Rename(tmp, l.path); err != nil {
+			return fail(err)
+		}
+	}
+
+	_ = l.file.Close()
+	l.file, l.start, l.size = f, before, pruned.size
+	return nil
+}
+
+func (l *pagelog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// 返回事务可见的所有page, 包括freelist page
+func (tx *Tx) reachablePages() map[pgid]*page {
+	reachable := make(map[pgid]*page)
+	reachable[tx.meta.freelist] = tx.page(tx.meta.freelist)
+	tx.forEachBucketPage(&tx.root, func(p *page, _ *Bucket) {
+		reachable[p.id] = p
+	})
+	return reachable
+}
+
+// 返回写入文件的page数据, c为nil时不加密
+func encodePage(c Cipher, p *page, pageSize int) []byte {
+	if c != nil {
+		return encryptPage(c, p, pageSize)
+	}
+	size := (int(p.overflow) + 1) * pageSize
+	return (*[maxAllocSize]byte)(unsafe.Pointer(p))[:size:size]
+}
+
+// 返回写入文件的元数据page
+func (tx *Tx) metaPage(id txid) []byte {
+	buf := make([]byte, tx.db.pageSize)
+	m := *tx.meta
+	m.txid = id
+	p := tx.db.pageInBuffer(buf, 0)
+	p.flags = metaPageFlag
+	m.write(p)
+	return buf
+}
+
+// 将事务可见的完整数据库写入w, 得到的文件可以直接打开
+// 空闲page写入0, 开启加密时写入加密后的数据
+func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	}
+	pageSize := tx.db.pageSize
+
+	// 两份meta page使用相同的数据, 另一份的事务id较小
+	ids := []txid{tx.meta.txid, tx.meta.txid - 1}
+	if tx.meta.txid%2 == 1 {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+	for _, id := range ids {
+		written, err := w.Write(tx.metaPage(id))
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	reachable := tx.reachablePages()
+	empty := make([]byte, pageSize)
+	for id := pgid(2); id < tx.meta.pgid; {
+		buf := empty
+		if p := reachable[id]; p != nil {
+			buf = encodePage(tx.db.cipher, p, pageSize)
+			id += pgid(p.overflow)
+		}
+		written, err := w.Write(buf)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+		id++
+	}
+	return n, nil
+}
+
+// 在读事务中将完整数据库写入w, 可以用于持久化内存数据库
+func (db *DB) WriteTo(w io.Writer) (n int64, err error) {
+	err = db.View(func(tx *Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// 将事务id大于since的提交写入且当前仍然可见的page, 以及当前的元数据写入w
+// 需要打开数据库时开启TrackPages, 并且since不早于开始记录的事务
+// 得到的增量备份可以通过ApplyIncremental应用到事务id不小于since的备份上
+func (tx *Tx) WriteIncrementalTo(w io.Writer, since int) (n int64, err error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if tx.db.pagelog == nil {
+		return 0, ErrPagelogIncomplete
+	} else if since < 0 || txid(since) > tx.meta.txid {
+		return 0, ErrBackupChain
+	}
+
+	written, err := tx.db.pagelog.written(txid(since), tx.meta.txid)
+	if err != nil {
+		return 0, err
+	}
+	reachable := tx.reachablePages()
+	var pages pages
+	for id := range written {
+		if p := reachable[id]; p != nil {
+			pages = append(pages, p)
+		}
+	}
+	sort.Sort(pages)
+
+	return tx.writeIncremental(w, txid(since), pages)
+}
+
+// 删除页日志中事务id不大于before的记录, 避免页日志无限增长
+// 之后WriteIncrementalTo的since不能早于before, before大于当前事务id时使用当前事务id
+func (db *DB) PrunePagelog(before int) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	} else if db.readOnly {
+		return ErrDatabaseReadOnly
+	} else if db.pagelog == nil {
+		return ErrPagelogIncomplete
+	} else if before < 0 {
+		return ErrBackupChain
+	}
+	if current := db.meta().txid; txid(before) > current {
+		before = int(current)
+	}
+	return db.pagelog.prune(txid(before))
+}
+
+// 将page和事务的元数据按照增量备份的格式写入w
+// 格式为: 头 + page... + meta page + 校验和, page与数据库文件中的格式相同
+func (tx *Tx) writeIncremental(w io.Writer, since txid, pages pages) (n int64, err error) {
+	header := make([]byte, incrementalHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], incrementalMagic)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(tx.db.pageSize))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(pages)))
+	binary.LittleEndian.PutUint64(header[16:24], uint64(since))
+	binary.LittleEndian.PutUint64(header[24:32], uint64(tx.meta.txid))
+
+	h := fnv.New64()
+	write := func(b []byte) error {
+		_, _ = h.Write(b)
+		written, err := w.Write(b)
+		n += int64(written)
+		return err
+	}
+	if err := write(header); err != nil {
+		return n, err
+	}
+	for _, p := range pages {
+		if err := write(encodePage(tx.db.cipher, p, tx.db.pageSize)); err != nil {
+			return n, err
+		}
+	}
+	if err := write(tx.metaPage(tx.meta.txid)); err != nil {
+		return n, err
+	}
+	return n, write(binary.LittleEndian.AppendUint64(nil, h.Sum64()))
+}
+
+// 解析后的增量备份
+type incremental struct {
+	pageSize int
+	since    txid
+	txid     txid
+	// 写入文件的page数据, 开启加密时只有page头是明文
+	pages [][]byte
+	// 暂存完整快照page数据的文件, 不为nil时pages为空
+	spool dbFile
+	// 暂存的page数量
+	count int
+	// meta page数据
+	meta []byte
+}
+
+// 从r中读取一个增量备份, r中没有数据时返回io.EOF, 数据不完整时返回io.ErrUnexpectedEOF
+// spool不为nil时完整快照的page数据写入spool返回的文件, 不保留在内存中, 使用后需要调用close
+func readIncremental(r io.Reader, spool func() (dbFile, error)) (inc *incremental, err error) {
+	h := fnv.New64()
+	read := func(b []byte) error {
+		if _, err := io.ReadFull(r, b); err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		_, _ = h.Write(b)
+		return nil
+	}
+
+	header := make([]byte, incrementalHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	} else if binary.LittleEndian.Uint32(header[0:4]) != incrementalMagic {
+		return nil, ErrInvalidBackup
+	}
+	_, _ = h.Write(header)
+	inc = &incremental{
+		pageSize: int(binary.LittleEndian.Uint32(header[4:8])),
+		since:    txid(binary.LittleEndian.Uint64(header[16:24])),
+		txid:     txid(binary.LittleEndian.Uint64(header[24:32])),
+	}
+	if inc.pageSize < pageHeaderSize || inc.pageSize > maxPageSize {
+		return nil, ErrInvalidBackup
+	}
+
+	// 完整快照可能很大, 写入暂存文件
+	var w *bufio.Writer
+	if inc.since == 0 && spool != nil {
+		if inc.spool, err = spool(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				inc.close()
+			}
+		}()
+		w = bufio.NewWriterSize(io.NewOffsetWriter(inc.spool, 0), incrementalSpoolBufferSize)
+	}
+
+	count := int(binary.LittleEndian.Uint32(header[8:12]))
+	var buf []byte
+	for i := 0; i < count; i++ {
+		hdr := make([]byte, pageHeaderSize)
+		if err := read(hdr); err != nil {
+			return nil, err
+		}
+		p := (*page)(unsafe.Pointer(&hdr[0]))
+		if p.id <= 1 || int64(p.overflow+1)*int64(inc.pageSize) > maxAllocSize {
+			return nil, ErrInvalidBackup
+		}
+		size := (int(p.overflow) + 1) * inc.pageSize
+		if w == nil || cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		copy(buf, hdr)
+		if err := read(buf[pageHeaderSize:]); err != nil {
+			return nil, err
+		}
+		if w == nil {
+			inc.pages = append(inc.pages, buf)
+		} else if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	if w != nil {
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		inc.count = count
+	}
+
+	inc.meta = make([]byte, inc.pageSize)
+	if err := read(inc.meta); err != nil {
+		return nil, err
+	}
+	sum := h.Sum64()
+	checksum := make([]byte, 8)
+	if err := read(checksum); err != nil {
+		return nil, err
+	} else if binary.LittleEndian.Uint64(checksum) != sum {
+		return nil, ErrInvalidBackup
+	}
+
+	if m := inc.metadata(); m.validate() != nil || m.txid != inc.txid || int(m.pageSize) != inc.pageSize {
+		return nil, ErrInvalidBackup
+	}
+	return inc, nil
+}
+
+// 返回增量备份中的元数据
+func (inc *incremental) metadata() *meta {
+	return (*page)(unsafe.Pointer(&inc.meta[0])).meta()
+}
+
+// 关闭暂存文件
+func (inc *incremental) close() {
+	if inc.spool != nil {
+		_ = inc.spool.Close()
+		inc.spool = nil
+	}
+}
+
+// 将page写入文件, fn不为nil时在每个page写入后调用
+func (inc *incremental) writePages(f io.WriterAt, fn func(p *page)) error {
+	write := func(buf []byte) error {
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		if _, err := f.WriteAt(buf, int64(p.id)*int64(inc.pageSize)); err != nil {
+			return err
+		}
+		if fn != nil {
+			fn(p)
+		}
+		return nil
+	}
+	if inc.spool == nil {
+		for _, buf := range inc.pages {
+			if err := write(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// 从暂存文件中依次读取page, 内容已经校验过
+	r := bufio.NewReaderSize(io.NewSectionReader(inc.spool, 0, math.MaxInt64), incrementalSpoolBufferSize)
+	var buf []byte
+	for i := 0; i < inc.count; i++ {
+		hdr, err := r.Peek(pageHeaderSize)
+		if err != nil {
+			return err
+		}
+		size := (int((*page)(unsafe.Pointer(&hdr[0])).overflow) + 1) * inc.pageSize
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if err := write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将元数据写入文件, full为true时另一份meta page写入事务id较小的相同数据
+func (inc *incremental) writeMeta(f io.WriterAt, full bool) error {
+	if _, err := f.WriteAt(inc.meta, int64(inc.txid%2)*int64(inc.pageSize)); err != nil {
+		return err
+	}
+	if !full {
+		return nil
+	}
+
+	buf := make([]byte, inc.pageSize)
+	copy(buf, inc.meta)
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	m := p.meta()
+	m.txid--
+	m.write(p)
+	_, err := f.WriteAt(buf, int64(p.id)*int64(inc.pageSize))
+	return err
+}
+
+// 将增量备份应用到path处的数据库文件, 数据库不能被打开
+// 数据库的事务id必须在增量备份的[since, txid)范围内, 应用中断后可以重新应用同一个增量备份
+func ApplyIncremental(path string, r io.Reader) error {
+	inc, err := readIncremental(r, nil)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidBackup
+	} else if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return err
+	}
+
+	// 校验增量备份可以应用到当前的数据库
+	current, err := readFileMeta(f, inc.pageSize)
+	if err != nil {
+		return err
+	} else if current.txid < inc.since || current.txid >= inc.txid {
+		return fmt.Errorf("database txid %d, backup %d-%d: %s", current.txid, inc.since, inc.txid, ErrBackupChain)
+	}
+
+	// 先写入page, 最后写入元数据
+	if err := inc.writePages(f, nil); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := inc.writeMeta(f, false); err != nil {
+		return err
+	} else if err := f.Truncate(int64(inc.metadata().pgid) * int64(inc.pageSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// 从没有打开的数据库文件中读取事务id较大且有效的元数据
+func readFileMeta(f *os.File, pageSize int) (*meta, error) {
+	buf := make([]byte, 2*pageSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	var current *meta
+	for i := 0; i < 2; i++ {
+		m := (*page)(unsafe.Pointer(&buf[i*pageSize])).meta()
+		if m.validate() != nil || int(m.pageSize) != pageSize {
+			continue
+		}
+		if current == nil || m.txid > current.txid {
+			current = m
+		}
+	}
+	if current == nil {
+		return nil, ErrInvalid
+	}
+	return current, nil
+}
@@ -0,0 +1,290 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pddb"
+	"strings"
+	"testing"
+)
+
+// 写入一批数据, 包括修改, 删除和子bucket
+func writeBatch(t *testing.T, db *pddb.DB, batch int) {
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 300; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i*(batch+1))), bytes.Repeat([]byte{byte(batch)}, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Delete([]byte(fmt.Sprintf("%04d", i*3))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		name := []byte(fmt.Sprintf("child-%d", batch))
+		child, err := b.CreateBucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Put([]byte("foo"), bytes.Repeat([]byte("x"), 5000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DeleteBucket([]byte(fmt.Sprintf("child-%d", batch-1))); err != nil && err != pddb.ErrBucketNotFound {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 返回数据库导出的内容, 用于比较两个数据库
+func dumpDB(t *testing.T, db *pddb.DB) string {
+	var buf bytes.Buffer
+	if err := db.View(func(tx *pddb.Tx) error {
+		if err := tx.Check(); err != nil {
+			t.Fatal(err)
+		}
+		return tx.Dump(&buf)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// 完整备份可以直接作为数据库打开
+func TestTx_WriteTo(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+	for i := 0; i < 3; i++ {
+		writeBatch(t, db, i)
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(backup)
+	if dumpDB(t, backup) != dumpDB(t, db) {
+		t.Fatal("backup mismatch")
+	}
+}
+
+// 在完整备份上依次应用增量备份
+func TestApplyIncremental(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + ".pagelog")
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{TrackPages: true, Cipher: MustCipher(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	writeBatch(t, db, 0)
+
+	// 完整备份
+	restored := tempfile()
+	defer os.Remove(restored)
+	var full bytes.Buffer
+	var txid int
+	if err := db.View(func(tx *pddb.Tx) error {
+		txid = tx.ID()
+		_, err := tx.WriteTo(&full)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(restored, full.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个较大的增量备份和一个只修改了一个key的增量备份
+	var incrementals []*bytes.Buffer
+	for i := 1; i <= 3; i++ {
+		if i < 3 {
+			writeBatch(t, db, i)
+			writeBatch(t, db, i+10)
+		} else if err := db.Update(func(tx *pddb.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := db.View(func(tx *pddb.Tx) error {
+			_, err := tx.WriteIncrementalTo(&buf, txid)
+			txid = tx.ID()
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		incrementals = append(incrementals, &buf)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		n, err := tx.WriteTo(&bytes.Buffer{})
+		if size := int64(incrementals[2].Len()); size*4 > n {
+			t.Fatalf("incremental too large: %d, full %d", size, n)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 顺序不对时不能应用
+	if err := pddb.ApplyIncremental(restored, bytes.NewReader(incrementals[1].Bytes())); err == nil || !strings.Contains(err.Error(), pddb.ErrBackupChain.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, buf := range incrementals {
+		if err := pddb.ApplyIncremental(restored, bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 损坏的增量备份
+	corrupt := append([]byte{}, incrementals[0].Bytes()...)
+	corrupt[len(corrupt)/2]++
+	if err := pddb.ApplyIncremental(restored, bytes.NewReader(corrupt)); err != pddb.ErrInvalidBackup {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backup, err := pddb.Open(restored, 0666, &pddb.Options{Cipher: MustCipher(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(backup)
+	if dumpDB(t, backup) != dumpDB(t, db) {
+		t.Fatal("restored database mismatch")
+	}
+}
+
+// 页日志不包含的事务不能导出增量备份
+func TestTx_WriteIncrementalTo_ErrPagelogIncomplete(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + ".pagelog")
+
+	db, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeBatch(t, db, 0)
+	if err := db.View(func(tx *pddb.Tx) error {
+		_, err := tx.WriteIncrementalTo(&bytes.Buffer{}, 0)
+		return err
+	}); err != pddb.ErrPagelogIncomplete {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 开启记录之前的提交没有记录
+	db, err = pddb.Open(path, 0666, &pddb.Options{TrackPages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	writeBatch(t, db, 1)
+	if err := db.View(func(tx *pddb.Tx) error {
+		if _, err := tx.WriteIncrementalTo(&bytes.Buffer{}, tx.ID()-1); err != nil {
+			t.Fatal(err)
+		}
+		_, err := tx.WriteIncrementalTo(&bytes.Buffer{}, tx.ID()-2)
+		return err
+	}); err != pddb.ErrPagelogIncomplete {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 删除页日志中较早的记录后, 只能从删除位置之后导出增量备份, 重新打开后同样有效
+func TestDB_PrunePagelog(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + ".pagelog")
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{TrackPages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		writeBatch(t, db, i)
+	}
+
+	// 删除位置的完整备份
+	restored := tempfile()
+	defer os.Remove(restored)
+	var full bytes.Buffer
+	var since int
+	if err := db.View(func(tx *pddb.Tx) error {
+		since = tx.ID()
+		_, err := tx.WriteTo(&full)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(restored, full.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	writeBatch(t, db, 3)
+
+	size := fileSize(t, path+".pagelog")
+	if err := db.PrunePagelog(since); err != nil {
+		t.Fatal(err)
+	} else if fileSize(t, path+".pagelog") >= size {
+		t.Fatal("expected pagelog pruned")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = pddb.Open(path, 0666, &pddb.Options{TrackPages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	writeBatch(t, db, 4)
+	var buf bytes.Buffer
+	if err := db.View(func(tx *pddb.Tx) error {
+		if _, err := tx.WriteIncrementalTo(&bytes.Buffer{}, since-1); err != pddb.ErrPagelogIncomplete {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err := tx.WriteIncrementalTo(&buf, since)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pddb.ApplyIncremental(restored, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := pddb.Open(restored, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(backup)
+	if dumpDB(t, backup) != dumpDB(t, db) {
+		t.Fatal("restored database mismatch")
+	}
+}
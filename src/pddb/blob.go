@@ -0,0 +1,371 @@
+package pddb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"unsafe"
+)
+
+// blob在叶子节点中保存的value: blob大小 + 第一个blob page的id
+const blobValueSize = 16
+
+// blob page头之后的数据: 下一个blob page的id + 本页数据长度 + 保留
+const blobPageHeaderSize = 16
+
+// blob允许的最大大小
+const MaxBlobSize = 1 << 40
+
+// 将r中的size字节作为value写入bucket, 数据保存在单独的blob page链中
+// 每个blob page独立分配, 不需要连续的空闲page, 写入过程中直接写入数据库文件或者预写日志, 不保存在内存中
+// blob不压缩, 不维护索引, 游标, ForEach和变更事件中不包含blob的数据
+// 写入时不重新映射数据库, 事务中之前读取的value和创建的游标仍然有效, 数据库文件增长后在提交时重新映射
+func (b *Bucket) PutReader(key []byte, r io.Reader, size int64) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writeable() {
+		return ErrTxNotWriteable
+	} else if err := b.tx.checkContext(); err != nil {
+		return err
+	} else if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	} else if size < 0 || size > MaxBlobSize {
+		return ErrValueTooLarge
+	}
+
+	c := b.Cursor()
+	k, _, flags := c.seek(key)
+	if bytes.Equal(key, k) && (flags&bucketLeafFlag) != 0 {
+		return ErrIncompatibleValue
+	}
+
+	first, err := b.tx.writeBlob(r, size)
+	if err != nil {
+		return err
+	}
+
+	value := make([]byte, blobValueSize)
+	binary.LittleEndian.PutUint64(value[0:8], uint64(size))
+	binary.LittleEndian.PutUint64(value[8:16], uint64(first))
+
+	// 与Put一样清除过期时间并移除旧value的索引, 失败时释放新写入的blob
+	old, blob, err := b.oldValue(key)
+	if err == nil {
+		err = b.clearExpiry(key)
+	}
+	if err == nil {
+		err = b.updateIndexes(key, old, nil)
+	}
+	if err != nil {
+		b.tx.freeBlob(value)
+		return err
+	}
+	b.tx.recordBlobChange(b.path, key, old, blob != nil)
+
+	key = cloneBytes(key)
+	c.node().put(key, key, value, 0, blobValueFlag)
+
+	// 新value写入之后再释放旧value引用的blob
+	if blob != nil {
+		b.tx.freeBlob(blob)
+	}
+	return nil
+}
+
+// 返回读取key对应value的io.ReadSeeker, key不存在或者是子bucket时返回nil
+// 读取blob时按需读取blob page, 返回的reader只在事务期间有效
+func (b *Bucket) GetReader(key []byte) io.ReadSeeker {
+	k, v, flags := b.Cursor().seek(key)
+	if !bytes.Equal(key, k) || (flags&bucketLeafFlag) != 0 || b.expired(key) {
+		return nil
+	}
+	if (flags & blobValueFlag) == 0 {
+		v, err := decodeValue(v, flags)
+		if err != nil {
+			return errReadSeeker{err}
+		}
+		return bytes.NewReader(v)
+	}
+	return b.tx.openBlob(v)
+}
+
+// value无法解码时GetReader返回的reader, 读取时返回错误
+type errReadSeeker struct {
+	err error
+}
+
+func (r errReadSeeker) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (r errReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return 0, r.err
+}
+
+// 返回覆盖或者删除key之前的旧value, 用于维护索引
+// 旧value是blob时old为nil, 返回blob引用, 调用者写入新value之后再释放
+func (b *Bucket) oldValue(key []byte) (old, blob []byte, err error) {
+	k, v, flags := b.Cursor().seek(key)
+	if !bytes.Equal(key, k) {
+		return nil, nil, nil
+	} else if (flags & blobValueFlag) != 0 {
+		return nil, cloneBytes(v), nil
+	}
+	old, err = decodeValue(v, flags)
+	if err != nil {
+		return nil, nil, err
+	} else if old == nil {
+		old = []byte{}
+	}
+	return old, nil, nil
+}
+
+// blob page中可以保存的数据大小
+func (db *DB) blobCapacity() int {
+	return db.pageSize - pageHeaderSize - blobPageHeaderSize - db.pageReserve
+}
+
+// 返回blob page中的数据和下一个blob page的id
+func blobData(p *page) ([]byte, pgid) {
+	body := (*[maxAllocSize]byte)(unsafe.Pointer(&p.ptr))
+	next := pgid(binary.LittleEndian.Uint64(body[0:8]))
+	n := int(binary.LittleEndian.Uint32(body[8:12]))
+	return body[blobPageHeaderSize : blobPageHeaderSize+n : blobPageHeaderSize+n], next
+}
+
+// 将r中的size字节写入新分配的blob page链, 返回第一个page的id
+// 出错时释放已经分配的page
+func (tx *Tx) writeBlob(r io.Reader, size int64) (first pgid, err error) {
+	db := tx.db
+	capacity := db.blobCapacity()
+
+	var allocated []pgid
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, id := range allocated {
+			db.freelist.free(tx.meta.txid, &page{id: id})
+		}
+	}()
+
+	// 开启预写日志时按批写入日志的blob page记录
+	var frame []byte
+	if db.wal != nil {
+		frame = make([]byte, walFrameHeaderSize, walFrameHeaderSize+walBlobFramePages*db.pageSize+8)
+		binary.LittleEndian.PutUint32(frame[0:4], walBlobMagic)
+		binary.LittleEndian.PutUint64(frame[8:16], uint64(tx.meta.txid))
+	}
+
+	var prev *page
+	for remaining := size; ; {
+		// 不重新映射, 避免事务中之前返回的value失效, 提交时再重新映射
+		p := tx.db.allocatePage(1)
+		tx.pages[p.id] = p
+		allocated = append(allocated, p.id)
+		p.flags = blobPageFlag
+		p.count = 0
+
+		n := capacity
+		if int64(n) > remaining {
+			n = int(remaining)
+		}
+		body := (*[maxAllocSize]byte)(unsafe.Pointer(&p.ptr))
+		binary.LittleEndian.PutUint64(body[0:8], 0)
+		binary.LittleEndian.PutUint32(body[8:12], uint32(n))
+		if _, err := io.ReadFull(r, body[blobPageHeaderSize:blobPageHeaderSize+n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		remaining -= int64(n)
+
+		if prev == nil {
+			first = p.id
+		} else {
+			binary.LittleEndian.PutUint64((*[maxAllocSize]byte)(unsafe.Pointer(&prev.ptr))[0:8], uint64(p.id))
+			if frame, err = tx.flushBlobPage(prev, frame); err != nil {
+				return 0, err
+			}
+		}
+		prev = p
+		if remaining == 0 {
+			break
+		}
+	}
+	if frame, err = tx.flushBlobPage(prev, frame); err != nil {
+		return 0, err
+	} else if len(frame) > walFrameHeaderSize {
+		return first, db.wal.appendBlobs(frame, db.pageSize)
+	}
+	return first, nil
+}
+
+// 将写满的blob page写入数据库文件, 开启预写日志时追加到blob page记录, 记录写满后写入日志
+// blob page是新分配的page, 提交之前不会被其他事务读取, 写入后不再保存在内存中
+func (tx *Tx) flushBlobPage(p *page, frame []byte) ([]byte, error) {
+	db := tx.db
+	buf := encodePage(db.cipher, p, db.pageSize)
+	if db.wal != nil {
+		frame = append(frame, buf...)
+		if len(frame) >= walFrameHeaderSize+walBlobFramePages*db.pageSize {
+			if err := db.wal.appendBlobs(frame, db.pageSize); err != nil {
+				return frame, err
+			}
+			frame = frame[:walFrameHeaderSize]
+		}
+	} else if _, err := db.file.WriteAt(buf, int64(p.id)*int64(db.pageSize)); err != nil {
+		return frame, err
+	}
+	db.invalidatePages(pages{p})
+
+	delete(tx.pages, p.id)
+	tx.blobs = append(tx.blobs, p.id)
+	buf = (*[maxAllocSize]byte)(unsafe.Pointer(p))[:db.pageSize]
+	for i := range buf {
+		buf[i] = 0
+	}
+	db.pagePool.Put(buf)
+	return frame, nil
+}
+
+// 返回直接写入文件或者日志的blob page, 用于复制
+func (tx *Tx) flushedBlobPages() pages {
+	pages := make(pages, 0, len(tx.blobs))
+	for _, id := range tx.blobs {
+		pages = append(pages, tx.db.page(id))
+	}
+	sort.Sort(pages)
+	return pages
+}
+
+// 返回本次提交写入的所有page id, 包括直接写入文件或者日志的blob page, 用于页日志
+func (tx *Tx) writtenIDs(pages pages) []pgid {
+	ids := make([]pgid, 0, len(pages)+len(tx.blobs))
+	for _, p := range pages {
+		ids = append(ids, p.id)
+	}
+	ids = append(ids, tx.blobs...)
+	sort.Sort(pgids(ids))
+	return ids
+}
+
+// 遍历blob value引用的所有page
+func (tx *Tx) forEachBlobPage(value []byte, fn func(p *page)) {
+	for id := pgid(binary.LittleEndian.Uint64(value[8:16])); id != 0; {
+		p := tx.page(id)
+		fn(p)
+		_, id = blobData(p)
+	}
+}
+
+// 释放blob value引用的所有page
+func (tx *Tx) freeBlob(value []byte) {
+	tx.forEachBlobPage(value, func(p *page) {
+		tx.db.freelist.free(tx.meta.txid, &page{id: p.id})
+	})
+}
+
+// 释放bucket中所有blob value引用的page, inline bucket中同样可能有blob
+func (b *Bucket) freeBlobs() {
+	b.forEachPageNode(func(p *page, n *node, _ int) {
+		b.tx.freeBlobs(p, n)
+	})
+}
+
+// 释放page或者node中blob value引用的page
+func (tx *Tx) freeBlobs(p *page, n *node) {
+	if n != nil {
+		if n.isLeaf {
+			for _, inode := range n.inodes {
+				if (inode.flags & blobValueFlag) != 0 {
+					tx.freeBlob(inode.value)
+				}
+			}
+		}
+		return
+	}
+	if p != nil && (p.flags&leafPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			if elem := p.leafPageElement(uint16(i)); (elem.flags & blobValueFlag) != 0 {
+				tx.freeBlob(elem.value())
+			}
+		}
+	}
+}
+
+// 读取完整的blob
+func (tx *Tx) readBlob(value []byte) []byte {
+	buf := make([]byte, 0, binary.LittleEndian.Uint64(value[0:8]))
+	tx.forEachBlobPage(value, func(p *page) {
+		data, _ := blobData(p)
+		buf = append(buf, data...)
+	})
+	return buf
+}
+
+// 打开blob reader
+func (tx *Tx) openBlob(value []byte) *blobReader {
+	return &blobReader{
+		tx:   tx,
+		size: int64(binary.LittleEndian.Uint64(value[0:8])),
+		ids:  []pgid{pgid(binary.LittleEndian.Uint64(value[8:16]))},
+	}
+}
+
+// 按需读取blob page的reader
+type blobReader struct {
+	tx     *Tx
+	size   int64
+	offset int64
+	// 已经读取过的blob page的id, 用于Seek
+	ids []pgid
+}
+
+func (r *blobReader) Read(b []byte) (int, error) {
+	if r.tx.db == nil {
+		return 0, ErrTxClosed
+	} else if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	capacity := int64(r.tx.db.blobCapacity())
+	index := int(r.offset / capacity)
+	for len(r.ids) <= index {
+		_, next := blobData(r.tx.page(r.ids[len(r.ids)-1]))
+		if next == 0 {
+			return 0, ErrInvalidBlob
+		}
+		r.ids = append(r.ids, next)
+	}
+
+	data, _ := blobData(r.tx.page(r.ids[index]))
+	off := int(r.offset % capacity)
+	if off >= len(data) {
+		return 0, ErrInvalidBlob
+	}
+	n := copy(b, data[off:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, ErrInvalidSeek
+	}
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+	r.offset = offset
+	return offset, nil
+}
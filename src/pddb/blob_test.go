@@ -0,0 +1,353 @@
+package pddb_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"pddb"
+	"testing"
+	"time"
+)
+
+// 检查数据库一致性
+func checkDB(t *testing.T, db *pddb.DB) {
+	if err := db.View(func(tx *pddb.Tx) error { return tx.Check() }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 写入blob后按需读取, 覆盖和删除时释放blob page
+func TestBucket_PutReader(t *testing.T) {
+	for name, options := range map[string]*pddb.Options{
+		"default": nil,
+		"cipher":  {Cipher: MustCipher(5)},
+		"wal":     {WAL: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := tempfile()
+			defer os.Remove(path)
+			defer os.Remove(path + ".wal")
+			db, err := pddb.Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blob := make([]byte, 1<<20+123)
+			rand.New(rand.NewSource(1)).Read(blob)
+			if err := db.Update(func(tx *pddb.Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte("a"), []byte("small")); err != nil {
+					return err
+				}
+				if err := b.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob))); err != nil {
+					return err
+				}
+				// 同一个事务中可以读取
+				if v := b.Get([]byte("blob")); !bytes.Equal(v, blob) {
+					t.Fatal("unexpected blob")
+				}
+				return b.PutReader([]byte("empty"), bytes.NewReader(nil), 0)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			checkDB(t, db)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if db, err = pddb.Open(path, 0666, options); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.View(func(tx *pddb.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				r := b.GetReader([]byte("blob"))
+				if v, err := ioutil.ReadAll(r); err != nil {
+					t.Fatal(err)
+				} else if !bytes.Equal(v, blob) {
+					t.Fatal("unexpected blob")
+				}
+
+				// 跳转到中间读取
+				if _, err := r.Seek(int64(len(blob)/2), io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, 10000)
+				if _, err := io.ReadFull(r, buf); err != nil {
+					t.Fatal(err)
+				} else if !bytes.Equal(buf, blob[len(blob)/2:len(blob)/2+len(buf)]) {
+					t.Fatal("unexpected data after seek")
+				}
+
+				if v := b.Get([]byte("empty")); v == nil || len(v) != 0 {
+					t.Fatalf("unexpected empty blob: %v", v)
+				}
+				if v, _ := ioutil.ReadAll(b.GetReader([]byte("a"))); string(v) != "small" {
+					t.Fatalf("unexpected value: %q", v)
+				}
+				if b.GetReader([]byte("missing")) != nil {
+					t.Fatal("expected nil reader")
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// 覆盖, 删除后blob page被释放
+			if err := db.Update(func(tx *pddb.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				if err := b.Put([]byte("blob"), []byte("replaced")); err != nil {
+					return err
+				}
+				if err := b.Delete([]byte("empty")); err != nil {
+					return err
+				}
+				return b.PutReader([]byte("a"), bytes.NewReader(blob[:5000]), 5000)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			checkDB(t, db)
+			if err := db.Update(func(tx *pddb.Tx) error {
+				return tx.DeleteBucket([]byte("widgets"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			checkDB(t, db)
+		})
+	}
+}
+
+// 游标和ForEach不读取blob的数据, 通过Cursor.Blob获取大小, Dump导出完整的value
+func TestCursor_Blob(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	blob := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(blob)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("a"), []byte("small")); err != nil {
+			return err
+		}
+		return b.PutReader([]byte("b"), bytes.NewReader(blob), int64(len(blob)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		c := b.Cursor()
+		if k, v := c.First(); string(k) != "a" || string(v) != "small" {
+			t.Fatalf("unexpected first: %s=%s", k, v)
+		} else if _, ok := c.Blob(); ok {
+			t.Fatal("unexpected blob")
+		}
+		if k, v := c.Next(); string(k) != "b" || v == nil || len(v) != 0 {
+			t.Fatalf("unexpected blob value: %s=%v", k, v)
+		} else if size, ok := c.Blob(); !ok || size != int64(len(blob)) {
+			t.Fatalf("unexpected blob size: %d, %v", size, ok)
+		}
+
+		var n int
+		if err := b.ForEach(func(k, v []byte) error {
+			if string(k) == "b" && len(v) != 0 {
+				t.Fatalf("unexpected blob value: %d bytes", len(v))
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.View(func(tx *pddb.Tx) error { return tx.Dump(&buf) }); err != nil {
+		t.Fatal(err)
+	}
+	loaded := MustOpenDB()
+	defer MustClose(loaded)
+	if err := loaded.Load(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("b")); !bytes.Equal(v, blob) {
+			t.Fatal("unexpected loaded blob")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 写入blob不重新映射, 不等待只读事务结束, 事务中之前读取的value仍然有效
+func TestBucket_PutReader_NoRemap(t *testing.T) {
+	for name, options := range map[string]*pddb.Options{
+		"default": nil,
+		"cipher":  {Cipher: MustCipher(5)},
+		"wal":     {WAL: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := tempfile()
+			defer os.Remove(path)
+			defer os.Remove(path + ".wal")
+			db, err := pddb.Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			update(t, db, "widgets", "a", []byte("small"))
+
+			reader, err := db.Begin(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = reader.Rollback() }()
+
+			blob := make([]byte, 4<<20)
+			rand.New(rand.NewSource(1)).Read(blob)
+			written := make(chan struct{})
+			done := make(chan error, 1)
+			go func() {
+				done <- db.Update(func(tx *pddb.Tx) error {
+					b := tx.Bucket([]byte("widgets"))
+					v := b.Get([]byte("a"))
+					if err := b.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob))); err != nil {
+						return err
+					}
+					close(written)
+					if string(v) != "small" {
+						t.Errorf("unexpected value: %q", v)
+					}
+					if v, err := ioutil.ReadAll(b.GetReader([]byte("blob"))); err != nil {
+						return err
+					} else if !bytes.Equal(v, blob) {
+						t.Error("unexpected blob")
+					}
+					return nil
+				})
+			}()
+			select {
+			case <-written:
+			case <-time.After(5 * time.Second):
+				t.Fatal("PutReader blocked by read transaction")
+			}
+
+			// 提交时重新映射, 等待只读事务结束
+			if err := reader.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if err := db.View(func(tx *pddb.Tx) error {
+				if v := tx.Bucket([]byte("widgets")).Get([]byte("blob")); !bytes.Equal(v, blob) {
+					t.Fatal("unexpected committed blob")
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			checkDB(t, db)
+		})
+	}
+}
+
+// 数据不足时写入失败, 已经分配的page被释放
+func TestBucket_PutReader_ErrUnexpectedEOF(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.PutReader([]byte("blob"), bytes.NewReader(make([]byte, 100000)), 200000); err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if b.Get([]byte("blob")) != nil {
+			t.Fatal("unexpected value")
+		}
+
+		// 回滚到保存点同样归还分配的page
+		sp, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		if err := b.PutReader([]byte("blob"), bytes.NewReader(make([]byte, 100000)), 100000); err != nil {
+			return err
+		}
+		return tx.RollbackTo(sp)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkDB(t, db)
+}
+
+// 压缩失败的codec
+type failCodec struct{}
+
+func (failCodec) ID() byte                              { return 202 }
+func (failCodec) Compress(src []byte) ([]byte, error)   { return nil, errors.New("compress failed") }
+func (failCodec) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+// 新value编码失败时旧blob保持不变, 不会被释放
+func TestBucket_Put_EncodeErrorKeepsBlob(t *testing.T) {
+	if err := pddb.RegisterCodec(failCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	blob := make([]byte, 50000)
+	rand.New(rand.NewSource(2)).Read(blob)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob))); err != nil {
+			return err
+		}
+		return b.SetCompression(failCodec{}, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("blob"), []byte("replaced")); err == nil {
+			t.Fatal("expected error")
+		}
+		if v := b.Get([]byte("blob")); !bytes.Equal(v, blob) {
+			t.Fatal("unexpected blob")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkDB(t, db)
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("blob")); !bytes.Equal(v, blob) {
+			t.Fatal("unexpected blob")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,7 @@ package pddb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"unsafe"
 )
@@ -20,6 +21,9 @@ const DefaultFillPercent = 0.5
 
 const bucketHeaderSize = int(unsafe.Sizeof(bucket{}))
 
+// 系统bucket名称前缀
+const systemBucketPrefix = "__pddb_"
+
 type bucket struct {
 	root     pgid
 	sequence uint64
@@ -28,12 +32,18 @@ type bucket struct {
 type Bucket struct {
 	*bucket
 	tx       *Tx
+	path     [][]byte
 	buckets  map[string]*Bucket
 	page     *page
 	rootNode *node
 	nodes    map[pgid]*node
 
 	FillPercent float64
+
+	// 压缩配置缓存
+	codec          Codec
+	codecThreshold int
+	codecLoaded    bool
 }
 
 func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
@@ -41,6 +51,8 @@ func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
 		return nil, ErrTxClosed
 	} else if !b.tx.writeable {
 		return nil, ErrTxNotWriteable
+	} else if err := b.tx.checkContext(); err != nil {
+		return nil, err
 	} else if len(key) == 0 {
 		return nil, ErrBucketNameRequired
 	}
@@ -71,6 +83,75 @@ func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
 	return b.Bucket(key), nil
 }
 
+// 创建bucket, 如果bucket已经存在则直接返回
+func (b *Bucket) CreateBucketIfNotExists(key []byte) (*Bucket, error) {
+	child, err := b.CreateBucket(key)
+	if err == ErrBucketExists {
+		return b.Bucket(key), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// 删除子bucket及其包含的所有数据
+func (b *Bucket) DeleteBucket(key []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writeable() {
+		return ErrTxNotWriteable
+	} else if err := b.tx.checkContext(); err != nil {
+		return err
+	}
+
+	c := b.Cursor()
+	k, _, flags := c.seek(key)
+
+	if !bytes.Equal(key, k) {
+		return ErrBucketNotFound
+	} else if (flags & bucketLeafFlag) == 0 {
+		return ErrIncompatibleValue
+	}
+
+	// 先递归删除所有子bucket
+	child := b.Bucket(key)
+	var names [][]byte
+	cc := child.Cursor()
+	for k, _, flags := cc.rawFirst(); k != nil; k, _, flags = cc.next() {
+		if (flags & bucketLeafFlag) != 0 {
+			names = append(names, cloneBytes(k))
+		}
+	}
+	for _, name := range names {
+		if err := child.DeleteBucket(name); err != nil {
+			return fmt.Errorf("delete bucket: %s", err)
+		}
+	}
+
+	// 清空bucket上的索引和过期时间, 避免重新创建后查询到旧的条目或者删除新的key
+	if !child.isSystem() {
+		if err := b.tx.resetIndexes(child.path); err != nil {
+			return err
+		} else if err := b.tx.clearExpiries(child.path); err != nil {
+			return err
+		}
+	}
+
+	// 移除缓存并释放bucket的所有page, 包括value引用的blob
+	child.freeBlobs()
+	delete(b.buckets, string(key))
+	child.nodes = nil
+	child.rootNode = nil
+	child.free()
+
+	c = b.Cursor()
+	c.seek(key)
+	c.node().del(key)
+	b.tx.recordChange(b.childPath(key), nil, nil, nil, false)
+
+	return nil
+}
+
 func (b *Bucket) Bucket(name []byte) *Bucket {
 	if b.buckets != nil {
 		if child := b.buckets[string(name)]; child != nil {
@@ -86,12 +167,79 @@ func (b *Bucket) Bucket(name []byte) *Bucket {
 	}
 
 	var child = b.openBucket(v)
+	child.path = b.childPath(name)
 	if b.buckets != nil {
 		b.buckets[string(name)] = child
 	}
 	return child
 }
 
+// 返回bucket所属的事务
+func (b *Bucket) Tx() *Tx {
+	return b.tx
+}
+
+// 返回bucket当前的序列号
+func (b *Bucket) Sequence() uint64 {
+	return b.bucket.sequence
+}
+
+// 设置bucket的序列号
+func (b *Bucket) SetSequence(v uint64) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writeable() {
+		return ErrTxNotWriteable
+	} else if err := b.tx.checkContext(); err != nil {
+		return err
+	} else if len(b.path) == 0 {
+		return ErrIncompatibleValue
+	}
+
+	// 实例化根节点, 保证提交时会写入bucket头
+	if b.rootNode == nil {
+		_ = b.node(b.root, nil)
+	}
+	b.bucket.sequence = v
+	return nil
+}
+
+// 递增并返回bucket的序列号, 可以用来生成自增id
+func (b *Bucket) NextSequence() (uint64, error) {
+	if err := b.SetSequence(b.bucket.sequence + 1); err != nil {
+		return 0, err
+	}
+	return b.bucket.sequence, nil
+}
+
+// 获取key对应的value, key不存在或者是子bucket时返回nil
+// 返回的value只在事务期间有效
+func (b *Bucket) Get(key []byte) []byte {
+	v, _ := b.Value(key)
+	return v
+}
+
+// 与Get相同, value无法解码时返回错误, 例如使用了当前进程没有注册的编码
+func (b *Bucket) Value(key []byte) ([]byte, error) {
+	k, v, flags := b.Cursor().seek(key)
+
+	if (flags & bucketLeafFlag) != 0 {
+		return nil, nil
+	}
+	if !bytes.Equal(key, k) {
+		return nil, nil
+	}
+	// 已经过期但还没有被清理的key视为不存在
+	if b.expired(key) {
+		return nil, nil
+	}
+	// blob需要读取完整的数据, 较大的blob应当使用GetReader
+	if (flags & blobValueFlag) != 0 {
+		return b.tx.readBlob(v), nil
+	}
+	return decodeValue(v, flags)
+}
+
 func (b *Bucket) Cursor() *Cursor {
 	// TODO 事务统计
 	return &Cursor{
@@ -105,10 +253,17 @@ func (b *Bucket) Writeable() bool {
 }
 
 func (b *Bucket) Put(key []byte, value []byte) error {
+	return b.put(key, value, true)
+}
+
+// 写入k/v, hooks为false时不清除过期时间也不维护索引, 用于原样导入数据
+func (b *Bucket) put(key []byte, value []byte, hooks bool) error {
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writeable() {
 		return ErrTxNotWriteable
+	} else if err := b.tx.checkContext(); err != nil {
+		return err
 	} else if len(key) == 0 {
 		return ErrKeyRequired
 	} else if len(key) > MaxKeySize {
@@ -117,6 +272,11 @@ func (b *Bucket) Put(key []byte, value []byte) error {
 		return ErrValueTooLarge
 	}
 
+	// nil与空value等价, 统一保存为空value, 避免Get时与key不存在混淆
+	if value == nil {
+		value = []byte{}
+	}
+
 	c := b.Cursor()
 	k, _, flags := c.seek(key)
 
@@ -124,12 +284,143 @@ func (b *Bucket) Put(key []byte, value []byte) error {
 		return ErrIncompatibleValue
 	}
 
+	old, blob, err := b.oldValue(key)
+	if err != nil {
+		return err
+	}
+
+	// 根据压缩配置编码value, 编码失败时不修改任何数据
+	encoded, vflags, err := b.encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	if hooks {
+		// 普通写入会清除key之前设置的过期时间
+		if err := b.clearExpiry(key); err != nil {
+			return err
+		}
+
+		// 维护bucket上注册的索引
+		if err := b.updateIndexes(key, old, value); err != nil {
+			return err
+		}
+		b.tx.recordChange(b.path, key, old, value, blob != nil)
+	}
+
 	key = cloneBytes(key)
-	c.node().put(key, key, value, 0, 0)
+	c.node().put(key, key, encoded, 0, vflags)
 
+	// 新value写入之后再释放旧value引用的blob
+	if blob != nil {
+		b.tx.freeBlob(blob)
+	}
+	return nil
+}
+
+// 删除key, key不存在时不做任何操作
+func (b *Bucket) Delete(key []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writeable() {
+		return ErrTxNotWriteable
+	} else if err := b.tx.checkContext(); err != nil {
+		return err
+	}
+
+	c := b.Cursor()
+	k, _, flags := c.seek(key)
+
+	if !bytes.Equal(key, k) {
+		return nil
+	} else if (flags & bucketLeafFlag) != 0 {
+		return ErrIncompatibleValue
+	}
+
+	old, blob, err := b.oldValue(key)
+	if err != nil {
+		return err
+	}
+	if err := b.updateIndexes(key, old, nil); err != nil {
+		return err
+	}
+	b.tx.recordChange(b.path, key, old, nil, blob != nil)
+
+	c.node().del(key)
+	if blob != nil {
+		b.tx.freeBlob(blob)
+	}
+
+	return b.clearExpiry(key)
+}
+
+// 按顺序遍历bucket中的所有k/v, 子bucket的value为nil, blob的value为空
+func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		// 关联的context取消后停止遍历
+		if err := b.tx.checkContext(); err != nil {
+			return err
+		} else if err := c.Err(); err != nil {
+			return err
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// 子bucket的完整路径
+func (b *Bucket) childPath(name []byte) [][]byte {
+	path := make([][]byte, len(b.path), len(b.path)+1)
+	copy(path, b.path)
+	return append(path, cloneBytes(name))
+}
+
+// bucket是否是pddb内部使用的系统bucket
+func (b *Bucket) isSystem() bool {
+	return len(b.path) > 0 && isSystemBucket(b.path[0])
+}
+
+// 以"__pddb_"开头的根bucket保留给pddb内部使用
+func isSystemBucket(name []byte) bool {
+	return bytes.HasPrefix(name, []byte(systemBucketPrefix))
+}
+
+// 将bucket路径编码成二进制, 格式为: 层数 + (名称长度 + 名称)...
+func encodeBucketPath(path [][]byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(path)))
+	for _, name := range path {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+	return buf
+}
+
+// 解码bucket路径, 返回路径以及剩余的数据
+func decodeBucketPath(buf []byte) ([][]byte, []byte, error) {
+	n, sz := binary.Uvarint(buf)
+	if sz <= 0 {
+		return nil, nil, ErrInvalidBucketPath
+	}
+	buf = buf[sz:]
+
+	path := make([][]byte, 0, n)
+	for i := uint64(0); i < n; i++ {
+		l, sz := binary.Uvarint(buf)
+		if sz <= 0 || uint64(len(buf)-sz) < l {
+			return nil, nil, ErrInvalidBucketPath
+		}
+		path = append(path, buf[sz:sz+int(l)])
+		buf = buf[sz+int(l):]
+	}
+	return path, buf, nil
+}
+
 func (b *Bucket) openBucket(value []byte) *Bucket {
 	var child = newBucket(b.tx)
 	if b.tx.writeable {
@@ -140,14 +431,29 @@ func (b *Bucket) openBucket(value []byte) *Bucket {
 	}
 
 	// Save a reference to the inline page if the bucket is inline.
+	// 写事务中写入blob可能重新映射数据库, 需要复制inline page
 	if child.root == 0 {
+		if b.tx.writeable {
+			value = cloneBytes(value)
+		}
 		child.page = (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
 	}
 	return &child
 }
 
-// TODO
+// 返回pgid对应的page或者node, 如果page已经被实例化成node则返回node
 func (b *Bucket) pageNode(id pgid) (*page, *node) {
+	// 行内bucket的page嵌在value中
+	if b.root == 0 {
+		if id != 0 {
+			panic(fmt.Sprintf("inline bucket non-zero page access(2): %d != 0", id))
+		}
+		if b.rootNode != nil {
+			return nil, b.rootNode
+		}
+		return b.page, nil
+	}
+
 	if b.nodes != nil {
 		if n := b.nodes[id]; n != nil {
 			return nil, n
@@ -300,7 +606,55 @@ func (b *Bucket) free() {
 	if b.root == 0 {
 		return
 	}
-	// TODO
+
+	var tx = b.tx
+	b.forEachPageNode(func(p *page, n *node, _ int) {
+		if p != nil {
+			tx.db.freelist.free(tx.meta.txid, p)
+		} else {
+			n.free()
+		}
+	})
+	b.root = 0
+}
+
+// 遍历bucket中的所有page
+func (b *Bucket) forEachPage(fn func(*page, int)) {
+	if b.page != nil {
+		fn(b.page, 0)
+		return
+	}
+	b.tx.forEachPage(b.root, 0, fn)
+}
+
+// 遍历bucket中的所有page或node
+func (b *Bucket) forEachPageNode(fn func(*page, *node, int)) {
+	if b.page != nil {
+		fn(b.page, nil, 0)
+		return
+	}
+	b._forEachPageNode(b.root, 0, fn)
+}
+
+func (b *Bucket) _forEachPageNode(pgid pgid, depth int, fn func(*page, *node, int)) {
+	var p, n = b.pageNode(pgid)
+
+	fn(p, n, depth)
+
+	if p != nil {
+		if (p.flags & branchPageFlag) != 0 {
+			for i := 0; i < int(p.count); i++ {
+				elem := p.branchPageElement(uint16(i))
+				b._forEachPageNode(elem.pgid, depth+1, fn)
+			}
+		}
+	} else {
+		if !n.isLeaf {
+			for _, inode := range n.inodes {
+				b._forEachPageNode(inode.pgid, depth+1, fn)
+			}
+		}
+	}
 }
 
 // 取消对于文件的引用
@@ -0,0 +1,242 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"pddb"
+	"testing"
+)
+
+// 写入的值可以在同一事务和之后的事务中读取
+func TestBucket_Get(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		if v := b.Get([]byte("baz")); v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 删除的key无法再读取
+func TestBucket_Delete(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Delete([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete([]byte("sub")); err != pddb.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 大量数据写入和删除后, 游标可以按顺序遍历所有key
+func TestBucket_Put_Large(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	const n = 5000
+	for i := 0; i < n; i += 1000 {
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := i; j < i+1000; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%08d", j)), make([]byte, 100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 删除所有奇数key
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 1; i < n; i += 2 {
+			if err := b.Delete([]byte(fmt.Sprintf("%08d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		i := 0
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if exp := fmt.Sprintf("%08d", i); string(k) != exp {
+				t.Fatalf("exp=%s; got=%s", exp, k)
+			}
+			i += 2
+		}
+		if i != n {
+			t.Fatalf("unexpected count: %d", i/2)
+		}
+
+		if k, _ := c.Seek([]byte("00000101")); string(k) != "00000102" {
+			t.Fatalf("unexpected seek: %s", k)
+		}
+		if k, _ := c.Prev(); string(k) != "00000100" {
+			t.Fatalf("unexpected prev: %s", k)
+		}
+		if k, _ := c.Last(); string(k) != fmt.Sprintf("%08d", n-2) {
+			t.Fatalf("unexpected last: %s", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 写事务中返回错误时回滚, 修改不可见且之后可以继续开启写事务
+func TestDB_Update_Rollback(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Errorf("marker")
+	}); err == nil || err.Error() != "marker" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 通过游标删除指定前缀的key, 其余key不受影响
+func TestCursor_Delete(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%c%04d", 'a'+i%3, i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.CreateBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		prefix := []byte("b")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if k, _ := c.Seek([]byte("sub")); string(k) != "sub" {
+			t.Fatalf("unexpected key: %s", k)
+		} else if err := c.Delete(); err != pddb.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		n := 0
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			if k[0] == 'b' {
+				t.Fatalf("unexpected key: %s", k)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 667+1 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,482 @@
+package pddb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// 变更日志所在的系统bucket
+// log子bucket: 事务id(8字节大端) + 序号(4字节大端) -> 编码后的变更
+// start: 变更日志完整记录的第一个事务id, last: 最后记录的事务id
+const changeLogBucketName = "__pddb_changes"
+
+var (
+	changeLogBucket   = []byte("log")
+	changeLogStartKey = []byte("start")
+	changeLogLastKey  = []byte("last")
+)
+
+// 变更日志默认保留的事务数量
+const DefaultChangeLogRetention = 10000
+
+// 编码后的变更中表示新value, 旧value是blob的标志
+const (
+	changeBlobFlag    = 0x08
+	changeOldBlobFlag = 0x10
+)
+
+// 订阅默认的缓冲区大小
+const DefaultSubscribeBufferSize = 1024
+
+// 已经提交的一次k/v变更
+type Change struct {
+	// 写入变更的事务id
+	TxID int
+	// bucket路径
+	Path [][]byte
+	// 为nil表示Path对应的bucket及其中的数据被删除
+	Key []byte
+	// 修改前的value, 为nil表示新增
+	Old []byte
+	// 修改前的value是blob时为true, 此时Old为空但不为nil, 不包含blob的数据
+	OldBlob bool
+	// 修改后的value, 为nil表示删除
+	New []byte
+	// 修改后的value是blob时为true, 此时New为空, 通过Bucket.GetReader读取
+	Blob bool
+}
+
+// 订阅者没有及时读取变更时的处理方式
+type Backpressure int
+
+const (
+	// 缓冲区满时关闭订阅, Err返回ErrSubscriberTooSlow
+	BackpressureDrop Backpressure = iota
+	// 缓冲区满时提交等待订阅者读取, 等待期间持有写锁
+	BackpressureBlock
+)
+
+// 订阅条件
+type ChangeFilter struct {
+	// bucket路径前缀, 为空时订阅所有用户bucket
+	Path [][]byte
+	// key前缀
+	Prefix []byte
+	// 先发送变更日志中该事务之后的变更, 需要开启Options.ChangeLog, 为0时只接收订阅之后的变更
+	Since int
+	// 缓冲区大小, <=0时使用DefaultSubscribeBufferSize
+	BufferSize int
+	// 缓冲区满时的处理方式
+	Backpressure Backpressure
+}
+
+// 变更是否满足订阅条件
+func (f *ChangeFilter) match(c *Change) bool {
+	// 删除上层bucket时订阅的数据同样被删除
+	if c.Key == nil && hasPathPrefix(f.Path, c.Path) {
+		return true
+	}
+	return hasPathPrefix(c.Path, f.Path) && bytes.HasPrefix(c.Key, f.Prefix)
+}
+
+// path是否以prefix开头
+func hasPathPrefix(path, prefix [][]byte) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if !bytes.Equal(path[i], prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 变更订阅, 通过C按照提交顺序接收变更
+// 变更只在提交成功写入磁盘后发送, 同一个事务中的变更按照写入顺序发送
+type Subscription struct {
+	// 订阅关闭后C被关闭
+	C <-chan *Change
+
+	db     *DB
+	c      chan *Change
+	filter ChangeFilter
+	err    error
+	done   chan struct{}
+	once   sync.Once
+}
+
+// 订阅已经提交的变更
+func (db *DB) Subscribe(filter *ChangeFilter) (*Subscription, error) {
+	var f ChangeFilter
+	if filter != nil {
+		f = *filter
+	}
+	if f.BufferSize <= 0 {
+		f.BufferSize = DefaultSubscribeBufferSize
+	}
+
+	// 持有写锁, 保证变更日志与之后的变更之间没有遗漏
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+
+	var backlog []*Change
+	if f.Since > 0 {
+		if !db.changeLog {
+			return nil, ErrChangeLogIncomplete
+		}
+		if err := db.View(func(tx *Tx) error {
+			var err error
+			backlog, err = tx.readChangeLog(&f)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Subscription{
+		db:     db,
+		c:      make(chan *Change, f.BufferSize+len(backlog)),
+		filter: f,
+		done:   make(chan struct{}),
+	}
+	s.C = s.c
+	for _, c := range backlog {
+		s.c <- c
+	}
+	db.subscriptions = append(db.subscriptions, s)
+	return s, nil
+}
+
+// 关闭订阅, C中已经缓冲的变更仍然可以读取
+func (s *Subscription) Close() {
+	s.once.Do(func() { close(s.done) })
+
+	db := s.db
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	for i, other := range db.subscriptions {
+		if other == s {
+			db.subscriptions = append(db.subscriptions[:i], db.subscriptions[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+// 返回订阅被关闭的原因, 需要在C关闭后调用, 主动关闭时返回nil
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// 发送事务的变更, 订阅被关闭时返回false
+func (s *Subscription) deliver(changes []*Change, stop <-chan struct{}) bool {
+	for _, c := range changes {
+		if !s.filter.match(c) {
+			continue
+		}
+		if s.filter.Backpressure == BackpressureBlock {
+			select {
+			case s.c <- c:
+			case <-s.done:
+				return false
+			case <-stop:
+				s.err = ErrDatabaseNotOpen
+				return false
+			}
+			continue
+		}
+		select {
+		case s.c <- c:
+		default:
+			s.err = ErrSubscriberTooSlow
+			return false
+		}
+	}
+	return true
+}
+
+// 将提交成功的变更发送给订阅者, 调用时持有写锁
+func (db *DB) publish(changes []*Change) {
+	if len(changes) == 0 || len(db.subscriptions) == 0 {
+		return
+	}
+	subscriptions := db.subscriptions[:0]
+	for _, s := range db.subscriptions {
+		if !s.deliver(changes, db.subscribeStop) {
+			close(s.c)
+			continue
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	db.subscriptions = subscriptions
+}
+
+// 关闭所有订阅, 先唤醒等待订阅者的提交
+func (db *DB) closeSubscriptions() {
+	if db.subscribeStop == nil {
+		return
+	}
+	close(db.subscribeStop)
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	for _, s := range db.subscriptions {
+		s.err = ErrDatabaseNotOpen
+		close(s.c)
+	}
+	db.subscriptions = nil
+	db.subscribeStop = nil
+}
+
+// 记录写事务对用户bucket的修改, 没有订阅并且没有开启变更日志时不记录
+// oldBlob表示修改前的value是blob, 此时old为nil
+func (tx *Tx) recordChange(path [][]byte, key, old, value []byte, oldBlob bool) *Change {
+	if !tx.db.changeLog && len(tx.db.subscriptions) == 0 {
+		return nil
+	} else if len(path) > 0 && isSystemBucket(path[0]) {
+		return nil
+	}
+
+	c := &Change{TxID: int(tx.meta.txid), Path: make([][]byte, len(path))}
+	for i, name := range path {
+		c.Path[i] = cloneBytes(name)
+	}
+	if key != nil {
+		c.Key = cloneBytes(key)
+	}
+	if oldBlob {
+		c.Old = []byte{}
+		c.OldBlob = true
+	} else if old != nil {
+		c.Old = cloneBytes(old)
+	}
+	if value != nil {
+		c.New = cloneBytes(value)
+	}
+	tx.changes = append(tx.changes, c)
+	return c
+}
+
+// 记录写入blob的变更, 变更中不保存blob的数据
+func (tx *Tx) recordBlobChange(path [][]byte, key, old []byte, oldBlob bool) {
+	if c := tx.recordChange(path, key, old, []byte{}, oldBlob); c != nil {
+		c.Blob = true
+	}
+}
+
+// 将事务的变更写入变更日志, 并删除超出保留数量的旧变更
+func (tx *Tx) writeChangeLog() error {
+	db := tx.db
+	if !db.changeLog {
+		return nil
+	}
+	// 没有变更并且日志已经完整时不需要写入
+	if len(tx.changes) == 0 && db.changeLogTxid == tx.meta.txid-1 {
+		return nil
+	}
+
+	root, err := tx.root.CreateBucketIfNotExists([]byte(changeLogBucketName))
+	if err != nil {
+		return err
+	}
+	entries, err := root.CreateBucketIfNotExists(changeLogBucket)
+	if err != nil {
+		return err
+	}
+
+	// 上一个事务没有记录时, 变更日志从当前事务开始
+	id := uint64(tx.meta.txid)
+	if uint64(db.changeLogTxid) != id-1 {
+		if err := entries.clear(); err != nil {
+			return err
+		}
+		if err := root.Put(changeLogStartKey, u64(id)); err != nil {
+			return err
+		}
+	}
+	if err := root.Put(changeLogLastKey, u64(id)); err != nil {
+		return err
+	}
+
+	for i, c := range tx.changes {
+		key := binary.BigEndian.AppendUint32(u64(id), uint32(i))
+		if err := entries.Put(key, encodeChange(c)); err != nil {
+			return err
+		}
+	}
+
+	// 删除超出保留数量的事务
+	if id <= uint64(db.changeLogRetention) {
+		return nil
+	}
+	cutoff := id - uint64(db.changeLogRetention) + 1
+	c := entries.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < cutoff; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	if v := root.Get(changeLogStartKey); binary.BigEndian.Uint64(v) < cutoff {
+		return root.Put(changeLogStartKey, u64(cutoff))
+	}
+	return nil
+}
+
+// 打开数据库时读取变更日志最后记录的事务
+func (db *DB) loadChangeLog() error {
+	if !db.changeLog {
+		return nil
+	}
+	return db.View(func(tx *Tx) error {
+		if root := tx.Bucket([]byte(changeLogBucketName)); root != nil {
+			if v := root.Get(changeLogLastKey); len(v) == 8 {
+				db.changeLogTxid = txid(binary.BigEndian.Uint64(v))
+			}
+		}
+		return nil
+	})
+}
+
+// 提交成功后变更日志已经完整记录到id, 调用时持有写锁
+func (db *DB) advanceChangeLog(id txid) {
+	if db.changeLog {
+		db.changeLogTxid = id
+	}
+}
+
+// 将变更日志最后记录的事务更新到当前事务, 之前没有变更的事务没有写入日志
+// 不需要更新时回滚, 不会产生新的事务
+func (db *DB) flushChangeLog() error {
+	if !db.changeLog || db.readOnly || db.follower {
+		return nil
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	root := tx.Bucket([]byte(changeLogBucketName))
+	if root == nil || db.changeLogTxid != tx.meta.txid-1 {
+		return tx.Rollback()
+	} else if v := root.Get(changeLogLastKey); len(v) == 8 && txid(binary.BigEndian.Uint64(v)) == db.changeLogTxid {
+		return tx.Rollback()
+	}
+	if err := root.Put(changeLogLastKey, u64(uint64(tx.meta.txid))); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// 删除bucket中的所有k/v
+func (b *Bucket) clear() error {
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取变更日志中Since之后满足条件的变更
+func (tx *Tx) readChangeLog(f *ChangeFilter) ([]*Change, error) {
+	since := uint64(f.Since)
+	current := uint64(tx.meta.txid)
+	if since >= current {
+		return nil, nil
+	}
+
+	root := tx.Bucket([]byte(changeLogBucketName))
+	if root == nil {
+		return nil, ErrChangeLogIncomplete
+	}
+	// 最后记录的事务之后可能有没有变更的事务, 由changeLogTxid判断日志是否完整
+	start := root.Get(changeLogStartKey)
+	if len(start) != 8 || tx.db.changeLogTxid != tx.meta.txid {
+		return nil, ErrChangeLogIncomplete
+	} else if since+1 < binary.BigEndian.Uint64(start) {
+		return nil, ErrChangeLogIncomplete
+	}
+
+	var changes []*Change
+	c := root.Bucket(changeLogBucket).Cursor()
+	for k, v := c.Seek(u64(since + 1)); k != nil; k, v = c.Next() {
+		change, err := decodeChange(v)
+		if err != nil {
+			return nil, err
+		}
+		change.TxID = int(binary.BigEndian.Uint64(k))
+		if f.match(change) {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// 8字节大端编码
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// 编码变更, 格式为: bucket路径 + 标志 + (长度 + 数据)...
+// 标志的低三位分别表示key, 旧value, 新value是否存在, changeBlobFlag, changeOldBlobFlag表示新value, 旧value是blob
+func encodeChange(c *Change) []byte {
+	buf := encodeBucketPath(c.Path)
+	var flags byte
+	fields := [][]byte{c.Key, c.Old, c.New}
+	for i, v := range fields {
+		if v != nil {
+			flags |= 1 << i
+		}
+	}
+	if c.Blob {
+		flags |= changeBlobFlag
+	}
+	if c.OldBlob {
+		flags |= changeOldBlobFlag
+	}
+	buf = append(buf, flags)
+	for _, v := range fields {
+		if v != nil {
+			buf = binary.AppendUvarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+		}
+	}
+	return buf
+}
+
+// 解码变更, 返回的数据不引用buf
+func decodeChange(buf []byte) (*Change, error) {
+	path, buf, err := decodeBucketPath(buf)
+	if err != nil {
+		return nil, err
+	} else if len(buf) == 0 {
+		return nil, ErrInvalidChange
+	}
+	c := &Change{Path: make([][]byte, len(path))}
+	for i, name := range path {
+		c.Path[i] = cloneBytes(name)
+	}
+
+	flags := buf[0]
+	buf = buf[1:]
+	c.Blob = flags&changeBlobFlag != 0
+	c.OldBlob = flags&changeOldBlobFlag != 0
+	for i, field := range []*[]byte{&c.Key, &c.Old, &c.New} {
+		if flags&(1<<i) == 0 {
+			continue
+		}
+		l, sz := binary.Uvarint(buf)
+		if sz <= 0 || uint64(len(buf)-sz) < l {
+			return nil, ErrInvalidChange
+		}
+		*field = cloneBytes(buf[sz : sz+int(l)])
+		buf = buf[sz+int(l):]
+	}
+	return c, nil
+}
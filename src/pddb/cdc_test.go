@@ -0,0 +1,310 @@
+package pddb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"pddb"
+	"reflect"
+	"testing"
+)
+
+// 读取n个变更
+func recvChanges(t *testing.T, s *pddb.Subscription, n int) []*pddb.Change {
+	var changes []*pddb.Change
+	for i := 0; i < n; i++ {
+		select {
+		case c, ok := <-s.C:
+			if !ok {
+				t.Fatalf("subscription closed: %v", s.Err())
+			}
+			changes = append(changes, c)
+		default:
+			t.Fatalf("expected change %d", i)
+		}
+	}
+	return changes
+}
+
+// 在bucket中写入k/v, 值为nil时删除
+func update(t *testing.T, db *pddb.DB, bucket, key string, value []byte) {
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return b.Delete([]byte(key))
+		}
+		return b.Put([]byte(key), value)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 订阅提交成功的变更, 回滚的事务和不满足条件的变更不会发送
+func TestDB_Subscribe(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	s, err := db.Subscribe(&pddb.ChangeFilter{Path: [][]byte{[]byte("widgets")}, Prefix: []byte("f")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	update(t, db, "widgets", "foo", []byte("bar"))
+	update(t, db, "widgets", "foo", []byte("baz"))
+	update(t, db, "widgets", "zzz", []byte("skip"))
+	update(t, db, "other", "foo", []byte("skip"))
+	update(t, db, "widgets", "foo", nil)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("rollback")); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	changes := recvChanges(t, s, 3)
+	path := [][]byte{[]byte("widgets")}
+	exp := []*pddb.Change{
+		{TxID: changes[0].TxID, Path: path, Key: []byte("foo"), New: []byte("bar")},
+		{TxID: changes[0].TxID + 1, Path: path, Key: []byte("foo"), Old: []byte("bar"), New: []byte("baz")},
+		{TxID: changes[0].TxID + 4, Path: path, Key: []byte("foo"), Old: []byte("baz")},
+	}
+	if !reflect.DeepEqual(changes, exp) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	// 删除bucket
+	if err := db.Update(func(tx *pddb.Tx) error { return tx.DeleteBucket([]byte("widgets")) }); err != nil {
+		t.Fatal(err)
+	}
+	if c := recvChanges(t, s, 1)[0]; c.Key != nil || !reflect.DeepEqual(c.Path, path) {
+		t.Fatalf("unexpected change: %+v", c)
+	}
+	if len(s.C) != 0 {
+		t.Fatalf("unexpected buffered changes: %d", len(s.C))
+	}
+
+	s.Close()
+	if _, ok := <-s.C; ok {
+		t.Fatal("expected closed")
+	} else if s.Err() != nil {
+		t.Fatalf("unexpected error: %v", s.Err())
+	}
+}
+
+// 缓冲区满时按照配置关闭订阅或者等待订阅者
+func TestDB_Subscribe_Backpressure(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	s, err := db.Subscribe(&pddb.ChangeFilter{BufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(t, db, "widgets", "foo", []byte("bar"))
+	update(t, db, "widgets", "baz", []byte("bat"))
+	recvChanges(t, s, 1)
+	if _, ok := <-s.C; ok {
+		t.Fatal("expected closed")
+	} else if s.Err() != pddb.ErrSubscriberTooSlow {
+		t.Fatalf("unexpected error: %v", s.Err())
+	}
+	s.Close()
+
+	// 订阅者读取之前提交等待
+	s, err = db.Subscribe(&pddb.ChangeFilter{BufferSize: 1, Backpressure: pddb.BackpressureBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			update(t, db, "widgets", "foo", []byte{byte(i)})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if c := <-s.C; c.New[0] != byte(i) {
+			t.Fatalf("unexpected change: %+v", c)
+		}
+	}
+	<-done
+
+	// 关闭订阅唤醒等待的提交
+	update(t, db, "widgets", "foo", []byte("full"))
+	go s.Close()
+	update(t, db, "widgets", "foo", []byte("blocked"))
+}
+
+// 从变更日志中的事务继续订阅
+func TestDB_Subscribe_Since(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	options := &pddb.Options{ChangeLog: true, ChangeLogRetention: 5}
+	db, err := pddb.Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		update(t, db, "widgets", "foo", []byte{byte(i)})
+	}
+	current := txID(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有开启变更日志时不能继续订阅
+	db, err = pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Subscribe(&pddb.ChangeFilter{Since: current - 2}); err != pddb.ErrChangeLogIncomplete {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = pddb.Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	if _, err := db.Subscribe(&pddb.ChangeFilter{Since: current - 6}); err != pddb.ErrChangeLogIncomplete {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s, err := db.Subscribe(&pddb.ChangeFilter{Since: current - 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	update(t, db, "widgets", "foo", []byte{10})
+	for i, c := range recvChanges(t, s, 3) {
+		if c.TxID != current-1+i || c.New[0] != byte(8+i) || c.Old[0] != byte(7+i) {
+			t.Fatalf("unexpected change: %+v", c)
+		}
+	}
+}
+
+// 返回变更日志最后记录的事务
+func changeLogLast(t *testing.T, db *pddb.DB) int {
+	var last int
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("__pddb_changes")).Get([]byte("last")); len(v) == 8 {
+			last = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return last
+}
+
+// 没有变更的事务不写入变更日志, 之后的变更和重新打开后仍然可以继续订阅
+func TestDB_ChangeLog_EmptyTx(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	options := &pddb.Options{ChangeLog: true}
+	db, err := pddb.Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(t, db, "widgets", "foo", []byte("bar"))
+	since := txID(t, db) - 1
+	for i := 0; i < 3; i++ {
+		if err := db.Update(func(tx *pddb.Tx) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last := changeLogLast(t, db); last != since+1 {
+		t.Fatalf("unexpected last: %d", last)
+	}
+	s, err := db.Subscribe(&pddb.ChangeFilter{Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = pddb.Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	if err := db.Update(func(tx *pddb.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	update(t, db, "widgets", "foo", []byte("baz"))
+	s, err = db.Subscribe(&pddb.ChangeFilter{Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if changes := recvChanges(t, s, 2); string(changes[0].New) != "bar" || string(changes[1].New) != "baz" {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
+
+// 写入blob产生变更, 变更中不包含blob的数据, 变更日志中同样保留blob标志
+func TestDB_Subscribe_PutReader(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	db, err := pddb.Open(path, 0666, &pddb.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	update(t, db, "widgets", "foo", []byte("bar"))
+	since := txID(t, db)
+
+	s, err := db.Subscribe(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("widgets")).PutReader([]byte("foo"), bytes.NewReader(make([]byte, 10000)), 10000)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 覆盖和删除blob时Old为空但不为nil, 与新增区分
+	update(t, db, "widgets", "foo", []byte("baz"))
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.PutReader([]byte("foo"), bytes.NewReader(make([]byte, 10000)), 10000); err != nil {
+			return err
+		}
+		return b.Delete([]byte("foo"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	widgets := [][]byte{[]byte("widgets")}
+	exp := []*pddb.Change{
+		{TxID: since + 1, Path: widgets, Key: []byte("foo"), Old: []byte("bar"), New: []byte{}, Blob: true},
+		{TxID: since + 2, Path: widgets, Key: []byte("foo"), Old: []byte{}, OldBlob: true, New: []byte("baz")},
+		{TxID: since + 3, Path: widgets, Key: []byte("foo"), Old: []byte("baz"), New: []byte{}, Blob: true},
+		{TxID: since + 3, Path: widgets, Key: []byte("foo"), Old: []byte{}, OldBlob: true},
+	}
+	if c := recvChanges(t, s, len(exp)); !reflect.DeepEqual(c, exp) {
+		t.Fatalf("unexpected changes: %+v", c)
+	}
+
+	logged, err := db.Subscribe(&pddb.ChangeFilter{Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logged.Close()
+	if c := recvChanges(t, logged, len(exp)); !reflect.DeepEqual(c, exp) {
+		t.Fatalf("unexpected logged changes: %+v", c)
+	}
+}
@@ -0,0 +1,210 @@
+package pddb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// 页加密接口, 除meta page以外的所有page写入磁盘前都会被加密
+// 加密后的数据比原数据长Overhead()字节, 这部分空间保留在每个page的末尾
+type Cipher interface {
+	// 密钥标识, 记录在meta中, 打开数据库时用来校验密钥, 不能为0
+	ID() uint64
+	// 加密增加的字节数
+	Overhead() int
+	// 加密plaintext并追加到dst, additionalData参与认证但不加密
+	Seal(dst, plaintext, additionalData []byte) []byte
+	// 解密ciphertext并追加到dst
+	Open(dst, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// 基于AES-GCM的页加密, 每次加密使用随机nonce并保存在密文之前
+type aesCipher struct {
+	id   uint64
+	aead cipher.AEAD
+}
+
+// 使用16, 24或32字节的密钥创建AES-GCM加密
+func NewAESCipher(key []byte) (Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// 密钥标识取自密钥的哈希, 不会泄露密钥本身
+	sum := sha256.Sum256(append([]byte("pddb-aes-gcm:"), key...))
+	id := binary.BigEndian.Uint64(sum[:8])
+	if id == 0 {
+		id = 1
+	}
+	return &aesCipher{id: id, aead: aead}, nil
+}
+
+func (c *aesCipher) ID() uint64 {
+	return c.id
+}
+
+func (c *aesCipher) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+func (c *aesCipher) Seal(dst, plaintext, additionalData []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(fmt.Sprintf("read nonce error: %s", err))
+	}
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, plaintext, additionalData)
+}
+
+func (c *aesCipher) Open(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, ErrDecrypt
+	}
+	out, err := c.aead.Open(dst, ciphertext[:n], ciphertext[n:], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return out, nil
+}
+
+// 加密page, 返回写入磁盘的数据
+// page头不加密并作为认证数据, page末尾的Overhead()字节用于保存nonce和认证标签
+func encryptPage(c Cipher, p *page, pageSize int) []byte {
+	size := (int(p.overflow) + 1) * pageSize
+	src := (*[maxAllocSize]byte)(unsafe.Pointer(p))[:size:size]
+
+	buf := make([]byte, pageHeaderSize, size)
+	copy(buf, src[:pageHeaderSize])
+	return c.Seal(buf, src[pageHeaderSize:size-c.Overhead()], src[:pageHeaderSize])
+}
+
+// 解密磁盘上的page, 返回的page位于新分配的内存中
+func decryptPage(c Cipher, raw *page, pageSize int) (*page, error) {
+	size := (int(raw.overflow) + 1) * pageSize
+	src := (*[maxAllocSize]byte)(unsafe.Pointer(raw))[:size:size]
+
+	buf := make([]byte, size)
+	copy(buf, src[:pageHeaderSize])
+	if _, err := c.Open(buf[pageHeaderSize:pageHeaderSize], src[pageHeaderSize:], src[:pageHeaderSize]); err != nil {
+		return nil, err
+	}
+	return (*page)(unsafe.Pointer(&buf[0])), nil
+}
+
+// 返回解密后的page, 解密结果保存在有上限的缓存中
+func (db *DB) decryptedPage(raw *page) *page {
+	p, gen := db.pageCache.get(raw.id)
+	if p != nil {
+		return p
+	}
+	p, err := decryptPage(db.cipher, raw, db.pageSize)
+	if err != nil {
+		panic(fmt.Sprintf("page %d: %s", raw.id, err))
+	}
+	return db.pageCache.put(raw.id, p, gen)
+}
+
+// page被重新写入后丢弃缓存的内容
+func (db *DB) invalidatePages(pages pages) {
+	db.source.invalidate(pages)
+}
+
+// 移除缓存的解密结果
+func (db *DB) invalidateDecrypted(pages pages) {
+	db.pageCache.invalidate(pages)
+}
+
+// 使用新的密钥重新加密数据库文件, 需要独占数据库
+// oldCipher为nil表示原数据库没有加密, newCipher为nil表示解密数据库
+func Rekey(path string, oldCipher, newCipher Cipher) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	db, err := Open(path, info.Mode(), &Options{Cipher: oldCipher})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tmp := path + ".rekey"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := db.View(func(tx *Tx) error {
+		return tx.rekeyTo(f, newCipher)
+	}); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 将事务可见的数据使用新的密钥写入文件, 空闲page写入0
+func (tx *Tx) rekeyTo(f *os.File, c Cipher) error {
+	pageSize := tx.db.pageSize
+
+	// 两份meta page使用相同的数据, 第二份的事务id较小
+	buf := make([]byte, pageSize)
+	p := tx.db.pageInBuffer(buf, 0)
+	m := *tx.meta
+	m.setCipher(0)
+	if c != nil {
+		m.setCipher(c.ID())
+	}
+	for i := 0; i < 2; i++ {
+		p.flags = metaPageFlag
+		m.write(p)
+		if _, err := f.WriteAt(buf, int64(p.id)*int64(pageSize)); err != nil {
+			return err
+		}
+		m.txid--
+	}
+
+	// 重新加密所有可见的page
+	write := func(p *page) error {
+		_, err := f.WriteAt(encodePage(c, p, pageSize), int64(p.id)*int64(pageSize))
+		return err
+	}
+	if err := write(tx.page(tx.meta.freelist)); err != nil {
+		return err
+	}
+	var err error
+	tx.forEachBucketPage(&tx.root, func(p *page, _ *Bucket) {
+		if err == nil {
+			err = write(p)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// 保证文件大小与高水位一致
+	return f.Truncate(int64(tx.meta.pgid) * int64(pageSize))
+}
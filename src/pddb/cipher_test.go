@@ -0,0 +1,215 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pddb"
+	"testing"
+)
+
+// 返回使用指定字节填充密钥的AES加密
+func MustCipher(b byte) pddb.Cipher {
+	c, err := pddb.NewAESCipher(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// 加密的数据库可以正常读写, 文件中不包含明文
+func TestOpen_Cipher(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{Cipher: MustCipher(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("top-secret-customer-data")
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("customers"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), secret); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(buf, secret) || bytes.Contains(buf, []byte("customers")) {
+		t.Fatal("plaintext found in database file")
+	}
+
+	// 使用相同的密钥重新打开
+	db, err = pddb.Open(path, 0666, &pddb.Options{Cipher: MustCipher(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("customers"))
+		if v := b.Get([]byte("0499")); !bytes.Equal(v, secret) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 解密缓存有上限, 淘汰后的page可以重新解密, 仍被引用的page不受影响
+func TestOpen_CipherPageCache(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	db, err := pddb.Open(path, 0666, &pddb.Options{Cipher: MustCipher(2), PageCacheSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	for i := 0; i < 5; i++ {
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 500; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("key%d%03d", i, j)), bytes.Repeat([]byte{byte(j)}, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDB(t, db)
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		first := b.Get([]byte("key0000"))
+		n := 0
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !bytes.Equal(v, bytes.Repeat([]byte{v[0]}, 100)) {
+				t.Fatalf("unexpected value: %s", k)
+			}
+			n++
+		}
+		if n != 2500 {
+			t.Fatalf("unexpected count: %d", n)
+		} else if !bytes.Equal(first, make([]byte, 100)) {
+			t.Fatal("unexpected value after eviction")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 加密的数据库需要使用正确的密钥打开
+func TestOpen_ErrCipher(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{Cipher: MustCipher(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pddb.Open(path, 0666, nil); err != pddb.ErrCipherRequired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := pddb.Open(path, 0666, &pddb.Options{Cipher: MustCipher(2)}); err != pddb.ErrCipherMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 未加密的数据库可以通过Rekey加密
+func TestRekey(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := child.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 64)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pddb.Rekey(path, nil, MustCipher(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = pddb.Open(path, 0666, &pddb.Options{Cipher: MustCipher(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 重新加密后可以继续写入
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("baz"), []byte("bat"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("baz")); string(v) != "bat" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		var n int
+		if err := b.Bucket([]byte("child")).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
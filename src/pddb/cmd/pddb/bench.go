@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"pddb"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 压测的bucket名称
+var benchBucketName = []byte("bench")
+
+// 压测参数错误
+var (
+	// 未知的写入或读取方式
+	errBenchMode = errors.New("unknown bench mode")
+	// key太短, 不能容纳所有顺序写入的key
+	errBenchKeySize = errors.New("key size too small for count")
+)
+
+// 压测数据库性能
+type benchCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newBenchCommand(m *Main) *benchCommand {
+	return &benchCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// 压测选项
+type benchOptions struct {
+	WriteMode string
+	ReadMode  string
+	Count     int
+	BatchSize int
+	KeySize   int
+	ValueSize int
+	Readers   int
+	Path      string
+	Work      bool
+	WAL       bool
+}
+
+// 一组操作的结果, latencies为每个操作的耗时
+type benchResult struct {
+	name      string
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+func (cmd *benchCommand) Run(args ...string) error {
+	var options benchOptions
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	fs.StringVar(&options.WriteMode, "write-mode", "seq", "")
+	fs.StringVar(&options.ReadMode, "read-mode", "seq", "")
+	fs.IntVar(&options.Count, "count", 1000, "")
+	fs.IntVar(&options.BatchSize, "batch-size", 0, "")
+	fs.IntVar(&options.KeySize, "key-size", 8, "")
+	fs.IntVar(&options.ValueSize, "value-size", 32, "")
+	fs.IntVar(&options.Readers, "readers", 1, "")
+	fs.StringVar(&options.Path, "path", "", "")
+	fs.BoolVar(&options.Work, "work", false, "")
+	fs.BoolVar(&options.WAL, "wal", false, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help || fs.NArg() > 0 || options.Count <= 0 || options.KeySize <= 0 || options.ValueSize < 0 || options.Readers <= 0 {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = options.Count
+	}
+	if options.KeySize < 8 && uint64(options.Count) > 1<<(8*uint(options.KeySize)) {
+		return errBenchKeySize
+	}
+
+	// 默认在临时文件上压测, 结束后删除
+	path := options.Path
+	if path == "" {
+		f, err := ioutil.TempFile("", "pddb-bench-")
+		if err != nil {
+			return err
+		}
+		path = f.Name()
+		f.Close()
+		os.Remove(path)
+	} else if _, err := os.Stat(path); err == nil {
+		return ErrFileExists
+	}
+	if !options.Work {
+		defer os.Remove(path)
+	}
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{WAL: options.WAL})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	keys, write, commit, err := benchWrite(db, &options)
+	if err != nil {
+		return err
+	}
+	read, err := benchRead(db, &options, keys)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	write.print(cmd.Stdout)
+	commit.print(cmd.Stdout)
+	read.print(cmd.Stdout)
+	fmt.Fprintf(cmd.Stdout, "# File size: %d bytes\n", fi.Size())
+	if options.Work {
+		fmt.Fprintf(cmd.Stdout, "# Database: %s\n", path)
+	}
+	return nil
+}
+
+func (cmd *benchCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb bench [options]
+
+Bench writes keys into a new database, reads them back and reports the
+throughput, the latency percentiles of single operations and the size of
+the resulting file. Write latencies cover single puts, the commits of the
+write transactions are reported separately.
+
+The options are:
+
+	-write-mode MODE   seq, rnd or seq-nest (default seq)
+	-read-mode MODE    seq for a cursor scan or rnd for random gets (default seq)
+	-count N           number of keys to write (default 1000)
+	-batch-size N      keys written per transaction (default all)
+	-key-size N        key size in bytes (default 8)
+	-value-size N      value size in bytes (default 32)
+	-readers N         number of parallel readers (default 1)
+	-path PATH         database path, a temporary file by default
+	-work              keep the database after the run
+	-wal               open the database with a write-ahead log
+
+With seq-nest every batch is written into a nested bucket of its own.
+Every reader reads -count keys in a read transaction of its own.
+`, "\n")
+}
+
+// 生成第i个key, 顺序写入时key按照i递增, 随机写入时key为随机字节
+func benchKey(options *benchOptions, i int) []byte {
+	key := make([]byte, options.KeySize)
+	if options.WriteMode == "rnd" {
+		rand.Read(key)
+		return key
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	if len(key) >= 8 {
+		copy(key[len(key)-8:], buf[:])
+	} else {
+		copy(key, buf[8-len(key):])
+	}
+	return key
+}
+
+// 写入count个key, 返回写入的key所在的子bucket和key, 以及写入和提交的结果
+func benchWrite(db *pddb.DB, options *benchOptions) ([][2][]byte, *benchResult, *benchResult, error) {
+	switch options.WriteMode {
+	case "seq", "rnd", "seq-nest":
+	default:
+		return nil, nil, nil, errBenchMode
+	}
+
+	result := &benchResult{name: "Write", latencies: make([]time.Duration, 0, options.Count)}
+	commit := &benchResult{name: "Commit"}
+	keys := make([][2][]byte, 0, options.Count)
+	value := make([]byte, options.ValueSize)
+	start := time.Now()
+	for i := 0; i < options.Count; i += options.BatchSize {
+		tx, err := db.Begin(true)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := func() error {
+			b, err := tx.CreateBucketIfNotExists(benchBucketName)
+			if err != nil {
+				return err
+			}
+			// 嵌套写入时每个批次使用单独的子bucket
+			var name []byte
+			if options.WriteMode == "seq-nest" {
+				name = benchKey(options, i)
+				if b, err = b.CreateBucket(name); err != nil {
+					return err
+				}
+			}
+			for j := i; j < i+options.BatchSize && j < options.Count; j++ {
+				key := benchKey(options, j)
+				t := time.Now()
+				if err := b.Put(key, value); err != nil {
+					return err
+				}
+				result.latencies = append(result.latencies, time.Since(t))
+				keys = append(keys, [2][]byte{name, key})
+			}
+			return nil
+		}(); err != nil {
+			_ = tx.Rollback()
+			return nil, nil, nil, err
+		}
+
+		t := time.Now()
+		if err := tx.Commit(); err != nil {
+			return nil, nil, nil, err
+		}
+		commit.latencies = append(commit.latencies, time.Since(t))
+	}
+	result.elapsed = time.Since(start)
+	commit.elapsed = result.elapsed
+	return keys, result, commit, nil
+}
+
+// 由options.Readers个读事务并行读取, 每个读事务读取count个key
+func benchRead(db *pddb.DB, options *benchOptions, keys [][2][]byte) (*benchResult, error) {
+	var read func(tx *pddb.Tx, latencies []time.Duration) ([]time.Duration, error)
+	switch options.ReadMode {
+	case "seq":
+		read = func(tx *pddb.Tx, latencies []time.Duration) ([]time.Duration, error) {
+			return benchReadSeq(tx.Bucket(benchBucketName), options.Count, latencies), nil
+		}
+	case "rnd":
+		read = func(tx *pddb.Tx, latencies []time.Duration) ([]time.Duration, error) {
+			root := tx.Bucket(benchBucketName)
+			r := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+			for i := 0; i < options.Count; i++ {
+				k := keys[r.Intn(len(keys))]
+				t := time.Now()
+				b := root
+				if k[0] != nil {
+					b = b.Bucket(k[0])
+				}
+				if v := b.Get(k[1]); v == nil && options.ValueSize > 0 {
+					return nil, fmt.Errorf("key %x not found", k[1])
+				}
+				latencies = append(latencies, time.Since(t))
+			}
+			return latencies, nil
+		}
+	default:
+		return nil, errBenchMode
+	}
+
+	result := &benchResult{name: "Read"}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, options.Readers)
+	start := time.Now()
+	for i := 0; i < options.Readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.View(func(tx *pddb.Tx) error {
+				latencies, err := read(tx, make([]time.Duration, 0, options.Count))
+				mu.Lock()
+				result.latencies = append(result.latencies, latencies...)
+				mu.Unlock()
+				return err
+			}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	close(errs)
+	return result, <-errs
+}
+
+// 使用游标顺序读取n个key, 嵌套的bucket按照深度优先读取, 读完所有key后从头开始
+func benchReadSeq(b *pddb.Bucket, n int, latencies []time.Duration) []time.Duration {
+	for len(latencies) < n {
+		before := len(latencies)
+		latencies = benchScan(b, n, latencies)
+		if len(latencies) == before {
+			break
+		}
+	}
+	return latencies
+}
+
+func benchScan(b *pddb.Bucket, n int, latencies []time.Duration) []time.Duration {
+	c := b.Cursor()
+	t := time.Now()
+	for k, v := c.First(); k != nil && len(latencies) < n; k, v = c.Next() {
+		if v == nil {
+			latencies = benchScan(b.Bucket(k), n, latencies)
+		} else {
+			latencies = append(latencies, time.Since(t))
+		}
+		t = time.Now()
+	}
+	return latencies
+}
+
+// 打印吞吐量和延迟的百分位数
+func (r *benchResult) print(w io.Writer) {
+	n := len(r.latencies)
+	ops := 0.0
+	if r.elapsed > 0 {
+		ops = float64(n) / r.elapsed.Seconds()
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if n == 0 {
+			return 0
+		}
+		return r.latencies[int(float64(n-1)*p)]
+	}
+	fmt.Fprintf(w, "# %s\t%d ops in %s\t(%.0f op/sec)\tp50 %s\tp95 %s\tp99 %s\tmax %s\n",
+		r.name, n, r.elapsed.Round(time.Microsecond), ops,
+		percentile(0.50), percentile(0.95), percentile(0.99), percentile(1))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"pddb"
+	"strings"
+	"text/tabwriter"
+)
+
+// 以Graphviz DOT格式输出bucket的page结构
+type dotCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newDotCommand(m *Main) *dotCommand {
+	return &dotCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *dotCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help || fs.NArg() > 2 {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: true, Cipher: c})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *pddb.Tx) error {
+		return tx.WriteDOT(cmd.Stdout, splitBucketPath(fs.Arg(1)))
+	})
+}
+
+func (cmd *dotCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb dot [-key-file PATH] PATH [BUCKET]
+
+Dot writes the pages of a bucket as a Graphviz DOT graph, starting at the
+root of the database when no bucket is given. Every page shows its type,
+number of keys, fill factor and key range. Nested buckets and blobs are
+shown as single nodes; pass their path to graph them.
+
+	pddb dot my.db users | dot -Tsvg > users.svg
+`, "\n")
+}
+
+// 输出碎片报告
+type fragCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newFragCommand(m *Main) *fragCommand {
+	return &fragCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *fragCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help || fs.NArg() > 1 {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: true, Cipher: c})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var r *pddb.FragmentationReport
+	if err := db.View(func(tx *pddb.Tx) error {
+		r, err = tx.Fragmentation()
+		return err
+	}); err != nil {
+		return err
+	}
+	writeFragmentation(cmd.Stdout, r)
+	return nil
+}
+
+func (cmd *fragCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb frag [-key-file PATH] PATH
+
+Frag reports how the pages of the database are used: the number of meta,
+freelist, branch, leaf, blob and free pages, the contiguous runs of free
+pages, the bytes left unused in overflow pages, and for every bucket the
+average fill factor and a histogram of the fill factors of its pages in
+steps of 10%.
+`, "\n")
+}
+
+// 打印碎片报告
+func writeFragmentation(w io.Writer, r *pddb.FragmentationReport) {
+	percent := func(n int) float64 {
+		if r.PageCount == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(r.PageCount)
+	}
+
+	fmt.Fprintf(w, "Page size: %d\n", r.PageSize)
+	fmt.Fprintf(w, "Pages: %d (%d bytes)\n", r.PageCount, r.PageCount*r.PageSize)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, row := range []struct {
+		name string
+		n    int
+	}{
+		{"meta", r.MetaPages},
+		{"freelist", r.FreelistPages},
+		{"branch", r.BranchPages},
+		{"leaf", r.LeafPages},
+		{"blob", r.BlobPages},
+		{"free", r.FreePages},
+	} {
+		fmt.Fprintf(tw, "  %s\t%d\t%.1f%%\n", row.name, row.n, percent(row.n))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "Free runs: %d, longest %d pages\n", r.FreeRuns, r.LongestFreeRun)
+	fmt.Fprintf(w, "Overflow: %d pages with %d overflow pages, %d bytes unused\n", r.OverflowedPages, r.OverflowPages, r.OverflowWaste)
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BUCKET\tBRANCH\tLEAF\tBLOB\tFILL\tHISTOGRAM (0-10% .. 90-100%)")
+	for _, b := range r.Buckets {
+		name := "(root)"
+		if len(b.Path) > 0 {
+			names := make([]string, len(b.Path))
+			for i, n := range b.Path {
+				names[i] = string(n)
+			}
+			name = strings.Join(names, "/")
+		}
+		if b.Inline {
+			fmt.Fprintf(tw, "%s\t-\t-\t%d\tinline\n", name, b.BlobPages)
+			continue
+		}
+		hist := make([]string, len(b.Histogram))
+		for i, n := range b.Histogram {
+			hist[i] = fmt.Sprint(n)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.0f%%\t%s\n", name, b.BranchPages, b.LeafPages, b.BlobPages, b.Fill()*100, strings.Join(hist, " "))
+	}
+	tw.Flush()
+}
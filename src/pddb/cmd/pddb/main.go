@@ -0,0 +1,983 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"pddb"
+	"pddb/resp"
+	"pddb/server"
+	"pddb/sql"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// 命令行错误
+var (
+	// 参数错误, 需要打印使用说明
+	ErrUsage = errors.New("usage")
+	// 未知命令
+	ErrUnknownCommand = errors.New("unknown command")
+	// 缺少数据库路径
+	ErrPathRequired = errors.New("path required")
+	// 数据库文件不存在
+	ErrFileNotFound = errors.New("file not found")
+	// 目标文件已经存在
+	ErrFileExists = errors.New("file exists")
+)
+
+func main() {
+	m := NewMain()
+	if err := m.Run(os.Args[1:]...); err == ErrUsage {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+// 命令行程序
+type Main struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func NewMain() *Main {
+	return &Main{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// 执行子命令
+func (m *Main) Run(args ...string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(m.Stderr, m.Usage())
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "help":
+		fmt.Fprintln(m.Stderr, m.Usage())
+		return ErrUsage
+	case "backup":
+		return newBackupCommand(m).Run(args[1:]...)
+	case "bench":
+		return newBenchCommand(m).Run(args[1:]...)
+	case "check":
+		return newCheckCommand(m).Run(args[1:]...)
+	case "dot":
+		return newDotCommand(m).Run(args[1:]...)
+	case "dump":
+		return newDumpCommand(m).Run(args[1:]...)
+	case "export-csv":
+		return newExportCSVCommand(m).Run(args[1:]...)
+	case "frag":
+		return newFragCommand(m).Run(args[1:]...)
+	case "import-csv":
+		return newImportCSVCommand(m).Run(args[1:]...)
+	case "load":
+		return newLoadCommand(m).Run(args[1:]...)
+	case "rekey":
+		return newRekeyCommand(m).Run(args[1:]...)
+	case "restore":
+		return newRestoreCommand(m).Run(args[1:]...)
+	case "serve":
+		return newServeCommand(m).Run(args[1:]...)
+	case "shell":
+		return newShellCommand(m).Run(args[1:]...)
+	case "sql":
+		return newSQLCommand(m).Run(args[1:]...)
+	default:
+		return ErrUnknownCommand
+	}
+}
+
+// 使用说明
+func (m *Main) Usage() string {
+	return strings.TrimLeft(`
+pddb is a tool for inspecting pddb databases.
+
+Usage:
+
+	pddb command [arguments]
+
+The commands are:
+
+	backup      write a full or incremental backup
+	bench       measure the performance of a new database
+	check       verify the consistency of a database
+	dot         write the pages of a bucket as a Graphviz graph
+	dump        write all buckets and keys as NDJSON
+	export-csv  write a bucket imported from CSV as CSV
+	frag        report page usage and fragmentation
+	help        print this screen
+	import-csv  import a CSV file into a bucket
+	load        load NDJSON written by dump into a database
+	rekey       re-encrypt a database with a new key
+	restore     rebuild a database from a full backup and incrementals
+	serve       serve a database over HTTP
+	shell       run an interactive shell on a database
+	sql         run a SQL statement against a database
+
+Use "pddb [command] -h" for more information about a command.
+`, "\n")
+}
+
+// 更换数据库密钥
+type rekeyCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newRekeyCommand(m *Main) *rekeyCommand {
+	return &rekeyCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *rekeyCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	oldKeyFile := fs.String("old-key-file", "", "")
+	newKeyFile := fs.String("new-key-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	oldCipher, err := loadCipher(*oldKeyFile)
+	if err != nil {
+		return err
+	}
+	newCipher, err := loadCipher(*newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if err := pddb.Rekey(path, oldCipher, newCipher); err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, "ok")
+	return nil
+}
+
+func (cmd *rekeyCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb rekey [-old-key-file PATH] [-new-key-file PATH] PATH
+
+Rekey re-encrypts every page of the database with a new AES-GCM key.
+Key files contain a hex encoded 16, 24 or 32 byte key. Omit the old key
+file to encrypt a plain database, or the new key file to decrypt it.
+
+The database must not be opened by any other process.
+`, "\n")
+}
+
+// 导出数据库
+type dumpCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newDumpCommand(m *Main) *dumpCommand {
+	return &dumpCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *dumpCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: true, Cipher: c})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *pddb.Tx) error {
+		return tx.Dump(cmd.Stdout)
+	})
+}
+
+func (cmd *dumpCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb dump [-key-file PATH] PATH
+
+Dump writes every bucket and key of the database to standard output as
+newline delimited JSON. Bucket names, keys and values are base64 encoded.
+The output can be loaded into another database with "pddb load".
+`, "\n")
+}
+
+// 导入数据库
+type loadCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newLoadCommand(m *Main) *loadCommand {
+	return &loadCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *loadCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	batchSize := fs.Int("batch-size", pddb.DefaultLoadBatchSize, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	}
+
+	// 默认从标准输入读取
+	r := cmd.Stdin
+	if name := fs.Arg(1); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{Cipher: c})
+	if err != nil {
+		return err
+	}
+	if err := db.Load(r, *batchSize); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, "ok")
+	return nil
+}
+
+func (cmd *loadCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb load [-key-file PATH] [-batch-size N] PATH [FILE]
+
+Load reads newline delimited JSON written by "pddb dump" from FILE, or
+from standard input when FILE is omitted or "-", and writes it into the
+database at PATH. The database is created if it does not exist. Existing
+keys are overwritten. Every write transaction loads at most N records.
+`, "\n")
+}
+
+// 导入CSV
+type importCSVCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newImportCSVCommand(m *Main) *importCSVCommand {
+	return &importCSVCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *importCSVCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	keyColumn := fs.String("key", "", "")
+	format := fs.String("format", "json", "")
+	batchSize := fs.Int("batch-size", pddb.DefaultLoadBatchSize, "")
+	comma := fs.String("comma", ",", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path, bucket := fs.Arg(0), fs.Arg(1)
+	if path == "" {
+		return ErrPathRequired
+	} else if bucket == "" {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	options := &pddb.CSVOptions{KeyColumn: *keyColumn, BatchSize: *batchSize}
+	switch *format {
+	case "json":
+		options.Format = pddb.CSVFormatJSON
+	case "columns":
+		options.Format = pddb.CSVFormatColumns
+	default:
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+	var err error
+	if options.Comma, err = parseComma(*comma); err != nil {
+		return err
+	}
+
+	// 默认从标准输入读取
+	r := cmd.Stdin
+	if name := fs.Arg(2); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{Cipher: c, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	n, err := db.ImportCSV(r, splitBucketPath(bucket), options)
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "%d rows imported\n", n)
+	return nil
+}
+
+func (cmd *importCSVCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb import-csv [-key-file PATH] [-key COLUMN] [-format json|columns] [-batch-size N] [-comma C] PATH BUCKET [FILE]
+
+Import-csv reads CSV from FILE, or from standard input when FILE is
+omitted or "-", and writes every row into BUCKET, a bucket path with
+names separated by "/". The first row is the header. The database and
+the bucket are created if they do not exist.
+
+With -key the value of COLUMN is used as the key, and keys that already
+exist are reported as errors. Otherwise rows get increasing 8 byte keys
+and keep their order. With -format json every row is stored as a JSON
+object, with -format columns as length prefixed fields in header order.
+Every write transaction imports at most N rows.
+`, "\n")
+}
+
+// 导出CSV
+type exportCSVCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newExportCSVCommand(m *Main) *exportCSVCommand {
+	return &exportCSVCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *exportCSVCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	comma := fs.String("comma", ",", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path, bucket := fs.Arg(0), fs.Arg(1)
+	if path == "" {
+		return ErrPathRequired
+	} else if bucket == "" {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+	sep, err := parseComma(*comma)
+	if err != nil {
+		return err
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: true, Cipher: c})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *pddb.Tx) error {
+		return tx.ExportCSV(cmd.Stdout, splitBucketPath(bucket), sep)
+	})
+}
+
+func (cmd *exportCSVCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb export-csv [-key-file PATH] [-comma C] PATH BUCKET
+
+Export-csv writes a bucket imported with "pddb import-csv" to standard
+output as CSV, with the header and column order of the import. BUCKET
+is a bucket path with names separated by "/".
+`, "\n")
+}
+
+// 备份数据库
+type backupCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newBackupCommand(m *Main) *backupCommand {
+	return &backupCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *backupCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	since := fs.Int("since", -1, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path, output := fs.Arg(0), fs.Arg(1)
+	if path == "" || output == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: true, Cipher: c, TrackPages: *since >= 0})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	var txid int
+	if err := db.View(func(tx *pddb.Tx) error {
+		txid = tx.ID()
+		if *since >= 0 {
+			_, err := tx.WriteIncrementalTo(f, *since)
+			return err
+		}
+		_, err := tx.WriteTo(f)
+		return err
+	}); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "txid %d\n", txid)
+	return nil
+}
+
+func (cmd *backupCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb backup [-key-file PATH] [-since TXID] PATH OUTPUT
+
+Backup writes a copy of the database to OUTPUT and prints the txid of the
+copied transaction. Without -since the copy is a full database file.
+
+With -since, only the pages written by transactions after TXID are saved.
+The database must have been opened with TrackPages since TXID. Pass the
+txid printed by the previous backup to build a chain of incrementals.
+`, "\n")
+}
+
+// 从备份恢复数据库
+type restoreCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newRestoreCommand(m *Main) *restoreCommand {
+	return &restoreCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *restoreCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path, full := fs.Arg(0), fs.Arg(1)
+	if path == "" || full == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); err == nil {
+		return ErrFileExists
+	} else if _, err := os.Stat(full); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	// 复制完整备份, 再按顺序应用增量备份
+	if err := copyFile(full, path); err != nil {
+		return err
+	}
+	for _, name := range fs.Args()[2:] {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = pddb.ApplyIncremental(path, f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if err := check(path, *keyFile); err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, "ok")
+	return nil
+}
+
+// 以流的方式将src复制到新建的dst并同步到磁盘
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return err
+	} else if err := w.Sync(); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (cmd *restoreCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb restore [-key-file PATH] PATH FULL [INCREMENTAL...]
+
+Restore copies the full backup FULL to PATH, applies each incremental
+backup in order and verifies the consistency of the result. PATH must
+not exist.
+`, "\n")
+}
+
+// 检查数据库一致性
+type checkCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newCheckCommand(m *Main) *checkCommand {
+	return &checkCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *checkCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	if err := check(path, *keyFile); err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, "ok")
+	return nil
+}
+
+func (cmd *checkCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb check [-key-file PATH] PATH
+
+Check verifies that every page of the database is either reachable
+exactly once or free, and that the keys of every page are ordered.
+`, "\n")
+}
+
+// 通过HTTP提供数据库访问
+type serveCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newServeCommand(m *Main) *serveCommand {
+	return &serveCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *serveCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	addr := fs.String("addr", ":8080", "")
+	readOnly := fs.Bool("read-only", false, "")
+	respAddr := fs.String("resp-addr", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: *readOnly, Cipher: c, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// 收到信号后等待正在处理的请求完成再关闭数据库
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	s := server.New(db)
+	done := make(chan error, 2)
+	go func() { done <- s.ListenAndServe(*addr) }()
+	fmt.Fprintf(cmd.Stdout, "serving %s on %s\n", path, *addr)
+
+	servers := 1
+	var rs *resp.Server
+	if *respAddr != "" {
+		rs = resp.New(db)
+		servers++
+		go func() { done <- rs.ListenAndServe(*respAddr) }()
+		fmt.Fprintf(cmd.Stdout, "serving %s over RESP on %s\n", path, *respAddr)
+	}
+
+	// 任意一个服务出错时也关闭所有服务
+	select {
+	case err = <-done:
+		servers--
+	case <-sig:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if e := s.Shutdown(ctx); e != nil && err == nil {
+		err = e
+	}
+	if rs != nil {
+		if e := rs.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	for ; servers > 0; servers-- {
+		if e := <-done; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (cmd *serveCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb serve [-key-file PATH] [-addr ADDR] [-resp-addr ADDR] [-read-only] PATH
+
+Serve exposes the buckets of the database over HTTP so that several
+processes can share one database file. Keys are read, written and
+deleted with GET, PUT and DELETE on /b/{bucket path}/k/{key}. GET on
+/b/{bucket path} lists a bucket page by page, POST /batch runs several
+operations in one transaction and GET /stats reports database statistics.
+
+With -resp-addr the database is also served over the Redis protocol.
+Each connection works on the bucket chosen with SELECT, "0" by default.
+
+The server listens on -addr, ":8080" by default. With -read-only the
+database is opened read-only and writes are rejected. On SIGINT or SIGTERM
+the server stops accepting requests, waits for the requests in progress
+and closes the database.
+`, "\n")
+}
+
+// 执行SQL语句
+type sqlCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newSQLCommand(m *Main) *sqlCommand {
+	return &sqlCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *sqlCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path, stmt := fs.Arg(0), fs.Arg(1)
+	if path == "" {
+		return ErrPathRequired
+	} else if stmt == "" || fs.NArg() > 2 {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{Cipher: c, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := sql.Exec(db, stmt)
+	if err != nil {
+		return err
+	}
+	return writeResult(cmd.Stdout, result)
+}
+
+func (cmd *sqlCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb sql [-key-file PATH] PATH STATEMENT
+
+Sql runs one statement against the database and prints the rows of a
+query as a table, or the number of rows affected by other statements.
+The database is created if it does not exist.
+
+The supported statements are CREATE TABLE, DROP TABLE, INSERT, SELECT,
+DELETE and EXPLAIN. Rows are stored by primary key, and comparisons of
+the primary key with constants in WHERE are turned into range scans.
+`, "\n")
+}
+
+// 以表格形式打印查询结果, 没有列时打印影响的行数
+func writeResult(w io.Writer, result *sql.Result) error {
+	if result.Columns == nil {
+		_, err := fmt.Fprintf(w, "%d rows affected\n", result.RowsAffected)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, c := range result.Columns {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, c.Name)
+	}
+	fmt.Fprintln(tw)
+	for _, row := range result.Rows {
+		for i, c := range row.Cells {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, c.String())
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// 以只读方式打开数据库并检查一致性
+func check(path, keyFile string) error {
+	c, err := loadCipher(keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: true, Cipher: c})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *pddb.Tx) error {
+		return tx.Check()
+	})
+}
+
+// 将以"/"分隔的bucket路径拆分成各级名称
+func splitBucketPath(s string) [][]byte {
+	var path [][]byte
+	for _, name := range strings.Split(strings.Trim(s, "/"), "/") {
+		if name != "" {
+			path = append(path, []byte(name))
+		}
+	}
+	return path
+}
+
+// 解析CSV分隔符, 必须是单个字符, "\t"表示制表符
+func parseComma(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+	r := []rune(s)
+	if len(r) != 1 {
+		return 0, fmt.Errorf("invalid separator %q", s)
+	}
+	return r[0], nil
+}
+
+// 从文件读取十六进制编码的密钥, 路径为空时返回nil
+func loadCipher(path string) (pddb.Cipher, error) {
+	if path == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file: %s", err)
+	}
+	return pddb.NewAESCipher(key)
+}
@@ -0,0 +1,528 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pddb"
+	main "pddb/cmd/pddb"
+	"pddb/resp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 测试用的命令行程序, 记录输出
+type Main struct {
+	*main.Main
+	Stdin  bytes.Buffer
+	Stdout bytes.Buffer
+	Stderr bytes.Buffer
+}
+
+func NewMain() *Main {
+	m := &Main{Main: main.NewMain()}
+	m.Main.Stdin = &m.Stdin
+	m.Main.Stdout = &m.Stdout
+	m.Main.Stderr = &m.Stderr
+	return m
+}
+
+// 在临时目录中创建数据库, 返回数据库路径
+func tempDB(t *testing.T, options *pddb.Options) (string, *pddb.DB) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := pddb.Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, db
+}
+
+// 写入十六进制密钥文件
+func keyFile(t *testing.T, key string) string {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 测试使用新密钥重新加密数据库
+func TestRekeyCommand_Run(t *testing.T) {
+	oldKey := strings.Repeat("01", 32)
+	newKey := strings.Repeat("02", 32)
+	oldCipher, _ := pddb.NewAESCipher(bytes.Repeat([]byte{1}, 32))
+	newCipher, _ := pddb.NewAESCipher(bytes.Repeat([]byte{2}, 32))
+
+	path, db := tempDB(t, &pddb.Options{Cipher: oldCipher})
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMain()
+	if err := m.Run("rekey", "-old-key-file", keyFile(t, oldKey), "-new-key-file", keyFile(t, newKey), path); err != nil {
+		t.Fatal(err)
+	} else if m.Stdout.String() != "ok\n" {
+		t.Fatalf("unexpected stdout: %q", m.Stdout.String())
+	}
+
+	if _, err := pddb.Open(path, 0666, &pddb.Options{Cipher: oldCipher}); err != pddb.ErrCipherMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{Cipher: newCipher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试数据库路径不能为空
+func TestRekeyCommand_ErrPathRequired(t *testing.T) {
+	if err := NewMain().Run("rekey"); err != main.ErrPathRequired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := NewMain().Run("rekey", filepath.Join(os.TempDir(), "pddb-missing")); err != main.ErrFileNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 测试导出数据后导入到新的数据库
+func TestDumpCommand_Run(t *testing.T) {
+	path, db := tempDB(t, nil)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMain()
+	if err := m.Run("dump", path); err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"type":"header","version":1}` + "\n" +
+		`{"type":"bucket","path":["d2lkZ2V0cw=="]}` + "\n" +
+		`{"type":"kv","path":["d2lkZ2V0cw=="],"key":"Zm9v","value":"YmFy"}` + "\n"
+	if m.Stdout.String() != exp {
+		t.Fatalf("unexpected stdout: %s", m.Stdout.String())
+	}
+
+	target := filepath.Join(t.TempDir(), "db")
+	lm := NewMain()
+	lm.Stdin.Write(m.Stdout.Bytes())
+	if err := lm.Run("load", target); err != nil {
+		t.Fatal(err)
+	} else if lm.Stdout.String() != "ok\n" {
+		t.Fatalf("unexpected stdout: %q", lm.Stdout.String())
+	}
+
+	db, err := pddb.Open(target, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试完整备份和增量备份的恢复
+func TestBackupCommand_Run(t *testing.T) {
+	path, db := tempDB(t, &pddb.Options{TrackPages: true})
+	put := func(k, v string) {
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(k), []byte(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+
+	// 命令行备份需要获取文件锁, 备份前先关闭数据库
+	put("foo", "bar")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMain()
+	if err := m.Run("backup", path, filepath.Join(dir, "full")); err != nil {
+		t.Fatal(err)
+	}
+	var txid int
+	if _, err := fmt.Sscanf(m.Stdout.String(), "txid %d", &txid); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{TrackPages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("baz", "bat")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMain().Run("backup", "-since", fmt.Sprint(txid), path, filepath.Join(dir, "incr")); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "db")
+	m = NewMain()
+	if err := m.Run("restore", target, filepath.Join(dir, "full"), filepath.Join(dir, "incr")); err != nil {
+		t.Fatal(err)
+	} else if m.Stdout.String() != "ok\n" {
+		t.Fatalf("unexpected stdout: %q", m.Stdout.String())
+	}
+	if err := NewMain().Run("restore", target, filepath.Join(dir, "full")); err != main.ErrFileExists {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := NewMain().Run("check", target); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = pddb.Open(target, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("baz")); string(v) != "bat" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试serve提供HTTP访问, 收到信号后关闭
+func TestServeCommand_Run(t *testing.T) {
+	path, db := tempDB(t, nil)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 获取一个空闲端口
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	respAddr := l.Addr().String()
+	l.Close()
+
+	m := NewMain()
+	done := make(chan error, 1)
+	go func() { done <- m.Run("serve", "-addr", addr, "-resp-addr", respAddr, path) }()
+
+	url := "http://" + addr + "/b/widgets/k/foo"
+	for i := 0; ; i++ {
+		req, _ := http.NewRequest("PUT", url, strings.NewReader("bar"))
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("unexpected status: %d", resp.StatusCode)
+			}
+			break
+		} else if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, err := resp.Dial(respAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Do("SELECT", "widgets"); err != nil {
+		t.Fatal(err)
+	} else if v, err := c.Do("GET", "foo"); err != nil || resp.String(v) != "bar" {
+		t.Fatalf("unexpected reply: %v %v", v, err)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// 数据库已经关闭, 可以重新打开
+	db, err = pddb.Open(path, 0666, &pddb.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试serve要求数据库文件存在
+func TestServeCommand_ErrFileNotFound(t *testing.T) {
+	m := NewMain()
+	if err := m.Run("serve", filepath.Join(t.TempDir(), "missing")); err != main.ErrFileNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 测试执行SQL语句并打印结果
+func TestSQLCommand_Run(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	for _, s := range []string{
+		`CREATE TABLE t (id INT PRIMARY KEY, name TEXT)`,
+		`INSERT INTO t VALUES (2, 'bob'), (1, 'alice')`,
+	} {
+		if err := NewMain().Run("sql", path, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMain()
+	if err := m.Run("sql", path, `DELETE FROM t WHERE id = 3`); err != nil {
+		t.Fatal(err)
+	} else if m.Stdout.String() != "0 rows affected\n" {
+		t.Fatalf("unexpected stdout: %q", m.Stdout.String())
+	}
+
+	m = NewMain()
+	if err := m.Run("sql", path, `SELECT id, name AS person FROM t`); err != nil {
+		t.Fatal(err)
+	} else if exp := "id  person\n1   alice\n2   bob\n"; m.Stdout.String() != exp {
+		t.Fatalf("unexpected stdout: %q", m.Stdout.String())
+	}
+
+	if err := NewMain().Run("sql", path, `SELECT * FROM missing`); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := NewMain().Run("sql", path); err != main.ErrUsage {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 测试交互式命令行
+func TestShellCommand_Run(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	m := NewMain()
+	m.Stdin.WriteString(strings.Join([]string{
+		`get a`,
+		`.use widgets/blue`,
+		`put a 1`,
+		`put "b c" "x\ty"`,
+		`begin`,
+		`put d 4`,
+		`del a`,
+		`rollback`,
+		`begin`,
+		`put e 5`,
+		`commit`,
+		`scan`,
+		`scan b`,
+		`.use widgets`,
+		`.buckets`,
+		`scan`,
+		`.use /widgets/blue`,
+		`.mode hex`,
+		`get 65`,
+		`put ff 00`,
+		`.mode utf8`,
+		`get a`,
+		`.check`,
+		`bogus`,
+		`.exit`,
+	}, "\n"))
+	if err := m.Run("shell", path); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := strings.Join([]string{
+		`pddb> error: no bucket selected, use .use PATH`,
+		`pddb> bucket does not exist yet, put creates it`,
+		`pddb> pddb> pddb> pddb*> pddb*> pddb*> pddb> pddb*> pddb*> pddb> a = 1`,
+		`"b c" = "x\ty"`,
+		`e = 5`,
+		`pddb> "b c" = "x\ty"`,
+		`pddb> pddb> blue`,
+		`pddb> blue (bucket)`,
+		`pddb> pddb> pddb> 35`,
+		`pddb> pddb> pddb> 1`,
+		`pddb> ok`,
+		`pddb> error: unknown command "bogus", see .help`,
+		`pddb> `,
+	}, "\n")
+	if m.Stdout.String() != exp {
+		t.Fatalf("unexpected stdout:\n%s", m.Stdout.String())
+	}
+
+	// 显式事务中的写入在提交后可见, 回滚的写入不可见
+	db, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets")).Bucket([]byte("blue"))
+		if v := b.Get([]byte("d")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte{0xff}); !bytes.Equal(v, []byte{0}) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试导入CSV后导出相同的内容
+func TestImportCSVCommand_Run(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	const data = "id\tname\n2\tbob\n1\t\"a\tb\"\n"
+
+	m := NewMain()
+	m.Stdin.WriteString(data)
+	if err := m.Run("import-csv", "-key", "id", "-format", "columns", "-comma", `\t`, path, "people/2024"); err != nil {
+		t.Fatal(err)
+	} else if m.Stdout.String() != "2 rows imported\n" {
+		t.Fatalf("unexpected stdout: %q", m.Stdout.String())
+	}
+
+	m = NewMain()
+	if err := m.Run("export-csv", "-comma", `\t`, path, "/people/2024"); err != nil {
+		t.Fatal(err)
+	} else if exp := "id\tname\n1\t\"a\tb\"\n2\tbob\n"; m.Stdout.String() != exp {
+		t.Fatalf("unexpected stdout: %q", m.Stdout.String())
+	}
+
+	if err := NewMain().Run("import-csv", "-format", "xml", path, "people"); err != main.ErrUsage {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := NewMain().Run("export-csv", path, "missing"); err != pddb.ErrBucketNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 测试输出page结构和碎片报告
+func TestDotCommand_Run(t *testing.T) {
+	path, db := tempDB(t, nil)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 500; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 32)); err != nil {
+				return err
+			}
+		}
+		_, err = b.CreateBucket([]byte("child"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	m := NewMain()
+	if err := m.Run("dot", path, "widgets"); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.HasPrefix(out, "digraph \"widgets\" {\n") || !strings.Contains(out, " branch\\n") {
+		t.Fatalf("unexpected stdout: %q", out)
+	}
+	if err := NewMain().Run("dot", path, "widgets/missing"); err != pddb.ErrBucketNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m = NewMain()
+	if err := m.Run("frag", path); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	for _, want := range []string{"Page size: ", "  meta      2 ", "Free runs: ", "(root)  ", "widgets  ", "widgets/child  ", "inline"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+}
+
+// 测试压测命令的各种写入和读取方式
+func TestBenchCommand_Run(t *testing.T) {
+	for _, args := range [][]string{
+		{"-count", "500", "-batch-size", "100"},
+		{"-count", "500", "-write-mode", "rnd", "-read-mode", "rnd", "-readers", "4"},
+		{"-count", "500", "-batch-size", "50", "-write-mode", "seq-nest", "-read-mode", "rnd", "-key-size", "4"},
+		{"-count", "200", "-batch-size", "50", "-write-mode", "seq-nest", "-readers", "2", "-wal"},
+	} {
+		m := NewMain()
+		if err := m.Run(append([]string{"bench"}, args...)...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		out := m.Stdout.String()
+		if !strings.Contains(out, "# Write\t500 ops") && !strings.Contains(out, "# Write\t200 ops") {
+			t.Fatalf("%v: unexpected stdout: %s", args, out)
+		} else if !strings.Contains(out, "# Read\t") || !strings.Contains(out, "p99") || !strings.Contains(out, "# File size: ") {
+			t.Fatalf("%v: unexpected stdout: %s", args, out)
+		}
+	}
+
+	// 保留压测后的数据库
+	path := filepath.Join(t.TempDir(), "db")
+	if err := NewMain().Run("bench", "-count", "10", "-path", path, "-work"); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMain().Run("bench", "-path", path); err != main.ErrFileExists {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := NewMain().Run("bench", "-write-mode", "foo"); err == nil {
+		t.Fatal("expected error")
+	}
+}
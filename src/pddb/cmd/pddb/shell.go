@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"pddb"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 交互式命令错误
+var (
+	// 当前没有选择bucket
+	errNoBucket = errors.New("no bucket selected, use .use PATH")
+	// 已经在显式事务中
+	errTxOpen = errors.New("transaction already open")
+	// 不在显式事务中
+	errNoTx = errors.New("no transaction open")
+)
+
+// 交互式命令行
+type shellCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func newShellCommand(m *Main) *shellCommand {
+	return &shellCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *shellCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
+	readOnly := fs.Bool("read-only", false, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	}
+
+	c, err := loadCipher(*keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := pddb.Open(path, 0666, &pddb.Options{ReadOnly: *readOnly, Cipher: c, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s := &shell{db: db, w: cmd.Stdout}
+	defer s.rollback()
+
+	// 逐行读取命令, 命令出错时打印错误并继续
+	scanner := bufio.NewScanner(cmd.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for {
+		s.prompt()
+		if !scanner.Scan() {
+			break
+		}
+		exit, err := s.exec(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(cmd.Stdout, "error: %s\n", err)
+		}
+		if exit {
+			return nil
+		}
+	}
+	fmt.Fprintln(cmd.Stdout)
+	return scanner.Err()
+}
+
+func (cmd *shellCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: pddb shell [-key-file PATH] [-read-only] PATH
+
+Shell opens the database and reads commands from standard input, one per
+line. The database is created if it does not exist.
+
+The commands are:
+
+	.buckets          list the buckets in the current bucket
+	.use [PATH]       select the bucket at PATH, buckets separated by /
+	.mode hex|utf8    choose how keys and values are read and printed
+	.stats            print database statistics
+	.check            verify the consistency of the database
+	.help             print the list of commands
+	.exit             leave the shell
+	get KEY           print the value of KEY
+	put KEY VALUE     set KEY to VALUE, creating the current bucket
+	del KEY           delete KEY
+	scan [PREFIX]     print the keys starting with PREFIX
+	begin             start a write transaction
+	commit            commit the transaction
+	rollback          roll the transaction back
+
+Without begin every command runs in a transaction of its own. Arguments
+containing spaces are written in double quotes with Go escapes. In hex
+mode keys and values are written and printed as hexadecimal.
+`, "\n")
+}
+
+// 交互式命令的状态
+type shell struct {
+	db *pddb.DB
+	w  io.Writer
+
+	// 由begin开始的显式事务
+	tx *pddb.Tx
+	// 当前选择的bucket路径, 为空时位于根
+	path [][]byte
+	// 以十六进制读写key和value
+	hex bool
+}
+
+func (s *shell) prompt() {
+	if s.tx != nil {
+		fmt.Fprint(s.w, "pddb*> ")
+	} else {
+		fmt.Fprint(s.w, "pddb> ")
+	}
+}
+
+// 执行一行命令, 返回是否退出
+func (s *shell) exec(line string) (bool, error) {
+	args, err := splitArgs(line)
+	if err != nil || len(args) == 0 {
+		return false, err
+	}
+
+	switch name, args := strings.ToLower(args[0]), args[1:]; name {
+	case ".exit", ".quit":
+		return true, nil
+	case ".help":
+		fmt.Fprint(s.w, (&shellCommand{}).Usage())
+		return false, nil
+	case ".buckets":
+		return false, s.expect(args, 0, 0, s.buckets)
+	case ".use":
+		return false, s.expect(args, 0, 1, s.use)
+	case ".mode":
+		return false, s.expect(args, 1, 1, s.mode)
+	case ".stats":
+		return false, s.expect(args, 0, 0, s.stats)
+	case ".check":
+		return false, s.expect(args, 0, 0, s.check)
+	case "get":
+		return false, s.expect(args, 1, 1, s.get)
+	case "put":
+		return false, s.expect(args, 2, 2, s.put)
+	case "del":
+		return false, s.expect(args, 1, 1, s.del)
+	case "scan":
+		return false, s.expect(args, 0, 1, s.scan)
+	case "begin":
+		return false, s.expect(args, 0, 0, s.begin)
+	case "commit":
+		return false, s.expect(args, 0, 0, s.commit)
+	case "rollback":
+		return false, s.expect(args, 0, 0, func([]string) error {
+			if s.tx == nil {
+				return errNoTx
+			}
+			return s.rollback()
+		})
+	}
+	return false, fmt.Errorf("unknown command %q, see .help", args[0])
+}
+
+// 检查参数个数后执行命令
+func (s *shell) expect(args []string, min, max int, fn func([]string) error) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("wrong number of arguments")
+	}
+	return fn(args)
+}
+
+// 在显式事务中执行fn, 没有显式事务时使用单独的事务
+func (s *shell) run(writeable bool, fn func(tx *pddb.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	} else if writeable {
+		return s.db.Update(fn)
+	}
+	return s.db.View(fn)
+}
+
+// 打开当前bucket, 位于根时返回errNoBucket
+func (s *shell) bucket(tx *pddb.Tx, create bool) (*pddb.Bucket, error) {
+	if len(s.path) == 0 {
+		return nil, errNoBucket
+	}
+	var b *pddb.Bucket
+	for i, name := range s.path {
+		var child *pddb.Bucket
+		var err error
+		switch {
+		case create && i == 0:
+			child, err = tx.CreateBucketIfNotExists(name)
+		case create:
+			child, err = b.CreateBucketIfNotExists(name)
+		case i == 0:
+			child = tx.Bucket(name)
+		default:
+			child = b.Bucket(name)
+		}
+		if err != nil {
+			return nil, err
+		} else if child == nil {
+			return nil, pddb.ErrBucketNotFound
+		}
+		b = child
+	}
+	return b, nil
+}
+
+func (s *shell) buckets(args []string) error {
+	return s.run(false, func(tx *pddb.Tx) error {
+		var c *pddb.Cursor
+		if len(s.path) == 0 {
+			c = tx.Cursor()
+		} else {
+			b, err := s.bucket(tx, false)
+			if err != nil {
+				return err
+			}
+			c = b.Cursor()
+		}
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v == nil {
+				fmt.Fprintln(s.w, s.format(k))
+			}
+		}
+		return nil
+	})
+}
+
+func (s *shell) use(args []string) error {
+	var path [][]byte
+	if len(args) > 0 {
+		for _, name := range strings.Split(strings.Trim(args[0], "/"), "/") {
+			if name == "" {
+				continue
+			}
+			b, err := s.decode(name)
+			if err != nil {
+				return err
+			}
+			path = append(path, b)
+		}
+	}
+
+	// 选择已经存在的bucket, 不存在的bucket由put创建
+	old := s.path
+	s.path = path
+	if len(path) == 0 {
+		return nil
+	}
+	err := s.run(false, func(tx *pddb.Tx) error {
+		_, err := s.bucket(tx, false)
+		return err
+	})
+	if err == pddb.ErrBucketNotFound {
+		fmt.Fprintln(s.w, "bucket does not exist yet, put creates it")
+		err = nil
+	} else if err != nil {
+		s.path = old
+	}
+	return err
+}
+
+func (s *shell) mode(args []string) error {
+	switch strings.ToLower(args[0]) {
+	case "hex":
+		s.hex = true
+	case "utf8", "utf-8":
+		s.hex = false
+	default:
+		return fmt.Errorf("unknown mode %q, use hex or utf8", args[0])
+	}
+	return nil
+}
+
+func (s *shell) stats(args []string) error {
+	return s.run(false, func(tx *pddb.Tx) error {
+		st := s.db.Stats()
+		fmt.Fprintf(s.w, "path:            %s\n", s.db.Path())
+		fmt.Fprintf(s.w, "size:            %d\n", tx.Size())
+		fmt.Fprintf(s.w, "txid:            %d\n", tx.ID())
+		fmt.Fprintf(s.w, "free pages:      %d\n", st.FreePageN)
+		fmt.Fprintf(s.w, "pending pages:   %d\n", st.PendingPageN)
+		fmt.Fprintf(s.w, "free bytes:      %d\n", st.FreeAlloc)
+		fmt.Fprintf(s.w, "freelist bytes:  %d\n", st.FreelistInuse)
+		fmt.Fprintf(s.w, "transactions:    %d\n", st.TxN)
+		fmt.Fprintf(s.w, "open read txs:   %d\n", st.OpenTxN)
+		return nil
+	})
+}
+
+func (s *shell) check(args []string) error {
+	return s.run(false, func(tx *pddb.Tx) error {
+		if err := tx.Check(); err != nil {
+			return err
+		}
+		fmt.Fprintln(s.w, "ok")
+		return nil
+	})
+}
+
+func (s *shell) get(args []string) error {
+	key, err := s.decode(args[0])
+	if err != nil {
+		return err
+	}
+	return s.run(false, func(tx *pddb.Tx) error {
+		b, err := s.bucket(tx, false)
+		if err != nil {
+			return err
+		}
+		if v := b.Get(key); v != nil {
+			fmt.Fprintln(s.w, s.format(v))
+		} else if b.Bucket(key) != nil {
+			fmt.Fprintln(s.w, "(bucket)")
+		} else {
+			fmt.Fprintln(s.w, "(nil)")
+		}
+		return nil
+	})
+}
+
+func (s *shell) put(args []string) error {
+	key, err := s.decode(args[0])
+	if err != nil {
+		return err
+	}
+	value, err := s.decode(args[1])
+	if err != nil {
+		return err
+	}
+	return s.run(true, func(tx *pddb.Tx) error {
+		b, err := s.bucket(tx, true)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	})
+}
+
+func (s *shell) del(args []string) error {
+	key, err := s.decode(args[0])
+	if err != nil {
+		return err
+	}
+	return s.run(true, func(tx *pddb.Tx) error {
+		b, err := s.bucket(tx, false)
+		if err != nil {
+			return err
+		}
+		return b.Delete(key)
+	})
+}
+
+func (s *shell) scan(args []string) error {
+	var prefix []byte
+	if len(args) > 0 {
+		var err error
+		if prefix, err = s.decode(args[0]); err != nil {
+			return err
+		}
+	}
+	return s.run(false, func(tx *pddb.Tx) error {
+		b, err := s.bucket(tx, false)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if v == nil {
+				fmt.Fprintf(s.w, "%s (bucket)\n", s.format(k))
+			} else if size, ok := c.Blob(); ok {
+				fmt.Fprintf(s.w, "%s (blob, %d bytes)\n", s.format(k), size)
+			} else {
+				fmt.Fprintf(s.w, "%s = %s\n", s.format(k), s.format(v))
+			}
+		}
+		return nil
+	})
+}
+
+func (s *shell) begin(args []string) error {
+	if s.tx != nil {
+		return errTxOpen
+	}
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	s.tx = tx
+	return nil
+}
+
+func (s *shell) commit(args []string) error {
+	if s.tx == nil {
+		return errNoTx
+	}
+	tx := s.tx
+	s.tx = nil
+	return tx.Commit()
+}
+
+// 回滚显式事务, 没有显式事务时不做任何事
+func (s *shell) rollback() error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx = nil
+	return tx.Rollback()
+}
+
+// 按照当前模式解析参数
+func (s *shell) decode(arg string) ([]byte, error) {
+	if !s.hex {
+		return []byte(arg), nil
+	}
+	b, err := hex.DecodeString(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex %q", arg)
+	}
+	return b, nil
+}
+
+// 按照当前模式显示key或value
+// utf8模式下不可打印的内容使用带引号的转义形式
+func (s *shell) format(b []byte) string {
+	if s.hex {
+		return hex.EncodeToString(b)
+	}
+	if printable(b) {
+		return string(b)
+	}
+	return strconv.Quote(string(b))
+}
+
+// 是否可以原样显示, 空串, 包含空白和以引号开头的内容需要加引号, 以便作为参数输入
+func printable(b []byte) bool {
+	if len(b) == 0 || b[0] == '"' || !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// 按照空白拆分命令行, 双引号中的内容按照Go字符串解析
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted argument")
+			}
+			arg, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted argument %s", line[i:j+1])
+			}
+			args = append(args, arg)
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' {
+				j++
+			}
+			args = append(args, line[i:j])
+			i = j
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,193 @@
+package pddb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// 压缩配置所在的系统bucket, bucket路径 -> 编码id + 阈值
+const codecBucketName = "__pddb_codec"
+
+// 值压缩编码, 压缩后的值以编码id开头, 读取时根据id找到对应的编码解压
+type Codec interface {
+	// 编码id, 写入每个压缩后的值中, 0保留不使用
+	ID() byte
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// 内置编码
+var (
+	// 使用compress/flate压缩
+	FlateCodec Codec = flateCodec{}
+	// 使用compress/gzip压缩
+	GzipCodec Codec = gzipCodec{}
+)
+
+var (
+	codecs    = map[byte]Codec{FlateCodec.ID(): FlateCodec, GzipCodec.ID(): GzipCodec}
+	codeclock sync.RWMutex
+)
+
+// 注册自定义编码, 读取使用该编码压缩的值之前必须先注册
+func RegisterCodec(c Codec) error {
+	codeclock.Lock()
+	defer codeclock.Unlock()
+
+	if c.ID() == 0 {
+		return ErrInvalidCodec
+	} else if _, ok := codecs[c.ID()]; ok {
+		return ErrCodecExists
+	}
+	codecs[c.ID()] = c
+	return nil
+}
+
+// 根据id返回编码
+func codecByID(id byte) Codec {
+	codeclock.RLock()
+	defer codeclock.RUnlock()
+	return codecs[id]
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte { return 1 }
+
+func (flateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() byte { return 2 }
+
+func (gzipCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// 设置bucket的压缩编码, 之后写入的长度不小于threshold的value会被压缩
+// c为nil时关闭压缩, 已经压缩的value仍然可以正常读取
+func (b *Bucket) SetCompression(c Codec, threshold int) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writeable() {
+		return ErrTxNotWriteable
+	} else if len(b.path) == 0 || b.isSystem() {
+		return ErrIncompatibleValue
+	} else if c != nil && codecByID(c.ID()) != c {
+		return ErrInvalidCodec
+	}
+	if threshold < 0 {
+		threshold = 0
+	}
+
+	if c == nil {
+		if cb := b.tx.root.Bucket([]byte(codecBucketName)); cb != nil {
+			if err := cb.Delete(encodeBucketPath(b.path)); err != nil {
+				return err
+			}
+		}
+	} else {
+		cb, err := b.tx.root.CreateBucketIfNotExists([]byte(codecBucketName))
+		if err != nil {
+			return err
+		}
+		value := binary.AppendUvarint([]byte{c.ID()}, uint64(threshold))
+		if err := cb.Put(encodeBucketPath(b.path), value); err != nil {
+			return err
+		}
+	}
+
+	b.codec, b.codecThreshold, b.codecLoaded = c, threshold, true
+	return nil
+}
+
+// 返回bucket的压缩配置
+func (b *Bucket) compression() (Codec, int) {
+	if b.codecLoaded {
+		return b.codec, b.codecThreshold
+	}
+	b.codec, b.codecThreshold = nil, 0
+	if !b.isSystem() && len(b.path) > 0 {
+		if cb := b.tx.root.Bucket([]byte(codecBucketName)); cb != nil {
+			if v := cb.Get(encodeBucketPath(b.path)); len(v) > 1 {
+				threshold, _ := binary.Uvarint(v[1:])
+				b.codec, b.codecThreshold = codecByID(v[0]), int(threshold)
+			}
+		}
+	}
+	b.codecLoaded = true
+	return b.codec, b.codecThreshold
+}
+
+// 根据bucket的压缩配置编码value, 返回写入page的value和标志位
+// 压缩后没有变小的value保持原样
+func (b *Bucket) encodeValue(value []byte) ([]byte, uint32, error) {
+	c, threshold := b.compression()
+	if c == nil || len(value) < threshold {
+		return value, 0, nil
+	}
+
+	compressed, err := c.Compress(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed)+1 >= len(value) {
+		return value, 0, nil
+	}
+	return append([]byte{c.ID()}, compressed...), compressedValueFlag, nil
+}
+
+// 解码page中保存的value
+func decodeValue(v []byte, flags uint32) ([]byte, error) {
+	if (flags & compressedValueFlag) == 0 {
+		return v, nil
+	} else if len(v) == 0 {
+		return nil, ErrInvalidCodec
+	}
+	c := codecByID(v[0])
+	if c == nil {
+		return nil, fmt.Errorf("codec %d: %w", v[0], ErrUnknownCodec)
+	}
+	return c.Decompress(v[1:])
+}
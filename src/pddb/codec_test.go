@@ -0,0 +1,313 @@
+package pddb_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"pddb"
+	"strings"
+	"testing"
+)
+
+// 可压缩的JSON value
+func jsonValue(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","tags":["%s"]}`, i, i, strings.Repeat("tag,", 64)))
+}
+
+// 压缩后的value可以通过Get和游标透明读取, 短value保持原样
+func TestBucket_SetCompression(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("raw"), jsonValue(0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetCompression(pddb.FlateCodec, 64); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("big"), jsonValue(1)); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("small"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("raw")); !bytes.Equal(v, jsonValue(0)) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("big")); !bytes.Equal(v, jsonValue(1)) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("small")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+
+		c := b.Cursor()
+		if k, v := c.First(); string(k) != "big" || !bytes.Equal(v, jsonValue(1)) {
+			t.Fatalf("unexpected first: %q=%q", k, v)
+		}
+		if k, v := c.Seek([]byte("c")); string(k) != "raw" || !bytes.Equal(v, jsonValue(0)) {
+			t.Fatalf("unexpected seek: %q=%q", k, v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 系统bucket不能设置压缩
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("__pddb_codec")).SetCompression(pddb.GzipCodec, 0)
+	}); err != pddb.ErrIncompatibleValue {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 压缩配置持久化, 压缩后的数据库文件更小
+func TestBucket_SetCompression_Reopen(t *testing.T) {
+	write := func(path string, codec pddb.Codec) int64 {
+		db, err := pddb.Open(path, 0666, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec != nil {
+				return b.SetCompression(codec, 0)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// 重新打开后配置仍然生效
+		if db, err = pddb.Open(path, 0666, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 500; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), jsonValue(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *pddb.Tx) error {
+			var n int
+			err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+				if !bytes.Equal(v, jsonValue(n)) {
+					t.Fatalf("unexpected value: %s=%q", k, v)
+				}
+				n++
+				return nil
+			})
+			if n != 500 {
+				t.Fatalf("unexpected count: %d", n)
+			}
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	raw, compressed := tempfile(), tempfile()
+	defer os.Remove(raw)
+	defer os.Remove(compressed)
+
+	if rawSize, size := write(raw, nil), write(compressed, pddb.GzipCodec); size >= rawSize {
+		t.Fatalf("expected smaller file: %d >= %d", size, rawSize)
+	}
+}
+
+// 游程编码, 每个字节保存为重复次数 + 字节
+type rleCodec struct{}
+
+func (rleCodec) ID() byte { return 200 }
+
+func (rleCodec) Compress(src []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(src); {
+		n := 1
+		for i+n < len(src) && src[i+n] == src[i] && n < 255 {
+			n++
+		}
+		out = append(out, byte(n), src[i])
+		i += n
+	}
+	return out, nil
+}
+
+func (rleCodec) Decompress(src []byte) ([]byte, error) {
+	if len(src)%2 != 0 {
+		return nil, fmt.Errorf("invalid rle data")
+	}
+	var out []byte
+	for i := 0; i < len(src); i += 2 {
+		out = append(out, bytes.Repeat(src[i+1:i+2], int(src[i]))...)
+	}
+	return out, nil
+}
+
+// 自定义编码需要注册后才能使用
+func TestRegisterCodec(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.SetCompression(rleCodec{}, 0)
+	}); err != pddb.ErrInvalidCodec {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := pddb.RegisterCodec(rleCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pddb.RegisterCodec(rleCodec{}); err != pddb.ErrCodecExists {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value := bytes.Repeat([]byte("a"), 1000)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetCompression(rleCodec{}, 0); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("foo"), value)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, value) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 只在子进程中注册的编码
+type otherCodec struct {
+	rleCodec
+}
+
+func (otherCodec) ID() byte { return 201 }
+
+// 子进程注册编码后写入压缩的value, 由TestBucket_Value_UnknownCodec启动
+func TestCodecHelperProcess(t *testing.T) {
+	path := os.Getenv("PDDB_CODEC_HELPER_PATH")
+	if path == "" {
+		t.Skip("helper process")
+	}
+	if err := pddb.RegisterCodec(otherCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("bar"), []byte("plain")); err != nil {
+			return err
+		} else if err := b.SetCompression(otherCodec{}, 0); err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), bytes.Repeat([]byte("a"), 1000))
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 读取使用没有注册的编码压缩的value返回错误, 不会panic
+func TestBucket_Value_UnknownCodec(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCodecHelperProcess$")
+	cmd.Env = append(os.Environ(), "PDDB_CODEC_HELPER_PATH="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("helper process: %s: %s", err, out)
+	}
+
+	db, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("foo")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		} else if _, err := b.Value([]byte("foo")); !errors.Is(err, pddb.ErrUnknownCodec) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if v, err := b.Value([]byte("bar")); err != nil || string(v) != "plain" {
+			t.Fatalf("unexpected value: %q, %v", v, err)
+		}
+		if _, err := ioutil.ReadAll(b.GetReader([]byte("foo"))); !errors.Is(err, pddb.ErrUnknownCodec) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		c := b.Cursor()
+		if k, v := c.First(); string(k) != "bar" || string(v) != "plain" || c.Err() != nil {
+			t.Fatalf("unexpected first: %q=%q", k, v)
+		} else if k, v := c.Next(); string(k) != "foo" || v != nil {
+			t.Fatalf("unexpected next: %q=%q", k, v)
+		} else if !errors.Is(c.Err(), pddb.ErrUnknownCodec) {
+			t.Fatalf("unexpected error: %v", c.Err())
+		}
+		if err := b.ForEach(func(k, v []byte) error { return nil }); !errors.Is(err, pddb.ErrUnknownCodec) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 覆盖时需要旧value维护索引和变更日志, 同样返回错误
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("new"))
+	}); !errors.Is(err, pddb.ErrUnknownCodec) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
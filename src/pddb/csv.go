@@ -0,0 +1,343 @@
+package pddb
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"unicode/utf8"
+)
+
+// 保存CSV布局的系统bucket, 编码后的bucket路径 -> JSON编码的csvLayout
+const csvBucketName = "__pddb_csv"
+
+// CSV行在bucket中的编码方式
+type CSVFormat int
+
+const (
+	// value为JSON对象, 按照表头的顺序保存列名和值
+	CSVFormatJSON CSVFormat = iota
+	// value为按照表头顺序排列的各列, 每列为uvarint长度 + 内容
+	CSVFormatColumns
+)
+
+func (f CSVFormat) String() string {
+	switch f {
+	case CSVFormatJSON:
+		return "json"
+	case CSVFormatColumns:
+		return "columns"
+	}
+	return fmt.Sprintf("CSVFormat(%d)", int(f))
+}
+
+// CSV导入选项
+type CSVOptions struct {
+	// 作为key的列名, 为空时使用NextSequence生成8字节大端key
+	// key列只保存在key中, 不重复写入value
+	KeyColumn string
+	// value的编码方式
+	Format CSVFormat
+	// 每个写事务最多导入的行数, 默认为DefaultLoadBatchSize
+	BatchSize int
+	// 字段分隔符, 默认为逗号
+	Comma rune
+}
+
+// 导入时记录的CSV布局, 导出时按照布局还原表头和列的顺序
+type csvLayout struct {
+	Columns []string  `json:"columns"`
+	Key     int       `json:"key"`
+	Format  CSVFormat `json:"format"`
+}
+
+// 将CSV导入到path指定的bucket, 第一行为表头, 返回导入的行数
+// bucket不存在时自动创建, 已经存在的key不会被覆盖而是返回ErrCSVDuplicateKey
+// 导入出错时已经提交的批次不会回滚
+func (db *DB) ImportCSV(r io.Reader, path [][]byte, options *CSVOptions) (int, error) {
+	if len(path) == 0 {
+		return 0, ErrInvalidBucketPath
+	}
+	if options == nil {
+		options = &CSVOptions{}
+	}
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultLoadBatchSize
+	}
+
+	cr := newCSVReader(r, options.Comma)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return 0, fmt.Errorf("header required: %w", ErrInvalidCSV)
+	} else if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, ErrInvalidCSV)
+	}
+	layout, err := newCSVLayout(header, options)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for done := false; !done; {
+		// 批次提交成功后才计入导入的行数
+		count := 0
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.csvBucket(path, layout)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < batchSize; i++ {
+				record, err := cr.Read()
+				if err == io.EOF {
+					done = true
+					return nil
+				} else if err != nil {
+					return fmt.Errorf("%s: %w", err, ErrInvalidCSV)
+				}
+				line, _ := cr.FieldPos(0)
+				if err := layout.put(b, record); err != nil {
+					return fmt.Errorf("line %d: %w", line, err)
+				}
+				count++
+			}
+			return nil
+		}); err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// 将ImportCSV导入的bucket按照导入时的布局导出为CSV, comma为0时使用逗号
+// 子bucket被跳过, 使用key列的bucket按照key的顺序导出
+func (tx *Tx) ExportCSV(w io.Writer, path [][]byte, comma rune) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	b := tx.bucketAt(path)
+	if b == nil || len(path) == 0 {
+		return ErrBucketNotFound
+	}
+	layout, err := tx.csvLayout(path)
+	if err != nil {
+		return err
+	} else if layout == nil {
+		return ErrCSVLayoutNotFound
+	}
+
+	cw := csv.NewWriter(w)
+	if comma != 0 {
+		cw.Comma = comma
+	}
+	if err := cw.Write(layout.Columns); err != nil {
+		return err
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := c.Err(); err != nil {
+			return err
+		} else if v == nil {
+			continue
+		}
+		// 游标不读取blob的数据, 导出完整的value
+		if _, raw, flags := c.keyValue(); (flags & blobValueFlag) != 0 {
+			v = b.tx.readBlob(raw)
+		}
+		record, err := layout.decode(k, v)
+		if err != nil {
+			return fmt.Errorf("key %x: %w", k, err)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// 读取CSV, 每行的列数必须与表头相同, 保留字段的前导空白
+func newCSVReader(r io.Reader, comma rune) *csv.Reader {
+	cr := csv.NewReader(r)
+	if comma != 0 {
+		cr.Comma = comma
+	}
+	cr.FieldsPerRecord = 0
+	cr.ReuseRecord = true
+	return cr
+}
+
+// 根据表头和选项生成布局, 列名不可重复, key列必须存在
+func newCSVLayout(header []string, options *CSVOptions) (*csvLayout, error) {
+	layout := &csvLayout{Columns: append([]string(nil), header...), Key: -1, Format: options.Format}
+	if layout.Format != CSVFormatJSON && layout.Format != CSVFormatColumns {
+		return nil, fmt.Errorf("unknown format %d: %w", int(layout.Format), ErrInvalidCSV)
+	}
+	seen := make(map[string]bool)
+	for i, name := range header {
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate column %q: %w", name, ErrInvalidCSV)
+		}
+		seen[name] = true
+		if layout.Format == CSVFormatJSON && !utf8.ValidString(name) {
+			return nil, fmt.Errorf("column %q is not valid UTF-8: %w", name, ErrInvalidCSV)
+		}
+		if options.KeyColumn != "" && name == options.KeyColumn {
+			layout.Key = i
+		}
+	}
+	if options.KeyColumn != "" && layout.Key < 0 {
+		return nil, fmt.Errorf("key column %q not found: %w", options.KeyColumn, ErrInvalidCSV)
+	}
+	return layout, nil
+}
+
+// 打开导入的目标bucket并记录布局, 已有的布局必须与本次导入相同
+func (tx *Tx) csvBucket(path [][]byte, layout *csvLayout) (*Bucket, error) {
+	existing, err := tx.csvLayout(path)
+	if err != nil {
+		return nil, err
+	} else if tx.bucketAt(path) == nil {
+		// bucket被删除后留下的布局不再有效
+		existing = nil
+	} else if existing != nil && !reflect.DeepEqual(existing, layout) {
+		return nil, ErrCSVLayoutMismatch
+	}
+
+	b := &tx.root
+	for _, name := range path {
+		if b, err = b.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+	if existing != nil {
+		return b, nil
+	}
+
+	layouts, err := tx.CreateBucketIfNotExists([]byte(csvBucketName))
+	if err != nil {
+		return nil, err
+	}
+	v, err := json.Marshal(layout)
+	if err != nil {
+		return nil, err
+	}
+	return b, layouts.Put(encodeBucketPath(path), v)
+}
+
+// 读取bucket的布局, 没有布局时返回nil
+func (tx *Tx) csvLayout(path [][]byte) (*csvLayout, error) {
+	layouts := tx.root.Bucket([]byte(csvBucketName))
+	if layouts == nil {
+		return nil, nil
+	}
+	v := layouts.Get(encodeBucketPath(path))
+	if v == nil {
+		return nil, nil
+	}
+	layout := &csvLayout{}
+	if err := json.Unmarshal(v, layout); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// 将一行写入bucket
+func (l *csvLayout) put(b *Bucket, record []string) error {
+	var key []byte
+	if l.Key >= 0 {
+		key = []byte(record[l.Key])
+		if b.Get(key) != nil || b.Bucket(key) != nil {
+			return fmt.Errorf("%q: %w", record[l.Key], ErrCSVDuplicateKey)
+		}
+	} else {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key = binary.BigEndian.AppendUint64(nil, id)
+	}
+
+	value, err := l.encode(record)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// 编码除key列以外的各列
+func (l *csvLayout) encode(record []string) ([]byte, error) {
+	var buf []byte
+	if l.Format == CSVFormatJSON {
+		buf = append(buf, '{')
+	}
+	first := true
+	for i, field := range record {
+		if i == l.Key {
+			continue
+		}
+		if l.Format == CSVFormatColumns {
+			buf = binary.AppendUvarint(buf, uint64(len(field)))
+			buf = append(buf, field...)
+			continue
+		}
+
+		// JSON不能无损保存非UTF-8的内容
+		if !utf8.ValidString(field) {
+			return nil, fmt.Errorf("column %q is not valid UTF-8: %w", l.Columns[i], ErrInvalidCSV)
+		}
+		if !first {
+			buf = append(buf, ',')
+		}
+		first = false
+		name, _ := json.Marshal(l.Columns[i])
+		value, _ := json.Marshal(field)
+		buf = append(buf, name...)
+		buf = append(buf, ':')
+		buf = append(buf, value...)
+	}
+	if l.Format == CSVFormatJSON {
+		buf = append(buf, '}')
+	}
+	return buf, nil
+}
+
+// 从key和value还原一行
+func (l *csvLayout) decode(key, value []byte) ([]string, error) {
+	record := make([]string, len(l.Columns))
+	if l.Key >= 0 {
+		record[l.Key] = string(key)
+	}
+
+	if l.Format == CSVFormatJSON {
+		fields := make(map[string]string)
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return nil, ErrInvalidCSV
+		}
+		for i, name := range l.Columns {
+			if i != l.Key {
+				record[i] = fields[name]
+			}
+		}
+		return record, nil
+	}
+
+	for i := range l.Columns {
+		if i == l.Key {
+			continue
+		}
+		n, sz := binary.Uvarint(value)
+		if sz <= 0 || uint64(len(value)-sz) < n {
+			return nil, ErrInvalidCSV
+		}
+		record[i] = string(value[sz : sz+int(n)])
+		value = value[sz+int(n):]
+	}
+	if len(value) > 0 {
+		return nil, ErrInvalidCSV
+	}
+	return record, nil
+}
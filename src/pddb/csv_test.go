@@ -0,0 +1,162 @@
+package pddb_test
+
+import (
+	"bytes"
+	"errors"
+	"pddb"
+	"strings"
+	"testing"
+)
+
+// 导入后导出的CSV与原始内容相同
+func TestDB_ImportCSV(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	const data = "id,name,note\n" +
+		"3,carol,\"multi\nline\"\n" +
+		"1,alice,\"with, comma\"\n" +
+		"2,bob,\" leading space\"\n" +
+		"4,dave,\n"
+	for _, tt := range []struct {
+		path    string
+		options *pddb.CSVOptions
+		want    string
+	}{
+		// 使用key列时按照key的顺序导出
+		{"by-id-json", &pddb.CSVOptions{KeyColumn: "id", BatchSize: 2}, "id,name,note\n" +
+			"1,alice,\"with, comma\"\n" +
+			"2,bob,\" leading space\"\n" +
+			"3,carol,\"multi\nline\"\n" +
+			"4,dave,\n"},
+		{"by-id-columns", &pddb.CSVOptions{KeyColumn: "id", Format: pddb.CSVFormatColumns}, "id,name,note\n" +
+			"1,alice,\"with, comma\"\n" +
+			"2,bob,\" leading space\"\n" +
+			"3,carol,\"multi\nline\"\n" +
+			"4,dave,\n"},
+		// 生成的key保持原始的顺序
+		{"generated", &pddb.CSVOptions{Format: pddb.CSVFormatColumns, BatchSize: 3}, data},
+	} {
+		path := [][]byte{[]byte("csv"), []byte(tt.path)}
+		if n, err := db.ImportCSV(strings.NewReader(data), path, tt.options); err != nil {
+			t.Fatal(err)
+		} else if n != 4 {
+			t.Fatalf("unexpected row count: %d", n)
+		}
+
+		var buf bytes.Buffer
+		if err := db.View(func(tx *pddb.Tx) error {
+			return tx.ExportCSV(&buf, path, 0)
+		}); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != tt.want {
+			t.Fatalf("%s: unexpected csv: %q", tt.path, buf.String())
+		}
+	}
+
+	// 值的编码
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("csv"))
+		if v := b.Bucket([]byte("by-id-json")).Get([]byte("1")); string(v) != `{"name":"alice","note":"with, comma"}` {
+			t.Fatalf("unexpected value: %s", v)
+		}
+		if v := b.Bucket([]byte("by-id-columns")).Get([]byte("4")); !bytes.Equal(v, []byte("\x04dave\x00")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Bucket([]byte("generated")).Get([]byte{0, 0, 0, 0, 0, 0, 0, 1}); !bytes.Equal(v, []byte("\x013\x05carol\x0amulti\nline")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 追加导入继续使用生成的key
+	path := [][]byte{[]byte("csv"), []byte("generated")}
+	if _, err := db.ImportCSV(strings.NewReader("id,name,note\n5,erin,x\n"), path, &pddb.CSVOptions{Format: pddb.CSVFormatColumns}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.View(func(tx *pddb.Tx) error {
+		return tx.ExportCSV(&buf, path, ';')
+	}); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasSuffix(buf.String(), "4;dave;\n5;erin;x\n") {
+		t.Fatalf("unexpected csv: %q", buf.String())
+	}
+}
+
+// 测试导入错误, 出错之前提交的批次仍然保留
+func TestDB_ImportCSV_Errors(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	path := [][]byte{[]byte("widgets")}
+	for _, tt := range []struct {
+		data    string
+		options *pddb.CSVOptions
+		err     error
+	}{
+		{"", nil, pddb.ErrInvalidCSV},
+		{"a,a\n", nil, pddb.ErrInvalidCSV},
+		{"a,b\n1\n", nil, pddb.ErrInvalidCSV},
+		{"a,b\n", &pddb.CSVOptions{KeyColumn: "c"}, pddb.ErrInvalidCSV},
+		{"a,b\n1,\xff\n", nil, pddb.ErrInvalidCSV},
+		{"a,b\n,1\n", &pddb.CSVOptions{KeyColumn: "a"}, pddb.ErrKeyRequired},
+	} {
+		if _, err := db.ImportCSV(strings.NewReader(tt.data), path, tt.options); !errors.Is(err, tt.err) {
+			t.Fatalf("%q: unexpected error: %v", tt.data, err)
+		}
+	}
+
+	options := &pddb.CSVOptions{KeyColumn: "a", BatchSize: 2}
+	if n, err := db.ImportCSV(strings.NewReader("a,b\n1,x\n2,y\n3,z\n1,w\n"), path, options); !errors.Is(err, pddb.ErrCSVDuplicateKey) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 2 || !strings.HasPrefix(err.Error(), "line 5:") {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+
+	// 回滚的批次不计入导入的行数
+	if err := db.View(func(tx *pddb.Tx) error {
+		var count int
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			count++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if count != 2 {
+			t.Fatalf("unexpected key count: %d", count)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ImportCSV(strings.NewReader("a,c\n"), path, options); err != pddb.ErrCSVLayoutMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 删除bucket后可以使用新的布局导入
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ImportCSV(strings.NewReader("a,b\n1,x\n2,y\n"), path, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("2")); string(v) != `{"b":"y"}` {
+			t.Fatalf("unexpected value: %s", v)
+		} else if v := b.Get([]byte("3")); v != nil {
+			t.Fatalf("unexpected value: %s", v)
+		}
+		if err := tx.ExportCSV(&bytes.Buffer{}, [][]byte{[]byte("missing")}, 0); err != pddb.ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,12 +2,194 @@ package pddb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"sort"
 )
 
 type Cursor struct {
 	bucket *Bucket
 	stack  []elemRef
+	// 过期索引中的key子bucket, 没有设置过过期时间时为nil
+	expiry       *Bucket
+	expiryLoaded bool
+	// 遍历过程中第一个无法解码的value的错误
+	err error
+}
+
+// 返回遍历过程中遇到的第一个错误, 例如value使用了当前进程没有注册的编码
+// 无法解码的value返回给调用者时为nil
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// 返回游标所在的bucket
+func (c *Cursor) Bucket() *Bucket {
+	return c.bucket
+}
+
+// 返回游标当前的value是否是blob以及blob的大小, 游标不读取blob的数据
+func (c *Cursor) Blob() (size int64, ok bool) {
+	if len(c.stack) == 0 {
+		return 0, false
+	}
+	_, v, flags := c.keyValue()
+	if (flags & blobValueFlag) == 0 {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(v[0:8])), true
+}
+
+// 将游标移动到bucket的第一个元素, 如果bucket为空则返回nil
+// 如果元素是子bucket, value为nil; 如果value是blob, value为空, 通过Bucket.GetReader读取
+func (c *Cursor) First() (key []byte, value []byte) {
+	if c.bucket.tx.db == nil {
+		panic("cursor.First(): transaction closed")
+	}
+	k, v, flags := c.rawFirst()
+	k, v, flags = c.skipExpired(k, v, flags, c.next)
+	return c.userKeyValue(k, v, flags)
+}
+
+// 移动到第一个元素, 返回page中保存的原始数据
+func (c *Cursor) rawFirst() ([]byte, []byte, uint32) {
+	c.stack = c.stack[:0]
+	p, n := c.bucket.pageNode(c.bucket.root)
+	c.stack = append(c.stack, elemRef{page: p, node: n, index: 0})
+	c.first()
+
+	// 落在空页上时需要移动到下一个元素
+	if c.stack[len(c.stack)-1].count() == 0 {
+		c.next()
+	}
+
+	return c.keyValue()
+}
+
+// 将游标移动到bucket的最后一个元素, 如果bucket为空则返回nil
+func (c *Cursor) Last() (key []byte, value []byte) {
+	if c.bucket.tx.db == nil {
+		panic("cursor.Last(): transaction closed")
+	}
+	c.stack = c.stack[:0]
+	p, n := c.bucket.pageNode(c.bucket.root)
+	ref := elemRef{page: p, node: n}
+	ref.index = ref.count() - 1
+	c.stack = append(c.stack, ref)
+	c.last()
+
+	k, v, flags := c.keyValue()
+	k, v, flags = c.skipExpired(k, v, flags, c.prev)
+	return c.userKeyValue(k, v, flags)
+}
+
+// 将游标移动到下一个元素, 到达末尾时返回nil
+func (c *Cursor) Next() (key []byte, value []byte) {
+	if c.bucket.tx.db == nil {
+		panic("cursor.Next(): transaction closed")
+	}
+	k, v, flags := c.next()
+	k, v, flags = c.skipExpired(k, v, flags, c.next)
+	return c.userKeyValue(k, v, flags)
+}
+
+// 将游标移动到上一个元素, 到达开头时返回nil
+func (c *Cursor) Prev() (key []byte, value []byte) {
+	if c.bucket.tx.db == nil {
+		panic("cursor.Prev(): transaction closed")
+	}
+	k, v, flags := c.prev()
+	k, v, flags = c.skipExpired(k, v, flags, c.prev)
+	return c.userKeyValue(k, v, flags)
+}
+
+// 移动到上一个叶子元素, 到达开头时返回nil
+func (c *Cursor) prev() ([]byte, []byte, uint32) {
+	// 逐层向上回退, 直到某一层可以向前移动
+	for i := len(c.stack) - 1; i >= 0; i-- {
+		elem := &c.stack[i]
+		if elem.index > 0 {
+			elem.index--
+			break
+		}
+		c.stack = c.stack[:i]
+	}
+
+	if len(c.stack) == 0 {
+		return nil, nil, 0
+	}
+
+	// 向下找到该分支下最后一个叶子元素
+	c.last()
+	return c.keyValue()
+}
+
+// 将游标移动到指定key, 如果key不存在则移动到下一个key
+func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
+	k, v, flags := c.seek(seek)
+
+	// 位于页尾时移动到下一页
+	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
+		k, v, flags = c.next()
+	}
+
+	if k == nil {
+		return nil, nil
+	}
+	k, v, flags = c.skipExpired(k, v, flags, c.next)
+	return c.userKeyValue(k, v, flags)
+}
+
+// 与Get一样跳过已经过期但还没有被清理的key, 使用move继续移动游标
+func (c *Cursor) skipExpired(k, v []byte, flags uint32, move func() ([]byte, []byte, uint32)) ([]byte, []byte, uint32) {
+	for k != nil && (flags&bucketLeafFlag) == 0 && c.expired(k) {
+		k, v, flags = move()
+	}
+	return k, v, flags
+}
+
+// key是否已经过期, 只读事务中过期索引不会改变, 只查找一次
+func (c *Cursor) expired(key []byte) bool {
+	if c.bucket.isSystem() {
+		return false
+	}
+	if !c.expiryLoaded || c.bucket.tx.writeable {
+		_, c.expiry = c.bucket.tx.expiryBuckets()
+		c.expiryLoaded = true
+	}
+	return expiredIn(c.expiry, c.bucket.path, key)
+}
+
+// 删除游标当前指向的元素
+func (c *Cursor) Delete() error {
+	if c.bucket.tx.db == nil {
+		return ErrTxClosed
+	} else if !c.bucket.Writeable() {
+		return ErrTxNotWriteable
+	} else if err := c.bucket.tx.checkContext(); err != nil {
+		return err
+	}
+
+	key, _, flags := c.keyValue()
+	if (flags & bucketLeafFlag) != 0 {
+		return ErrIncompatibleValue
+	}
+
+	// 与Bucket.Delete一样释放blob, 维护索引和过期时间
+	old, blob, err := c.bucket.oldValue(key)
+	if err != nil {
+		return err
+	}
+	if err := c.bucket.updateIndexes(key, old, nil); err != nil {
+		return err
+	}
+	c.bucket.tx.recordChange(c.bucket.path, key, old, nil, blob != nil)
+	c.node().del(key)
+	if blob != nil {
+		c.bucket.tx.freeBlob(blob)
+	}
+
+	return c.bucket.clearExpiry(key)
 }
 
 // 将数据库游标移动到指定key，如果key不存在，则指向下一个key
@@ -27,9 +209,83 @@ func (c *Cursor) seek(seek []byte) (key []byte, value []byte, flags uint32) {
 	return c.keyValue()
 }
 
+// 沿着栈顶元素一直向下移动到第一个叶子元素
+func (c *Cursor) first() {
+	for {
+		var ref = &c.stack[len(c.stack)-1]
+		if ref.isLeaf() {
+			break
+		}
+
+		var pgid pgid
+		if ref.node != nil {
+			pgid = ref.node.inodes[ref.index].pgid
+		} else {
+			pgid = ref.page.branchPageElement(uint16(ref.index)).pgid
+		}
+		p, n := c.bucket.pageNode(pgid)
+		c.stack = append(c.stack, elemRef{page: p, node: n, index: 0})
+	}
+}
+
+// 沿着栈顶元素一直向下移动到最后一个叶子元素
+func (c *Cursor) last() {
+	for {
+		ref := &c.stack[len(c.stack)-1]
+		if ref.isLeaf() {
+			break
+		}
+
+		var pgid pgid
+		if ref.node != nil {
+			pgid = ref.node.inodes[ref.index].pgid
+		} else {
+			pgid = ref.page.branchPageElement(uint16(ref.index)).pgid
+		}
+		p, n := c.bucket.pageNode(pgid)
+
+		var nextRef = elemRef{page: p, node: n}
+		nextRef.index = nextRef.count() - 1
+		c.stack = append(c.stack, nextRef)
+	}
+}
+
+// 移动到下一个叶子元素, 到达末尾时游标停留在最后一个元素
+func (c *Cursor) next() (key []byte, value []byte, flags uint32) {
+	for {
+		// 逐层向上, 直到某一层还可以向后移动
+		var i int
+		for i = len(c.stack) - 1; i >= 0; i-- {
+			elem := &c.stack[i]
+			if elem.index < elem.count()-1 {
+				elem.index++
+				break
+			}
+		}
+
+		if i == -1 {
+			return nil, nil, 0
+		}
+
+		// 从移动的位置向下找到第一个叶子元素
+		c.stack = c.stack[:i+1]
+		c.first()
+
+		// 空页需要继续向后移动
+		if c.stack[len(c.stack)-1].count() == 0 {
+			continue
+		}
+
+		return c.keyValue()
+	}
+}
+
 // 递归搜索指定key
 func (c *Cursor) search(key []byte, pgid pgid) {
 	p, n := c.bucket.pageNode(pgid)
+	if p != nil && (p.flags&(branchPageFlag|leafPageFlag)) == 0 {
+		panic(fmt.Sprintf("invalid page type: %d: %x", p.id, p.flags))
+	}
 	e := elemRef{page: p, node: n}
 	c.stack = append(c.stack, e)
 
@@ -37,6 +293,50 @@ func (c *Cursor) search(key []byte, pgid pgid) {
 		c.nsearch(key)
 		return
 	}
+
+	if n != nil {
+		c.searchNode(key, n)
+		return
+	}
+	c.searchPage(key, p)
+}
+
+// 在分支node中搜索并进入对应的子节点
+func (c *Cursor) searchNode(key []byte, n *node) {
+	var exact bool
+	index := sort.Search(len(n.inodes), func(i int) bool {
+		ret := bytes.Compare(n.inodes[i].key, key)
+		if ret == 0 {
+			exact = true
+		}
+		return ret != -1
+	})
+	if !exact && index > 0 {
+		index--
+	}
+	c.stack[len(c.stack)-1].index = index
+
+	c.search(key, n.inodes[index].pgid)
+}
+
+// 在分支page中搜索并进入对应的子节点
+func (c *Cursor) searchPage(key []byte, p *page) {
+	inodes := p.branchPageElements()
+
+	var exact bool
+	index := sort.Search(int(p.count), func(i int) bool {
+		ret := bytes.Compare(inodes[i].key(), key)
+		if ret == 0 {
+			exact = true
+		}
+		return ret != -1
+	})
+	if !exact && index > 0 {
+		index--
+	}
+	c.stack[len(c.stack)-1].index = index
+
+	c.search(key, inodes[index].pgid)
 }
 
 // 搜索栈
@@ -87,14 +387,35 @@ func (c *Cursor) node() *node {
 		return ref.node
 	}
 
+	// 从根节点开始沿着栈向下找到叶子节点
 	n := c.stack[0].node
 	if n == nil {
 		n = c.bucket.node(c.stack[0].page.id, nil)
 	}
+	for _, ref := range c.stack[:len(c.stack)-1] {
+		n = n.childAt(ref.index)
+	}
 
 	return n
 }
 
+// 将游标处的k/v转换成返回给用户的k/v, 子bucket的value为nil, blob的value为空, 压缩的value需要解压
+func (c *Cursor) userKeyValue(k, v []byte, flags uint32) ([]byte, []byte) {
+	if (flags & bucketLeafFlag) != 0 {
+		return k, nil
+	} else if (flags & blobValueFlag) != 0 {
+		return k, []byte{}
+	}
+	v, err := decodeValue(v, flags)
+	if err != nil {
+		if c.err == nil {
+			c.err = fmt.Errorf("key %x: %w", k, err)
+		}
+		return k, nil
+	}
+	return k, v
+}
+
 type elemRef struct {
 	page  *page
 	node  *node
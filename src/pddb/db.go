@@ -1,8 +1,10 @@
 package pddb
 
 import (
+	"context"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"log"
 	"os"
 	"sync"
@@ -24,6 +26,10 @@ const magic uint32 = 0xEC0CDAED
 // 数据库文件格式版本
 const version = 2
 
+// meta的标志位, 表示checksum之后记录了加密的密钥id
+// 新增字段放在checksum之后, 未加密的文件与之前的格式完全相同
+const metaCipherFlag = 0x01
+
 // 数据库允许的最大大小
 const maxMapSize = 0x7FFFFFFF // 2GB
 
@@ -43,17 +49,18 @@ type DB struct {
 
 	// 数据库路径
 	path string
-	// 数据库文件指针
-	file *os.File
+	// 数据库文件指针, 内存数据库为memFile
+	file dbFile
+	// 是否为内存数据库
+	memory bool
 	// 数据库是否已打开
 	opened bool
 	// 页大小, 受操作系统控制
 	pageSize int
 	// 缓存申请但未使用的item用于之后的重用，以减轻GC的压力
 	pagePool sync.Pool
-	dataref  []byte
-	data     *[maxMapSize]byte
-	datasz   int
+	// 读取page的方式, 内存映射或者pread
+	source   pageSource
 	filesz   int
 	meta0    *meta
 	meta1    *meta
@@ -68,28 +75,115 @@ type DB struct {
 	metalock sync.Mutex
 	// 保护数据库状态
 	statlock sync.RWMutex
-	// 保护数据写过程
-	rwlock sync.Mutex
+	// 保护数据写过程, 等待时可以取消
+	rwlock ctxMutex
 
 	// 数据库只读选项
 	readOnly bool
+	// 副本模式, 只能通过Follow写入主库发送的数据
+	follower bool
+	// 每次提交时截断文件末尾的空闲page
+	autoShrink bool
+
+	// 页加密, 为nil时不加密
+	cipher Cipher
+	// 每个page末尾为加密保留的字节数
+	pageReserve int
+	// 解密后的page缓存
+	pageCache *pageCache
+
+	// bucket路径 -> 注册的索引
+	indexes   map[string][]*index
+	indexlock sync.RWMutex
+
+	// 后台清理过期key
+	sweepBatchSize int
+	sweepStop      chan struct{}
+	sweepDone      chan struct{}
+
+	// 预写日志, 为nil时提交直接写入数据库文件
+	wal *wal
+	// 页日志, 为nil时不记录提交写入的page
+	pagelog *pagelog
+	// 后台检查点
+	checkpointSize int
+	checkpointC    chan struct{}
+	checkpointStop chan struct{}
+	checkpointDone chan struct{}
+
+	// 接收提交数据的副本, 由rwlock保护
+	replicas            []*replica
+	replicaQueueSize    int
+	replicaWriteTimeout time.Duration
+
+	// 变更订阅, 由rwlock保护
+	subscriptions []*Subscription
+	subscribeStop chan struct{}
+	// 提交时将变更写入变更日志
+	changeLog          bool
+	changeLogRetention int
+	// 变更日志已经完整记录到的事务, 之后没有变更的事务不写入日志, 由rwlock保护
+	changeLogTxid txid
 }
 
 // 开启一个新事务
 // 只允许一个写事务
 func (db *DB) Begin(writeable bool) (*Tx, error) {
+	return db.BeginContext(context.Background(), writeable)
+}
+
+// 开启一个与ctx关联的事务, ctx取消时停止等待写锁并返回ctx.Err()
+// 事务中的写操作和提交在ctx取消后返回ctx.Err()
+func (db *DB) BeginContext(ctx context.Context, writeable bool) (*Tx, error) {
+	var tx *Tx
+	var err error
 	if writeable {
-		return db.beginRWTx()
+		tx, err = db.beginRWTx(ctx)
+	} else if err = ctx.Err(); err == nil {
+		tx, err = db.beginTx()
+	}
+	if err != nil {
+		return nil, err
 	}
-	return db.beginTx()
+	tx.ctx = ctx
+	return tx, nil
 }
 
 func (db *DB) Path() string {
 	return db.path
 }
 
+// 返回数据库的统计信息
+func (db *DB) Stats() Stats {
+	db.statlock.RLock()
+	defer db.statlock.RUnlock()
+	return db.stats
+}
+
 // 关闭数据库, 所有的资源引用必须释放
 func (db *DB) Close() error {
+	// 后台清理需要开启事务, 先等待其退出
+	db.stopSweeper()
+	db.stopCheckpointer()
+	db.closeSubscriptions()
+	db.closeReplicas()
+
+	// 记录最后几个没有写入变更日志的事务, 重新打开后变更日志仍然完整
+	if err := db.flushChangeLog(); err != nil && err != ErrDatabaseNotOpen {
+		return err
+	}
+
+	// 关闭前将预写日志写回数据库文件
+	if db.wal != nil && !db.readOnly {
+		if err := db.Checkpoint(); err != nil && err != ErrDatabaseNotOpen {
+			return err
+		}
+	}
+
+	// 等待副本正在应用的数据
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
 	db.mmaplock.RLock()
 	defer db.mmaplock.RUnlock()
 
@@ -98,7 +192,12 @@ func (db *DB) Close() error {
 
 // 读事务函数装饰器
 func (db *DB) View(fn func(*Tx) error) error {
-	tx, err := db.Begin(false)
+	return db.ViewContext(context.Background(), fn)
+}
+
+// 与ctx关联的读事务装饰器, 事务中的读取因为ctx取消而中断时返回ctx.Err()
+func (db *DB) ViewContext(ctx context.Context, fn func(*Tx) error) error {
+	tx, err := db.BeginContext(ctx, false)
 	if err != nil {
 		return err
 	}
@@ -121,17 +220,22 @@ func (db *DB) View(fn func(*Tx) error) error {
 		return err
 	}
 
-	err = tx.Rollback()
-	if err != nil {
+	// fn可能忽略了中断返回的错误, 此时读取的结果不完整
+	interrupted := tx.interrupted
+	if err := tx.Rollback(); err != nil {
 		return err
 	}
-
-	return nil
+	return interrupted
 }
 
 // 写事务装饰器
 func (db *DB) Update(fn func(*Tx) error) error {
-	tx, err := db.Begin(true)
+	return db.UpdateContext(context.Background(), fn)
+}
+
+// 与ctx关联的写事务装饰器, ctx取消后fn中的写操作返回ctx.Err(), 事务回滚
+func (db *DB) UpdateContext(ctx context.Context, fn func(*Tx) error) error {
+	tx, err := db.BeginContext(ctx, true)
 	if err != nil {
 		return err
 	}
@@ -189,12 +293,14 @@ func (db *DB) beginTx() (*Tx, error) {
 }
 
 // 开始一个读写事务
-func (db *DB) beginRWTx() (*Tx, error) {
-	if db.readOnly {
+func (db *DB) beginRWTx(ctx context.Context) (*Tx, error) {
+	if db.readOnly || db.follower {
 		return nil, ErrDatabaseReadOnly
 	}
 
-	db.rwlock.Lock()
+	if err := db.rwlock.LockContext(ctx); err != nil {
+		return nil, err
+	}
 	db.metalock.Lock()
 	defer db.metalock.Unlock()
 
@@ -208,7 +314,16 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	t.init(db)
 	db.rwtx = t
 
-	// TODO: 释放Freelist
+	// 释放已经没有只读事务引用的page
+	var minid txid = 0xFFFFFFFFFFFFFFFF
+	for _, t := range db.txs {
+		if t.meta.txid < minid {
+			minid = t.meta.txid
+		}
+	}
+	if minid > 0 {
+		db.freelist.release(minid - 1)
+	}
 
 	return t, nil
 }
@@ -219,12 +334,28 @@ func (db *DB) close() error {
 	}
 	db.opened = false
 	db.freelist = nil
-	if err := db.munmap(); err != nil {
-		return err
+	if db.source != nil {
+		if err := db.source.close(); err != nil {
+			return err
+		}
+	}
+	// 关闭页日志
+	if db.pagelog != nil {
+		if err := db.pagelog.close(); err != nil {
+			return fmt.Errorf("pagelog file close error: %s", err)
+		}
+		db.pagelog = nil
+	}
+	// 关闭预写日志
+	if db.wal != nil {
+		if err := db.wal.file.Close(); err != nil {
+			return fmt.Errorf("wal file close error: %s", err)
+		}
+		db.wal = nil
 	}
 	// 释放文件引用
 	if db.file != nil {
-		if !db.readOnly {
+		if !db.readOnly && !db.memory {
 			err := funlock(db)
 			if err != nil {
 				log.Printf("Database close; funlock error %s", err)
@@ -261,6 +392,9 @@ func (db *DB) init() error {
 		m.root = bucket{root: 3}
 		m.pgid = 4
 		m.txid = txid(i)
+		if db.cipher != nil {
+			m.setCipher(db.cipher.ID())
+		}
 		m.checksum = m.sum64()
 	}
 
@@ -276,6 +410,13 @@ func (db *DB) init() error {
 	p.flags = leafPageFlag
 	p.count = 0
 
+	// 加密非meta page
+	if db.cipher != nil {
+		for id := pgid(2); id < 4; id++ {
+			copy(buf[int(id)*db.pageSize:], encryptPage(db.cipher, db.pageInBuffer(buf, id), db.pageSize))
+		}
+	}
+
 	// 数据写入文件
 	if _, err := db.file.WriteAt(buf, 0); err != nil {
 		return err
@@ -297,7 +438,11 @@ func (db *DB) pageInBuffer(b []byte, id pgid) *page {
 func (db *DB) mmap(minsz int) error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
+	return db.remap(minsz)
+}
 
+// 重新映射数据库文件并读取元数据, 调用者需要持有mmaplock
+func (db *DB) remap(minsz int) error {
 	info, err := db.file.Stat()
 	if err != nil {
 		return fmt.Errorf("mmap stat error: %s", err)
@@ -310,25 +455,29 @@ func (db *DB) mmap(minsz int) error {
 	if size < minsz {
 		size = minsz
 	}
-	size, err = db.mmapSize(size)
-	if err != nil {
-		return err
-	}
 
+	// 重新映射后之前的page失效, node需要先复制引用的数据
 	if db.rwtx != nil {
 		db.rwtx.root.dereference()
+		for _, sp := range db.rwtx.savepoints {
+			sp.dereference()
+		}
 	}
 
-	// 取消映射
-	if err := db.munmap(); err != nil {
+	if err := db.source.remap(size); err != nil {
 		return err
 	}
+	return db.loadMeta()
+}
 
-	// 将文件映射到内存
-	if err := mmap(db, size); err != nil {
-		return err
-	}
+// 元数据写入文件后丢弃缓存并重新读取, 调用者需要持有metalock
+func (db *DB) reloadMeta() error {
+	db.source.invalidate(pages{&page{id: 0}, &page{id: 1}})
+	return db.loadMeta()
+}
 
+// 读取两份元数据
+func (db *DB) loadMeta() error {
 	// 数据库元数据的引用
 	db.meta0 = db.page(0).meta()
 	db.meta1 = db.page(1).meta()
@@ -343,10 +492,13 @@ func (db *DB) mmap(minsz int) error {
 	return nil
 }
 
-// 取消数据库文件的内存映射
-func (db *DB) munmap() error {
-	if err := munmap(db); err != nil {
-		return fmt.Errorf("munmap error: %s", err)
+// 校验打开数据库使用的密钥与文件记录的密钥一致
+func (db *DB) checkCipher() error {
+	id := db.meta().cipherID()
+	if id != 0 && db.cipher == nil {
+		return ErrCipherRequired
+	} else if db.cipher != nil && db.cipher.ID() != id {
+		return ErrCipherMismatch
 	}
 	return nil
 }
@@ -376,14 +528,86 @@ func (db *DB) mmapSize(size int) (int, error) {
 	return int(sz), nil
 }
 
-// 获取数据库的任意页
+// 获取数据库的任意页, 开启加密时返回解密后的page
 func (db *DB) page(id pgid) *page {
-	pos := id * pgid(db.pageSize)
-	return (*page)(unsafe.Pointer(&db.data[pos]))
+	// 预写日志中的page比数据库文件中的新
+	if db.wal != nil {
+		if p := db.walPage(id); p != nil {
+			return p
+		}
+	}
+
+	// 写事务中直接写入文件的blob page可能超出映射范围, 提交时才重新映射, 之前从文件读取
+	if int(id+1)*db.pageSize > db.source.size() {
+		return db.readPageAt(db.file, id, int64(id)*int64(db.pageSize))
+	}
+	return db.source.page(id)
+}
+
+// 从r的off处读取一个page, 开启加密时解密, 读取失败时panic
+func (db *DB) readPageAt(r io.ReaderAt, id pgid, off int64) *page {
+	buf := make([]byte, db.pageSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		panic(fmt.Sprintf("page %d: %s", id, err))
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if db.cipher != nil {
+		var err error
+		if p, err = decryptPage(db.cipher, p, db.pageSize); err != nil {
+			panic(fmt.Sprintf("page %d: %s", id, err))
+		}
+	}
+	return p
+}
+
+// 将page按序写入数据库文件, 开启加密时写入加密后的数据
+func (db *DB) writePages(pages pages) error {
+	for _, p := range pages {
+		size := (int(p.overflow) + 1) * db.pageSize
+		offset := int64(p.id) * int64(db.pageSize)
+
+		// 将page按照chunk大小写
+		ptr := (*[maxAllocSize]byte)(unsafe.Pointer(p))
+		if db.cipher != nil {
+			buf := encryptPage(db.cipher, p, db.pageSize)
+			ptr = (*[maxAllocSize]byte)(unsafe.Pointer(&buf[0]))
+		}
+		for {
+			sz := size
+			if sz > maxAllocSize-1 {
+				sz = maxAllocSize - 1
+			}
+
+			// 写入磁盘
+			buf := ptr[:sz]
+			if _, err := db.file.WriteAt(buf, offset); err != nil {
+				return err
+			}
+			size -= sz
+			if size == 0 {
+				break
+			}
+			offset += int64(sz)
+			ptr = (*[maxAllocSize]byte)(unsafe.Pointer(&ptr[sz]))
+		}
+	}
+	return nil
+}
+
+// 保存size字节的数据需要的page数量
+func (db *DB) pageCount(size int) int {
+	return ((size + db.pageReserve) / db.pageSize) + 1
 }
 
 // 数据库的元数据页, 返回事务id较大且通过验证的元数据
 func (db *DB) meta() *meta {
+	// 预写日志中的元数据总是最新的
+	if db.wal != nil {
+		if m := db.wal.latest(); m != nil {
+			return m
+		}
+	}
+
 	metaA := db.meta0
 	metaB := db.meta1
 	if db.meta1.txid > db.meta0.txid {
@@ -401,6 +625,20 @@ func (db *DB) meta() *meta {
 }
 
 func (db *DB) allocate(count int) (*page, error) {
+	p := db.allocatePage(count)
+
+	// 如果内存不够, 重新申请内存
+	var minsz = int(p.id+pgid(count)+1) * db.pageSize
+	if minsz >= db.source.size() {
+		if err := db.mmap(minsz); err != nil {
+			return nil, fmt.Errorf("mmap allocate error: %s", err)
+		}
+	}
+	return p, nil
+}
+
+// 分配count个连续的page, 超出映射范围时只提高高水位, 不重新映射
+func (db *DB) allocatePage(count int) *page {
 	// 分配临时buffer
 	var buf []byte
 	if count == 1 {
@@ -413,21 +651,13 @@ func (db *DB) allocate(count int) (*page, error) {
 
 	// 如果freelist中有可用空间, 直接从freelist中取
 	if p.id = db.freelist.allocate(count); p.id != 0 {
-		return p, nil
+		return p
 	}
 
-	// 如果内存不够, 重新申请内存
-	p.id = db.rwtx.meta.pgid
-	var minsz = int((p.id+pgid(count))+1) * db.pageSize
-	if minsz >= db.datasz {
-		if err := db.mmap(minsz); err != nil {
-			return nil, fmt.Errorf("mmap allocate error: %s", err)
-		}
-	}
 	// pgid移动到高水位
+	p.id = db.rwtx.meta.pgid
 	db.rwtx.meta.pgid += pgid(count)
-
-	return p, nil
+	return p
 }
 
 // 将数据库大小增长到指定大小
@@ -435,8 +665,8 @@ func (db *DB) grow(sz int) error {
 	if sz <= db.filesz {
 		return nil
 	}
-	if db.datasz < db.AllocSize {
-		sz = db.datasz
+	if db.source.size() < db.AllocSize {
+		sz = db.source.size()
 	} else {
 		sz += db.AllocSize
 	}
@@ -444,9 +674,83 @@ func (db *DB) grow(sz int) error {
 	return nil
 }
 
-// TODO
+// 截断文件末尾的空闲page, 将空间归还给操作系统
+// 只有紧邻文件末尾且没有被任何读事务引用的空闲page会被截断, 开启预写日志时在检查点之后截断
+// 仍被读事务引用的page会在读事务结束后的下一次Shrink或者自动截断时释放
+func (db *DB) Shrink() error {
+	for i := 0; i < 2; i++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			return err
+		}
+		// 文件末尾为当前的freelist page时也需要提交一次, 提交后freelist page被移到其他位置
+		// 旧的freelist page在第二次提交时已经释放, 可以和之前的空闲page一起截断
+		last := tx.meta.pgid - 1
+		ids, fp := db.freelist.ids, tx.page(tx.meta.freelist)
+		free := len(ids) > 0 && ids[len(ids)-1] == last
+		blocked := i == 0 && fp.id+pgid(fp.overflow) == last
+		if !free && !blocked {
+			_ = tx.Rollback()
+			break
+		}
+		tx.shrink = true
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if db.wal != nil {
+		return db.Checkpoint()
+	}
+	return nil
+}
+
+// 将数据库文件截断到sz字节, 调用者需要持有写锁
+// 映射中超出文件末尾的部分不会再被访问, 没有读事务持有映射时才缩小映射
+func (db *DB) truncate(sz int) error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	} else if info.Size() <= int64(sz) {
+		return nil
+	}
+	if err := db.file.Truncate(int64(sz)); err != nil {
+		return err
+	}
+	if err := fdatasync(db); err != nil {
+		return err
+	}
+	db.filesz = sz
+
+	if !db.mmaplock.TryLock() {
+		return nil
+	}
+	defer db.mmaplock.Unlock()
+	if size, err := db.mmapSize(sz); err != nil || size >= db.source.size() {
+		return nil
+	}
+	return db.remap(sz)
+}
+
+// 移除只读事务, 并释放事务持有的mmap读锁
 func (db *DB) removeTx(tx *Tx) {
-	return
+	db.mmaplock.RUnlock()
+
+	db.metalock.Lock()
+	for i, t := range db.txs {
+		if t == tx {
+			last := len(db.txs) - 1
+			db.txs[i] = db.txs[last]
+			db.txs[last] = nil
+			db.txs = db.txs[:last]
+			break
+		}
+	}
+	n := len(db.txs)
+	db.metalock.Unlock()
+
+	db.statlock.Lock()
+	db.stats.OpenTxN = n
+	db.statlock.Unlock()
 }
 
 type meta struct {
@@ -459,15 +763,38 @@ type meta struct {
 	pgid     pgid
 	txid     txid
 	checksum uint64
+	// 以下字段由flags中的标志位表示是否有效
+	cipher uint64
 }
 
-// 生成meta数据的校验和
+// 生成meta数据的校验和, 包括标志位表示有效的字段
 func (m *meta) sum64() uint64 {
 	h := fnv.New64()
 	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	if (m.flags & metaCipherFlag) != 0 {
+		_, _ = h.Write((*[8]byte)(unsafe.Pointer(&m.cipher))[:])
+	}
 	return h.Sum64()
 }
 
+// 返回加密的密钥id, 没有加密时返回0
+func (m *meta) cipherID() uint64 {
+	if (m.flags & metaCipherFlag) == 0 {
+		return 0
+	}
+	return m.cipher
+}
+
+// 记录加密的密钥id, id为0表示不加密
+func (m *meta) setCipher(id uint64) {
+	m.cipher = id
+	if id == 0 {
+		m.flags &^= metaCipherFlag
+	} else {
+		m.flags |= metaCipherFlag
+	}
+}
+
 // validate校验标志位确保文件格式匹配数据库要求的文件格式
 func (m *meta) validate() error {
 	if m.magic != magic {
@@ -510,6 +837,36 @@ type Options struct {
 	ReadOnly bool
 	// 数据库内存映射的初始大小, <=0时无效
 	InitialMmapSize int
+	// 读取page的方式, 默认将整个文件映射到内存
+	Backend Backend
+	// 使用pread读取或者加密时缓存的page数量, <=0时使用DefaultPageCacheSize
+	PageCacheSize int
+	// 后台清理过期key的时间间隔, <=0时不启动后台清理
+	SweepInterval time.Duration
+	// 单个清理事务最多删除的key数量, <=0时使用DefaultSweepBatchSize
+	SweepBatchSize int
+	// 页加密, 加密的数据库必须使用相同的密钥打开
+	Cipher Cipher
+	// 提交时写入预写日志, 由检查点写回数据库文件
+	WAL bool
+	// 预写日志超过该大小时执行检查点, <=0时使用DefaultCheckpointSize
+	CheckpointSize int
+	// 定期执行检查点的时间间隔, <=0时只按照日志大小执行
+	CheckpointInterval time.Duration
+	// 记录每次提交写入的page, 用于增量备份, 每次提交会增加一次fsync
+	TrackPages bool
+	// 以副本模式打开, 不能开启写事务, 通过Follow应用主库发送的数据
+	Follower bool
+	// 每个副本最多缓冲的提交数量, 超过时断开副本, <=0时使用DefaultReplicaQueueSize
+	ReplicaQueueSize int
+	// 向副本写入一次提交的超时时间, 超时后断开副本, <=0时使用DefaultReplicaWriteTimeout
+	ReplicaWriteTimeout time.Duration
+	// 提交时将变更写入变更日志, 订阅时可以从日志中的事务继续
+	ChangeLog bool
+	// 变更日志保留的事务数量, <=0时使用DefaultChangeLogRetention
+	ChangeLogRetention int
+	// 每次提交时截断文件末尾的空闲page, 开启预写日志时在检查点之后截断
+	AutoShrink bool
 }
 
 var DefaultOptions = &Options{
@@ -528,8 +885,8 @@ type Stats struct {
 	OpenTxN int
 }
 
-// flock获取文件描述符的锁
-func flock(db *DB, mode os.FileMode, exclusive bool, timeout time.Duration) error {
+// flock获取文件描述符的锁, 超时返回ErrTimeOut, ctx取消时返回ctx.Err()
+func flock(ctx context.Context, db *DB, exclusive bool, timeout time.Duration) error {
 	var t time.Time
 	for {
 		// 超时
@@ -544,7 +901,7 @@ func flock(db *DB, mode os.FileMode, exclusive bool, timeout time.Duration) erro
 		if exclusive {
 			flag = syscall.LOCK_EX
 		}
-		err := syscall.Flock(int(db.file.Fd()), flag|syscall.LOCK_NB)
+		err := syscall.Flock(int(db.file.(*os.File).Fd()), flag|syscall.LOCK_NB)
 		if err == nil {
 			return nil
 		} else if err != syscall.EWOULDBLOCK {
@@ -552,13 +909,17 @@ func flock(db *DB, mode os.FileMode, exclusive bool, timeout time.Duration) erro
 		}
 
 		// 等待锁释放
-		time.Sleep(50 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
 	}
 }
 
 // funlock释放文件描述符的锁
 func funlock(db *DB) error {
-	return syscall.Flock(int(db.file.Fd()), syscall.LOCK_UN)
+	return syscall.Flock(int(db.file.(*os.File).Fd()), syscall.LOCK_UN)
 }
 
 // fdatasync将数据写入文件描述符
@@ -566,37 +927,18 @@ func fdatasync(db *DB) error {
 	return db.file.Sync()
 }
 
-// mmap将数据库文件映射到内存
-func mmap(db *DB, sz int) error {
-	b, err := syscall.Mmap(int(db.file.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED)
-	if err != nil {
-		return err
-	}
-	// 与内核交互, 采用随机访问模式
-	// if err := syscall.Madvise(b, syscall.MADV_RANDOM); err != nil {
-	// 	return fmt.Errorf("madvise error: %s", err)
-	// }
-	// 数据库对于内存的引用
-	db.dataref = b
-	db.data = (*[maxMapSize]byte)(unsafe.Pointer(&b[0]))
-	db.datasz = sz
-	return nil
+func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
+	return OpenContext(context.Background(), path, mode, options)
 }
 
-// munmap取消数据库文件的内存映射
-func munmap(db *DB) error {
-	if db.dataref == nil {
-		return nil
-	}
-	err := syscall.Munmap(db.dataref)
-	db.dataref = nil
-	db.data = nil
-	db.datasz = 0
-	return err
+// 打开数据库, ctx取消时停止等待文件锁并返回ctx.Err()
+func OpenContext(ctx context.Context, path string, mode os.FileMode, options *Options) (*DB, error) {
+	return open(ctx, path, mode, options, false)
 }
 
-func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
-	var db = &DB{opened: true}
+// 打开数据库文件, memory为true时打开内存数据库
+func open(ctx context.Context, path string, mode os.FileMode, options *Options, memory bool) (*DB, error) {
+	var db = &DB{opened: true, memory: memory}
 
 	// 用户没有指定选项使用默认用户选项
 	if options == nil {
@@ -607,25 +949,60 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	db.MaxBatchSize = DefaultMaxBatchSize
 	db.MaxBatchDelay = DefaultMaxBatchDelay
 	db.AllocSize = DefaultAllocSize
+	db.sweepBatchSize = DefaultSweepBatchSize
+	if options.SweepBatchSize > 0 {
+		db.sweepBatchSize = options.SweepBatchSize
+	}
+	db.checkpointSize = DefaultCheckpointSize
+	if options.CheckpointSize > 0 {
+		db.checkpointSize = options.CheckpointSize
+	}
+
+	db.changeLog = options.ChangeLog
+	db.changeLogRetention = DefaultChangeLogRetention
+	if options.ChangeLogRetention > 0 {
+		db.changeLogRetention = options.ChangeLogRetention
+	}
+	db.subscribeStop = make(chan struct{})
+
+	if options.Cipher != nil {
+		db.cipher = options.Cipher
+		db.pageReserve = options.Cipher.Overhead()
+		db.pageCache = newPageCache(options.PageCacheSize)
+	}
 
 	flag := os.O_RDWR
 	if options.ReadOnly {
 		flag = os.O_RDONLY
 		db.readOnly = true
 	}
+	db.follower = options.Follower
+	db.replicaQueueSize = DefaultReplicaQueueSize
+	if options.ReplicaQueueSize > 0 {
+		db.replicaQueueSize = options.ReplicaQueueSize
+	}
+	db.replicaWriteTimeout = DefaultReplicaWriteTimeout
+	if options.ReplicaWriteTimeout > 0 {
+		db.replicaWriteTimeout = options.ReplicaWriteTimeout
+	}
+	db.autoShrink = options.AutoShrink
 
 	// 创建数据库文件
 	db.path = path
 	var err error
-	if db.file, err = os.OpenFile(path, flag|os.O_CREATE, mode); err != nil {
+	if db.memory {
+		db.file = &memFile{}
+	} else if db.file, err = os.OpenFile(path, flag|os.O_CREATE, mode); err != nil {
 		_ = db.close()
 		return nil, err
 	}
 
 	// 给数据库加锁避免写冲突
-	if err := flock(db, mode, !db.readOnly, options.Timeout); err != nil {
-		_ = db.close()
-		return nil, err
+	if !db.memory {
+		if err := flock(ctx, db, !db.readOnly, options.Timeout); err != nil {
+			_ = db.close()
+			return nil, err
+		}
 	}
 
 	// 数据库不存在则进行初始化
@@ -655,15 +1032,104 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		},
 	}
 
+	// 读取page的方式
+	switch options.Backend {
+	case BackendMmap:
+		if db.memory {
+			db.source = &memSource{db: db, file: db.file.(*memFile)}
+		} else {
+			db.source = &mmapSource{db: db}
+		}
+	case BackendPread:
+		db.source = newPreadSource(db.file, db.pageSize, db.cipher, options.PageCacheSize)
+	default:
+		_ = db.close()
+		return nil, ErrUnknownBackend
+	}
+
 	// 数据库文件映射到内存
 	if err := db.mmap(options.InitialMmapSize); err != nil {
 		_ = db.close()
 		return nil, err
 	}
 
+	// 校验加密密钥
+	if err := db.checkCipher(); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	// 恢复预写日志中的事务
+	if err := db.openWAL(options.WAL && !db.follower, mode); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	// 打开页日志
+	if options.TrackPages && db.memory {
+		if db.pagelog, err = newPagelog(&memFile{}, db.meta().txid); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	} else if options.TrackPages {
+		if db.pagelog, err = openPagelog(db.path+pagelogSuffix, mode, db.meta().txid, db.readOnly); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
 	// 读取freelist
 	db.freelist = newFreelist()
 	db.freelist.read(db.page(db.meta().freelist))
 
+	if err := db.loadChangeLog(); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	// 启动后台清理
+	if !db.readOnly && !db.follower && options.SweepInterval > 0 {
+		db.startSweeper(options.SweepInterval)
+	}
+
+	// 启动后台检查点
+	if db.wal != nil && !db.readOnly {
+		db.startCheckpointer(options.CheckpointInterval)
+	}
+
 	return db, nil
 }
+
+// 等待时可以通过context取消的互斥锁, 零值可以直接使用
+type ctxMutex struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (m *ctxMutex) init() {
+	m.once.Do(func() { m.ch = make(chan struct{}, 1) })
+}
+
+func (m *ctxMutex) Lock() {
+	m.init()
+	m.ch <- struct{}{}
+}
+
+// 获取锁, ctx取消时放弃等待并返回ctx.Err()
+func (m *ctxMutex) LockContext(ctx context.Context) error {
+	m.init()
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *ctxMutex) Unlock() {
+	select {
+	case <-m.ch:
+	default:
+		panic("pddb: unlock of unlocked mutex")
+	}
+}
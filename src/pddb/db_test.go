@@ -1,12 +1,14 @@
 package pddb_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"pddb"
 	"testing"
+	"time"
 )
 
 // 测试正常打开数据库
@@ -65,6 +67,45 @@ func TestOpen_ErrInvalid(t *testing.T) {
 	}
 }
 
+// 可以打开之前版本写入的数据库文件, 并继续读写
+func TestOpen_Version2(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	copyFile(t, filepath.Join("testdata", "v2.db"), path)
+
+	for i := 0; i < 2; i++ {
+		db, err := pddb.Open(path, 0666, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *pddb.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			if b == nil {
+				t.Fatal("expected bucket")
+			}
+			if v := b.Get([]byte("key042")); string(v) != "value042" {
+				t.Fatalf("unexpected value: %q", v)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		checkDB(t, db)
+		if err := db.Update(func(tx *pddb.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte(fmt.Sprintf("new%d", i)), []byte("value"))
+		}); err != nil {
+			t.Fatal(err)
+		} else if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 未加密的文件不能使用密钥打开
+	if _, err := pddb.Open(path, 0666, &pddb.Options{Cipher: MustCipher(1)}); err != pddb.ErrCipherMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 // Ensure that a database cannot open a transaction when it's not open.
 func TestDB_Begin_ErrDatabaseNotOpen(t *testing.T) {
 	var db pddb.DB
@@ -104,6 +145,257 @@ func TestDB_BeginRW_Closed(t *testing.T) {
 	}
 }
 
+// 等待文件锁时ctx超时
+func TestOpenContext_DeadlineExceeded(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := pddb.OpenContext(ctx, db.Path(), 0666, nil); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 等待写锁时ctx取消
+func TestDB_BeginContext(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.BeginContext(ctx, true); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tx, err = db.BeginContext(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ctx取消后事务中的操作返回错误, 事务回滚
+func TestDB_UpdateContext(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := db.UpdateContext(ctx, func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		cancel()
+		if err := b.Put([]byte("baz"), []byte("bat")); err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// 忽略错误仍然不会提交
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.ViewContext(ctx, func(tx *pddb.Tx) error {
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("unexpected bucket")
+		}
+		return tx.ForEach(func(name []byte, b *pddb.Bucket) error { return nil })
+	}); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 读取完成后ctx取消不影响结果, 读取被中断时即使fn忽略错误也返回ctx.Err()
+func TestDB_ViewContext(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+	putKeys(t, db, 0, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := db.ViewContext(ctx, func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("0001")); string(v) != "value-1" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		cancel()
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	n := 0
+	if err := db.ViewContext(ctx, func(tx *pddb.Tx) error {
+		_ = tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			if n++; n == 5 {
+				cancel()
+			}
+			return nil
+		})
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 5 {
+		t.Fatalf("unexpected count: %d", n)
+	}
+}
+
+// 删除大量数据后截断文件末尾的空闲page
+func TestDB_Shrink(t *testing.T) {
+	for _, options := range []*pddb.Options{nil, {WAL: true}} {
+		path := tempfile()
+		db, err := pddb.Open(path, 0666, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill := func(name string) {
+			if err := db.Update(func(tx *pddb.Tx) error {
+				b, err := tx.CreateBucket([]byte(name))
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 10000; i++ {
+					if err := b.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fill("keep")
+		fill("drop")
+		if options != nil {
+			if err := db.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		full := fileSize(t, path)
+
+		if err := db.Update(func(tx *pddb.Tx) error {
+			return tx.DeleteBucket([]byte("drop"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// 读事务仍在使用被删除的page, 不能截断
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Shrink(); err != nil {
+			t.Fatal(err)
+		} else if size := fileSize(t, path); size < full {
+			t.Fatalf("unexpected size with open reader: %d != %d", size, full)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Shrink(); err != nil {
+			t.Fatal(err)
+		}
+		size := fileSize(t, path)
+		if size > full*2/3 {
+			t.Fatalf("file not shrunk: %d of %d", size, full)
+		}
+		if err := db.View(func(tx *pddb.Tx) error {
+			if tx.Size() != size {
+				t.Fatalf("size mismatch: %d != %d", tx.Size(), size)
+			} else if tx.Bucket([]byte("drop")) != nil || tx.Bucket([]byte("keep")).Get([]byte("00009999")) == nil {
+				t.Fatal("unexpected buckets")
+			}
+			return tx.Check()
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// 截断后可以继续写入, 重新打开后数据不变
+		fill("again")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = pddb.Open(path, 0666, options); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *pddb.Tx) error {
+			if tx.Bucket([]byte("again")).Get([]byte("00009999")) == nil {
+				t.Fatal("unexpected buckets")
+			}
+			return tx.Check()
+		}); err != nil {
+			t.Fatal(err)
+		}
+		MustClose(db)
+	}
+}
+
+// 开启自动截断时每次提交后文件大小与高水位一致
+func TestDB_AutoShrink(t *testing.T) {
+	path := tempfile()
+	db, err := pddb.Open(path, 0666, &pddb.Options{AutoShrink: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	var full int64
+	for i := 0; i < 5; i++ {
+		name := []byte(fmt.Sprintf("bucket%d", i))
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 5000; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%08d", j)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if size := fileSize(t, path); size > full {
+			full = size
+		}
+
+		// 删除最后写入的bucket, 之后的提交释放其page
+		if err := db.Update(func(tx *pddb.Tx) error {
+			return tx.DeleteBucket(name)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *pddb.Tx) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		if size := fileSize(t, path); size != tx.Size() {
+			t.Fatalf("size mismatch: %d != %d", size, tx.Size())
+		} else if size > full/2 {
+			t.Fatalf("file not shrunk: %d of %d", size, full)
+		}
+		return tx.Check()
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // MustOpenDB returns a new, open DB at a temporary location.
 func MustOpenDB() *pddb.DB {
 	db, err := pddb.Open(tempfile(), 0666, nil)
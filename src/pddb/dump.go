@@ -0,0 +1,167 @@
+package pddb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// 导出格式版本, 格式不兼容时递增
+const dumpVersion = 1
+
+// 默认每个导入事务写入的记录数量
+const DefaultLoadBatchSize = 1000
+
+// 导出记录的类型
+const (
+	dumpTypeHeader = "header"
+	dumpTypeBucket = "bucket"
+	dumpTypeKV     = "kv"
+)
+
+// 导出文件中的一行, []byte字段按照base64编码
+// 第一行是header, 之后每个bucket先输出bucket记录, 再按顺序输出其中的k/v和子bucket
+type dumpRecord struct {
+	Type     string   `json:"type"`
+	Version  int      `json:"version,omitempty"`
+	Path     [][]byte `json:"path,omitempty"`
+	Sequence uint64   `json:"sequence,omitempty"`
+	Key      []byte   `json:"key,omitempty"`
+	Value    []byte   `json:"value,omitempty"`
+}
+
+// 将事务可见的所有数据按照NDJSON格式导出
+// 系统bucket最先导出, 保证导入时压缩等配置先于数据生效
+// value是解压后的原始数据, blob导出完整的数据, 导入后成为普通value, 过期时间和索引随系统bucket原样导出
+func (tx *Tx) Dump(w io.Writer) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(&dumpRecord{Type: dumpTypeHeader, Version: dumpVersion}); err != nil {
+		return err
+	}
+
+	for _, system := range []bool{true, false} {
+		if err := tx.ForEach(func(name []byte, b *Bucket) error {
+			if isSystemBucket(name) != system {
+				return nil
+			}
+			return dumpBucket(enc, b)
+		}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// 导出bucket及其子bucket
+func dumpBucket(enc *json.Encoder, b *Bucket) error {
+	if err := enc.Encode(&dumpRecord{Type: dumpTypeBucket, Path: b.path, Sequence: b.Sequence()}); err != nil {
+		return err
+	}
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := c.Err(); err != nil {
+			return err
+		}
+		if v == nil {
+			if err := dumpBucket(enc, b.Bucket(k)); err != nil {
+				return err
+			}
+			continue
+		}
+		// 游标不读取blob的数据, 导出完整的value
+		if _, raw, flags := c.keyValue(); (flags & blobValueFlag) != 0 {
+			v = b.tx.readBlob(raw)
+		}
+		if err := enc.Encode(&dumpRecord{Type: dumpTypeKV, Path: b.path, Key: k, Value: v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 导入Dump导出的数据, 每个写事务最多写入batchSize条记录
+// 已经存在的bucket和key会被覆盖, 导入的数据不会触发过期清理和索引维护
+// 导入出错时已经提交的批次不会回滚
+func (db *DB) Load(r io.Reader, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = DefaultLoadBatchSize
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var line int
+	next := func() (*dumpRecord, error) {
+		rec := &dumpRecord{}
+		if err := dec.Decode(rec); err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line+1, err)
+		}
+		line++
+		return rec, nil
+	}
+
+	// 校验文件头
+	if rec, err := next(); err != nil {
+		return err
+	} else if rec == nil || rec.Type != dumpTypeHeader {
+		return fmt.Errorf("line 1: %s", ErrInvalidDump)
+	} else if rec.Version != dumpVersion {
+		return fmt.Errorf("dump version %d: %s", rec.Version, ErrInvalidDump)
+	}
+
+	for done := false; !done; {
+		if err := db.Update(func(tx *Tx) error {
+			for i := 0; i < batchSize; i++ {
+				rec, err := next()
+				if err != nil {
+					return err
+				} else if rec == nil {
+					done = true
+					return nil
+				}
+				if err := tx.load(rec); err != nil {
+					return fmt.Errorf("line %d: %s", line, err)
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 导入一条记录
+func (tx *Tx) load(rec *dumpRecord) error {
+	switch rec.Type {
+	case dumpTypeBucket:
+		if len(rec.Path) == 0 {
+			return ErrInvalidDump
+		}
+		b := &tx.root
+		for _, name := range rec.Path {
+			var err error
+			if b, err = b.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return b.SetSequence(rec.Sequence)
+
+	case dumpTypeKV:
+		b := tx.bucketAt(rec.Path)
+		if len(rec.Path) == 0 || b == nil {
+			return ErrInvalidDump
+		}
+		return b.put(rec.Key, rec.Value, false)
+
+	default:
+		return ErrInvalidDump
+	}
+}
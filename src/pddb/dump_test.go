@@ -0,0 +1,108 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"pddb"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 导出后导入到新的数据库, 再次导出的内容完全相同
+func TestTx_Dump(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetCompression(pddb.GzipCodec, 0); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), jsonValue(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Put([]byte("empty"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("session"), []byte("abc"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := child.NextSequence(); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.SetSequence(42); err != nil {
+			t.Fatal(err)
+		}
+		return child.Put([]byte("foo"), []byte{0, 1, 2})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	if err := db.View(func(tx *pddb.Tx) error {
+		return tx.Dump(&dump)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if line := strings.SplitN(dump.String(), "\n", 2)[0]; line != `{"type":"header","version":1}` {
+		t.Fatalf("unexpected header: %s", line)
+	}
+
+	other := MustOpenDB()
+	defer MustClose(other)
+	if err := other.Load(bytes.NewReader(dump.Bytes()), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	var again bytes.Buffer
+	if err := other.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("0199")); !bytes.Equal(v, jsonValue(199)) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("empty")); v == nil || len(v) != 0 {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		if s := b.Bucket([]byte("child")).Sequence(); s != 42 {
+			t.Fatalf("unexpected sequence: %d", s)
+		}
+		return tx.Dump(&again)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if dump.String() != again.String() {
+		t.Fatalf("dump mismatch:\n%s\n%s", dump.String(), again.String())
+	}
+
+}
+
+// 导入格式错误的数据
+func TestDB_Load_ErrInvalidDump(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	for _, s := range []string{
+		``,
+		`{"type":"kv"}`,
+		`{"type":"header","version":99}`,
+		"{\"type\":\"header\",\"version\":1}\n{\"type\":\"kv\",\"path\":[\"bWlzc2luZw==\"],\"key\":\"Zm9v\"}",
+		"{\"type\":\"header\",\"version\":1}\n{\"type\":\"other\"}",
+	} {
+		if err := db.Load(strings.NewReader(s), 0); err == nil || !strings.Contains(err.Error(), pddb.ErrInvalidDump.Error()) {
+			t.Fatalf("unexpected error for %q: %v", s, err)
+		}
+	}
+	if err := db.Load(strings.NewReader("{\"type\":\"header\",\"version\":1}\n{bad"), 0); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -16,6 +16,14 @@ var (
 	ErrDatabaseNotOpen = errors.New("database not open")
 	// 数据库只读错误
 	ErrDatabaseReadOnly = errors.New("database read only")
+	// 数据库已加密, 打开时需要提供密钥
+	ErrCipherRequired = errors.New("database is encrypted")
+	// 密钥与数据库记录的密钥不一致
+	ErrCipherMismatch = errors.New("cipher mismatch")
+	// page解密失败
+	ErrDecrypt = errors.New("decrypt error")
+	// 未知的page读取方式
+	ErrUnknownBackend = errors.New("unknown backend")
 )
 
 // 事务错误
@@ -24,6 +32,8 @@ var (
 	ErrTxClosed = errors.New("transaction closed")
 	// 事务不可写
 	ErrTxNotWriteable = errors.New("transaction not writeable")
+	// 保存点不属于当前事务, 或者已经因为回滚到更早的保存点而失效
+	ErrInvalidSavepoint = errors.New("invalid savepoint")
 )
 
 // 数据错误
@@ -38,8 +48,86 @@ var (
 	ErrValueTooLarge = errors.New("error value too large")
 	// 创建bucket时，不能重复创建
 	ErrBucketExists = errors.New("error bucket exsits")
+	// bucket不存在
+	ErrBucketNotFound = errors.New("bucket not found")
 	// ErrIncompatibleValue is returned when trying create or delete a bucket
 	// on an existing non-bucket key or when trying to create or delete a
 	// non-bucket key on an existing bucket key.
 	ErrIncompatibleValue = errors.New("incompatible value")
+	// 过期时间必须大于0
+	ErrInvalidTTL = errors.New("invalid ttl")
+	// 系统bucket中记录的bucket路径无法解析
+	ErrInvalidBucketPath = errors.New("invalid bucket path")
+	// 导入的数据格式错误
+	ErrInvalidDump = errors.New("invalid dump")
+	// blob page链与记录的大小不一致
+	ErrInvalidBlob = errors.New("invalid blob")
+	// 读取blob时的位置无效
+	ErrInvalidSeek = errors.New("invalid seek")
+)
+
+// 索引错误
+var (
+	// 索引名称不可为空
+	ErrIndexNameRequired = errors.New("index name required")
+	// 同一个bucket上不能重复注册同名索引
+	ErrIndexExists = errors.New("index exists")
+	// 索引不存在或者没有注册
+	ErrIndexNotFound = errors.New("index not found")
+	// 索引正在重建, 暂时不能查询
+	ErrIndexNotReady = errors.New("index not ready")
+	// 索引没有注册时bucket被修改过, 需要注册后重建
+	ErrIndexStale = errors.New("index stale")
+	// 索引条目格式错误
+	ErrInvalidIndexEntry = errors.New("invalid index entry")
+)
+
+// 压缩错误
+var (
+	// 编码id不能为0, 或者编码没有注册
+	ErrInvalidCodec = errors.New("invalid codec")
+	// 编码id已经被注册
+	ErrCodecExists = errors.New("codec exists")
+	// 读取的value使用了没有注册的编码
+	ErrUnknownCodec = errors.New("unknown codec")
+)
+
+// 备份错误
+var (
+	// 没有开启页日志, 或者页日志不包含需要的事务
+	ErrPagelogIncomplete = errors.New("pagelog incomplete")
+	// 增量备份格式错误或者数据损坏
+	ErrInvalidBackup = errors.New("invalid backup")
+	// 增量备份不能应用到当前的数据库
+	ErrBackupChain = errors.New("backup chain mismatch")
+)
+
+// 复制错误
+var (
+	// 只有以Follower模式打开的数据库可以应用主库的数据
+	ErrNotFollower = errors.New("not a follower")
+	// 收到的数据不能接在副本当前的事务之后
+	ErrReplicationGap = errors.New("replication gap")
+)
+
+// 订阅错误
+var (
+	// 没有开启变更日志, 或者变更日志不包含需要的事务
+	ErrChangeLogIncomplete = errors.New("change log incomplete")
+	// 订阅者没有及时读取变更, 订阅被关闭
+	ErrSubscriberTooSlow = errors.New("subscriber too slow")
+	// 变更日志中的数据格式错误
+	ErrInvalidChange = errors.New("invalid change")
+)
+
+// CSV错误
+var (
+	// CSV格式错误, 或者内容不能按照选项导入
+	ErrInvalidCSV = errors.New("invalid csv")
+	// key列的值在bucket中已经存在
+	ErrCSVDuplicateKey = errors.New("csv duplicate key")
+	// bucket不是通过ImportCSV导入的, 没有可以导出的布局
+	ErrCSVLayoutNotFound = errors.New("csv layout not found")
+	// 导入的表头或选项与bucket已有的布局不同
+	ErrCSVLayoutMismatch = errors.New("csv layout mismatch")
 )
@@ -32,6 +32,54 @@ func (f *freelist) free(txid txid, p *page) {
 	f.pending[txid] = ids
 }
 
+// 释放所有txid及之前的事务pending的page
+func (f *freelist) release(txid txid) {
+	m := make(pgids, 0)
+	for tid, ids := range f.pending {
+		if tid <= txid {
+			m = append(m, ids...)
+			delete(f.pending, tid)
+		}
+	}
+	sort.Sort(m)
+	f.ids = pgids(f.ids).merge(m)
+}
+
+// 撤销事务pending的page
+func (f *freelist) rollback(txid txid) {
+	for _, id := range f.pending[txid] {
+		delete(f.cache, id)
+	}
+	delete(f.pending, txid)
+}
+
+// page是否已经被释放
+func (f *freelist) freed(pgid pgid) bool {
+	return f.cache[pgid]
+}
+
+// 从freelist page重新读取, 并排除仍处于pending状态的page
+func (f *freelist) reload(p *page) {
+	f.read(p)
+
+	pcache := make(map[pgid]bool)
+	for _, pendingIDs := range f.pending {
+		for _, pendingID := range pendingIDs {
+			pcache[pendingID] = true
+		}
+	}
+
+	var a []pgid
+	for _, id := range f.ids {
+		if !pcache[id] {
+			a = append(a, id)
+		}
+	}
+	f.ids = a
+
+	f.reindex()
+}
+
 // 返回连续空间的起始id, 如果freelist中没有空间, 返回0
 func (f *freelist) allocate(n int) pgid {
 	if len(f.ids) == 0 {
@@ -67,6 +115,19 @@ func (f *freelist) allocate(n int) pgid {
 	return 0
 }
 
+// 移除紧邻高水位high的连续空闲page, 返回新的高水位
+// pending的page可能仍被读事务使用, 不会被移除
+func (f *freelist) trim(high pgid) pgid {
+	i := len(f.ids)
+	for i > 0 && f.ids[i-1] == high-1 {
+		i--
+		high--
+		delete(f.cache, high)
+	}
+	f.ids = f.ids[:i]
+	return high
+}
+
 // 返回freelist大小
 func (f *freelist) size() int {
 	n := f.count()
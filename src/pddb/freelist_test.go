@@ -1,7 +1,7 @@
 package pddb
 
 import (
-	// "math/rand"
+	"math/rand"
 	"reflect"
 	// "sort"
 	"testing"
@@ -27,22 +27,22 @@ func TestFreelist_free_overflow(t *testing.T) {
 }
 
 // Ensure that a transaction's free pages can be released.
-// func TestFreelist_release(t *testing.T) {
-// 	f := newFreelist()
-// 	f.free(100, &page{id: 12, overflow: 1})
-// 	f.free(100, &page{id: 9})
-// 	f.free(102, &page{id: 39})
-// 	f.release(100)
-// 	f.release(101)
-// 	if exp := []pgid{9, 12, 13}; !reflect.DeepEqual(exp, f.ids) {
-// 		t.Fatalf("exp=%v; got=%v", exp, f.ids)
-// 	}
+func TestFreelist_release(t *testing.T) {
+	f := newFreelist()
+	f.free(100, &page{id: 12, overflow: 1})
+	f.free(100, &page{id: 9})
+	f.free(102, &page{id: 39})
+	f.release(100)
+	f.release(101)
+	if exp := []pgid{9, 12, 13}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
 
-// 	f.release(102)
-// 	if exp := []pgid{9, 12, 13, 39}; !reflect.DeepEqual(exp, f.ids) {
-// 		t.Fatalf("exp=%v; got=%v", exp, f.ids)
-// 	}
-// }
+	f.release(102)
+	if exp := []pgid{9, 12, 13, 39}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
 
 // Ensure that a freelist can find contiguous blocks of pages.
 func TestFreelist_allocate(t *testing.T) {
@@ -86,6 +86,35 @@ func TestFreelist_allocate(t *testing.T) {
 	}
 }
 
+// 只移除紧邻高水位的空闲page, pending的page保留
+func TestFreelist_trim(t *testing.T) {
+	f := newFreelist()
+	f.free(100, &page{id: 5, overflow: 1})
+	f.free(100, &page{id: 9, overflow: 2})
+	f.release(100)
+	f.free(101, &page{id: 13})
+
+	if high := f.trim(20); high != 20 {
+		t.Fatalf("exp=20; got=%v", high)
+	}
+	if high := f.trim(12); high != 9 {
+		t.Fatalf("exp=9; got=%v", high)
+	}
+	if exp := []pgid{5, 6}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	} else if f.freed(10) || !f.freed(6) || !f.freed(13) {
+		t.Fatalf("unexpected cache: %v", f.cache)
+	}
+
+	// pending的page阻止继续截断
+	if high := f.trim(14); high != 14 {
+		t.Fatalf("exp=14; got=%v", high)
+	}
+	if high := f.trim(7); high != 5 || len(f.ids) != 0 {
+		t.Fatalf("exp=5; got=%v %v", high, f.ids)
+	}
+}
+
 // Ensure that a freelist can deserialize from a freelist page.
 // func TestFreelist_read(t *testing.T) {
 // 	// Create a page.
@@ -131,3 +160,36 @@ func TestFreelist_allocate(t *testing.T) {
 // 		t.Fatalf("exp=%v; got=%v", exp, f2.ids)
 // 	}
 // }
+
+func BenchmarkFreelist_allocate1K(b *testing.B)   { benchmarkFreelistAllocate(b, 1000) }
+func BenchmarkFreelist_allocate10K(b *testing.B)  { benchmarkFreelistAllocate(b, 10000) }
+func BenchmarkFreelist_allocate100K(b *testing.B) { benchmarkFreelistAllocate(b, 100000) }
+
+// 在碎片化的freelist中分配1到4个连续page, 用完后重新填充
+func benchmarkFreelistAllocate(b *testing.B, size int) {
+	ids := fragmentedPgids(size)
+	f := newFreelist()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if f.allocate(i%4+1) == 0 {
+			b.StopTimer()
+			f.ids = append(f.ids[:0], ids...)
+			b.StartTimer()
+		}
+	}
+}
+
+// 生成size个有序的page id, 由长度1到8的连续区间和间隔组成
+func fragmentedPgids(size int) []pgid {
+	r := rand.New(rand.NewSource(42))
+	ids := make([]pgid, 0, size)
+	id := pgid(2)
+	for len(ids) < size {
+		for n := r.Intn(8) + 1; n > 0 && len(ids) < size; n-- {
+			ids = append(ids, id)
+			id++
+		}
+		id += pgid(r.Intn(4) + 1)
+	}
+	return ids
+}
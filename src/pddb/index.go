@@ -0,0 +1,451 @@
+package pddb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// 索引所在的系统bucket
+// 每个索引对应一个子bucket, 名称由bucket路径和索引名编码而成, 其中:
+// entries子bucket: 编码后的索引值 + 主键 -> 空
+// state: 索引状态, progress: 重建索引时已经处理到的主键
+const indexBucketName = "__pddb_index"
+
+var (
+	indexEntriesBucket = []byte("entries")
+	indexStateKey      = []byte("state")
+	indexProgressKey   = []byte("progress")
+)
+
+// 索引状态
+var (
+	indexStateReady    = []byte("ready")
+	indexStateBuilding = []byte("building")
+	// 没有注册索引函数时bucket被修改过, 需要重建
+	indexStateStale = []byte("stale")
+)
+
+// 默认每个重建事务处理的key数量
+const DefaultRebuildBatchSize = 1000
+
+// 从k/v中提取索引值, 一条数据可以对应多个索引值, value是blob的数据不建立索引
+type IndexFunc func(k, v []byte) [][]byte
+
+// 注册在bucket上的索引
+type index struct {
+	name string
+	id   []byte
+	fn   IndexFunc
+}
+
+// 在bucket上注册索引, 之后在写事务中Put/Delete都会自动维护索引
+// 索引函数只保存在内存中, 每次打开数据库后都需要重新注册
+// 没有注册时修改bucket会使索引过时, 查询返回ErrIndexStale, 需要注册后调用RebuildIndex
+// 如果bucket中已经有数据, 需要调用RebuildIndex为已有数据建立索引
+func (db *DB) RegisterIndex(path [][]byte, name string, fn IndexFunc) error {
+	if len(path) == 0 {
+		return ErrBucketNameRequired
+	} else if name == "" {
+		return ErrIndexNameRequired
+	}
+
+	ix := &index{name: name, id: indexID(path, name), fn: fn}
+	if db.index(path, name) != nil {
+		return ErrIndexExists
+	}
+
+	// 首次注册时记录索引状态, 已有数据的bucket需要重建索引
+	// 在写事务中完成注册, 保证之后的写事务都会维护索引
+	var registered bool
+	err := db.Update(func(tx *Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte(indexBucketName))
+		if err != nil {
+			return err
+		}
+		b, err := root.CreateBucketIfNotExists(ix.id)
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists(indexEntriesBucket); err != nil {
+			return err
+		}
+		if b.Get(indexStateKey) == nil {
+			state := indexStateReady
+			if target := tx.bucketAt(path); target != nil {
+				if k, _, _ := target.Cursor().rawFirst(); k != nil {
+					state = indexStateBuilding
+				}
+			}
+			if err := b.Put(indexStateKey, state); err != nil {
+				return err
+			}
+		}
+
+		if registered = db.addIndex(path, ix); !registered {
+			return ErrIndexExists
+		}
+		return nil
+	})
+	if err != nil && registered {
+		db.removeIndex(path, ix)
+	}
+	return err
+}
+
+// 在内存中记录索引, 同名索引已经存在时返回false
+func (db *DB) addIndex(path [][]byte, ix *index) bool {
+	db.indexlock.Lock()
+	defer db.indexlock.Unlock()
+
+	pathKey := string(encodeBucketPath(path))
+	for _, other := range db.indexes[pathKey] {
+		if other.name == ix.name {
+			return false
+		}
+	}
+	if db.indexes == nil {
+		db.indexes = make(map[string][]*index)
+	}
+	db.indexes[pathKey] = append(db.indexes[pathKey], ix)
+	return true
+}
+
+// 从内存中移除索引
+func (db *DB) removeIndex(path [][]byte, ix *index) {
+	db.indexlock.Lock()
+	defer db.indexlock.Unlock()
+
+	pathKey := string(encodeBucketPath(path))
+	indexes := db.indexes[pathKey]
+	for i, other := range indexes {
+		if other == ix {
+			db.indexes[pathKey] = append(indexes[:i:i], indexes[i+1:]...)
+			return
+		}
+	}
+}
+
+// 为bucket中已有的数据重建索引, 每个写事务最多处理batchSize个key
+// 如果上一次重建被中断, 会从中断的位置继续, 否则清空索引后重新建立
+func (db *DB) RebuildIndex(path [][]byte, name string, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = DefaultRebuildBatchSize
+	}
+	ix := db.index(path, name)
+	if ix == nil {
+		return ErrIndexNotFound
+	}
+
+	// 已经建好的索引需要先清空
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.indexBucket(ix.id)
+		if b == nil {
+			return ErrIndexNotFound
+		}
+		if bytes.Equal(b.Get(indexStateKey), indexStateBuilding) {
+			return nil
+		}
+		return clearIndex(b, indexStateBuilding)
+	}); err != nil {
+		return err
+	}
+
+	for done := false; !done; {
+		if err := db.Update(func(tx *Tx) error {
+			var err error
+			done, err = tx.rebuildIndex(path, ix, batchSize)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 清空索引的所有条目和重建进度, 并设置索引状态
+func clearIndex(b *Bucket, state []byte) error {
+	if err := b.DeleteBucket(indexEntriesBucket); err != nil {
+		return err
+	}
+	if _, err := b.CreateBucket(indexEntriesBucket); err != nil {
+		return err
+	}
+	if err := b.Delete(indexProgressKey); err != nil {
+		return err
+	}
+	return b.Put(indexStateKey, state)
+}
+
+// 从上次的进度开始为最多n个key建立索引, 全部完成时返回true
+func (tx *Tx) rebuildIndex(path [][]byte, ix *index, n int) (bool, error) {
+	b := tx.indexBucket(ix.id)
+	if b == nil {
+		return false, ErrIndexNotFound
+	}
+	entries := b.Bucket(indexEntriesBucket)
+
+	var last []byte
+	if target := tx.bucketAt(path); target != nil {
+		c := target.Cursor()
+		var k, v []byte
+		if progress := b.Get(indexProgressKey); progress != nil {
+			if k, v = c.Seek(progress); bytes.Equal(k, progress) {
+				k, v = c.Next()
+			}
+		} else {
+			k, v = c.First()
+		}
+		for i := 0; k != nil && i < n; k, v = c.Next() {
+			if err := c.Err(); err != nil {
+				return false, err
+			}
+			// 跳过子bucket, blob不维护索引
+			if _, _, flags := c.keyValue(); (flags & (bucketLeafFlag | blobValueFlag)) != 0 {
+				continue
+			}
+			for _, value := range ix.fn(k, v) {
+				if err := entries.Put(encodeIndexKey(value, k), []byte{}); err != nil {
+					return false, err
+				}
+			}
+			last = cloneBytes(k)
+			i++
+		}
+		if k != nil {
+			return false, b.Put(indexProgressKey, last)
+		}
+	}
+
+	if err := b.Delete(indexProgressKey); err != nil {
+		return false, err
+	}
+	return true, b.Put(indexStateKey, indexStateReady)
+}
+
+// 返回已注册的索引
+func (db *DB) index(path [][]byte, name string) *index {
+	db.indexlock.RLock()
+	defer db.indexlock.RUnlock()
+	for _, ix := range db.indexes[string(encodeBucketPath(path))] {
+		if ix.name == name {
+			return ix
+		}
+	}
+	return nil
+}
+
+// 根据系统bucket中的名称返回已注册的索引
+func (db *DB) indexByID(path [][]byte, id []byte) *index {
+	db.indexlock.RLock()
+	defer db.indexlock.RUnlock()
+	for _, ix := range db.indexes[string(encodeBucketPath(path))] {
+		if bytes.Equal(ix.id, id) {
+			return ix
+		}
+	}
+	return nil
+}
+
+// 根据k/v的新旧值更新索引, old为nil表示新增, value为nil表示删除
+// 已经持久化但没有在本次打开后注册的索引无法维护, 标记为过时
+func (b *Bucket) updateIndexes(key, old, value []byte) error {
+	if b.isSystem() {
+		return nil
+	}
+
+	for _, id := range b.tx.indexIDs(b.path) {
+		ib := b.tx.indexBucket(id)
+		ix := b.tx.db.indexByID(b.path, id)
+		if ix == nil {
+			if bytes.Equal(ib.Get(indexStateKey), indexStateStale) {
+				continue
+			}
+			if err := ib.Put(indexStateKey, indexStateStale); err != nil {
+				return err
+			}
+			continue
+		}
+		entries := ib.Bucket(indexEntriesBucket)
+
+		if old != nil {
+			for _, v := range ix.fn(key, old) {
+				if err := entries.Delete(encodeIndexKey(v, key)); err != nil {
+					return err
+				}
+			}
+		}
+		if value != nil {
+			for _, v := range ix.fn(key, value) {
+				if err := entries.Put(encodeIndexKey(v, key), []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bucket被删除后清空其上所有索引, 重新创建的bucket为空, 索引可以直接使用
+func (tx *Tx) resetIndexes(path [][]byte) error {
+	for _, id := range tx.indexIDs(path) {
+		if err := clearIndex(tx.indexBucket(id), indexStateReady); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回bucket上已经持久化的所有索引在系统bucket中的名称
+func (tx *Tx) indexIDs(path [][]byte) [][]byte {
+	root := tx.root.Bucket([]byte(indexBucketName))
+	if root == nil {
+		return nil
+	}
+	prefix := indexPrefix(path)
+	var ids [][]byte
+	c := root.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ids = append(ids, cloneBytes(k))
+	}
+	return ids
+}
+
+// 返回索引在系统bucket中对应的bucket
+func (tx *Tx) indexBucket(id []byte) *Bucket {
+	root := tx.root.Bucket([]byte(indexBucketName))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket(id)
+}
+
+// 根据路径返回bucket, 不存在时返回nil
+func (tx *Tx) bucketAt(path [][]byte) *Bucket {
+	b := &tx.root
+	for _, name := range path {
+		if b = b.Bucket(name); b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// 通过索引查询bucket中的数据
+type Index struct {
+	bucket  *Bucket
+	name    string
+	index   *Bucket
+	entries *Bucket
+}
+
+// 返回bucket上指定名称的索引, 索引不存在时返回nil
+// 查询只依赖已经持久化的索引数据, 不需要在本次打开数据库后注册
+func (b *Bucket) Index(name string) *Index {
+	ib := b.tx.indexBucket(indexID(b.path, name))
+	if ib == nil {
+		return nil
+	}
+	entries := ib.Bucket(indexEntriesBucket)
+	if entries == nil {
+		return nil
+	}
+	return &Index{bucket: b, name: name, index: ib, entries: entries}
+}
+
+// 返回索引名称
+func (ix *Index) Name() string {
+	return ix.name
+}
+
+// 按索引值顺序遍历索引值在[min, max]范围内的数据, fn的参数为主键和值
+// min或max为nil时表示不限制, 精确查询时min和max相同
+func (ix *Index) Scan(min, max []byte, fn func(k, v []byte) error) error {
+	if ix.bucket.tx.db == nil {
+		return ErrTxClosed
+	}
+	switch state := ix.index.Get(indexStateKey); {
+	case bytes.Equal(state, indexStateStale):
+		return ErrIndexStale
+	case !bytes.Equal(state, indexStateReady):
+		return ErrIndexNotReady
+	}
+
+	c := ix.entries.Cursor()
+	var k []byte
+	if min == nil {
+		k, _ = c.First()
+	} else {
+		k, _ = c.Seek(encodeIndexKey(min, nil))
+	}
+	for ; k != nil; k, _ = c.Next() {
+		value, pk, ok := decodeIndexKey(k)
+		if !ok {
+			return ErrInvalidIndexEntry
+		}
+		if max != nil && bytes.Compare(value, max) > 0 {
+			break
+		}
+
+		// 数据可能已经过期
+		v, err := ix.bucket.Value(pk)
+		if err != nil {
+			return err
+		} else if v == nil {
+			continue
+		}
+		if err := fn(pk, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 索引在系统bucket中的名称
+func indexID(path [][]byte, name string) []byte {
+	id := make([][]byte, len(path), len(path)+1)
+	copy(id, path)
+	return encodeBucketPath(append(id, []byte(name)))
+}
+
+// bucket上所有索引名称的公共前缀, 路径长度按照indexID加上索引名计算
+func indexPrefix(path [][]byte) []byte {
+	buf := encodeBucketPath(path)
+	_, sz := binary.Uvarint(buf)
+	return append(binary.AppendUvarint(nil, uint64(len(path)+1)), buf[sz:]...)
+}
+
+// 将索引值和主键编码成索引条目
+// 索引值中的0x00转义为0x00 0xFF, 并以0x00 0x01结尾, 保证条目按照索引值排序
+func encodeIndexKey(value, pk []byte) []byte {
+	buf := make([]byte, 0, len(value)+len(pk)+2)
+	for _, c := range value {
+		if c == 0x00 {
+			buf = append(buf, 0x00, 0xFF)
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	buf = append(buf, 0x00, 0x01)
+	return append(buf, pk...)
+}
+
+// 从索引条目中解码索引值和主键
+func decodeIndexKey(k []byte) (value, pk []byte, ok bool) {
+	value = make([]byte, 0, len(k))
+	for i := 0; i < len(k)-1; i++ {
+		if k[i] != 0x00 {
+			value = append(value, k[i])
+			continue
+		}
+		switch k[i+1] {
+		case 0xFF:
+			value = append(value, 0x00)
+			i++
+		case 0x01:
+			return value, k[i+2:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,354 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"pddb"
+	"strings"
+	"testing"
+)
+
+// 按照value中"@"后的域名建立索引
+func domainIndex(k, v []byte) [][]byte {
+	if i := bytes.IndexByte(v, '@'); i >= 0 {
+		return [][]byte{v[i+1:]}
+	}
+	return nil
+}
+
+// 返回索引查询到的所有主键
+func scanIndex(t *testing.T, db *pddb.DB, min, max string) []string {
+	var keys []string
+	if err := db.View(func(tx *pddb.Tx) error {
+		ix := tx.Bucket([]byte("users")).Index("domain")
+		if ix == nil {
+			t.Fatal("expected index")
+		}
+		var lo, hi []byte
+		if min != "" {
+			lo = []byte(min)
+		}
+		if max != "" {
+			hi = []byte(max)
+		}
+		return ix.Scan(lo, hi, func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// 写事务中的Put/Delete会自动维护索引
+func TestIndex_Maintain(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.RegisterIndex([][]byte{[]byte("users")}, "domain", domainIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range map[string]string{
+			"alice": "alice@a.com",
+			"bob":   "bob@b.com",
+			"carol": "carol@a.com",
+			"dave":  "dave@c.com",
+		} {
+			if err := b.Put([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := scanIndex(t, db, "a.com", "a.com"); strings.Join(keys, ",") != "alice,carol" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys := scanIndex(t, db, "b.com", ""); strings.Join(keys, ",") != "bob,dave" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	// 修改和删除数据
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		if err := b.Put([]byte("alice"), []byte("alice@c.com")); err != nil {
+			t.Fatal(err)
+		}
+		return b.Delete([]byte("dave"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := scanIndex(t, db, "a.com", "a.com"); strings.Join(keys, ",") != "carol" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys := scanIndex(t, db, "c.com", "c.com"); strings.Join(keys, ",") != "alice" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	// 回滚的修改不会影响索引
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if err := tx.Bucket([]byte("users")).Put([]byte("erin"), []byte("erin@a.com")); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Errorf("rollback")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+	if keys := scanIndex(t, db, "a.com", "a.com"); strings.Join(keys, ",") != "carol" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+// 通过游标删除key同样维护索引
+func TestIndex_CursorDelete(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.RegisterIndex([][]byte{[]byte("users")}, "domain", domainIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("alice"), []byte("alice@a.com")); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("bob"), []byte("bob@b.com"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		c := tx.Bucket([]byte("users")).Cursor()
+		if k, _ := c.Seek([]byte("alice")); string(k) != "alice" {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		if err := c.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		// 旧的索引条目已经删除, 重新写入后只能通过新的value查询
+		return tx.Bucket([]byte("users")).Put([]byte("alice"), []byte("alice@c.com"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := scanIndex(t, db, "a.com", "a.com"); len(keys) != 0 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys := scanIndex(t, db, "", ""); strings.Join(keys, ",") != "bob,alice" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+// 已有数据的bucket需要重建索引, 重建可以从中断处继续
+func TestIndex_Rebuild(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("u%03d", i)), []byte(fmt.Sprintf("u%03d@%d.com", i, i%3))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := [][]byte{[]byte("users")}
+	if err := db.RegisterIndex(path, "domain", domainIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RegisterIndex(path, "domain", domainIndex); err != pddb.ErrIndexExists {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 重建完成前不能查询
+	if err := db.View(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("users")).Index("domain").Scan(nil, nil, func(k, v []byte) error { return nil })
+	}); err != pddb.ErrIndexNotReady {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.RebuildIndex(path, "domain", 7); err != nil {
+		t.Fatal(err)
+	}
+	if keys := scanIndex(t, db, "1.com", "1.com"); len(keys) != 33 || keys[0] != "u001" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys := scanIndex(t, db, "", ""); len(keys) != 100 {
+		t.Fatalf("unexpected count: %d", len(keys))
+	}
+
+	// 再次重建会清空之前的索引数据
+	if err := db.RebuildIndex(path, "domain", 0); err != nil {
+		t.Fatal(err)
+	}
+	if keys := scanIndex(t, db, "", ""); len(keys) != 100 {
+		t.Fatalf("unexpected count: %d", len(keys))
+	}
+
+	if err := db.RebuildIndex(path, "missing", 0); err != pddb.ErrIndexNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 重建索引时跳过blob, 之后覆盖blob不会留下旧的索引数据
+func TestIndex_Rebuild_Blob(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.PutReader([]byte("k1"), strings.NewReader("a@old.com"), 9)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := [][]byte{[]byte("users")}
+	if err := db.RegisterIndex(path, "domain", domainIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RebuildIndex(path, "domain", 0); err != nil {
+		t.Fatal(err)
+	}
+	if keys := scanIndex(t, db, "", ""); len(keys) != 0 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("users")).Put([]byte("k1"), []byte("a@new.com"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := scanIndex(t, db, "old.com", "old.com"); len(keys) != 0 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys := scanIndex(t, db, "new.com", "new.com"); len(keys) != 1 || keys[0] != "k1" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+// 没有注册索引时修改bucket, 索引标记为过时, 重新注册并重建后恢复
+func TestIndex_Stale(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	db, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := [][]byte{[]byte("users")}
+	if err := db.RegisterIndex(bucket, "domain", domainIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("alice"), []byte("alice@a.com"))
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后没有注册索引就修改数据
+	if db, err = pddb.Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("users")).Put([]byte("alice"), []byte("alice@b.com"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("users")).Index("domain").Scan(nil, nil, func(k, v []byte) error { return nil })
+	}); err != pddb.ErrIndexStale {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 注册后仍然是过时的, 重建后可以查询
+	if err := db.RegisterIndex(bucket, "domain", domainIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		return tx.Bucket([]byte("users")).Index("domain").Scan(nil, nil, func(k, v []byte) error { return nil })
+	}); err != pddb.ErrIndexStale {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.RebuildIndex(bucket, "domain", 0); err != nil {
+		t.Fatal(err)
+	}
+	if keys := scanIndex(t, db, "a.com", "a.com"); len(keys) != 0 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys := scanIndex(t, db, "b.com", "b.com"); strings.Join(keys, ",") != "alice" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+// 删除bucket时清空索引, 重新创建后不会查询到旧的条目
+func TestIndex_DeleteBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.RegisterIndex([][]byte{[]byte("users")}, "domain", domainIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("alice"), []byte("alice@a.com")); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("bob"), []byte("bob@a.com"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if err := tx.DeleteBucket([]byte("users")); err != nil {
+			t.Fatal(err)
+		}
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("alice"), []byte("alice@b.com"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := scanIndex(t, db, "a.com", "a.com"); len(keys) != 0 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys := scanIndex(t, db, "", ""); strings.Join(keys, ",") != "alice" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
@@ -0,0 +1,344 @@
+package pddb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// page的使用情况
+type PageInfo struct {
+	ID uint64
+	// branch, leaf或blob
+	Type string
+	// overflow page的数量
+	Overflow int
+	// 元素数量, blob page为0
+	Count int
+	// 已经使用的字节数, 包括page头
+	Used int
+	// page及其overflow的总字节数
+	Capacity int
+	// page中第一个和最后一个key, blob page为nil
+	FirstKey []byte
+	LastKey  []byte
+}
+
+// page的填充率
+func (p *PageInfo) Fill() float64 {
+	if p.Capacity == 0 {
+		return 0
+	}
+	return float64(p.Used) / float64(p.Capacity)
+}
+
+// 数据库的碎片报告
+type FragmentationReport struct {
+	PageSize int
+	// 文件中已经分配的page数量, 即最高的page id + 1
+	PageCount int
+	// 元数据, freelist, bucket和blob使用的page数量, 包括overflow
+	MetaPages     int
+	FreelistPages int
+	BranchPages   int
+	LeafPages     int
+	BlobPages     int
+	// freelist中的page数量, 包括等待读事务结束后才能重用的page
+	FreePages int
+	// freelist中连续空闲区间的数量和最长区间的page数量
+	FreeRuns       int
+	LongestFreeRun int
+	// 以overflow page存储的page数量, overflow page数量, 以及这些page中未使用的字节数
+	OverflowedPages int
+	OverflowPages   int
+	OverflowWaste   int
+	// 每个bucket的填充情况, 按照路径排序
+	Buckets []BucketFill
+}
+
+// bucket的填充情况, 只统计bucket自身的page, 不包括子bucket
+type BucketFill struct {
+	Path [][]byte
+	// 行内bucket保存在父bucket的leaf page中, 没有独立的page
+	Inline      bool
+	BranchPages int
+	LeafPages   int
+	BlobPages   int
+	// branch和leaf page已经使用的字节数和总字节数
+	Used     int
+	Capacity int
+	// branch和leaf page按照填充率分布, Histogram[i]为填充率在[i*10%, (i+1)*10%)的page数量
+	Histogram [10]int
+}
+
+// bucket的平均填充率
+func (b *BucketFill) Fill() float64 {
+	if b.Capacity == 0 {
+		return 0
+	}
+	return float64(b.Used) / float64(b.Capacity)
+}
+
+// 读取page的使用情况
+func (tx *Tx) pageInfo(p *page) *PageInfo {
+	info := &PageInfo{
+		ID:       uint64(p.id),
+		Overflow: int(p.overflow),
+		Count:    int(p.count),
+		Used:     pageHeaderSize,
+		Capacity: (int(p.overflow) + 1) * tx.db.pageSize,
+	}
+	switch {
+	case (p.flags & branchPageFlag) != 0:
+		info.Type = "branch"
+		for i := 0; i < int(p.count); i++ {
+			elem := p.branchPageElement(uint16(i))
+			info.Used += branchPageElementSize + int(elem.ksize)
+		}
+		if p.count > 0 {
+			info.FirstKey = cloneBytes(p.branchPageElement(0).key())
+			info.LastKey = cloneBytes(p.branchPageElement(p.count - 1).key())
+		}
+	case (p.flags & leafPageFlag) != 0:
+		info.Type = "leaf"
+		for i := 0; i < int(p.count); i++ {
+			elem := p.leafPageElement(uint16(i))
+			info.Used += leafPageElementSize + int(elem.ksize) + int(elem.vsize)
+		}
+		if p.count > 0 {
+			info.FirstKey = cloneBytes(p.leafPageElement(0).key())
+			info.LastKey = cloneBytes(p.leafPageElement(p.count - 1).key())
+		}
+	case (p.flags & blobPageFlag) != 0:
+		info.Type = "blob"
+		data, _ := blobData(p)
+		info.Used += blobPageHeaderSize + len(data)
+	default:
+		info.Type = fmt.Sprintf("unknown(%#x)", p.flags)
+	}
+	return info
+}
+
+// 统计事务开始时已经提交的数据的碎片情况, 应在只读事务中调用
+func (tx *Tx) Fragmentation() (*FragmentationReport, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+
+	f := newFreelist()
+	freelistPage := tx.page(tx.meta.freelist)
+	f.read(freelistPage)
+
+	r := &FragmentationReport{
+		PageSize:      tx.db.pageSize,
+		PageCount:     int(tx.meta.pgid),
+		MetaPages:     2,
+		FreelistPages: int(freelistPage.overflow) + 1,
+		FreePages:     len(f.ids),
+	}
+
+	// 空闲区间
+	run := 0
+	for i, id := range f.ids {
+		if i > 0 && id == f.ids[i-1]+1 {
+			run++
+		} else {
+			run = 1
+			r.FreeRuns++
+		}
+		if run > r.LongestFreeRun {
+			r.LongestFreeRun = run
+		}
+	}
+
+	// 先登记所有bucket, 行内bucket没有独立的page也需要出现在报告中
+	fills := make(map[string]*BucketFill)
+	var order []*BucketFill
+	fill := func(b *Bucket) *BucketFill {
+		key := string(encodeBucketPath(b.path))
+		if bf := fills[key]; bf != nil {
+			return bf
+		}
+		bf := &BucketFill{Path: b.path, Inline: b.root == 0}
+		fills[key] = bf
+		order = append(order, bf)
+		return bf
+	}
+	var walk func(b *Bucket)
+	walk = func(b *Bucket) {
+		fill(b)
+		c := b.Cursor()
+		for k, _, flags := c.rawFirst(); k != nil; k, _, flags = c.next() {
+			if (flags & bucketLeafFlag) != 0 {
+				walk(b.Bucket(k))
+			}
+		}
+	}
+	walk(&tx.root)
+
+	tx.forEachBucketPage(&tx.root, func(p *page, b *Bucket) {
+		info := tx.pageInfo(p)
+		bf := fill(b)
+		if info.Overflow > 0 {
+			r.OverflowedPages++
+			r.OverflowPages += info.Overflow
+			r.OverflowWaste += info.Capacity - info.Used
+		}
+		switch info.Type {
+		case "branch":
+			r.BranchPages += info.Overflow + 1
+			bf.BranchPages++
+		case "leaf":
+			r.LeafPages += info.Overflow + 1
+			bf.LeafPages++
+		default:
+			r.BlobPages += info.Overflow + 1
+			bf.BlobPages++
+			return
+		}
+		bf.Used += info.Used
+		bf.Capacity += info.Capacity
+		i := int(info.Fill() * 10)
+		if i > 9 {
+			i = 9
+		}
+		bf.Histogram[i]++
+	})
+
+	sort.Slice(order, func(i, j int) bool {
+		return comparePaths(order[i].Path, order[j].Path) < 0
+	})
+	for _, bf := range order {
+		r.Buckets = append(r.Buckets, *bf)
+	}
+	return r, nil
+}
+
+// 按照路径的字典序比较
+func comparePaths(a, b [][]byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(string(a[i]), string(b[i])); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// 将path指定的bucket的page结构以Graphviz DOT格式写入w, path为空时从meta.root开始
+// 子bucket只显示为一个节点, 不展开其中的page, 应在只读事务中调用
+func (tx *Tx) WriteDOT(w io.Writer, path [][]byte) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	b := tx.bucketAt(path)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", dotQuote(dotPath(path)))
+	fmt.Fprintf(bw, "\tnode [shape=box, fontname=\"monospace\"];\n")
+
+	if b.root == 0 {
+		fmt.Fprintf(bw, "\tinline [label=%s];\n", dotQuote("inline bucket"))
+	} else {
+		tx.writeDOTPage(bw, b, b.root)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// 输出page及其子page
+func (tx *Tx) writeDOTPage(w io.Writer, b *Bucket, id pgid) {
+	p := tx.page(id)
+	info := tx.pageInfo(p)
+
+	label := fmt.Sprintf("page %d %s\n%d keys, %.0f%% full", info.ID, info.Type, info.Count, info.Fill()*100)
+	if info.Overflow > 0 {
+		label += fmt.Sprintf("\n+%d overflow", info.Overflow)
+	}
+	if info.Count > 0 {
+		label += fmt.Sprintf("\n%s .. %s", dotKey(info.FirstKey), dotKey(info.LastKey))
+	}
+	style := ""
+	if info.Type == "branch" {
+		style = ", style=filled, fillcolor=lightgrey"
+	}
+	fmt.Fprintf(w, "\tp%d [label=%s%s];\n", id, dotQuote(label), style)
+
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			elem := p.branchPageElement(uint16(i))
+			fmt.Fprintf(w, "\tp%d -> p%d;\n", id, elem.pgid)
+			tx.writeDOTPage(w, b, elem.pgid)
+		}
+		return
+	}
+
+	// 子bucket和blob value只显示为一个节点
+	for i := 0; i < int(p.count); i++ {
+		elem := p.leafPageElement(uint16(i))
+		switch {
+		case (elem.flags & bucketLeafFlag) != 0:
+			child := b.Bucket(elem.key())
+			label := "bucket " + dotKey(elem.key())
+			if child.root == 0 {
+				label += "\ninline"
+			} else {
+				label += fmt.Sprintf("\nroot page %d", child.root)
+			}
+			fmt.Fprintf(w, "\tp%d_%d [label=%s, shape=ellipse];\n", id, i, dotQuote(label))
+			fmt.Fprintf(w, "\tp%d -> p%d_%d [style=dashed];\n", id, id, i)
+		case (elem.flags & blobValueFlag) != 0:
+			n := 0
+			tx.forEachBlobPage(elem.value(), func(*page) { n++ })
+			label := fmt.Sprintf("blob %s\n%d pages", dotKey(elem.key()), n)
+			fmt.Fprintf(w, "\tp%d_%d [label=%s, shape=note];\n", id, i, dotQuote(label))
+			fmt.Fprintf(w, "\tp%d -> p%d_%d [style=dotted];\n", id, id, i)
+		}
+	}
+}
+
+// 用于显示的bucket路径
+func dotPath(path [][]byte) string {
+	if len(path) == 0 {
+		return "root"
+	}
+	names := make([]string, len(path))
+	for i, name := range path {
+		names[i] = dotKey(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// 用于显示的key, 不可打印的key显示为十六进制, 过长的key被截断
+func dotKey(key []byte) string {
+	const max = 24
+	printable := utf8.Valid(key)
+	for _, r := range string(key) {
+		if !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+	s := string(key)
+	if !printable {
+		s = fmt.Sprintf("0x%x", key)
+	}
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	return s
+}
+
+// DOT字符串, 转义引号和反斜杠, 换行使用\n
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
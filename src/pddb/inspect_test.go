@@ -0,0 +1,161 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"pddb"
+	"strings"
+	"testing"
+)
+
+// 输出bucket的page结构
+func TestTx_WriteDOT(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 32)); err != nil {
+				return err
+			}
+		}
+		if _, err := b.CreateBucket([]byte("child")); err != nil {
+			return err
+		}
+		blob := bytes.Repeat([]byte("x"), 10000)
+		return b.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		var buf bytes.Buffer
+		if err := tx.WriteDOT(&buf, [][]byte{[]byte("widgets")}); err != nil {
+			return err
+		}
+		s := buf.String()
+		for _, want := range []string{
+			`digraph "widgets" {`,
+			" branch\\n",
+			" leaf\\n",
+			`\nblob .. key`,
+			`.. key0999"`,
+			`"bucket child\ninline", shape=ellipse`,
+			`"blob blob\n3 pages", shape=note`,
+		} {
+			if !strings.Contains(s, want) {
+				t.Fatalf("expected %q in:\n%s", want, s)
+			}
+		}
+		if !strings.HasSuffix(s, "}\n") {
+			t.Fatalf("unterminated graph:\n%s", s)
+		}
+
+		// 行内bucket只有一个节点
+		buf.Reset()
+		if err := tx.WriteDOT(&buf, [][]byte{[]byte("widgets"), []byte("child")}); err != nil {
+			return err
+		} else if !strings.Contains(buf.String(), `inline [label="inline bucket"]`) {
+			t.Fatalf("unexpected graph:\n%s", buf.String())
+		}
+
+		// 从meta.root开始
+		buf.Reset()
+		if err := tx.WriteDOT(&buf, nil); err != nil {
+			return err
+		} else if !strings.Contains(buf.String(), `"bucket widgets\nroot page `) {
+			t.Fatalf("unexpected graph:\n%s", buf.String())
+		}
+
+		if err := tx.WriteDOT(&buf, [][]byte{[]byte("missing")}); err != pddb.ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 碎片报告中的page数量之和等于文件中的page数量
+func TestTx_Fragmentation(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 64)); err != nil {
+				return err
+			}
+		}
+		// 超过一个page的value产生overflow page
+		if err := b.Put([]byte("large"), make([]byte, 10000)); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("empty"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除一半的key之后产生空闲page
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 2000; i += 2 {
+			if err := b.Delete([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		r, err := tx.Fragmentation()
+		if err != nil {
+			return err
+		}
+		if sum := r.MetaPages + r.FreelistPages + r.BranchPages + r.LeafPages + r.BlobPages + r.FreePages; sum != r.PageCount {
+			t.Fatalf("page count mismatch: %d != %d (%+v)", sum, r.PageCount, r)
+		}
+		if r.FreePages == 0 || r.FreeRuns == 0 || r.LongestFreeRun == 0 || r.LongestFreeRun > r.FreePages {
+			t.Fatalf("unexpected free pages: %+v", r)
+		}
+		if r.OverflowedPages != 1 || r.OverflowPages < 2 || r.OverflowWaste <= 0 || r.OverflowWaste >= r.PageSize*(r.OverflowPages+1) {
+			t.Fatalf("unexpected overflow: %+v", r)
+		}
+
+		// 根bucket, empty和widgets按照路径排序
+		if len(r.Buckets) != 3 {
+			t.Fatalf("unexpected buckets: %+v", r.Buckets)
+		}
+		root, empty, widgets := r.Buckets[0], r.Buckets[1], r.Buckets[2]
+		if root.Path != nil || root.Inline || root.LeafPages != 1 {
+			t.Fatalf("unexpected root: %+v", root)
+		} else if string(empty.Path[0]) != "empty" || !empty.Inline || empty.LeafPages != 0 {
+			t.Fatalf("unexpected empty bucket: %+v", empty)
+		} else if string(widgets.Path[0]) != "widgets" || widgets.BranchPages == 0 {
+			t.Fatalf("unexpected widgets bucket: %+v", widgets)
+		}
+		n := 0
+		for _, c := range widgets.Histogram {
+			n += c
+		}
+		if n != widgets.BranchPages+widgets.LeafPages {
+			t.Fatalf("unexpected histogram: %v", widgets.Histogram)
+		} else if fill := widgets.Fill(); fill <= 0 || fill > 1 {
+			t.Fatalf("unexpected fill: %f", fill)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,174 @@
+package pddb
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// 数据库文件, 预写日志和页日志需要的文件操作, *os.File和memFile都满足
+type dbFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// 打开只保存在内存中的数据库, 不加文件锁, 不同步到磁盘, 也不使用内存映射
+// 关闭后数据丢失, 需要保留时通过WriteTo写出, 写出的文件可以用Open打开
+func OpenMemory(options *Options) (*DB, error) {
+	return open(context.Background(), "", 0, options, true)
+}
+
+// 内存数据库的文件, 数据保存在可以增长的缓冲区中
+// 缓冲区重新分配后, 之前返回的page仍然引用原来的缓冲区, 读事务可以继续使用
+type memFile struct {
+	mu  sync.RWMutex
+	buf []byte
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off >= int64(len(f.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.buf[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := int(off) + len(b); end > len(f.buf) {
+		f.resize(end)
+	}
+	return copy(f.buf[off:], b), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.resize(int(size))
+	return nil
+}
+
+// 修改长度, 新增的部分为0; 容量不足时按照两倍重新分配, 调用者需要持有锁
+func (f *memFile) resize(n int) {
+	if n > cap(f.buf) {
+		f.reserve(n)
+	}
+	if old := len(f.buf); n > old {
+		f.buf = f.buf[:n]
+		clear(f.buf[old:])
+	} else {
+		f.buf = f.buf[:n]
+	}
+}
+
+// 保证容量不小于n, 调用者需要持有锁
+func (f *memFile) reserve(n int) {
+	if n <= cap(f.buf) {
+		return
+	}
+	if n < 2*cap(f.buf) {
+		n = 2 * cap(f.buf)
+	}
+	buf := make([]byte, len(f.buf), n)
+	copy(buf, f.buf)
+	f.buf = buf
+}
+
+// 返回缓冲区中offset处的page
+func (f *memFile) page(offset int) *page {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return (*page)(unsafe.Pointer(&f.buf[:cap(f.buf)][offset]))
+}
+
+// 数据只在内存中, 不需要同步
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return memFileInfo(len(f.buf)), nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf = nil
+	return nil
+}
+
+// 内存数据库文件的信息, 只有大小有意义
+type memFileInfo int64
+
+func (fi memFileInfo) Name() string       { return "" }
+func (fi memFileInfo) Size() int64        { return int64(fi) }
+func (fi memFileInfo) Mode() os.FileMode  { return 0 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// 直接引用内存数据库的缓冲区, 与mmapSource相同不需要复制page
+type memSource struct {
+	db   *DB
+	file *memFile
+	sz   int
+}
+
+func (s *memSource) page(id pgid) *page {
+	// meta page写入时直接覆盖缓冲区, 返回副本避免与读取元数据的事务竞争
+	if id <= 1 {
+		buf := make([]byte, s.db.pageSize)
+		_, _ = s.file.ReadAt(buf, int64(id)*int64(s.db.pageSize))
+		return (*page)(unsafe.Pointer(&buf[0]))
+	}
+	p := s.file.page(int(id) * s.db.pageSize)
+	if s.db.cipher == nil {
+		return p
+	}
+	return s.db.decryptedPage(p)
+}
+
+func (s *memSource) size() int {
+	return s.sz
+}
+
+// 预留容量, 之后写入时不需要重新分配缓冲区
+func (s *memSource) remap(sz int) error {
+	sz, err := s.db.mmapSize(sz)
+	if err != nil {
+		return err
+	}
+	s.file.mu.Lock()
+	s.file.reserve(sz)
+	s.file.mu.Unlock()
+	s.sz = sz
+	return nil
+}
+
+func (s *memSource) invalidate(pages pages) {
+	if s.db.cipher != nil {
+		s.db.invalidateDecrypted(pages)
+	}
+}
+
+func (s *memSource) close() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"pddb"
+	"testing"
+)
+
+// 内存数据库与文件数据库的行为一致, 写出的文件可以直接打开
+func TestOpenMemory(t *testing.T) {
+	for name, options := range map[string]*pddb.Options{
+		"default": nil,
+		"cipher":  {Cipher: MustCipher(7)},
+		"wal":     {WAL: true, CheckpointSize: 64 * 1024},
+		"pread":   {Backend: pddb.BackendPread, PageCacheSize: 16},
+		"pagelog": {TrackPages: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := pddb.OpenMemory(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer MustClose(db)
+			if db.Path() != "" {
+				t.Fatalf("unexpected path: %q", db.Path())
+			}
+
+			blob := bytes.Repeat([]byte("blob"), 5000)
+			for i := 0; i < 10; i++ {
+				if err := db.Update(func(tx *pddb.Tx) error {
+					b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+					if err != nil {
+						return err
+					}
+					for j := 0; j < 200; j++ {
+						if err := b.Put([]byte(fmt.Sprintf("key%02d%03d", i, j)), []byte(fmt.Sprintf("value%d", i*1000+j))); err != nil {
+							return err
+						}
+					}
+					if err := b.Put([]byte(fmt.Sprintf("large%02d", i)), bytes.Repeat([]byte{byte(i)}, 10000)); err != nil {
+						return err
+					}
+					return b.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob)))
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkDB(t, db)
+
+			path := tempfile()
+			defer os.Remove(path)
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.WriteTo(f); err != nil {
+				t.Fatal(err)
+			} else if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var cipher pddb.Cipher
+			if options != nil {
+				cipher = options.Cipher
+			}
+			fdb, err := pddb.Open(path, 0666, &pddb.Options{Cipher: cipher})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer MustClose(fdb)
+			checkDB(t, fdb)
+			if err := fdb.View(func(tx *pddb.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				if v := b.Get([]byte("key09123")); string(v) != "value9123" {
+					t.Fatalf("unexpected value: %q", v)
+				} else if v := b.Get([]byte("large05")); !bytes.Equal(v, bytes.Repeat([]byte{5}, 10000)) {
+					t.Fatal("unexpected large value")
+				} else if v := b.Get([]byte("blob")); !bytes.Equal(v, blob) {
+					t.Fatal("unexpected blob")
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// 读事务期间写事务需要扩展缓冲区, 读事务读取的数据不受影响
+func TestOpenMemory_Grow(t *testing.T) {
+	db, err := pddb.OpenMemory(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+
+	// 读事务持有期间写入超过初始容量的数据
+	done := make(chan error)
+	go func() {
+		done <- db.Update(func(tx *pddb.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 1000)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}()
+	if string(v) != "bar" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkDB(t, db)
+
+	// 删除后收缩
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	checkDB(t, db)
+}
@@ -0,0 +1,396 @@
+package pddb_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"pddb"
+	"sort"
+	"testing"
+	"time"
+)
+
+var (
+	modelSeed  = flag.Int64("model.seed", 0, "seed of TestModel, 0 picks a random seed")
+	modelSteps = flag.Int("model.steps", 3000, "number of operations run by TestModel")
+)
+
+// 随机执行操作并与内存中的模型比较, 失败时使用-model.seed重现
+func TestModel(t *testing.T) {
+	runModel(t, nil)
+}
+
+// 使用很小的page缓存, 频繁淘汰仍被引用的page
+func TestModel_Pread(t *testing.T) {
+	runModel(t, &pddb.Options{Backend: pddb.BackendPread, PageCacheSize: 8})
+}
+
+func runModel(t *testing.T, options *pddb.Options) {
+	seed := *modelSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", seed)
+
+	steps := *modelSteps
+	if testing.Short() {
+		steps /= 10
+	}
+	r := newModelRunner(t, filepath.Join(t.TempDir(), "db"), options, &randChooser{rand.New(rand.NewSource(seed))})
+	defer r.close()
+	for i := 0; i < steps; i++ {
+		r.step()
+	}
+}
+
+// 由模糊测试的输入决定执行的操作
+func FuzzModel(f *testing.F) {
+	f.Add([]byte{0, 2, 1, 3, 0, 5, 2, 9, 7, 4, 1, 1, 8, 6, 3})
+	f.Add(bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, 20))
+	f.Add([]byte("put and delete some keys, then reopen the database"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := &bytesChooser{data: data}
+		r := newModelRunner(t, filepath.Join(t.TempDir(), "db"), nil, c)
+		defer r.close()
+		for len(c.data) > 0 {
+			r.step()
+		}
+	})
+}
+
+// 选择操作和参数的来源
+type chooser interface {
+	// 返回[0, n)中的一个数
+	intn(n int) int
+}
+
+type randChooser struct{ rand *rand.Rand }
+
+func (c *randChooser) intn(n int) int { return c.rand.Intn(n) }
+
+// 依次消耗输入的字节, 用完后总是返回0
+type bytesChooser struct{ data []byte }
+
+func (c *bytesChooser) intn(n int) int {
+	if len(c.data) == 0 {
+		return 0
+	}
+	v := int(c.data[0])
+	c.data = c.data[1:]
+	return v % n
+}
+
+// 模型中的bucket
+type modelBucket struct {
+	values  map[string]string
+	buckets map[string]*modelBucket
+}
+
+func newModelBucket() *modelBucket {
+	return &modelBucket{values: make(map[string]string), buckets: make(map[string]*modelBucket)}
+}
+
+func (m *modelBucket) clone() *modelBucket {
+	other := newModelBucket()
+	for k, v := range m.values {
+		other.values[k] = v
+	}
+	for k, b := range m.buckets {
+		other.buckets[k] = b.clone()
+	}
+	return other
+}
+
+// 执行随机操作的状态
+// committed是已经提交的数据, 开启写事务时复制到pending, 提交时替换committed
+type modelRunner struct {
+	t       testing.TB
+	path    string
+	options *pddb.Options
+	c       chooser
+	db      *pddb.DB
+
+	tx        *pddb.Tx
+	committed *modelBucket
+	pending   *modelBucket
+	n         int
+}
+
+func newModelRunner(t testing.TB, path string, options *pddb.Options, c chooser) *modelRunner {
+	r := &modelRunner{t: t, path: path, options: options, c: c, committed: newModelBucket()}
+	r.open()
+	return r
+}
+
+func (r *modelRunner) open() {
+	db, err := pddb.Open(r.path, 0666, r.options)
+	if err != nil {
+		r.fatalf("open: %v", err)
+	}
+	r.db = db
+}
+
+func (r *modelRunner) close() {
+	if r.tx != nil {
+		_ = r.tx.Rollback()
+		r.tx = nil
+	}
+	if r.db != nil {
+		_ = r.db.Close()
+		_ = os.Remove(r.path)
+	}
+}
+
+func (r *modelRunner) fatalf(format string, args ...interface{}) {
+	r.t.Helper()
+	r.t.Fatalf("step %d: %s", r.n, fmt.Sprintf(format, args...))
+}
+
+// key和bucket名称共用一个较小的集合, 以便经常发生冲突
+func (r *modelRunner) name() string {
+	return fmt.Sprintf("k%02d", r.c.intn(24))
+}
+
+// 大多数value较小, 偶尔超过一个page以产生overflow page
+func (r *modelRunner) value() string {
+	n := r.c.intn(64)
+	if r.c.intn(16) == 0 {
+		n = 4096 + r.c.intn(8192)
+	}
+	return fmt.Sprintf("%d:%s", r.n, bytes.Repeat([]byte{byte('a' + r.c.intn(26))}, n))
+}
+
+// 随机选择一个已有的bucket路径, 深度不超过3
+func (r *modelRunner) bucketPath() ([]string, *modelBucket) {
+	var path []string
+	m := r.pending
+	for len(path) < 3 && len(m.buckets) > 0 && r.c.intn(3) > 0 {
+		names := make([]string, 0, len(m.buckets))
+		for name := range m.buckets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		name := names[r.c.intn(len(names))]
+		path = append(path, name)
+		m = m.buckets[name]
+	}
+	return path, m
+}
+
+// 在写事务中打开路径对应的bucket, 路径为空时返回nil表示根
+func (r *modelRunner) bucket(path []string) *pddb.Bucket {
+	var b *pddb.Bucket
+	for _, name := range path {
+		if b == nil {
+			b = r.tx.Bucket([]byte(name))
+		} else {
+			b = b.Bucket([]byte(name))
+		}
+		if b == nil {
+			r.fatalf("bucket %v not found", path)
+		}
+	}
+	return b
+}
+
+// 执行一个随机操作并检查结果
+func (r *modelRunner) step() {
+	r.t.Helper()
+	r.n++
+
+	if r.tx == nil {
+		switch r.c.intn(8) {
+		case 0:
+			// 重新打开后数据不变
+			if err := r.db.Close(); err != nil {
+				r.fatalf("close: %v", err)
+			}
+			r.open()
+			r.verifyCommitted()
+		case 1:
+			// 截断文件后数据不变
+			if err := r.db.Shrink(); err != nil {
+				r.fatalf("shrink: %v", err)
+			}
+			r.verifyCommitted()
+		default:
+			tx, err := r.db.Begin(true)
+			if err != nil {
+				r.fatalf("begin: %v", err)
+			}
+			r.tx = tx
+			r.pending = r.committed.clone()
+		}
+		return
+	}
+
+	path, m := r.bucketPath()
+	b := r.bucket(path)
+	name := r.name()
+	switch op := r.c.intn(16); {
+	case op < 6:
+		value := r.value()
+		var err error
+		if b == nil {
+			// 根bucket不能保存key, 改为创建bucket
+			_, err = r.tx.CreateBucket([]byte(name))
+			r.expect("create bucket", err, m, name, true)
+		} else {
+			err = b.Put([]byte(name), []byte(value))
+			if r.expect("put", err, m, name, false) {
+				m.values[name] = value
+			}
+		}
+	case op < 8:
+		if b == nil {
+			return
+		}
+		err := b.Delete([]byte(name))
+		if _, isBucket := m.buckets[name]; isBucket {
+			if err != pddb.ErrIncompatibleValue {
+				r.fatalf("delete %v/%s: unexpected error: %v", path, name, err)
+			}
+		} else if err != nil {
+			r.fatalf("delete %v/%s: %v", path, name, err)
+		}
+		delete(m.values, name)
+	case op < 10:
+		var err error
+		if b == nil {
+			_, err = r.tx.CreateBucket([]byte(name))
+		} else {
+			_, err = b.CreateBucket([]byte(name))
+		}
+		r.expect("create bucket", err, m, name, true)
+	case op < 11:
+		var err error
+		if b == nil {
+			err = r.tx.DeleteBucket([]byte(name))
+		} else {
+			err = b.DeleteBucket([]byte(name))
+		}
+		_, isValue := m.values[name]
+		_, isBucket := m.buckets[name]
+		switch {
+		case isValue && err != pddb.ErrIncompatibleValue:
+			r.fatalf("delete bucket %v/%s: unexpected error: %v", path, name, err)
+		case !isValue && !isBucket && err != pddb.ErrBucketNotFound:
+			r.fatalf("delete bucket %v/%s: unexpected error: %v", path, name, err)
+		case isBucket && err != nil:
+			r.fatalf("delete bucket %v/%s: %v", path, name, err)
+		}
+		delete(m.buckets, name)
+	case op < 14:
+		if b == nil {
+			if got := r.tx.Bucket([]byte(name)); (got != nil) != (m.buckets[name] != nil) {
+				r.fatalf("bucket %s: unexpected result %v", name, got)
+			}
+		} else if got, want := b.Get([]byte(name)), m.values[name]; string(got) != want {
+			r.fatalf("get %v/%s: got %d bytes, want %d", path, name, len(got), len(want))
+		}
+	case op < 15:
+		if err := r.tx.Commit(); err != nil {
+			r.fatalf("commit: %v", err)
+		}
+		r.tx = nil
+		r.committed, r.pending = r.pending, nil
+		r.verifyCommitted()
+	default:
+		if err := r.tx.Rollback(); err != nil {
+			r.fatalf("rollback: %v", err)
+		}
+		r.tx, r.pending = nil, nil
+		r.verifyCommitted()
+	}
+
+	// 每个操作之后事务中可见的数据与模型相同
+	if r.tx != nil {
+		r.verify(r.tx, r.pending)
+	}
+}
+
+// 根据模型检查写入bucket或者value的结果, 返回操作是否应该成功
+// 创建bucket成功时同时更新模型
+func (r *modelRunner) expect(op string, err error, m *modelBucket, name string, bucket bool) bool {
+	r.t.Helper()
+	_, isValue := m.values[name]
+	_, isBucket := m.buckets[name]
+
+	var want error
+	switch {
+	case bucket && isBucket:
+		want = pddb.ErrBucketExists
+	case bucket && isValue, !bucket && isBucket:
+		want = pddb.ErrIncompatibleValue
+	}
+	if err != want {
+		r.fatalf("%s %s: unexpected error: %v, want %v", op, name, err, want)
+	}
+	if err == nil && bucket {
+		m.buckets[name] = newModelBucket()
+	}
+	return err == nil
+}
+
+// 在只读事务中检查已提交的数据和页的一致性
+func (r *modelRunner) verifyCommitted() {
+	r.t.Helper()
+	if err := r.db.View(func(tx *pddb.Tx) error {
+		r.verify(tx, r.committed)
+		return tx.Check()
+	}); err != nil {
+		r.fatalf("check: %v", err)
+	}
+}
+
+// 事务中可见的数据与模型完全相同
+func (r *modelRunner) verify(tx *pddb.Tx, m *modelBucket) {
+	r.t.Helper()
+	var names []string
+	if err := tx.ForEach(func(name []byte, b *pddb.Bucket) error {
+		names = append(names, string(name))
+		child, ok := m.buckets[string(name)]
+		if !ok {
+			return fmt.Errorf("unexpected bucket %s", name)
+		}
+		return r.verifyBucket(b, child, string(name))
+	}); err != nil {
+		r.fatalf("verify: %v", err)
+	}
+	if len(names) != len(m.buckets) {
+		r.fatalf("verify: got buckets %v, want %d", names, len(m.buckets))
+	}
+}
+
+func (r *modelRunner) verifyBucket(b *pddb.Bucket, m *modelBucket, path string) error {
+	values, buckets := 0, 0
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil {
+			child, ok := m.buckets[string(k)]
+			if !ok {
+				return fmt.Errorf("%s: unexpected bucket %s", path, k)
+			}
+			if err := r.verifyBucket(b.Bucket(k), child, path+"/"+string(k)); err != nil {
+				return err
+			}
+			buckets++
+			continue
+		}
+		if want, ok := m.values[string(k)]; !ok {
+			return fmt.Errorf("%s: unexpected key %s", path, k)
+		} else if string(v) != want {
+			return fmt.Errorf("%s: key %s has %d bytes, want %d", path, k, len(v), len(want))
+		} else if got := b.Get(k); string(got) != want {
+			return fmt.Errorf("%s: get %s returned %d bytes, want %d", path, k, len(got), len(want))
+		}
+		values++
+	}
+	if values != len(m.values) || buckets != len(m.buckets) {
+		return fmt.Errorf("%s: got %d keys and %d buckets, want %d and %d", path, values, buckets, len(m.values), len(m.buckets))
+	}
+	return nil
+}
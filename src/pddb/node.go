@@ -29,6 +29,57 @@ func (n *node) root() *node {
 	return n.parent.root()
 }
 
+// 节点允许的最少key数量
+func (n *node) minKeys() int {
+	if n.isLeaf {
+		return 1
+	}
+	return 2
+}
+
+// 返回指定位置的子节点
+func (n *node) childAt(index int) *node {
+	if n.isLeaf {
+		panic(fmt.Sprintf("invalid childAt(%d) on a leaf node", index))
+	}
+	return n.bucket.node(n.inodes[index].pgid, n)
+}
+
+// 返回子节点在父节点中的位置
+func (n *node) childIndex(child *node) int {
+	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, child.key) != -1 })
+	return index
+}
+
+// 子节点数量
+func (n *node) numChildren() int {
+	return len(n.inodes)
+}
+
+// 同一父节点下的后一个兄弟节点
+func (n *node) nextSibling() *node {
+	if n.parent == nil {
+		return nil
+	}
+	index := n.parent.childIndex(n)
+	if index >= n.parent.numChildren()-1 {
+		return nil
+	}
+	return n.parent.childAt(index + 1)
+}
+
+// 同一父节点下的前一个兄弟节点
+func (n *node) prevSibling() *node {
+	if n.parent == nil {
+		return nil
+	}
+	index := n.parent.childIndex(n)
+	if index == 0 {
+		return nil
+	}
+	return n.parent.childAt(index - 1)
+}
+
 // 将node写入page
 func (n *node) write(p *page) {
 	if n.isLeaf {
@@ -74,9 +125,6 @@ func (n *node) write(p *page) {
 		copy(b[0:], item.value)
 		b = b[len(item.value):]
 	}
-
-	// FOR DEBUG
-	n.dump()
 }
 
 // 从page初始化node
@@ -135,6 +183,21 @@ func (n *node) put(oldKey, newKey, value []byte, pgid pgid, flags uint32) {
 	inode.pgid = pgid
 }
 
+// 从node中删除key
+func (n *node) del(key []byte) {
+	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, key) != -1 })
+
+	// key不存在直接返回
+	if index >= len(n.inodes) || !bytes.Equal(n.inodes[index].key, key) {
+		return
+	}
+
+	n.inodes = append(n.inodes[:index], n.inodes[index+1:]...)
+
+	// 标记需要重新平衡
+	n.unbalanced = true
+}
+
 // 节点数量不足时与兄弟节点结合
 func (n *node) rebalance() {
 	if !n.unbalanced {
@@ -142,7 +205,112 @@ func (n *node) rebalance() {
 	}
 	n.unbalanced = false
 
-	// TODO rebalance
+	// 节点大小超过阈值且key数量足够时无需处理
+	var threshold = n.bucket.tx.db.pageSize / 4
+	if n.size() > threshold && len(n.inodes) > n.minKeys() {
+		return
+	}
+
+	// 根节点特殊处理
+	if n.parent == nil {
+		// 根节点是只有一个子节点的分支节点时, 将子节点提升为根节点
+		if !n.isLeaf && len(n.inodes) == 1 {
+			child := n.bucket.node(n.inodes[0].pgid, n)
+			n.isLeaf = child.isLeaf
+			n.inodes = child.inodes[:]
+			n.children = child.children
+
+			// 重新设置被移动节点的父节点
+			for _, inode := range n.inodes {
+				if child, ok := n.bucket.nodes[inode.pgid]; ok {
+					child.parent = n
+				}
+			}
+
+			// 移除旧的子节点
+			child.parent = nil
+			delete(n.bucket.nodes, child.pgid)
+			child.free()
+		}
+
+		return
+	}
+
+	// 没有key的节点直接删除
+	if n.numChildren() == 0 {
+		n.parent.del(n.key)
+		n.parent.removeChild(n)
+		delete(n.bucket.nodes, n.pgid)
+		n.free()
+		n.parent.rebalance()
+		return
+	}
+
+	if n.parent.numChildren() <= 1 {
+		panic("parent must have at least 2 children")
+	}
+
+	// 第一个子节点与右兄弟合并, 其余节点与左兄弟合并
+	var target *node
+	var useNextSibling = (n.parent.childIndex(n) == 0)
+	if useNextSibling {
+		target = n.nextSibling()
+	} else {
+		target = n.prevSibling()
+	}
+
+	if useNextSibling {
+		// 重新设置被移动节点的父节点
+		for _, inode := range target.inodes {
+			if child, ok := n.bucket.nodes[inode.pgid]; ok {
+				child.parent.removeChild(child)
+				child.parent = n
+				child.parent.children = append(child.parent.children, child)
+			}
+		}
+
+		// 复制目标节点的数据并删除目标节点
+		n.inodes = append(n.inodes, target.inodes...)
+		n.parent.del(target.key)
+		n.parent.removeChild(target)
+		delete(n.bucket.nodes, target.pgid)
+		target.free()
+	} else {
+		for _, inode := range n.inodes {
+			if child, ok := n.bucket.nodes[inode.pgid]; ok {
+				child.parent.removeChild(child)
+				child.parent = target
+				child.parent.children = append(child.parent.children, child)
+			}
+		}
+
+		target.inodes = append(target.inodes, n.inodes...)
+		n.parent.del(n.key)
+		n.parent.removeChild(n)
+		delete(n.bucket.nodes, n.pgid)
+		n.free()
+	}
+
+	// 父节点删除了子节点, 同样需要重新平衡
+	n.parent.rebalance()
+}
+
+// 移除子节点的引用
+func (n *node) removeChild(target *node) {
+	for i, child := range n.children {
+		if child == target {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// 将node对应的page加入freelist
+func (n *node) free() {
+	if n.pgid != 0 {
+		n.bucket.tx.db.freelist.free(n.bucket.tx.meta.txid, n.bucket.tx.page(n.pgid))
+		n.pgid = 0
+	}
 }
 
 // 将node写入脏页, 如果脏页无法分配则报错
@@ -163,15 +331,15 @@ func (n *node) spill() error {
 	// 不再需要对于子节点的引用, 因为子节点仅在spill过程中进行追踪
 	n.children = nil
 
-	// 将node分割成适当的大小
-	var nodes = n.split(tx.db.pageSize)
+	// 将node分割成适当的大小, page末尾需要为加密保留空间
+	var nodes = n.split(tx.db.pageSize - tx.db.pageReserve)
 	for _, node := range nodes {
 		if node.pgid > 0 {
 			tx.db.freelist.free(tx.meta.txid, tx.page(node.pgid))
 			node.pgid = 0
 		}
 		// 为node分配连续空间
-		p, err := tx.allocate((node.size() / tx.db.pageSize) + 1)
+		p, err := tx.allocate(tx.db.pageCount(node.size()))
 		if err != nil {
 			return err
 		}
@@ -1,6 +1,7 @@
 package pddb
 
 import (
+	"fmt"
 	"testing"
 	"unsafe"
 )
@@ -154,3 +155,27 @@ func TestNode_split_SinglePage(t *testing.T) {
 		t.Fatalf("expected nil parent")
 	}
 }
+
+func BenchmarkNode_split100(b *testing.B)   { benchmarkNodeSplit(b, 100) }
+func BenchmarkNode_split1000(b *testing.B)  { benchmarkNodeSplit(b, 1000) }
+func BenchmarkNode_split10000(b *testing.B) { benchmarkNodeSplit(b, 10000) }
+
+// 将包含size个key的node分割成4096字节的page
+func benchmarkNodeSplit(b *testing.B, size int) {
+	bucket := &Bucket{tx: &Tx{db: &DB{}, meta: &meta{pgid: 1}}}
+	inodes := make(inodes, size)
+	for i := range inodes {
+		key := []byte(fmt.Sprintf("%08d", i))
+		inodes[i] = inode{key: key, value: []byte("0123456701234567")}
+	}
+
+	n := &node{bucket: bucket, isLeaf: true}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.inodes = inodes
+		n.parent = nil
+		if nodes := n.split(4096); size > 100 && len(nodes) < 2 {
+			b.Fatalf("unexpected node count: %d", len(nodes))
+		}
+	}
+}
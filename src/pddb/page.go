@@ -18,10 +18,13 @@ const (
 	leafPageFlag     = 0x02
 	metaPageFlag     = 0x04
 	freelistPageFlag = 0x10
+	blobPageFlag     = 0x20
 )
 
 const (
-	bucketLeafFlag = 0x01
+	bucketLeafFlag      = 0x01
+	compressedValueFlag = 0x02
+	blobValueFlag       = 0x04
 )
 
 type pgid uint64
@@ -53,6 +56,13 @@ func (p *page) branchPageElement(index uint16) *branchPageElement {
 	return &((*[0x7FFFFFF]branchPageElement)(unsafe.Pointer(&p.ptr)))[index]
 }
 
+func (p *page) branchPageElements() []branchPageElement {
+	if p.count == 0 {
+		return nil
+	}
+	return ((*[0x7FFFFFF]branchPageElement)(unsafe.Pointer(&p.ptr)))[:]
+}
+
 type leafPageElement struct {
 	flags uint32
 	pos   uint32
@@ -87,6 +97,19 @@ func (s pgids) Len() int           { return len(s) }
 func (s pgids) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s pgids) Less(i, j int) bool { return s[i] < s[j] }
 
+// 合并两个有序的pgid列表
+func (a pgids) merge(b pgids) pgids {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	merged := make(pgids, len(a)+len(b))
+	mergepgids(merged, a, b)
+	return merged
+}
+
 type pages []*page
 
 func (s pages) Len() int           { return len(s) }
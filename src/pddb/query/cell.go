@@ -0,0 +1,272 @@
+package query
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 单元格的数据类型
+type Type byte
+
+const (
+	// 空值, 用作列类型时表示该列可以保存任意类型
+	TypeNull Type = iota
+	TypeInt
+	TypeFloat
+	TypeString
+	TypeBytes
+	TypeBool
+)
+
+var typeNames = [...]string{
+	TypeNull:   "any",
+	TypeInt:    "int",
+	TypeFloat:  "float",
+	TypeString: "string",
+	TypeBytes:  "bytes",
+	TypeBool:   "bool",
+}
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return "type(" + strconv.Itoa(int(t)) + ")"
+}
+
+func (t Type) MarshalText() ([]byte, error) {
+	if int(t) >= len(typeNames) {
+		return nil, ErrUnknownType
+	}
+	return []byte(typeNames[t]), nil
+}
+
+func (t *Type) UnmarshalText(text []byte) error {
+	v, err := ParseType(string(text))
+	*t = v
+	return err
+}
+
+// 根据名称返回类型, 不区分大小写, 支持常见的SQL类型名称
+func ParseType(name string) (Type, error) {
+	switch strings.ToLower(name) {
+	case "any", "":
+		return TypeNull, nil
+	case "int", "integer", "bigint":
+		return TypeInt, nil
+	case "float", "real", "double":
+		return TypeFloat, nil
+	case "string", "text", "varchar":
+		return TypeString, nil
+	case "bytes", "blob":
+		return TypeBytes, nil
+	case "bool", "boolean":
+		return TypeBool, nil
+	}
+	return TypeNull, ErrUnknownType
+}
+
+// 单元格, 根据Type使用对应的字段保存值
+// 整数和布尔值保存在Int中, 字符串和二进制数据保存在Bytes中
+type Cell struct {
+	Type  Type
+	Int   int64
+	Float float64
+	Bytes []byte
+}
+
+func Null() Cell              { return Cell{} }
+func Int(v int64) Cell        { return Cell{Type: TypeInt, Int: v} }
+func Float(v float64) Cell    { return Cell{Type: TypeFloat, Float: v} }
+func String(v string) Cell    { return Cell{Type: TypeString, Bytes: []byte(v)} }
+func Bytes(v []byte) Cell     { return Cell{Type: TypeBytes, Bytes: v} }
+func Bool(v bool) Cell        { return Cell{Type: TypeBool, Int: boolToInt(v)} }
+func (c Cell) IsNull() bool   { return c.Type == TypeNull }
+func (c Cell) isNumber() bool { return c.Type == TypeInt || c.Type == TypeFloat || c.Type == TypeBool }
+
+// 单元格是否为真, 空值, 0和空字符串为假
+func (c Cell) Truthy() bool {
+	switch c.Type {
+	case TypeInt, TypeBool:
+		return c.Int != 0
+	case TypeFloat:
+		return c.Float != 0
+	case TypeString, TypeBytes:
+		return len(c.Bytes) > 0
+	}
+	return false
+}
+
+// 数值类型转换成浮点数
+func (c Cell) float() float64 {
+	if c.Type == TypeFloat {
+		return c.Float
+	}
+	return float64(c.Int)
+}
+
+// 比较两个单元格, 空值最小, 数值之间按大小比较, 字符串和二进制数据按字节比较
+// 其他不同类型之间按类型排序
+func (c Cell) Compare(other Cell) int {
+	switch {
+	case c.isNumber() && other.isNumber():
+		if c.Type != TypeFloat && other.Type != TypeFloat {
+			return compareInt(c.Int, other.Int)
+		}
+		a, b := c.float(), other.float()
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case isText(c.Type) && isText(other.Type):
+		return bytes.Compare(c.Bytes, other.Bytes)
+	case c.Type != other.Type:
+		return compareInt(int64(c.Type), int64(other.Type))
+	}
+	return 0
+}
+
+// 转换成可读的字符串, 二进制数据使用十六进制
+func (c Cell) String() string {
+	switch c.Type {
+	case TypeInt:
+		return strconv.FormatInt(c.Int, 10)
+	case TypeFloat:
+		return strconv.FormatFloat(c.Float, 'g', -1, 64)
+	case TypeString:
+		return string(c.Bytes)
+	case TypeBytes:
+		return hex.EncodeToString(c.Bytes)
+	case TypeBool:
+		return strconv.FormatBool(c.Int != 0)
+	}
+	return "NULL"
+}
+
+// 将单元格转换成列的类型, 整数可以转换成浮点数, 空值可以保存到任意列
+func (c Cell) Convert(t Type) (Cell, error) {
+	switch {
+	case t == TypeNull || c.Type == TypeNull || c.Type == t:
+		return c, nil
+	case t == TypeFloat && c.Type == TypeInt:
+		return Float(float64(c.Int)), nil
+	}
+	return c, ErrTypeMismatch
+}
+
+// 一行数据, Key是行在表中的key, 由运算产生的行Key为nil
+type Row struct {
+	Key   []byte
+	Cells []Cell
+}
+
+// 编码行, 行的编码: 单元格数量 + (类型 + 值)...
+// 整数使用zigzag变长编码, 浮点数使用8字节大端, 字符串和二进制数据使用长度 + 内容
+func EncodeRow(cells []Cell) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(cells)))
+	for _, c := range cells {
+		buf = append(buf, byte(c.Type))
+		switch c.Type {
+		case TypeInt, TypeBool:
+			buf = binary.AppendVarint(buf, c.Int)
+		case TypeFloat:
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(c.Float))
+		case TypeString, TypeBytes:
+			buf = binary.AppendUvarint(buf, uint64(len(c.Bytes)))
+			buf = append(buf, c.Bytes...)
+		}
+	}
+	return buf
+}
+
+// 解码EncodeRow编码的行, 字符串和二进制数据会被复制, 返回的单元格在事务结束后仍然有效
+func DecodeRow(buf []byte) ([]Cell, error) {
+	n, sz := binary.Uvarint(buf)
+	if sz <= 0 || n > uint64(len(buf)) {
+		return nil, ErrInvalidRow
+	}
+	buf = buf[sz:]
+
+	cells := make([]Cell, n)
+	for i := range cells {
+		if len(buf) == 0 {
+			return nil, ErrInvalidRow
+		}
+		c := Cell{Type: Type(buf[0])}
+		buf = buf[1:]
+		switch c.Type {
+		case TypeNull:
+		case TypeInt, TypeBool:
+			if c.Int, sz = binary.Varint(buf); sz <= 0 {
+				return nil, ErrInvalidRow
+			}
+			buf = buf[sz:]
+		case TypeFloat:
+			if len(buf) < 8 {
+				return nil, ErrInvalidRow
+			}
+			c.Float = math.Float64frombits(binary.BigEndian.Uint64(buf))
+			buf = buf[8:]
+		case TypeString, TypeBytes:
+			l, sz := binary.Uvarint(buf)
+			if sz <= 0 || l > uint64(len(buf)-sz) {
+				return nil, ErrInvalidRow
+			}
+			c.Bytes = append([]byte{}, buf[sz:sz+int(l)]...)
+			buf = buf[sz+int(l):]
+		default:
+			return nil, ErrInvalidRow
+		}
+		cells[i] = c
+	}
+	if len(buf) != 0 {
+		return nil, ErrInvalidRow
+	}
+	return cells, nil
+}
+
+// 将单元格编码成保持顺序的key, 编码后的字节顺序与Compare的顺序一致
+// 整数和浮点数不能混合作为同一列的key, 空值不能作为key
+func EncodeKey(c Cell) ([]byte, error) {
+	switch c.Type {
+	case TypeInt, TypeBool:
+		// 翻转符号位, 负数排在正数之前
+		return binary.BigEndian.AppendUint64(nil, uint64(c.Int)^(1<<63)), nil
+	case TypeFloat:
+		// 正数翻转符号位, 负数翻转所有位
+		bits := math.Float64bits(c.Float)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(nil, bits), nil
+	case TypeString, TypeBytes:
+		return append([]byte{}, c.Bytes...), nil
+	}
+	return nil, ErrTypeMismatch
+}
+
+func isText(t Type) bool { return t == TypeString || t == TypeBytes }
+
+func compareInt(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func boolToInt(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
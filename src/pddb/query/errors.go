@@ -0,0 +1,31 @@
+package query
+
+import "errors"
+
+// 表错误
+var (
+	// 表不存在, 或者bucket不是用CreateTable创建的
+	ErrTableNotFound = errors.New("table not found")
+	// 表已经存在
+	ErrTableExists = errors.New("table exists")
+	// 列名不可为空且不能重复
+	ErrInvalidColumn = errors.New("invalid column")
+	// 行的单元格数量与表的列数量不一致
+	ErrColumnCount = errors.New("column count mismatch")
+	// 单元格类型与列类型不一致, 或者运算的类型不支持
+	ErrTypeMismatch = errors.New("type mismatch")
+	// 未知的类型名称
+	ErrUnknownType = errors.New("unknown type")
+	// 行数据格式错误
+	ErrInvalidRow = errors.New("invalid row")
+	// 行不存在
+	ErrRowNotFound = errors.New("row not found")
+)
+
+// 运算错误
+var (
+	// 整数除以0
+	ErrDivideByZero = errors.New("divide by zero")
+	// 列序号超出行的范围
+	ErrColumnOutOfRange = errors.New("column out of range")
+)
@@ -0,0 +1,201 @@
+package query
+
+import "math"
+
+// 表达式, 根据输入行计算出一个单元格
+type Expr interface {
+	Eval(row *Row) (Cell, error)
+}
+
+// 使用函数实现的表达式, 用于计算自定义的列
+type ExprFunc func(row *Row) (Cell, error)
+
+func (fn ExprFunc) Eval(row *Row) (Cell, error) { return fn(row) }
+
+// 引用输入行的第i列
+func Col(i int) Expr { return colExpr(i) }
+
+type colExpr int
+
+func (e colExpr) Eval(row *Row) (Cell, error) {
+	if int(e) < 0 || int(e) >= len(row.Cells) {
+		return Cell{}, ErrColumnOutOfRange
+	}
+	return row.Cells[e], nil
+}
+
+// 常量
+func Const(c Cell) Expr { return constExpr(c) }
+
+type constExpr Cell
+
+func (e constExpr) Eval(row *Row) (Cell, error) { return Cell(e), nil }
+
+// 二元运算符
+type Op int
+
+const (
+	OpEq Op = iota
+	OpNe
+	OpLt
+	OpLe
+	OpGt
+	OpGe
+	OpAnd
+	OpOr
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+)
+
+var opNames = [...]string{
+	OpEq: "=", OpNe: "!=", OpLt: "<", OpLe: "<=", OpGt: ">", OpGe: ">=",
+	OpAnd: "AND", OpOr: "OR",
+	OpAdd: "+", OpSub: "-", OpMul: "*", OpDiv: "/", OpMod: "%",
+}
+
+func (op Op) String() string { return opNames[op] }
+
+// 二元运算
+// 比较和算术运算的任意一边为空值时结果为空值, 空值在筛选时视为假
+// AND和OR按照两边是否为真计算, 结果为布尔值
+func Binary(op Op, l, r Expr) Expr { return &binaryExpr{op: op, l: l, r: r} }
+
+type binaryExpr struct {
+	op   Op
+	l, r Expr
+}
+
+func (e *binaryExpr) Eval(row *Row) (Cell, error) {
+	l, err := e.l.Eval(row)
+	if err != nil {
+		return Cell{}, err
+	}
+
+	// 逻辑运算短路求值
+	switch e.op {
+	case OpAnd:
+		if !l.Truthy() {
+			return Bool(false), nil
+		}
+	case OpOr:
+		if l.Truthy() {
+			return Bool(true), nil
+		}
+	}
+
+	r, err := e.r.Eval(row)
+	if err != nil {
+		return Cell{}, err
+	}
+
+	switch e.op {
+	case OpAnd, OpOr:
+		return Bool(r.Truthy()), nil
+	}
+	if l.IsNull() || r.IsNull() {
+		return Null(), nil
+	}
+
+	switch e.op {
+	case OpEq:
+		return Bool(l.Compare(r) == 0), nil
+	case OpNe:
+		return Bool(l.Compare(r) != 0), nil
+	case OpLt:
+		return Bool(l.Compare(r) < 0), nil
+	case OpLe:
+		return Bool(l.Compare(r) <= 0), nil
+	case OpGt:
+		return Bool(l.Compare(r) > 0), nil
+	case OpGe:
+		return Bool(l.Compare(r) >= 0), nil
+	}
+	return arith(e.op, l, r)
+}
+
+// 算术运算, 两边都是整数时结果为整数, 否则为浮点数
+// 两个字符串相加时拼接
+func arith(op Op, l, r Cell) (Cell, error) {
+	if op == OpAdd && l.Type == TypeString && r.Type == TypeString {
+		return String(string(l.Bytes) + string(r.Bytes)), nil
+	}
+	if !l.isNumber() || !r.isNumber() {
+		return Cell{}, ErrTypeMismatch
+	}
+
+	if l.Type != TypeFloat && r.Type != TypeFloat {
+		a, b := l.Int, r.Int
+		switch op {
+		case OpAdd:
+			return Int(a + b), nil
+		case OpSub:
+			return Int(a - b), nil
+		case OpMul:
+			return Int(a * b), nil
+		}
+		if b == 0 {
+			return Cell{}, ErrDivideByZero
+		}
+		if op == OpDiv {
+			return Int(a / b), nil
+		}
+		return Int(a % b), nil
+	}
+
+	a, b := l.float(), r.float()
+	switch op {
+	case OpAdd:
+		return Float(a + b), nil
+	case OpSub:
+		return Float(a - b), nil
+	case OpMul:
+		return Float(a * b), nil
+	case OpDiv:
+		return Float(a / b), nil
+	}
+	return Float(math.Mod(a, b)), nil
+}
+
+// 逻辑非, 空值的结果仍为空值
+func Not(e Expr) Expr {
+	return ExprFunc(func(row *Row) (Cell, error) {
+		c, err := e.Eval(row)
+		if err != nil || c.IsNull() {
+			return c, err
+		}
+		return Bool(!c.Truthy()), nil
+	})
+}
+
+// 取负数
+func Neg(e Expr) Expr {
+	return ExprFunc(func(row *Row) (Cell, error) {
+		c, err := e.Eval(row)
+		if err != nil {
+			return c, err
+		}
+		switch c.Type {
+		case TypeNull:
+			return c, nil
+		case TypeInt, TypeBool:
+			return Int(-c.Int), nil
+		case TypeFloat:
+			return Float(-c.Float), nil
+		}
+		return Cell{}, ErrTypeMismatch
+	})
+}
+
+// 判断是否为空值
+func IsNull(e Expr) Expr {
+	return ExprFunc(func(row *Row) (Cell, error) {
+		c, err := e.Eval(row)
+		if err != nil {
+			return c, err
+		}
+		return Bool(c.IsNull()), nil
+	})
+}
@@ -0,0 +1,382 @@
+// query包在bucket之上提供简单的关系查询
+//
+// 表以bucket保存, 每行编码成一个value. 查询由操作符组合而成, 每个操作符从子操作符
+// 逐行读取数据(Volcano模型), 扫描操作符通过Cursor读取表中的行:
+//
+//	op := query.Limit(query.Sort(query.Filter(query.Scan(t), pred), keys...), 0, 10)
+//	rs, err := query.Collect(op)
+//
+// 操作符只在创建它的事务期间有效
+package query
+
+import (
+	"bytes"
+	"pddb"
+	"sort"
+)
+
+// 操作符, 使用前调用Open, 使用后调用Close
+type Operator interface {
+	// 输出行的列
+	Columns() []Column
+	Open() error
+	// 返回下一行, 没有更多的行时返回nil
+	Next() (*Row, error)
+	Close() error
+}
+
+// 查询结果
+type RowSet struct {
+	Columns []Column
+	Rows    []*Row
+}
+
+// 执行操作符并读取所有的行
+func Collect(op Operator) (*RowSet, error) {
+	if err := op.Open(); err != nil {
+		op.Close()
+		return nil, err
+	}
+
+	rs := &RowSet{Columns: op.Columns()}
+	for {
+		row, err := op.Next()
+		if err != nil {
+			op.Close()
+			return nil, err
+		} else if row == nil {
+			break
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+	return rs, op.Close()
+}
+
+// key范围, Start包含在范围内, End不包含在范围内, nil表示不限制
+type Range struct {
+	Start []byte
+	End   []byte
+}
+
+// 按照key的顺序读取bucket中的行
+type ScanOperator struct {
+	bucket  *pddb.Bucket
+	columns []Column
+	rng     Range
+	cursor  *pddb.Cursor
+}
+
+// 读取表中所有的行
+func Scan(t *Table) *ScanOperator {
+	return RangeScan(t.rows, t.columns, Range{})
+}
+
+// 读取bucket中key在范围内的行, value必须是EncodeRow编码的行
+func RangeScan(b *pddb.Bucket, columns []Column, r Range) *ScanOperator {
+	return &ScanOperator{bucket: b, columns: columns, rng: r}
+}
+
+func (op *ScanOperator) Columns() []Column { return op.columns }
+
+func (op *ScanOperator) Open() error {
+	op.cursor = nil
+	return nil
+}
+
+func (op *ScanOperator) Next() (*Row, error) {
+	var k, v []byte
+	if op.cursor == nil {
+		op.cursor = op.bucket.Cursor()
+		if op.rng.Start != nil {
+			k, v = op.cursor.Seek(op.rng.Start)
+		} else {
+			k, v = op.cursor.First()
+		}
+	} else {
+		k, v = op.cursor.Next()
+	}
+	if k == nil || (op.rng.End != nil && bytes.Compare(k, op.rng.End) >= 0) {
+		return nil, nil
+	}
+
+	cells, err := DecodeRow(v)
+	if err != nil {
+		return nil, err
+	} else if len(cells) != len(op.columns) {
+		return nil, ErrInvalidRow
+	}
+	return &Row{Key: append([]byte{}, k...), Cells: cells}, nil
+}
+
+func (op *ScanOperator) Close() error { return nil }
+
+// 读取内存中的行, 用于查询不在表中的数据
+type ValuesOperator struct {
+	columns []Column
+	rows    []*Row
+	index   int
+}
+
+func Values(columns []Column, rows []*Row) *ValuesOperator {
+	return &ValuesOperator{columns: columns, rows: rows}
+}
+
+func (op *ValuesOperator) Columns() []Column { return op.columns }
+
+func (op *ValuesOperator) Open() error {
+	op.index = 0
+	return nil
+}
+
+func (op *ValuesOperator) Next() (*Row, error) {
+	if op.index >= len(op.rows) {
+		return nil, nil
+	}
+	op.index++
+	return op.rows[op.index-1], nil
+}
+
+func (op *ValuesOperator) Close() error { return nil }
+
+// 筛选出表达式为真的行
+type FilterOperator struct {
+	child Operator
+	pred  Expr
+}
+
+func Filter(child Operator, pred Expr) *FilterOperator {
+	return &FilterOperator{child: child, pred: pred}
+}
+
+func (op *FilterOperator) Columns() []Column { return op.child.Columns() }
+func (op *FilterOperator) Open() error       { return op.child.Open() }
+func (op *FilterOperator) Close() error      { return op.child.Close() }
+
+func (op *FilterOperator) Next() (*Row, error) {
+	for {
+		row, err := op.child.Next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		c, err := op.pred.Eval(row)
+		if err != nil {
+			return nil, err
+		} else if c.Truthy() {
+			return row, nil
+		}
+	}
+}
+
+// 投影中的一列
+type Projection struct {
+	Name string
+	Type Type
+	Expr Expr
+}
+
+// 根据表达式计算出新的行, 输出行保留输入行的Key
+type ProjectionOperator struct {
+	child   Operator
+	exprs   []Expr
+	columns []Column
+}
+
+func Project(child Operator, projections ...Projection) *ProjectionOperator {
+	op := &ProjectionOperator{child: child}
+	for _, p := range projections {
+		op.exprs = append(op.exprs, p.Expr)
+		op.columns = append(op.columns, Column{Name: p.Name, Type: p.Type})
+	}
+	return op
+}
+
+// 按照序号选择子操作符的列
+func Select(child Operator, indexes ...int) *ProjectionOperator {
+	columns := child.Columns()
+	projections := make([]Projection, len(indexes))
+	for i, index := range indexes {
+		p := Projection{Expr: Col(index)}
+		if index >= 0 && index < len(columns) {
+			p.Name, p.Type = columns[index].Name, columns[index].Type
+		}
+		projections[i] = p
+	}
+	return Project(child, projections...)
+}
+
+func (op *ProjectionOperator) Columns() []Column { return op.columns }
+func (op *ProjectionOperator) Open() error       { return op.child.Open() }
+func (op *ProjectionOperator) Close() error      { return op.child.Close() }
+
+func (op *ProjectionOperator) Next() (*Row, error) {
+	row, err := op.child.Next()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	cells, err := evalAll(op.exprs, row)
+	if err != nil {
+		return nil, err
+	}
+	return &Row{Key: row.Key, Cells: cells}, nil
+}
+
+// 在输入行的末尾追加计算出的列
+type ComputeOperator struct {
+	child   Operator
+	expr    Expr
+	columns []Column
+}
+
+func Compute(child Operator, column Column, expr Expr) *ComputeOperator {
+	columns := append(append([]Column{}, child.Columns()...), column)
+	return &ComputeOperator{child: child, expr: expr, columns: columns}
+}
+
+func (op *ComputeOperator) Columns() []Column { return op.columns }
+func (op *ComputeOperator) Open() error       { return op.child.Open() }
+func (op *ComputeOperator) Close() error      { return op.child.Close() }
+
+func (op *ComputeOperator) Next() (*Row, error) {
+	row, err := op.child.Next()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	c, err := op.expr.Eval(row)
+	if err != nil {
+		return nil, err
+	}
+	cells := append(append(make([]Cell, 0, len(row.Cells)+1), row.Cells...), c)
+	return &Row{Key: row.Key, Cells: cells}, nil
+}
+
+// 排序键, Desc为true时降序
+type SortKey struct {
+	Expr Expr
+	Desc bool
+}
+
+// 按照排序键排序, Open时读取子操作符的所有行, 相等的行保持原来的顺序
+type SortOperator struct {
+	child Operator
+	keys  []SortKey
+	rows  []*Row
+	index int
+}
+
+func Sort(child Operator, keys ...SortKey) *SortOperator {
+	return &SortOperator{child: child, keys: keys}
+}
+
+func (op *SortOperator) Columns() []Column { return op.child.Columns() }
+
+func (op *SortOperator) Open() error {
+	if err := op.child.Open(); err != nil {
+		return err
+	}
+
+	// 每行的排序键只计算一次
+	type sortRow struct {
+		row  *Row
+		keys []Cell
+	}
+	var rows []sortRow
+	exprs := make([]Expr, len(op.keys))
+	for i, k := range op.keys {
+		exprs[i] = k.Expr
+	}
+	for {
+		row, err := op.child.Next()
+		if err != nil {
+			return err
+		} else if row == nil {
+			break
+		}
+		keys, err := evalAll(exprs, row)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, sortRow{row: row, keys: keys})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		for n, k := range op.keys {
+			c := rows[i].keys[n].Compare(rows[j].keys[n])
+			if k.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	op.rows, op.index = make([]*Row, len(rows)), 0
+	for i := range rows {
+		op.rows[i] = rows[i].row
+	}
+	return nil
+}
+
+func (op *SortOperator) Next() (*Row, error) {
+	if op.index >= len(op.rows) {
+		return nil, nil
+	}
+	op.index++
+	return op.rows[op.index-1], nil
+}
+
+func (op *SortOperator) Close() error {
+	op.rows = nil
+	return op.child.Close()
+}
+
+// 跳过前offset行, 最多返回limit行, limit小于0时不限制数量
+type LimitOperator struct {
+	child         Operator
+	offset, limit int
+	n             int
+}
+
+func Limit(child Operator, offset, limit int) *LimitOperator {
+	return &LimitOperator{child: child, offset: offset, limit: limit}
+}
+
+func (op *LimitOperator) Columns() []Column { return op.child.Columns() }
+func (op *LimitOperator) Close() error      { return op.child.Close() }
+
+func (op *LimitOperator) Open() error {
+	op.n = 0
+	return op.child.Open()
+}
+
+func (op *LimitOperator) Next() (*Row, error) {
+	for op.n < op.offset {
+		row, err := op.child.Next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		op.n++
+	}
+	if op.limit >= 0 && op.n >= op.offset+op.limit {
+		return nil, nil
+	}
+	row, err := op.child.Next()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	op.n++
+	return row, nil
+}
+
+// 对同一行计算多个表达式
+func evalAll(exprs []Expr, row *Row) ([]Cell, error) {
+	cells := make([]Cell, len(exprs))
+	for i, e := range exprs {
+		var err error
+		if cells[i], err = e.Eval(row); err != nil {
+			return nil, err
+		}
+	}
+	return cells, nil
+}
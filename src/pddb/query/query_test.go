@@ -0,0 +1,243 @@
+package query_test
+
+import (
+	"path/filepath"
+	"pddb"
+	"pddb/query"
+	"reflect"
+	"testing"
+)
+
+// 在临时目录中打开数据库
+func openDB(t *testing.T) *pddb.DB {
+	db, err := pddb.Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+var peopleColumns = []query.Column{
+	{Name: "name", Type: query.TypeString},
+	{Name: "age", Type: query.TypeInt},
+	{Name: "score", Type: query.TypeFloat},
+}
+
+// 创建people表并写入测试数据
+func createPeople(t *testing.T, db *pddb.DB) {
+	if err := db.Update(func(tx *pddb.Tx) error {
+		tbl, err := query.CreateTable(tx, []byte("people"), peopleColumns)
+		if err != nil {
+			return err
+		}
+		for _, row := range [][]query.Cell{
+			{query.String("alice"), query.Int(31), query.Float(88.5)},
+			{query.String("bob"), query.Int(25), query.Int(72)},
+			{query.String("carol"), query.Int(42), query.Float(91)},
+			{query.String("dave"), query.Null(), query.Float(60)},
+			{query.String("erin"), query.Int(25), query.Float(95)},
+		} {
+			if _, err := tbl.Insert(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 将结果转换成字符串, 方便比较
+func rowStrings(rs *query.RowSet) [][]string {
+	out := make([][]string, len(rs.Rows))
+	for i, row := range rs.Rows {
+		for _, c := range row.Cells {
+			out[i] = append(out[i], c.String())
+		}
+	}
+	return out
+}
+
+// 测试表的创建和行的读写
+func TestTable(t *testing.T) {
+	db := openDB(t)
+	createPeople(t, db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if _, err := query.CreateTable(tx, []byte("people"), peopleColumns); err != query.ErrTableExists {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := query.CreateTable(tx, []byte("bad"), []query.Column{{Name: "a"}, {Name: "a"}}); err != query.ErrInvalidColumn {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := query.OpenTable(tx, []byte("missing")); err != query.ErrTableNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		tbl, err := query.OpenTable(tx, []byte("people"))
+		if err != nil {
+			return err
+		} else if !reflect.DeepEqual(tbl.Columns(), peopleColumns) {
+			t.Fatalf("unexpected columns: %v", tbl.Columns())
+		}
+
+		if _, err := tbl.Insert([]query.Cell{query.String("x")}); err != query.ErrColumnCount {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tbl.Insert([]query.Cell{query.String("x"), query.String("y"), query.Null()}); err != query.ErrTypeMismatch {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// 整数写入浮点数列时被转换
+		key, err := tbl.Insert([]query.Cell{query.String("frank"), query.Int(50), query.Int(1)})
+		if err != nil {
+			return err
+		}
+		row, err := tbl.Get(key)
+		if err != nil {
+			return err
+		} else if !reflect.DeepEqual(row.Cells[2], query.Float(1)) {
+			t.Fatalf("unexpected cell: %#v", row.Cells[2])
+		}
+
+		if err := tbl.Update(key, []query.Cell{query.String("frank"), query.Int(51), query.Null()}); err != nil {
+			return err
+		}
+		if row, err = tbl.Get(key); err != nil {
+			return err
+		} else if !reflect.DeepEqual(row.Cells[1], query.Int(51)) || !row.Cells[2].IsNull() {
+			t.Fatalf("unexpected row: %v", row.Cells)
+		}
+
+		if err := tbl.Delete(key); err != nil {
+			return err
+		}
+		if _, err := tbl.Get(key); err != query.ErrRowNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := tbl.Update(key, row.Cells); err != query.ErrRowNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if err := query.DropTable(tx, []byte("people")); err != nil {
+			return err
+		}
+		if _, err := query.OpenTable(tx, []byte("people")); err != query.ErrTableNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试组合操作符查询
+func TestOperators(t *testing.T) {
+	db := openDB(t)
+	createPeople(t, db)
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		tbl, err := query.OpenTable(tx, []byte("people"))
+		if err != nil {
+			return err
+		}
+
+		// SELECT name, age, score * 2 AS double FROM people WHERE age >= 25 AND score > 70
+		// ORDER BY age DESC, name LIMIT 3
+		var op query.Operator = query.Scan(tbl)
+		op = query.Filter(op, query.Binary(query.OpAnd,
+			query.Binary(query.OpGe, query.Col(1), query.Const(query.Int(25))),
+			query.Binary(query.OpGt, query.Col(2), query.Const(query.Int(70))),
+		))
+		op = query.Compute(op, query.Column{Name: "double", Type: query.TypeFloat},
+			query.Binary(query.OpMul, query.Col(2), query.Const(query.Int(2))))
+		op = query.Select(op, 0, 1, 3)
+		op = query.Sort(op, query.SortKey{Expr: query.Col(1), Desc: true}, query.SortKey{Expr: query.Col(0)})
+		op = query.Limit(op, 0, 3)
+
+		rs, err := query.Collect(op)
+		if err != nil {
+			return err
+		}
+		if names := []string{rs.Columns[0].Name, rs.Columns[1].Name, rs.Columns[2].Name}; !reflect.DeepEqual(names, []string{"name", "age", "double"}) {
+			t.Fatalf("unexpected columns: %v", names)
+		}
+		if got, want := rowStrings(rs), [][]string{
+			{"carol", "42", "182"},
+			{"alice", "31", "177"},
+			{"bob", "25", "144"},
+		}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected rows: %v", got)
+		}
+
+		// 投影保留行的key
+		if len(rs.Rows[0].Key) != 8 {
+			t.Fatalf("unexpected key: %x", rs.Rows[0].Key)
+		}
+
+		// 空值排在最前, 偏移跳过前两行
+		rs, err = query.Collect(query.Limit(query.Sort(query.Scan(tbl), query.SortKey{Expr: query.Col(1)}), 2, -1))
+		if err != nil {
+			return err
+		}
+		if got, want := rowStrings(rs), [][]string{
+			{"erin", "25", "95"},
+			{"alice", "31", "88.5"},
+			{"carol", "42", "91"},
+		}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected rows: %v", got)
+		}
+
+		// 计算出错时停止查询
+		_, err = query.Collect(query.Compute(query.Scan(tbl), query.Column{Name: "x"},
+			query.Binary(query.OpDiv, query.Col(1), query.Const(query.Int(0)))))
+		if err != query.ErrDivideByZero {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试表达式的空值和类型规则
+func TestExpr(t *testing.T) {
+	row := &query.Row{Cells: []query.Cell{query.Int(7), query.Null(), query.String("ab")}}
+	for _, tt := range []struct {
+		expr query.Expr
+		want query.Cell
+	}{
+		{query.Binary(query.OpDiv, query.Col(0), query.Const(query.Int(2))), query.Int(3)},
+		{query.Binary(query.OpDiv, query.Col(0), query.Const(query.Float(2))), query.Float(3.5)},
+		{query.Binary(query.OpMod, query.Col(0), query.Const(query.Int(4))), query.Int(3)},
+		{query.Binary(query.OpAdd, query.Col(0), query.Col(1)), query.Null()},
+		{query.Binary(query.OpEq, query.Col(1), query.Col(1)), query.Null()},
+		{query.Binary(query.OpLt, query.Col(2), query.Const(query.String("b"))), query.Bool(true)},
+		{query.Binary(query.OpAdd, query.Col(2), query.Const(query.String("c"))), query.String("abc")},
+		{query.Binary(query.OpOr, query.Col(1), query.Col(0)), query.Bool(true)},
+		{query.Binary(query.OpAnd, query.Col(1), query.Col(0)), query.Bool(false)},
+		{query.Not(query.Col(1)), query.Null()},
+		{query.Neg(query.Col(0)), query.Int(-7)},
+		{query.IsNull(query.Col(1)), query.Bool(true)},
+	} {
+		got, err := tt.expr.Eval(row)
+		if err != nil {
+			t.Fatal(err)
+		} else if got.Type != tt.want.Type || got.Compare(tt.want) != 0 {
+			t.Fatalf("unexpected result: %#v != %#v", got, tt.want)
+		}
+	}
+
+	if _, err := query.Binary(query.OpSub, query.Col(2), query.Col(0)).Eval(row); err != query.ErrTypeMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := query.Col(3).Eval(row); err != query.ErrColumnOutOfRange {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
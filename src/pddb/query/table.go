@@ -0,0 +1,159 @@
+package query
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"pddb"
+)
+
+// 表在bucket中的布局:
+// schema: 列定义, JSON编码
+// rows子bucket: 行key(自增序号, 8字节大端) -> 编码后的行
+var (
+	schemaKey  = []byte("schema")
+	rowsBucket = []byte("rows")
+)
+
+// 列定义, Type为TypeNull时可以保存任意类型
+type Column struct {
+	Name string `json:"name"`
+	Type Type   `json:"type"`
+}
+
+// 返回名称对应的列序号, 不存在时返回-1
+func ColumnIndex(columns []Column, name string) int {
+	for i, c := range columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// 以bucket保存的表, 只在打开它的事务期间有效
+type Table struct {
+	name    []byte
+	columns []Column
+	rows    *pddb.Bucket
+}
+
+// 在事务中创建表
+func CreateTable(tx *pddb.Tx, name []byte, columns []Column) (*Table, error) {
+	seen := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		if c.Name == "" || seen[c.Name] || int(c.Type) >= len(typeNames) {
+			return nil, ErrInvalidColumn
+		}
+		seen[c.Name] = true
+	}
+	schema, err := json.Marshal(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := tx.CreateBucket(name)
+	if err == pddb.ErrBucketExists {
+		return nil, ErrTableExists
+	} else if err != nil {
+		return nil, err
+	}
+	if err := b.Put(schemaKey, schema); err != nil {
+		return nil, err
+	}
+	rows, err := b.CreateBucket(rowsBucket)
+	if err != nil {
+		return nil, err
+	}
+	return &Table{name: name, columns: columns, rows: rows}, nil
+}
+
+// 打开已经存在的表
+func OpenTable(tx *pddb.Tx, name []byte) (*Table, error) {
+	b := tx.Bucket(name)
+	if b == nil {
+		return nil, ErrTableNotFound
+	}
+	schema, rows := b.Get(schemaKey), b.Bucket(rowsBucket)
+	if schema == nil || rows == nil {
+		return nil, ErrTableNotFound
+	}
+	var columns []Column
+	if err := json.Unmarshal(schema, &columns); err != nil {
+		return nil, ErrTableNotFound
+	}
+	return &Table{name: name, columns: columns, rows: rows}, nil
+}
+
+// 删除表及其中的所有行
+func DropTable(tx *pddb.Tx, name []byte) error {
+	if _, err := OpenTable(tx, name); err != nil {
+		return err
+	}
+	return tx.DeleteBucket(name)
+}
+
+func (t *Table) Name() []byte      { return t.name }
+func (t *Table) Columns() []Column { return t.columns }
+
+// 插入一行, 返回行的key
+func (t *Table) Insert(cells []Cell) ([]byte, error) {
+	value, err := t.encode(cells)
+	if err != nil {
+		return nil, err
+	}
+	id, err := t.rows.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	if err := t.rows.Put(key, value); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// 覆盖key对应的行
+func (t *Table) Update(key []byte, cells []Cell) error {
+	if t.rows.Get(key) == nil {
+		return ErrRowNotFound
+	}
+	value, err := t.encode(cells)
+	if err != nil {
+		return err
+	}
+	return t.rows.Put(key, value)
+}
+
+// 删除key对应的行
+func (t *Table) Delete(key []byte) error {
+	return t.rows.Delete(key)
+}
+
+// 读取key对应的行
+func (t *Table) Get(key []byte) (*Row, error) {
+	v := t.rows.Get(key)
+	if v == nil {
+		return nil, ErrRowNotFound
+	}
+	cells, err := DecodeRow(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Row{Key: append([]byte{}, key...), Cells: cells}, nil
+}
+
+// 按照表的列检查并转换单元格, 返回编码后的行
+func (t *Table) encode(cells []Cell) ([]byte, error) {
+	if len(cells) != len(t.columns) {
+		return nil, ErrColumnCount
+	}
+	converted := make([]Cell, len(cells))
+	for i, c := range cells {
+		var err error
+		if converted[i], err = c.Convert(t.columns[i].Type); err != nil {
+			return nil, err
+		}
+	}
+	return EncodeRow(converted), nil
+}
@@ -0,0 +1,322 @@
+package pddb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 副本默认最多缓冲的提交数量
+const DefaultReplicaQueueSize = 256
+
+// 副本默认的单次写入超时时间
+const DefaultReplicaWriteTimeout = 10 * time.Second
+
+// 发送快照时每次写入的数据大小
+const replicaSnapshotChunkSize = 1 << 20
+
+// 接收提交数据的副本, 每个副本使用单独的goroutine按顺序写入缓冲的数据
+// 缓冲区满或者写入超时的副本被断开, 不会阻塞提交
+type replica struct {
+	w       io.Writer
+	timeout time.Duration
+	frames  chan []byte
+	// 断开后关闭, goroutine放弃剩余的数据
+	stop chan struct{}
+	once sync.Once
+	// goroutine退出后关闭
+	done chan struct{}
+}
+
+// 添加副本, 先向w发送当前数据的完整快照, 之后每次提交成功后发送事务写入的page和元数据
+// 数据按照增量备份的格式发送, 副本使用Follow应用收到的数据
+// 快照在只读事务中分块同步发送, 不阻塞提交, 发送期间的提交进入缓冲区, 之后的数据由后台goroutine发送
+// 和其他只读事务一样, 需要重新映射的提交会等待快照发送完成, 可以通过InitialMmapSize避免
+// 发送失败, 缓冲区满或者写入超时的副本被断开, w实现io.Closer时会被关闭, 不影响提交
+func (db *DB) AddReplica(w io.Writer) error {
+	r := &replica{
+		w:       w,
+		timeout: db.replicaWriteTimeout,
+		frames:  make(chan []byte, db.replicaQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// 持有写锁开始只读事务并注册副本, 之后的提交都在快照之后, 不会遗漏
+	db.rwlock.Lock()
+	tx, err := db.beginTx()
+	if err != nil {
+		db.rwlock.Unlock()
+		return err
+	}
+	db.replicas = append(db.replicas, r)
+	db.rwlock.Unlock()
+
+	err = r.sendSnapshot(tx)
+	_ = tx.Rollback()
+	if err != nil {
+		r.disconnect()
+		db.rwlock.Lock()
+		for i, other := range db.replicas {
+			if other == r {
+				db.replicas = append(db.replicas[:i], db.replicas[i+1:]...)
+				break
+			}
+		}
+		db.rwlock.Unlock()
+		close(r.done)
+		return err
+	}
+	go r.run()
+	return nil
+}
+
+// 分块发送事务可见的完整快照
+func (r *replica) sendSnapshot(tx *Tx) error {
+	reachable := tx.reachablePages()
+	pages := make(pages, 0, len(reachable))
+	for _, p := range reachable {
+		pages = append(pages, p)
+	}
+	sort.Sort(pages)
+
+	bw := bufio.NewWriterSize(r, replicaSnapshotChunkSize)
+	if _, err := tx.writeIncremental(bw, 0, pages); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// 移除副本, 之后的提交不再发送给w, 等待已经缓冲的数据发送完成后返回
+func (db *DB) RemoveReplica(w io.Writer) {
+	db.rwlock.Lock()
+	var removed *replica
+	for i, r := range db.replicas {
+		if r.w == w {
+			removed = r
+			db.replicas = append(db.replicas[:i], db.replicas[i+1:]...)
+			close(r.frames)
+			break
+		}
+	}
+	db.rwlock.Unlock()
+
+	if removed != nil {
+		<-removed.done
+	}
+}
+
+// 移除所有副本, 等待已经缓冲的数据发送完成
+func (db *DB) closeReplicas() {
+	db.rwlock.Lock()
+	replicas := db.replicas
+	db.replicas = nil
+	for _, r := range replicas {
+		close(r.frames)
+	}
+	db.rwlock.Unlock()
+
+	for _, r := range replicas {
+		<-r.done
+	}
+}
+
+// 将提交写入的page和元数据编码成发送给副本的数据, 没有副本时返回nil
+func (tx *Tx) replicationFrame(pages pages) []byte {
+	if len(tx.db.replicas) == 0 {
+		return nil
+	}
+	// 已经写入文件或者日志的blob page同样需要复制
+	if len(tx.blobs) > 0 {
+		pages = append(tx.flushedBlobPages(), pages...)
+		sort.Sort(pages)
+	}
+	var buf bytes.Buffer
+	_, _ = tx.writeIncremental(&buf, tx.meta.txid-1, pages)
+	return buf.Bytes()
+}
+
+// 将数据放入所有副本的缓冲区, 调用时持有写锁
+// 已经断开的副本被移除, 缓冲区满的副本被断开
+func (db *DB) ship(frame []byte) {
+	if frame == nil {
+		return
+	}
+	replicas := db.replicas[:0]
+	for _, r := range db.replicas {
+		select {
+		case <-r.stop:
+			continue
+		default:
+		}
+		select {
+		case r.frames <- frame:
+		default:
+			log.Printf("Database replica queue full, disconnecting")
+			r.disconnect()
+			continue
+		}
+		replicas = append(replicas, r)
+	}
+	db.replicas = replicas
+}
+
+// 按顺序写入缓冲的数据, 直到缓冲区被关闭或者副本被断开
+func (r *replica) run() {
+	defer close(r.done)
+	for frame := range r.frames {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		if _, err := r.Write(frame); err != nil {
+			log.Printf("Database replica write error: %s", err)
+			r.disconnect()
+			return
+		}
+	}
+}
+
+// 写入w, 副本已经断开时返回io.ErrClosedPipe
+// 超时后断开副本, 关闭w使阻塞的写入返回
+func (r *replica) Write(b []byte) (int, error) {
+	select {
+	case <-r.stop:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	timer := time.AfterFunc(r.timeout, func() {
+		log.Printf("Database replica write timeout, disconnecting")
+		r.disconnect()
+	})
+	n, err := r.w.Write(b)
+	timer.Stop()
+	return n, err
+}
+
+// 断开副本, 之后的提交不再发送给副本
+func (r *replica) disconnect() {
+	r.once.Do(func() {
+		close(r.stop)
+		if c, ok := r.w.(io.Closer); ok {
+			_ = c.Close()
+		}
+	})
+}
+
+// 应用主库发送的数据, 直到r中没有更多数据时返回nil, 数据不完整或者应用出错时返回错误
+// 数据库需要以Follower模式打开, 应用期间可以开启只读事务
+// 只有完整快照, 需要重新映射, 或者有只读事务使用更早的快照时才等待只读事务结束
+func (db *DB) Follow(r io.Reader) error {
+	if !db.follower {
+		return ErrNotFollower
+	}
+	for {
+		inc, err := readIncremental(r, db.spoolFile)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = db.applyIncremental(inc)
+		inc.close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 将一条数据写入数据库文件并重新映射
+func (db *DB) applyIncremental(inc *incremental) error {
+	m := inc.metadata()
+	if inc.pageSize != db.pageSize {
+		return ErrInvalidBackup
+	}
+	var cipher uint64
+	if db.cipher != nil {
+		cipher = db.cipher.ID()
+	}
+	if m.cipherID() != cipher {
+		return ErrCipherMismatch
+	}
+
+	// 阻止新的只读事务开始, 正在执行的只读事务不受影响
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+
+	// 快照可以覆盖任意状态, 增量数据必须接在当前事务之后
+	full := inc.since == 0
+	current := db.meta().txid
+	if !full && (current < inc.since || current >= inc.txid) {
+		return fmt.Errorf("database txid %d, frame %d-%d: %w", current, inc.since, inc.txid, ErrReplicationGap)
+	}
+
+	// 紧接当前事务的一次提交只会写入当前快照中不可达的page, 使用当前快照的只读事务不受影响
+	// 可能覆盖只读事务正在读取的page, 或者需要重新映射时, 才等待正在执行的只读事务结束
+	minsz := int(m.pgid+1) * db.pageSize
+	if full || inc.txid != current+1 || db.hasReadersBefore(current) || minsz > db.source.size() {
+		db.mmaplock.Lock()
+		defer db.mmaplock.Unlock()
+	}
+
+	// 写入后移除page的缓存
+	err := inc.writePages(db.file, func(p *page) {
+		db.invalidatePages(pages{p})
+	})
+	if err == nil {
+		err = fdatasync(db)
+	}
+	if err == nil {
+		err = inc.writeMeta(db.file, full)
+	}
+	if err == nil {
+		err = fdatasync(db)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 文件增长后重新映射, 此时持有mmaplock
+	if minsz > db.source.size() {
+		return db.remap(minsz)
+	}
+	return db.reloadMeta()
+}
+
+// 创建暂存完整快照的临时文件, 创建后立即删除, 关闭后释放空间
+func (db *DB) spoolFile() (dbFile, error) {
+	if db.memory {
+		return &memFile{}, nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(db.path), filepath.Base(db.path)+".snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// 是否有只读事务使用txid之前的快照, 调用者需要持有metalock
+func (db *DB) hasReadersBefore(id txid) bool {
+	for _, t := range db.txs {
+		if t.meta.txid < id {
+			return true
+		}
+	}
+	return false
+}
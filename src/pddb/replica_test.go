@@ -0,0 +1,383 @@
+package pddb_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"pddb"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 等待副本应用到指定的事务
+func waitTxID(t *testing.T, db *pddb.DB, id int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current := tx.ID()
+		_ = tx.Rollback()
+		if current == id {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting txid %d: %d", id, current)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 返回主库当前的事务id
+func txID(t *testing.T, db *pddb.DB) int {
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	return tx.ID()
+}
+
+// 通过本地TCP连接复制到副本, 复制期间副本可以执行只读事务
+func TestDB_Follow(t *testing.T) {
+	primary := MustOpenDB()
+	defer MustClose(primary)
+	putKeys(t, primary, 0, 50)
+
+	path := tempfile()
+	defer os.Remove(path)
+	follower, err := pddb.Open(path, 0666, &pddb.Options{Follower: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(follower)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	followErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			followErr <- err
+			return
+		}
+		defer conn.Close()
+		followErr <- follower.Follow(conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.AddReplica(conn); err != nil {
+		t.Fatal(err)
+	}
+	waitTxID(t, follower, txID(t, primary))
+	checkKeys(t, follower, 50)
+
+	// 复制期间在副本上持续读取
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				readErr <- nil
+				return
+			default:
+			}
+			if err := follower.View(func(tx *pddb.Tx) error {
+				if b := tx.Bucket([]byte("widgets")); b != nil {
+					return b.ForEach(func(k, v []byte) error { return nil })
+				}
+				return nil
+			}); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	putKeys(t, primary, 50, 500)
+	waitTxID(t, follower, txID(t, primary))
+	close(stop)
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, follower, 500)
+	if err := follower.View(func(tx *pddb.Tx) error { return tx.Check() }); err != nil {
+		t.Fatal(err)
+	}
+
+	// 副本不能开启写事务
+	if err := follower.Update(func(tx *pddb.Tx) error { return nil }); err != pddb.ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 主库关闭连接后副本停止复制
+	primary.RemoveReplica(conn)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-followErr; err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, primary, 500, 510)
+	checkKeys(t, follower, 500)
+}
+
+// 记录每次写入的数据
+type frameRecorder struct {
+	frames [][]byte
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.frames = append(r.frames, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// 副本跳过事务时返回错误, 非副本模式不能应用数据
+func TestDB_Follow_ErrReplicationGap(t *testing.T) {
+	primary := MustOpenDB()
+	defer MustClose(primary)
+	putKeys(t, primary, 0, 10)
+
+	r := &frameRecorder{}
+	if err := primary.AddReplica(r); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := bytes.Join(r.frames, nil)
+	r.frames = nil
+	putKeys(t, primary, 10, 12)
+	primary.RemoveReplica(r)
+	if len(r.frames) != 2 {
+		t.Fatalf("unexpected frame count: %d", len(r.frames))
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	follower, err := pddb.Open(path, 0666, &pddb.Options{Follower: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(follower)
+
+	if err := follower.Follow(bytes.NewReader(r.frames[1])); !errors.Is(err, pddb.ErrReplicationGap) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := follower.Follow(bytes.NewReader(append(snapshot, r.frames[0]...))); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, follower, 11)
+
+	// 不完整的数据
+	if err := follower.Follow(bytes.NewReader(r.frames[1][:100])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkKeys(t, follower, 11)
+
+	if err := primary.Follow(bytes.NewReader(r.frames[1])); err != pddb.ErrNotFollower {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 快照写入后阻塞的副本, 关闭后写入返回错误
+type stalledWriter struct {
+	stalled bool
+	closed  chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	if w.stalled {
+		<-w.closed
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func (w *stalledWriter) Close() error {
+	close(w.closed)
+	return nil
+}
+
+// 阻塞的副本不影响提交, 缓冲区满或者写入超时后被断开
+func TestDB_AddReplica_Stalled(t *testing.T) {
+	for name, options := range map[string]*pddb.Options{
+		"overflow": {ReplicaQueueSize: 2, ReplicaWriteTimeout: time.Hour},
+		"timeout":  {ReplicaWriteTimeout: 10 * time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := tempfile()
+			primary, err := pddb.Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer MustClose(primary)
+
+			w := &stalledWriter{closed: make(chan struct{})}
+			if err := primary.AddReplica(w); err != nil {
+				t.Fatal(err)
+			}
+			w.stalled = true
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				putKeys(t, primary, 0, 10)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("commit blocked by replica")
+			}
+			select {
+			case <-w.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("replica not disconnected")
+			}
+			checkKeys(t, primary, 10)
+		})
+	}
+}
+
+// 第一次写入时阻塞直到release被关闭的副本
+type gatedWriter struct {
+	w       io.Writer
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		<-w.release
+	})
+	return w.w.Write(p)
+}
+
+// 发送快照期间不阻塞提交, 期间的提交在快照之后发送
+func TestDB_AddReplica_SnapshotConcurrentCommit(t *testing.T) {
+	// 映射足够大, 提交不需要等待快照的只读事务结束后重新映射
+	primary, err := pddb.Open(tempfile(), 0666, &pddb.Options{InitialMmapSize: 1 << 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(primary)
+	putKeys(t, primary, 0, 10)
+
+	path := tempfile()
+	defer os.Remove(path)
+	follower, err := pddb.Open(path, 0666, &pddb.Options{Follower: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(follower)
+
+	pr, pw := io.Pipe()
+	followErr := make(chan error, 1)
+	go func() { followErr <- follower.Follow(pr) }()
+
+	w := &gatedWriter{w: pw, started: make(chan struct{}), release: make(chan struct{})}
+	addErr := make(chan error, 1)
+	go func() { addErr <- primary.AddReplica(w) }()
+	<-w.started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		putKeys(t, primary, 10, 20)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(w.release)
+		t.Fatal("commit blocked by replica snapshot")
+	}
+	close(w.release)
+	if err := <-addErr; err != nil {
+		t.Fatal(err)
+	}
+
+	waitTxID(t, follower, txID(t, primary))
+	checkKeys(t, follower, 20)
+	if err := follower.View(func(tx *pddb.Tx) error { return tx.Check() }); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.RemoveReplica(w)
+	_ = pw.Close()
+	if err := <-followErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 副本应用紧接当前事务的数据时不需要等待只读事务结束
+func TestDB_Follow_ConcurrentReader(t *testing.T) {
+	primary := MustOpenDB()
+	defer MustClose(primary)
+	putKeys(t, primary, 0, 10)
+
+	r := &frameRecorder{}
+	if err := primary.AddReplica(r); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := bytes.Join(r.frames, nil)
+	r.frames = nil
+	putKeys(t, primary, 10, 12)
+	primary.RemoveReplica(r)
+
+	path := tempfile()
+	defer os.Remove(path)
+	follower, err := pddb.Open(path, 0666, &pddb.Options{Follower: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(follower)
+	if err := follower.Follow(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := follower.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- follower.Follow(bytes.NewReader(r.frames[0])) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("apply blocked by reader")
+	}
+
+	// 只读事务仍然读取开始时的快照
+	if v := tx.Bucket([]byte("widgets")).Get([]byte("0010")); v != nil {
+		t.Fatalf("unexpected value: %q", v)
+	} else if v := tx.Bucket([]byte("widgets")).Get([]byte("0009")); string(v) != "value-9" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	checkKeys(t, follower, 11)
+
+	// 存在更早快照的只读事务时需要等待
+	go func() { done <- follower.Follow(bytes.NewReader(r.frames[1])) }()
+	select {
+	case err := <-done:
+		t.Fatalf("apply not blocked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	} else if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, follower, 12)
+}
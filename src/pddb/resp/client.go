@@ -0,0 +1,73 @@
+package resp
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+)
+
+// 简单的RESP客户端, 用于测试和调试, 不支持并发使用
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// 连接到RESP服务
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// 发送一个命令并读取回复, 错误回复以Error类型返回
+func (c *Client) Do(args ...string) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+// 缓存一个命令但不发送, 用于流水线请求
+func (c *Client) Send(args ...string) error {
+	buf := appendArray(nil, len(args))
+	for _, arg := range args {
+		buf = appendBulk(buf, []byte(arg))
+	}
+	_, err := c.w.Write(buf)
+	return err
+}
+
+// 发送所有缓存的命令并读取一个回复
+func (c *Client) Receive() (interface{}, error) {
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	v, err := readReply(c.r)
+	if err != nil {
+		return nil, err
+	} else if e, ok := v.(Error); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// 将回复转换成字符串, 用于读取GET等命令的结果
+func String(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,190 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// 单个bulk string和数组的最大长度, 防止恶意请求申请过多内存
+const (
+	maxBulkLen  = 512 << 20
+	maxArrayLen = 1 << 20
+)
+
+// 协议错误
+var (
+	// 请求或者回复不符合RESP协议
+	ErrProtocol = errors.New("protocol error")
+)
+
+// 服务端返回的错误回复
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// 读取一个命令, 支持RESP数组和以空格分隔的内联命令
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// 内联命令, 方便通过telnet调试
+	if len(line) == 0 || line[0] != '*' {
+		args := bytes.Fields(line)
+		for i := range args {
+			args[i] = append([]byte{}, args[i]...)
+		}
+		return args, nil
+	}
+
+	n, err := parseLen(line[1:], maxArrayLen)
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		} else if len(line) == 0 || line[0] != '$' {
+			return nil, ErrProtocol
+		}
+		arg, err := readBulk(r, line[1:])
+		if err != nil {
+			return nil, err
+		} else if arg == nil {
+			return nil, ErrProtocol
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// 读取一个回复, 返回string, int64, []byte, []interface{}, nil或者Error
+// 简单字符串返回string, bulk string返回[]byte
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	} else if len(line) == 0 {
+		return nil, ErrProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		return n, nil
+	case '$':
+		v, err := readBulk(r, line[1:])
+		if err != nil || v == nil {
+			return nil, err
+		}
+		return v, nil
+	case '*':
+		if string(line[1:]) == "-1" {
+			return nil, nil
+		}
+		n, err := parseLen(line[1:], maxArrayLen)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	default:
+		return nil, ErrProtocol
+	}
+}
+
+// 读取bulk string的内容, 长度为-1时返回nil
+func readBulk(r *bufio.Reader, header []byte) ([]byte, error) {
+	if string(header) == "-1" {
+		return nil, nil
+	}
+	n, err := parseLen(header, maxBulkLen)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	} else if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, ErrProtocol
+	}
+	return buf[:n], nil
+}
+
+// 读取以\r\n结尾的一行, 不包含结尾的\r\n
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrProtocol
+	} else if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func parseLen(b []byte, max int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < 0 || n > max {
+		return 0, ErrProtocol
+	}
+	return n, nil
+}
+
+// 以下函数将回复追加到buf中
+
+func appendSimple(buf []byte, s string) []byte {
+	buf = append(buf, '+')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+func appendError(buf []byte, s string) []byte {
+	buf = append(buf, '-')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+func appendInt(buf []byte, n int64) []byte {
+	buf = append(buf, ':')
+	buf = strconv.AppendInt(buf, n, 10)
+	return append(buf, '\r', '\n')
+}
+
+// v为nil时追加空回复
+func appendBulk(buf []byte, v []byte) []byte {
+	if v == nil {
+		return append(buf, "$-1\r\n"...)
+	}
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(v)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, v...)
+	return append(buf, '\r', '\n')
+}
+
+func appendArray(buf []byte, n int) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, '\r', '\n')
+}
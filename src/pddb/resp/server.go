@@ -0,0 +1,688 @@
+// resp包通过Redis的RESP协议对外提供pddb数据库的访问, 让已有的Redis客户端可以直接使用pddb
+//
+// 每个连接选中一个bucket, 默认是"0", SELECT可以切换到任意名称的bucket, 读取时bucket不存在视为空
+// 普通命令各自在一个事务中执行, MULTI和EXEC之间的命令在同一个事务中执行
+// 与Redis一样, EXEC中单个命令的错误作为该命令的回复返回, 不会回滚其他命令
+package resp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"pddb"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 连接默认选中的bucket
+const DefaultBucket = "0"
+
+// SCAN默认每次检查的key数量
+const DefaultScanCount = 10
+
+// 每个连接最多保留的SCAN游标数量, 超过后最早的游标失效
+const maxScanCursors = 1024
+
+// 通过RESP协议对外提供数据库访问的服务
+type Server struct {
+	db *pddb.DB
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closing   bool
+	wg        sync.WaitGroup
+}
+
+// 创建服务, 服务不负责关闭数据库
+func New(db *pddb.DB) *Server {
+	return &Server{
+		db:        db,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+	}
+}
+
+// 监听地址并处理连接, 调用Shutdown后返回nil
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// 在监听器上处理连接, 调用Shutdown后返回nil
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return err
+		}
+
+		c := &conn{
+			s:      s,
+			nc:     nc,
+			r:      bufio.NewReader(nc),
+			w:      bufio.NewWriter(nc),
+			bucket: []byte(DefaultBucket),
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			nc.Close()
+			continue
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+// 停止接收新的连接, 等待正在执行的命令完成后关闭连接
+// ctx结束时强制关闭剩余的连接并返回ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	// 正在等待命令的连接立即返回, 正在执行命令的连接在回复后返回
+	for c := range s.conns {
+		c.nc.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			c.nc.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// 客户端连接及其状态
+type conn struct {
+	s  *Server
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+
+	// 当前选中的bucket
+	bucket []byte
+
+	// MULTI之后排队的命令, 排队时出错则EXEC时放弃整个事务
+	multi    bool
+	queued   [][][]byte
+	multiErr bool
+
+	// SCAN游标id -> 下一个key
+	scans  map[uint64][]byte
+	scanID uint64
+}
+
+// 循环读取并执行命令, 流水线请求在读完缓冲区中的命令后统一发送回复
+func (c *conn) serve() {
+	defer func() {
+		c.nc.Close()
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+		c.s.wg.Done()
+	}()
+
+	for {
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+
+		args, err := c.readCommand()
+		if err == ErrProtocol {
+			c.w.Write(appendError(nil, "ERR Protocol error"))
+			c.w.Flush()
+			return
+		} else if err != nil {
+			c.w.Flush()
+			return
+		} else if len(args) == 0 {
+			continue
+		}
+
+		out, quit := c.handle(args)
+		if _, err := c.w.Write(out); err != nil || quit {
+			c.w.Flush()
+			return
+		}
+	}
+}
+
+// 读取命令, 关闭服务时不再读取新的命令
+func (c *conn) readCommand() ([][]byte, error) {
+	c.s.mu.Lock()
+	closing := c.s.closing
+	c.s.mu.Unlock()
+	if closing && c.r.Buffered() == 0 {
+		return nil, net.ErrClosed
+	}
+	return readCommand(c.r)
+}
+
+// 执行一个命令, 返回回复和是否需要关闭连接
+func (c *conn) handle(args [][]byte) ([]byte, bool) {
+	name := strings.ToUpper(string(args[0]))
+	switch name {
+	case "QUIT":
+		return appendSimple(nil, "OK"), true
+	case "MULTI":
+		if c.multi {
+			return appendError(nil, "ERR MULTI calls can not be nested"), false
+		}
+		c.multi, c.queued, c.multiErr = true, nil, false
+		return appendSimple(nil, "OK"), false
+	case "DISCARD":
+		if !c.multi {
+			return appendError(nil, "ERR DISCARD without MULTI"), false
+		}
+		c.multi, c.queued, c.multiErr = false, nil, false
+		return appendSimple(nil, "OK"), false
+	case "EXEC":
+		if !c.multi {
+			return appendError(nil, "ERR EXEC without MULTI"), false
+		}
+		return c.exec(), false
+	}
+
+	cmd, errReply := lookup(name, args)
+	if c.multi {
+		if errReply != nil {
+			c.multiErr = true
+			return errReply, false
+		}
+		c.queued = append(c.queued, args)
+		return appendSimple(nil, "QUEUED"), false
+	} else if errReply != nil {
+		return errReply, false
+	}
+
+	if cmd.noTx {
+		return cmd.fn(c, nil, args, nil), false
+	}
+	var out []byte
+	fn := func(tx *pddb.Tx) error {
+		out = cmd.fn(c, tx, args, nil)
+		return nil
+	}
+	if err := c.s.update(cmd.writeable, fn); err != nil {
+		return appendError(nil, errorString(err)), false
+	}
+	return out, false
+}
+
+// 在一个事务中执行排队的命令, 只有读命令时使用只读事务
+func (c *conn) exec() []byte {
+	queued, multiErr := c.queued, c.multiErr
+	c.multi, c.queued, c.multiErr = false, nil, false
+	if multiErr {
+		return appendError(nil, "EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	writeable := false
+	for _, args := range queued {
+		if commands[strings.ToUpper(string(args[0]))].writeable {
+			writeable = true
+		}
+	}
+
+	var out []byte
+	fn := func(tx *pddb.Tx) error {
+		out = appendArray(nil, len(queued))
+		for _, args := range queued {
+			cmd := commands[strings.ToUpper(string(args[0]))]
+			out = cmd.fn(c, tx, args, out)
+		}
+		return nil
+	}
+	if err := c.s.update(writeable, fn); err != nil {
+		return appendError(nil, errorString(err))
+	}
+	return out
+}
+
+// 按照命令是否写入选择读写事务或者只读事务
+func (s *Server) update(writeable bool, fn func(tx *pddb.Tx) error) error {
+	if writeable {
+		return s.db.Update(fn)
+	}
+	return s.db.View(fn)
+}
+
+// 当前选中的bucket, 不存在时返回nil
+func (c *conn) bucketIn(tx *pddb.Tx) *pddb.Bucket {
+	return tx.Bucket(c.bucket)
+}
+
+// 当前选中的bucket, 不存在时创建
+func (c *conn) createBucketIn(tx *pddb.Tx) (*pddb.Bucket, error) {
+	return tx.CreateBucketIfNotExists(c.bucket)
+}
+
+// 命令定义
+type command struct {
+	// 参数数量, 包含命令名称, 负数表示最少的参数数量
+	arity int
+	// 需要读写事务
+	writeable bool
+	// 不访问数据库, 执行时tx为nil
+	noTx bool
+	// 执行命令, 将回复追加到out
+	fn func(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte
+}
+
+// 支持的命令, MULTI, EXEC, DISCARD和QUIT由连接直接处理
+var commands = map[string]*command{
+	"PING":   {arity: -1, noTx: true, fn: pingCommand},
+	"SELECT": {arity: 2, noTx: true, fn: selectCommand},
+	"GET":    {arity: 2, fn: getCommand},
+	"MGET":   {arity: -2, fn: mgetCommand},
+	"EXISTS": {arity: -2, fn: existsCommand},
+	"SCAN":   {arity: -2, fn: scanCommand},
+	"SET":    {arity: -3, writeable: true, fn: setCommand},
+	"MSET":   {arity: -3, writeable: true, fn: msetCommand},
+	"DEL":    {arity: -2, writeable: true, fn: delCommand},
+	"INCR":   {arity: 2, writeable: true, fn: incrCommand},
+	"INCRBY": {arity: 3, writeable: true, fn: incrCommand},
+	"DECR":   {arity: 2, writeable: true, fn: incrCommand},
+	"DECRBY": {arity: 3, writeable: true, fn: incrCommand},
+}
+
+// 查找命令并检查参数数量, 出错时返回错误回复
+func lookup(name string, args [][]byte) (*command, []byte) {
+	cmd := commands[name]
+	if cmd == nil {
+		return nil, appendError(nil, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		return nil, appendError(nil, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+	return cmd, nil
+}
+
+// 数据库错误对应的错误回复
+func errorString(err error) string {
+	switch err {
+	case pddb.ErrIncompatibleValue:
+		return "WRONGTYPE Operation against a key holding the wrong kind of value"
+	case pddb.ErrDatabaseReadOnly:
+		return "READONLY You can't write against a read only database"
+	default:
+		return "ERR " + err.Error()
+	}
+}
+
+// PING [message]
+func pingCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	if len(args) > 1 {
+		return appendBulk(out, args[1])
+	}
+	return appendSimple(out, "PONG")
+}
+
+// SELECT bucket
+func selectCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	if len(args[1]) == 0 {
+		return appendError(out, errorString(pddb.ErrBucketNameRequired))
+	}
+	c.bucket = args[1]
+	return appendSimple(out, "OK")
+}
+
+// GET key
+func getCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	b := c.bucketIn(tx)
+	if b == nil {
+		return appendBulk(out, nil)
+	}
+	return appendBulk(out, b.Get(args[1]))
+}
+
+// MGET key [key ...]
+func mgetCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	b := c.bucketIn(tx)
+	out = appendArray(out, len(args)-1)
+	for _, key := range args[1:] {
+		var v []byte
+		if b != nil {
+			v = b.Get(key)
+		}
+		out = appendBulk(out, v)
+	}
+	return out
+}
+
+// EXISTS key [key ...], 重复的key重复计数
+func existsCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	var n int64
+	if b := c.bucketIn(tx); b != nil {
+		for _, key := range args[1:] {
+			if b.GetReader(key) != nil {
+				n++
+			}
+		}
+	}
+	return appendInt(out, n)
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+// 游标保存在连接中, 只能在同一个连接中继续使用
+func scanCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	id, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return appendError(out, "ERR invalid cursor")
+	}
+	var start []byte
+	if id != 0 {
+		if start = c.scans[id]; start == nil {
+			return appendError(out, "ERR invalid cursor")
+		}
+		delete(c.scans, id)
+	}
+
+	var pattern []byte
+	count := DefaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return appendError(out, "ERR syntax error")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				return appendError(out, "ERR value is not an integer or out of range")
+			}
+			count = n
+		default:
+			return appendError(out, "ERR syntax error")
+		}
+	}
+
+	// 检查count个key, 跳过子bucket, 已过期和不匹配的key
+	var keys [][]byte
+	var next uint64
+	if b := c.bucketIn(tx); b != nil {
+		cur := b.Cursor()
+		k, _ := cur.First()
+		if start != nil {
+			k, _ = cur.Seek(start)
+		}
+		for n := 0; k != nil; k, _ = cur.Next() {
+			if n == count {
+				next = c.saveScan(k)
+				break
+			}
+			n++
+			if b.GetReader(k) == nil {
+				continue
+			}
+			if pattern != nil && !matchGlob(pattern, k) {
+				continue
+			}
+			keys = append(keys, k)
+		}
+	}
+
+	out = appendArray(out, 2)
+	out = appendBulk(out, strconv.AppendUint(nil, next, 10))
+	out = appendArray(out, len(keys))
+	for _, k := range keys {
+		out = appendBulk(out, k)
+	}
+	return out
+}
+
+// 与Redis相同的glob匹配, 按字节比较, *和?可以匹配包括"/"在内的任意字节
+// 支持*, ?, [abc], [^a-z]和\转义, 没有闭合的[延续到模式末尾
+func matchGlob(pattern, s []byte) bool {
+	p, i := 0, 0
+	// 最近一个*之后的位置, 以及它已经匹配到的位置, 用于回溯
+	star, mark := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, mark = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if ok, next := matchByte(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		// 不匹配时让最近的*多匹配一个字节
+		if star < 0 {
+			return false
+		}
+		mark++
+		p, i = star, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// 用pattern[p:]开头的一个元素匹配字节c, 返回下一个元素的位置
+func matchByte(pattern []byte, p int, c byte) (bool, int) {
+	switch pattern[p] {
+	case '?':
+		return true, p + 1
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+		return pattern[p] == c, p + 1
+	case '[':
+		p++
+		not := p < len(pattern) && pattern[p] == '^'
+		if not {
+			p++
+		}
+		var match bool
+		for p < len(pattern) && pattern[p] != ']' {
+			switch {
+			case pattern[p] == '\\' && p+1 < len(pattern):
+				match = match || pattern[p+1] == c
+				p += 2
+			case p+2 < len(pattern) && pattern[p+1] == '-':
+				lo, hi := pattern[p], pattern[p+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				match = match || (lo <= c && c <= hi)
+				p += 3
+			default:
+				match = match || pattern[p] == c
+				p++
+			}
+		}
+		if p < len(pattern) {
+			p++
+		}
+		return match != not, p
+	}
+	return pattern[p] == c, p + 1
+}
+
+// 保存SCAN的下一个key, 返回游标id
+func (c *conn) saveScan(key []byte) uint64 {
+	if c.scans == nil || len(c.scans) >= maxScanCursors {
+		c.scans = make(map[uint64][]byte)
+	}
+	c.scanID++
+	c.scans[c.scanID] = append([]byte{}, key...)
+	return c.scanID
+}
+
+// SET key value [EX seconds|PX milliseconds] [NX|XX]
+func setCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) || ttl != 0 {
+				return appendError(out, "ERR syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				return appendError(out, "ERR invalid expire time in 'set' command")
+			}
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+		default:
+			return appendError(out, "ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return appendError(out, "ERR syntax error")
+	}
+
+	b, err := c.createBucketIn(tx)
+	if err != nil {
+		return appendError(out, errorString(err))
+	}
+	if nx || xx {
+		if exists := b.GetReader(args[1]) != nil; exists == nx {
+			return appendBulk(out, nil)
+		}
+	}
+
+	if ttl > 0 {
+		err = b.PutWithTTL(args[1], args[2], ttl)
+	} else {
+		err = b.Put(args[1], args[2])
+	}
+	if err != nil {
+		return appendError(out, errorString(err))
+	}
+	return appendSimple(out, "OK")
+}
+
+// MSET key value [key value ...]
+func msetCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	if len(args)%2 != 1 {
+		return appendError(out, "ERR wrong number of arguments for 'mset' command")
+	}
+	b, err := c.createBucketIn(tx)
+	if err != nil {
+		return appendError(out, errorString(err))
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := b.Put(args[i], args[i+1]); err != nil {
+			return appendError(out, errorString(err))
+		}
+	}
+	return appendSimple(out, "OK")
+}
+
+// DEL key [key ...], 返回删除的key数量
+func delCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	var n int64
+	if b := c.bucketIn(tx); b != nil {
+		for _, key := range args[1:] {
+			if b.GetReader(key) == nil {
+				continue
+			}
+			if err := b.Delete(key); err != nil {
+				return appendError(out, errorString(err))
+			}
+			n++
+		}
+	}
+	return appendInt(out, n)
+}
+
+// INCR key, INCRBY key increment, DECR key, DECRBY key decrement
+// value以十进制字符串保存, key不存在时视为0
+func incrCommand(c *conn, tx *pddb.Tx, args [][]byte, out []byte) []byte {
+	name := strings.ToUpper(string(args[0]))
+	delta := int64(1)
+	if len(args) == 3 {
+		n, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return appendError(out, "ERR value is not an integer or out of range")
+		}
+		delta = n
+	}
+	if strings.HasPrefix(name, "DECR") {
+		if delta == math.MinInt64 {
+			return appendError(out, "ERR decrement would overflow")
+		}
+		delta = -delta
+	}
+
+	b, err := c.createBucketIn(tx)
+	if err != nil {
+		return appendError(out, errorString(err))
+	}
+	var n int64
+	if v := b.Get(args[1]); v != nil {
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return appendError(out, "ERR value is not an integer or out of range")
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return appendError(out, "ERR increment or decrement would overflow")
+	}
+	n += delta
+
+	if err := b.Put(args[1], strconv.AppendInt(nil, n, 10)); err != nil {
+		return appendError(out, errorString(err))
+	}
+	return appendInt(out, n)
+}
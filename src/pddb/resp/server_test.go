@@ -0,0 +1,278 @@
+package resp_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"pddb"
+	"pddb/resp"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 在临时目录中打开数据库并在本地端口启动服务
+func newServer(t *testing.T) (string, *resp.Server, *pddb.DB) {
+	db, err := pddb.Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := resp.New(db)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return l.Addr().String(), s, db
+}
+
+func dial(t *testing.T, addr string) *resp.Client {
+	c, err := resp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// 执行命令并检查回复
+func expect(t *testing.T, c *resp.Client, want interface{}, args ...string) {
+	t.Helper()
+	v, err := c.Do(args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Fatalf("%v: unexpected reply: %#v", args, v)
+	}
+}
+
+// 执行命令并检查错误回复
+func expectError(t *testing.T, c *resp.Client, want string, args ...string) {
+	t.Helper()
+	if _, err := c.Do(args...); err == nil || err.Error() != want {
+		t.Fatalf("%v: unexpected error: %v", args, err)
+	}
+}
+
+// 测试基本的读写命令
+func TestServer_Commands(t *testing.T) {
+	addr, _, db := newServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, "PONG", "PING")
+	expect(t, c, nil, "GET", "foo")
+	expect(t, c, "OK", "SET", "foo", "bar")
+	expect(t, c, "bar", "GET", "foo")
+	expect(t, c, nil, "SET", "foo", "baz", "NX")
+	expect(t, c, "OK", "SET", "foo", "baz", "XX")
+	expect(t, c, "OK", "MSET", "a", "1", "b", "2")
+	expect(t, c, []interface{}{[]byte("1"), nil, []byte("2")}, "MGET", "a", "x", "b")
+	expect(t, c, int64(3), "EXISTS", "a", "b", "a", "x")
+	expect(t, c, int64(2), "INCR", "a")
+	expect(t, c, int64(12), "INCRBY", "a", "10")
+	expect(t, c, int64(-1), "DECR", "counter")
+	expectError(t, c, "ERR value is not an integer or out of range", "INCR", "foo")
+	expect(t, c, int64(2), "DEL", "a", "b", "x")
+	expect(t, c, int64(0), "EXISTS", "a", "b")
+	expectError(t, c, "ERR unknown command 'NOPE'", "NOPE")
+	expectError(t, c, "ERR wrong number of arguments for 'get' command", "GET")
+
+	// SELECT切换到其他bucket
+	expect(t, c, "OK", "SELECT", "widgets")
+	expect(t, c, nil, "GET", "foo")
+	expect(t, c, "OK", "SET", "foo", "w")
+	expect(t, c, "OK", "SELECT", "0")
+	expect(t, c, "baz", "GET", "foo")
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "w" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := tx.Bucket([]byte(resp.DefaultBucket)).Get([]byte("counter")); string(v) != "-1" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 子bucket不能作为key覆盖
+	if err := db.Update(func(tx *pddb.Tx) error {
+		_, err := tx.Bucket([]byte("widgets")).CreateBucket([]byte("sub"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, "OK", "SELECT", "widgets")
+	expectError(t, c, "WRONGTYPE Operation against a key holding the wrong kind of value", "SET", "sub", "x")
+	expect(t, c, int64(0), "EXISTS", "sub")
+}
+
+// 测试SET的过期时间
+func TestServer_SetExpire(t *testing.T) {
+	addr, _, _ := newServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, "OK", "SET", "foo", "bar", "PX", "1000")
+	expect(t, c, "bar", "GET", "foo")
+	time.Sleep(1100 * time.Millisecond)
+	expect(t, c, nil, "GET", "foo")
+	expectError(t, c, "ERR invalid expire time in 'set' command", "SET", "foo", "bar", "EX", "0")
+}
+
+// 测试SCAN分批返回所有key
+func TestServer_Scan(t *testing.T) {
+	addr, _, _ := newServer(t)
+	c := dial(t, addr)
+
+	want := make([]string, 0, 25)
+	for i := 0; i < 25; i++ {
+		k := fmt.Sprintf("key%02d", i)
+		expect(t, c, "OK", "SET", k, "v")
+		if i%2 == 0 {
+			want = append(want, k)
+		}
+	}
+
+	var got []string
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 10 {
+			t.Fatal("too many calls")
+		}
+		v, err := c.Do("SCAN", cursor, "MATCH", "key*[02468]", "COUNT", "7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := v.([]interface{})
+		for _, k := range reply[1].([]interface{}) {
+			got = append(got, resp.String(k))
+		}
+		if cursor = resp.String(reply[0]); cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected keys: %v", got)
+	}
+	expectError(t, c, "ERR invalid cursor", "SCAN", "12345")
+}
+
+// 测试SCAN MATCH与Redis的glob规则相同, *和?可以匹配"/"
+func TestServer_ScanMatch(t *testing.T) {
+	addr, _, _ := newServer(t)
+	c := dial(t, addr)
+	for _, k := range []string{"user:a/b", "user:c", "users", "a?b", "axb"} {
+		expect(t, c, "OK", "SET", k, "v")
+	}
+
+	for pattern, want := range map[string][]string{
+		"user:*":      {"user:a/b", "user:c"},
+		"user:?/?":    {"user:a/b"},
+		"user:[a-b]*": {"user:a/b"},
+		"user[^:]":    {"users"},
+		`a\?b`:        {"a?b"},
+		"a?b":         {"a?b", "axb"},
+		"*[":          nil,
+	} {
+		v, err := c.Do("SCAN", "0", "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, k := range v.([]interface{})[1].([]interface{}) {
+			got = append(got, resp.String(k))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: unexpected keys: %v", pattern, got)
+		}
+	}
+}
+
+// 测试MULTI/EXEC在一个事务中执行
+func TestServer_Multi(t *testing.T) {
+	addr, _, db := newServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, "OK", "MULTI")
+	expect(t, c, "QUEUED", "SET", "foo", "1")
+	expect(t, c, "QUEUED", "INCR", "foo")
+	expect(t, c, "QUEUED", "GET", "foo")
+
+	// 提交前其他连接看不到排队的命令
+	expect(t, dial(t, addr), nil, "GET", "foo")
+
+	txid := func() (id int) {
+		db.View(func(tx *pddb.Tx) error { id = tx.ID(); return nil })
+		return
+	}
+	before := txid()
+	expect(t, c, []interface{}{"OK", int64(2), []byte("2")}, "EXEC")
+	if after := txid(); after != before+1 {
+		t.Fatalf("unexpected txid: %d -> %d", before, after)
+	}
+
+	// 排队时出错则放弃整个事务
+	expect(t, c, "OK", "MULTI")
+	expect(t, c, "QUEUED", "SET", "foo", "3")
+	expectError(t, c, "ERR wrong number of arguments for 'incr' command", "INCR")
+	expectError(t, c, "EXECABORT Transaction discarded because of previous errors.", "EXEC")
+	expect(t, c, "2", "GET", "foo")
+
+	expect(t, c, "OK", "MULTI")
+	expect(t, c, "QUEUED", "SET", "foo", "4")
+	expect(t, c, "OK", "DISCARD")
+	expect(t, c, "2", "GET", "foo")
+	expectError(t, c, "ERR EXEC without MULTI", "EXEC")
+}
+
+// 测试流水线请求
+func TestServer_Pipeline(t *testing.T) {
+	addr, _, _ := newServer(t)
+	c := dial(t, addr)
+
+	for i := 0; i < 100; i++ {
+		if err := c.Send("INCR", "n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 100; i++ {
+		if v, err := c.Receive(); err != nil {
+			t.Fatal(err)
+		} else if v != int64(i) {
+			t.Fatalf("unexpected reply: %v", v)
+		}
+	}
+}
+
+// 测试Shutdown关闭空闲连接并拒绝新的连接
+func TestServer_Shutdown(t *testing.T) {
+	addr, s, _ := newServer(t)
+	c := dial(t, addr)
+	expect(t, c, "PONG", "PING")
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do("PING"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := resp.Dial(addr); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,168 @@
+package pddb
+
+// 写事务中的保存点, 记录创建时事务中所有bucket, node和脏页的状态
+// 创建保存点需要复制事务已经修改过的node, 修改较多的事务中创建的开销较大
+type Savepoint struct {
+	tx *Tx
+	// 事务中打开的bucket -> 创建保存点时的状态
+	buckets map[*Bucket]*Bucket
+	meta    meta
+	pages   map[pgid]*page
+	// 事务释放的page数量和可以分配的空闲page
+	pending int
+	ids     []pgid
+	blobs   int
+	// 事务记录的变更和注册的函数数量
+	changes          int
+	commitHandlers   int
+	rollbackHandlers int
+}
+
+// 在写事务中创建保存点, 之后可以通过RollbackTo撤销保存点之后的修改
+func (tx *Tx) Savepoint() (*Savepoint, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	} else if !tx.writeable {
+		return nil, ErrTxNotWriteable
+	}
+
+	sp := &Savepoint{
+		tx:               tx,
+		buckets:          make(map[*Bucket]*Bucket),
+		meta:             *tx.meta,
+		pages:            make(map[pgid]*page, len(tx.pages)),
+		pending:          len(tx.db.freelist.pending[tx.meta.txid]),
+		ids:              append([]pgid(nil), tx.db.freelist.ids...),
+		blobs:            len(tx.blobs),
+		changes:          len(tx.changes),
+		commitHandlers:   len(tx.commitHandlers),
+		rollbackHandlers: len(tx.rollbackHandlers),
+	}
+	for id, p := range tx.pages {
+		sp.pages[id] = p
+	}
+	sp.save(&tx.root)
+
+	tx.savepoints = append(tx.savepoints, sp)
+	return sp, nil
+}
+
+// 撤销保存点之后的所有修改, 事务保持打开, 之后创建的保存点失效
+// 保存点之前打开的bucket仍然可以使用, 游标需要重新创建
+func (tx *Tx) RollbackTo(sp *Savepoint) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writeable {
+		return ErrTxNotWriteable
+	}
+
+	n := -1
+	for i, other := range tx.savepoints {
+		if other == sp {
+			n = i
+		}
+	}
+	if n < 0 {
+		return ErrInvalidSavepoint
+	}
+	tx.savepoints = tx.savepoints[:n+1]
+
+	// 撤销保存点之后释放的page
+	f := tx.db.freelist
+	if ids := f.pending[tx.meta.txid]; len(ids) > sp.pending {
+		for _, id := range ids[sp.pending:] {
+			delete(f.cache, id)
+		}
+		f.pending[tx.meta.txid] = ids[:sp.pending]
+	}
+
+	// 归还保存点之后分配的page
+	f.ids = append(f.ids[:0], sp.ids...)
+	for _, id := range sp.ids {
+		f.cache[id] = true
+	}
+	tx.blobs = tx.blobs[:sp.blobs]
+
+	*tx.meta = sp.meta
+	tx.pages = make(map[pgid]*page, len(sp.pages))
+	for id, p := range sp.pages {
+		tx.pages[id] = p
+	}
+	for b, saved := range sp.buckets {
+		restoreBucket(b, saved)
+	}
+
+	tx.changes = tx.changes[:sp.changes]
+	tx.commitHandlers = tx.commitHandlers[:sp.commitHandlers]
+	tx.rollbackHandlers = tx.rollbackHandlers[:sp.rollbackHandlers]
+	return nil
+}
+
+// 数据库重新映射前复制保存点中引用文件的数据
+func (sp *Savepoint) dereference() {
+	for _, saved := range sp.buckets {
+		if saved.rootNode != nil {
+			saved.rootNode.root().dereference()
+		}
+	}
+}
+
+// 递归保存bucket及其打开的子bucket的状态
+func (sp *Savepoint) save(b *Bucket) {
+	saved := &Bucket{}
+	restoreBucket(saved, b)
+	sp.buckets[b] = saved
+	for _, child := range b.buckets {
+		sp.save(child)
+	}
+}
+
+// 将src的状态复制到dst, node复制后属于dst
+func restoreBucket(dst, src *Bucket) {
+	header := *src.bucket
+	buckets := make(map[string]*Bucket, len(src.buckets))
+	for name, child := range src.buckets {
+		buckets[name] = child
+	}
+
+	*dst = *src
+	dst.bucket = &header
+	dst.buckets = buckets
+	dst.nodes = make(map[pgid]*node, len(src.nodes))
+
+	copied := make(map[*node]*node)
+	dst.rootNode = copyNode(src.rootNode, dst, copied)
+	for id, n := range src.nodes {
+		dst.nodes[id] = copyNode(n, dst, copied)
+	}
+}
+
+// 复制node及其父子节点, 已经复制的node记录在copied中
+func copyNode(n *node, b *Bucket, copied map[*node]*node) *node {
+	if n == nil {
+		return nil
+	} else if c := copied[n]; c != nil {
+		return c
+	}
+
+	c := &node{
+		bucket:     b,
+		isLeaf:     n.isLeaf,
+		unbalanced: n.unbalanced,
+		spilled:    n.spilled,
+		pgid:       n.pgid,
+		key:        n.key,
+		inodes:     make(inodes, len(n.inodes)),
+	}
+	copy(c.inodes, n.inodes)
+	copied[n] = c
+
+	c.parent = copyNode(n.parent, b, copied)
+	if n.children != nil {
+		c.children = make(nodes, len(n.children))
+		for i, child := range n.children {
+			c.children[i] = copyNode(child, b, copied)
+		}
+	}
+	return c
+}
@@ -0,0 +1,166 @@
+package pddb_test
+
+import (
+	"fmt"
+	"pddb"
+	"testing"
+)
+
+// 回滚到保存点撤销之后的修改, 事务仍然可以继续写入并提交
+func TestTx_RollbackTo(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	// 准备一个占用多个page的bucket, 保存点之后删除
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("large"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var committed bool
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+
+		sp, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("changed")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket([]byte("child")); err != nil {
+			return err
+		}
+		if err := b.SetSequence(10); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte("large")); err != nil {
+			return err
+		}
+		tx.OnCommit(func() { t.Fatal("unexpected commit handler") })
+
+		if err := tx.RollbackTo(sp); err != nil {
+			return err
+		}
+		tx.OnCommit(func() { committed = true })
+
+		// 保存点之前打开的bucket可以继续使用
+		if v := b.Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if b.Get([]byte("baz")) != nil || b.Bucket([]byte("child")) != nil {
+			t.Fatal("expected rollback")
+		} else if b.Sequence() != 0 {
+			t.Fatalf("unexpected sequence: %d", b.Sequence())
+		} else if tx.Bucket([]byte("large")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return b.Put([]byte("qux"), []byte("quux"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !committed {
+		t.Fatal("expected commit handler")
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("qux")); string(v) != "quux" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if b.Get([]byte("baz")) != nil {
+			t.Fatal("expected rollback")
+		}
+		var n int
+		if err := tx.Bucket([]byte("large")).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if n != 1000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return tx.Check()
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 回滚到较早的保存点后, 之后创建的保存点失效
+func TestTx_RollbackTo_ErrInvalidSavepoint(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		sp1, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		sp2, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+			return err
+		}
+
+		if err := tx.RollbackTo(sp2); err != nil {
+			t.Fatal(err)
+		} else if b.Get([]byte("foo")) == nil || b.Get([]byte("baz")) != nil {
+			t.Fatal("unexpected state")
+		}
+		if err := tx.RollbackTo(sp1); err != nil {
+			t.Fatal(err)
+		} else if b.Get([]byte("foo")) != nil {
+			t.Fatal("unexpected state")
+		}
+		if err := tx.RollbackTo(sp2); err != pddb.ErrInvalidSavepoint {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// 同一个保存点可以多次回滚
+		if err := b.Put([]byte("foo"), []byte("again")); err != nil {
+			return err
+		}
+		return tx.RollbackTo(sp1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		if _, err := tx.Savepoint(); err != pddb.ErrTxNotWriteable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if k, _ := tx.Bucket([]byte("widgets")).Cursor().First(); k != nil {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,583 @@
+// server包通过HTTP/JSON对外提供pddb数据库的访问, 让多个进程共享同一个数据库文件
+//
+// 路由:
+//
+//	GET    /b/{bucket...}/k/{key}  读取value, 支持Range
+//	PUT    /b/{bucket...}/k/{key}  写入value, 不存在的bucket会被创建
+//	DELETE /b/{bucket...}/k/{key}  删除key
+//	GET    /b/{bucket...}          按顺序列出bucket中的元素, 支持prefix, limit, cursor参数, blob只返回大小
+//	POST   /batch                  在一个事务中执行多个操作
+//	GET    /stats                  数据库统计信息
+//
+// 路径中的bucket名称和key需要经过URL转义, key中的"/"写作"%2F"
+// JSON中的bucket名称, key和value都是base64编码的二进制数据
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"pddb"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// value超过该大小时直接以流的方式写入blob
+const DefaultStreamThreshold = 1 << 20
+
+// 非流式写入和batch请求体的最大大小
+const DefaultMaxBodySize = 32 << 20
+
+// 列表请求默认和最多返回的元素数量
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// 请求错误
+var (
+	// key或者bucket不存在
+	ErrNotFound = errors.New("not found")
+	// 请求路径, 参数或者请求体格式错误
+	ErrBadRequest = errors.New("bad request")
+	// 请求方法不支持
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// 请求体太大
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// 对外提供数据库访问的HTTP服务
+type Server struct {
+	db *pddb.DB
+
+	// value的Content-Length达到该大小时使用PutReader写入
+	StreamThreshold int64
+	// 非流式请求体的最大大小
+	MaxBodySize int64
+	// 流式写入的请求体在开始事务之前暂存的目录, 为空时使用系统临时目录
+	TempDir string
+
+	mu   sync.Mutex
+	http *http.Server
+}
+
+// 创建服务, 服务不负责关闭数据库
+func New(db *pddb.DB) *Server {
+	return &Server{
+		db:              db,
+		StreamThreshold: DefaultStreamThreshold,
+		MaxBodySize:     DefaultMaxBodySize,
+	}
+}
+
+// 在监听器上处理请求, 调用Shutdown后返回nil
+func (s *Server) Serve(l net.Listener) error {
+	if err := s.httpServer().Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// 监听地址并处理请求, 调用Shutdown后返回nil
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// 停止接收新的请求, 等待正在处理的请求完成或者ctx结束
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer().Shutdown(ctx)
+}
+
+func (s *Server) httpServer() *http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.http == nil {
+		s.http = &http.Server{Handler: s}
+	}
+	return s.http
+}
+
+// 分发请求
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case path == "/stats":
+		if r.Method != http.MethodGet {
+			writeError(w, ErrMethodNotAllowed)
+			return
+		}
+		s.handleStats(w, r)
+	case path == "/batch":
+		if r.Method != http.MethodPost {
+			writeError(w, ErrMethodNotAllowed)
+			return
+		}
+		s.handleBatch(w, r)
+	case strings.HasPrefix(path, "/b/"):
+		segments, err := splitPath(strings.TrimPrefix(path, "/b/"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		// 倒数第二段为"k"时最后一段是key, 否则整个路径都是bucket
+		if n := len(segments); n >= 3 && string(segments[n-2]) == "k" {
+			s.handleKey(w, r, segments[:n-2], segments[n-1])
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeError(w, ErrMethodNotAllowed)
+			return
+		}
+		s.handleList(w, r, segments)
+	default:
+		writeError(w, ErrNotFound)
+	}
+}
+
+// 处理单个key的读写
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request, path [][]byte, key []byte) {
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		err = s.db.ViewContext(r.Context(), func(tx *pddb.Tx) error {
+			b := bucketAt(tx, path)
+			if b == nil {
+				return ErrNotFound
+			}
+			rs := b.GetReader(key)
+			if rs == nil {
+				return ErrNotFound
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", time.Time{}, rs)
+			return nil
+		})
+	case http.MethodPut:
+		err = s.put(r, path, key)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		err = s.db.UpdateContext(r.Context(), func(tx *pddb.Tx) error {
+			b := bucketAt(tx, path)
+			if b == nil {
+				return ErrNotFound
+			}
+			return b.Delete(key)
+		})
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		err = ErrMethodNotAllowed
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// 写入请求体, 请求体都在开始事务前读取, 读取网络数据期间不持有写锁
+// 较大的请求体暂存到临时文件, 在事务中以流的方式写入, 其他请求体读取到内存
+func (s *Server) put(r *http.Request, path [][]byte, key []byte) error {
+	if r.ContentLength >= s.StreamThreshold {
+		f, err := s.spoolBody(r)
+		if err != nil {
+			return err
+		}
+		defer removeTemp(f)
+		return s.db.UpdateContext(r.Context(), func(tx *pddb.Tx) error {
+			b, err := createBucketAt(tx, path)
+			if err != nil {
+				return err
+			}
+			return b.PutReader(key, f, r.ContentLength)
+		})
+	}
+
+	value, err := s.readBody(r)
+	if err != nil {
+		return err
+	}
+	return s.db.UpdateContext(r.Context(), func(tx *pddb.Tx) error {
+		b, err := createBucketAt(tx, path)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	})
+}
+
+// 列表中的一个元素, 子bucket的value为空, blob只返回大小, 通过GET /b/{bucket}/k/{key}读取
+type item struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Bucket bool   `json:"bucket,omitempty"`
+	Blob   bool   `json:"blob,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// 列表结果, Next不为空时可以作为cursor参数继续读取
+type listResponse struct {
+	Items []item `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// 按顺序列出bucket中的元素
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request, path [][]byte) {
+	q := r.URL.Query()
+	prefix := []byte(q.Get("prefix"))
+
+	limit := DefaultListLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, ErrBadRequest)
+			return
+		}
+		if n < MaxListLimit {
+			limit = n
+		} else {
+			limit = MaxListLimit
+		}
+	}
+
+	// cursor是上一页返回的下一个key
+	start := prefix
+	if v := q.Get("cursor"); v != "" {
+		k, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || !bytes.HasPrefix(k, prefix) {
+			writeError(w, ErrBadRequest)
+			return
+		}
+		start = k
+	}
+
+	resp := listResponse{Items: []item{}}
+	if err := s.db.ViewContext(r.Context(), func(tx *pddb.Tx) error {
+		b := bucketAt(tx, path)
+		if b == nil {
+			return ErrNotFound
+		}
+
+		c := b.Cursor()
+		k, v := c.Seek(start)
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(resp.Items) == limit {
+				resp.Next = base64.RawURLEncoding.EncodeToString(k)
+				break
+			}
+			it := item{Key: clone(k)}
+			if v == nil {
+				it.Bucket = b.Bucket(k) != nil
+			} else if size, ok := c.Blob(); ok {
+				it.Blob, it.Size = true, size
+			} else {
+				it.Value = clone(v)
+			}
+			resp.Items = append(resp.Items, it)
+		}
+		return nil
+	}); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// batch中的操作类型
+const (
+	opGet    = "get"
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// batch中的一个操作, put时不存在的bucket会被创建
+type op struct {
+	Op     string   `json:"op"`
+	Bucket [][]byte `json:"bucket"`
+	Key    []byte   `json:"key"`
+	Value  []byte   `json:"value,omitempty"`
+}
+
+// 每个操作的结果, 只有get操作有value
+type opResult struct {
+	Found bool   `json:"found,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type batchRequest struct {
+	Ops []op `json:"ops"`
+}
+
+type batchResponse struct {
+	Results []opResult `json:"results"`
+}
+
+// 执行失败的操作, 返回给客户端用于定位
+type opError struct {
+	index int
+	err   error
+}
+
+func (e *opError) Error() string { return e.err.Error() }
+func (e *opError) Unwrap() error { return e.err }
+
+// 在一个事务中执行多个操作, 任意一个操作失败时整个事务回滚
+// 只包含get操作时使用只读事务
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	body, err := s.readBody(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req batchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	writeable := false
+	for _, o := range req.Ops {
+		switch o.Op {
+		case opGet:
+		case opPut, opDelete:
+			writeable = true
+		default:
+			writeError(w, ErrBadRequest)
+			return
+		}
+	}
+
+	resp := batchResponse{Results: make([]opResult, len(req.Ops))}
+	fn := func(tx *pddb.Tx) error {
+		for i, o := range req.Ops {
+			if err := execOp(tx, &o, &resp.Results[i]); err != nil {
+				return &opError{index: i, err: err}
+			}
+		}
+		return nil
+	}
+	if writeable {
+		err = s.db.UpdateContext(r.Context(), fn)
+	} else {
+		err = s.db.ViewContext(r.Context(), fn)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// 执行batch中的单个操作
+func execOp(tx *pddb.Tx, o *op, result *opResult) error {
+	if len(o.Bucket) == 0 {
+		return pddb.ErrBucketNameRequired
+	}
+
+	switch o.Op {
+	case opGet:
+		if b := bucketAt(tx, o.Bucket); b != nil {
+			if v := b.Get(o.Key); v != nil {
+				result.Found, result.Value = true, clone(v)
+			}
+		}
+		return nil
+	case opPut:
+		b, err := createBucketAt(tx, o.Bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(o.Key, o.Value)
+	default:
+		b := bucketAt(tx, o.Bucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete(o.Key)
+	}
+}
+
+// 统计信息
+type statsResponse struct {
+	TxID          int   `json:"txid"`
+	Size          int64 `json:"size"`
+	FreePageN     int   `json:"free_page_n"`
+	PendingPageN  int   `json:"pending_page_n"`
+	FreeAlloc     int   `json:"free_alloc"`
+	FreelistInuse int   `json:"freelist_inuse"`
+	TxN           int   `json:"tx_n"`
+	OpenTxN       int   `json:"open_tx_n"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	var resp statsResponse
+	if err := s.db.ViewContext(r.Context(), func(tx *pddb.Tx) error {
+		resp.TxID, resp.Size = tx.ID(), tx.Size()
+		return nil
+	}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stats := s.db.Stats()
+	resp.FreePageN = stats.FreePageN
+	resp.PendingPageN = stats.PendingPageN
+	resp.FreeAlloc = stats.FreeAlloc
+	resp.FreelistInuse = stats.FreelistInuse
+	resp.TxN = stats.TxN
+	resp.OpenTxN = stats.OpenTxN
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// 读取请求体, 超过MaxBodySize时返回ErrBodyTooLarge
+func (s *Server) readBody(r *http.Request) ([]byte, error) {
+	if r.ContentLength > s.MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, s.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(buf)) > s.MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	return buf, nil
+}
+
+// 将Content-Length大小的请求体暂存到临时文件, 返回定位到开头的文件
+func (s *Server) spoolBody(r *http.Request) (*os.File, error) {
+	if r.ContentLength > pddb.MaxBlobSize {
+		return nil, ErrBodyTooLarge
+	}
+	f, err := ioutil.TempFile(s.TempDir, "pddb-put-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(f, r.Body, r.ContentLength); err != nil {
+		removeTemp(f)
+		return nil, err
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		removeTemp(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// 关闭并删除临时文件
+func removeTemp(f *os.File) {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
+
+// 将转义后的路径拆分成bucket名称和key, 不允许空的路径段
+func splitPath(path string) ([][]byte, error) {
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		return nil, ErrBadRequest
+	}
+
+	var segments [][]byte
+	for _, s := range strings.Split(path, "/") {
+		v, err := url.PathUnescape(s)
+		if err != nil || v == "" {
+			return nil, ErrBadRequest
+		}
+		segments = append(segments, []byte(v))
+	}
+	return segments, nil
+}
+
+// 按照路径查找bucket, 不存在时返回nil
+func bucketAt(tx *pddb.Tx, path [][]byte) *pddb.Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// 按照路径创建bucket
+func createBucketAt(tx *pddb.Tx, path [][]byte) (*pddb.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	return b, err
+}
+
+// 错误对应的HTTP状态码
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, pddb.ErrBucketNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, ErrBodyTooLarge), errors.Is(err, pddb.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadRequest),
+		errors.Is(err, pddb.ErrBucketNameRequired),
+		errors.Is(err, pddb.ErrKeyRequired),
+		errors.Is(err, pddb.ErrKeyTooLarge),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadRequest
+	case errors.Is(err, pddb.ErrIncompatibleValue), errors.Is(err, pddb.ErrBucketExists):
+		return http.StatusConflict
+	case errors.Is(err, pddb.ErrDatabaseReadOnly), errors.Is(err, pddb.ErrTxNotWriteable):
+		return http.StatusForbidden
+	case errors.Is(err, pddb.ErrDatabaseNotOpen),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// 错误响应, Op是batch中失败的操作序号
+type errorResponse struct {
+	Error string `json:"error"`
+	Op    *int   `json:"op,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	resp := errorResponse{Error: err.Error()}
+	var oe *opError
+	if errors.As(err, &oe) {
+		resp.Op = &oe.index
+	}
+	writeJSON(w, statusCode(err), &resp)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func clone(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
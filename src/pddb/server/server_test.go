@@ -0,0 +1,457 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"pddb"
+	"pddb/server"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 在临时目录中打开数据库并启动测试服务
+func newServer(t *testing.T) (*httptest.Server, *server.Server, *pddb.DB) {
+	db, err := pddb.Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(db)
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		db.Close()
+	})
+	return ts, s, db
+}
+
+// 发送请求, 返回状态码和响应体
+func do(t *testing.T, method, url string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, buf
+}
+
+// 测试单个key的写入, 读取和删除
+func TestServer_Key(t *testing.T) {
+	ts, _, db := newServer(t)
+	url := ts.URL + "/b/widgets/parts/k/a%2Fb"
+
+	if code, _ := do(t, "GET", url, nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if code, body := do(t, "PUT", url, []byte("bar")); code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d %s", code, body)
+	}
+	if code, body := do(t, "GET", url, nil); code != http.StatusOK || string(body) != "bar" {
+		t.Fatalf("unexpected response: %d %q", code, body)
+	}
+
+	// 数据写入了嵌套的bucket
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Bucket([]byte("parts")).Get([]byte("a/b")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 子bucket不能作为key覆盖
+	if code, _ := do(t, "PUT", ts.URL+"/b/widgets/k/parts", []byte("x")); code != http.StatusConflict {
+		t.Fatalf("unexpected status: %d", code)
+	}
+
+	if code, _ := do(t, "DELETE", url, nil); code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if code, _ := do(t, "GET", url, nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if code, _ := do(t, "DELETE", ts.URL+"/b/missing/k/foo", nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if code, _ := do(t, "POST", url, nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status: %d", code)
+	}
+}
+
+// 测试大value以流的方式写入, 并支持Range读取
+func TestServer_Key_Stream(t *testing.T) {
+	ts, s, _ := newServer(t)
+	s.StreamThreshold = 1024
+
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+	url := ts.URL + "/b/widgets/k/large"
+	if code, body := do(t, "PUT", url, value); code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d %s", code, body)
+	}
+	if code, body := do(t, "GET", url, nil); code != http.StatusOK || !bytes.Equal(body, value) {
+		t.Fatalf("unexpected response: %d len=%d", code, len(body))
+	}
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Range", "bytes=50003-50006")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusPartialContent || string(body) != "3456" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+}
+
+// 第一次读取时关闭c
+type notifyReader struct {
+	io.ReadCloser
+	c    chan struct{}
+	once sync.Once
+}
+
+func (r *notifyReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.c) })
+	return r.ReadCloser.Read(p)
+}
+
+// 流式写入在开始事务前读取完请求体, 读取期间其他写事务不会被阻塞
+func TestServer_Key_StreamSpool(t *testing.T) {
+	_, s, db := newServer(t)
+	s.StreamThreshold = 1024
+	s.TempDir = t.TempDir()
+
+	// 服务开始读取请求体时通知
+	started := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			r.Body = &notifyReader{ReadCloser: r.Body, c: started}
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest("PUT", ts.URL+"/b/widgets/k/large", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(len(value))
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	if _, err := pw.Write(value[:len(value)/2]); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	updated := make(chan error, 1)
+	go func() {
+		updated <- db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("other"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), []byte("bar"))
+		})
+	}()
+	select {
+	case err := <-updated:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update blocked by streaming put")
+	}
+
+	if _, err := pw.Write(value[len(value)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if code := <-done; code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if code, body := do(t, "GET", ts.URL+"/b/widgets/k/large", nil); code != http.StatusOK || !bytes.Equal(body, value) {
+		t.Fatalf("unexpected response: %d len=%d", code, len(body))
+	}
+
+	// 临时文件已经删除
+	if files, err := ioutil.ReadDir(s.TempDir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("unexpected temp files: %d", len(files))
+	}
+}
+
+// 测试通过cursor分页列出bucket
+func TestServer_List(t *testing.T) {
+	ts, _, db := newServer(t)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"a1", "a2", "a3", "a4", "a5", "b1"} {
+			if err := b.Put([]byte(k), []byte("v"+k)); err != nil {
+				return err
+			}
+		}
+		_, err = b.CreateBucket([]byte("a6"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	var cursor string
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		code, body := do(t, "GET", ts.URL+"/b/widgets?prefix=a&limit=2&cursor="+cursor, nil)
+		if code != http.StatusOK {
+			t.Fatalf("unexpected status: %d %s", code, body)
+		}
+		var resp struct {
+			Items []struct {
+				Key    []byte
+				Value  []byte
+				Bucket bool
+			}
+			Next string
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, it := range resp.Items {
+			if it.Bucket {
+				keys = append(keys, string(it.Key)+"/")
+			} else if string(it.Value) != "v"+string(it.Key) {
+				t.Fatalf("unexpected value: %q", it.Value)
+			} else {
+				keys = append(keys, string(it.Key))
+			}
+		}
+		if resp.Next == "" {
+			break
+		}
+		cursor = resp.Next
+	}
+	if s := strings.Join(keys, ","); s != "a1,a2,a3,a4,a5,a6/" {
+		t.Fatalf("unexpected keys: %s", s)
+	}
+
+	if code, _ := do(t, "GET", ts.URL+"/b/missing", nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if code, _ := do(t, "GET", ts.URL+"/b/widgets?limit=x", nil); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", code)
+	}
+}
+
+// 列表中的blob只返回大小, 通过key读取数据
+func TestServer_List_Blob(t *testing.T) {
+	ts, _, db := newServer(t)
+	blob := bytes.Repeat([]byte("x"), 10000)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("a"), []byte("small")); err != nil {
+			return err
+		}
+		return b.PutReader([]byte("b"), bytes.NewReader(blob), int64(len(blob)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := do(t, "GET", ts.URL+"/b/widgets", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", code, body)
+	}
+	var resp struct {
+		Items []struct {
+			Key   []byte
+			Value []byte
+			Blob  bool
+			Size  int64
+		}
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 2 {
+		t.Fatalf("unexpected items: %s", body)
+	} else if it := resp.Items[0]; string(it.Value) != "small" || it.Blob {
+		t.Fatalf("unexpected item: %s", body)
+	} else if it := resp.Items[1]; it.Value != nil || !it.Blob || it.Size != int64(len(blob)) {
+		t.Fatalf("unexpected blob item: %s", body)
+	}
+
+	if code, body := do(t, "GET", ts.URL+"/b/widgets/k/b", nil); code != http.StatusOK || !bytes.Equal(body, blob) {
+		t.Fatalf("unexpected blob: %d %d bytes", code, len(body))
+	}
+}
+
+// 测试batch在一个事务中执行, 失败时整体回滚
+func TestServer_Batch(t *testing.T) {
+	ts, _, db := newServer(t)
+
+	body := `{"ops":[
+		{"op":"put","bucket":["d2lkZ2V0cw=="],"key":"Zm9v","value":"YmFy"},
+		{"op":"get","bucket":["d2lkZ2V0cw=="],"key":"Zm9v"},
+		{"op":"get","bucket":["d2lkZ2V0cw=="],"key":"YmF6"}
+	]}`
+	code, resp := do(t, "POST", ts.URL+"/batch", []byte(body))
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", code, resp)
+	} else if s := strings.TrimSpace(string(resp)); s != `{"results":[{},{"found":true,"value":"YmFy"},{}]}` {
+		t.Fatalf("unexpected response: %s", s)
+	}
+
+	// 第二个操作的key为空, 第一个操作也不会生效
+	body = `{"ops":[
+		{"op":"delete","bucket":["d2lkZ2V0cw=="],"key":"Zm9v"},
+		{"op":"put","bucket":["d2lkZ2V0cw=="],"value":"YmFy"}
+	]}`
+	code, resp = do(t, "POST", ts.URL+"/batch", []byte(body))
+	if code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d %s", code, resp)
+	} else if s := strings.TrimSpace(string(resp)); s != `{"error":"error key required","op":1}` {
+		t.Fatalf("unexpected response: %s", s)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := do(t, "POST", ts.URL+"/batch", []byte(`{"ops":[{"op":"x"}]}`)); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", code)
+	}
+}
+
+// 测试统计信息
+func TestServer_Stats(t *testing.T) {
+	ts, _, _ := newServer(t)
+	if code, _ := do(t, "PUT", ts.URL+"/b/widgets/k/foo", []byte("bar")); code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+
+	code, body := do(t, "GET", ts.URL+"/stats", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	var stats struct {
+		TxID int   `json:"txid"`
+		Size int64 `json:"size"`
+		TxN  int   `json:"tx_n"`
+	}
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatal(err)
+	} else if stats.TxID < 2 || stats.Size <= 0 || stats.TxN < 1 {
+		t.Fatalf("unexpected stats: %s", body)
+	}
+}
+
+// 测试只读数据库拒绝写入
+func TestServer_ReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = pddb.Open(path, 0666, &pddb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ts := httptest.NewServer(server.New(db))
+	defer ts.Close()
+
+	if code, _ := do(t, "PUT", ts.URL+"/b/widgets/k/foo", []byte("bar")); code != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", code)
+	}
+}
+
+// 测试Shutdown等待正在处理的请求完成
+func TestServer_Shutdown(t *testing.T) {
+	db, err := pddb.Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(db)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+
+	// 持有写锁, 让请求阻塞在事务中
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan int, 1)
+	go func() {
+		code, _ := do(t, "PUT", "http://"+l.Addr().String()+"/b/widgets/k/foo", []byte("bar"))
+		result <- code
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before request completed")
+	default:
+	}
+
+	tx.Rollback()
+	if code := <-result; code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,313 @@
+package pddb
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+	"weak"
+)
+
+// 读取数据库page的方式
+type Backend int
+
+const (
+	// 将整个数据库文件映射到内存, 数据库大小受maxMapSize限制
+	BackendMmap Backend = iota
+	// 使用pread按需读取page, 读取的page保存在有上限的LRU缓存中
+	BackendPread
+)
+
+// pread缓存默认最多保存的page数量, 包括overflow
+const DefaultPageCacheSize = 4096
+
+func (b Backend) String() string {
+	switch b {
+	case BackendMmap:
+		return "mmap"
+	case BackendPread:
+		return "pread"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// 数据库page的来源, DB.page在预写日志中找不到page时从这里读取
+type pageSource interface {
+	// 返回id对应的page, 开启加密时返回解密后的page, 返回的page在下一次remap之前有效
+	page(id pgid) *page
+	// 不需要remap就可以访问的大小
+	size() int
+	// 确保可以访问sz字节以内的page, 调用者需要持有mmaplock
+	remap(sz int) error
+	// page被重新写入后丢弃缓存的内容
+	invalidate(pages pages)
+	// 释放资源, 之后不能再读取page
+	close() error
+}
+
+// 将数据库文件映射到内存
+type mmapSource struct {
+	db      *DB
+	dataref []byte
+	data    *[maxMapSize]byte
+	datasz  int
+}
+
+func (s *mmapSource) page(id pgid) *page {
+	p := (*page)(unsafe.Pointer(&s.data[id*pgid(s.db.pageSize)]))
+	if s.db.cipher == nil || id <= 1 {
+		return p
+	}
+	return s.db.decryptedPage(p)
+}
+
+func (s *mmapSource) size() int {
+	return s.datasz
+}
+
+func (s *mmapSource) remap(sz int) error {
+	sz, err := s.db.mmapSize(sz)
+	if err != nil {
+		return err
+	}
+
+	// 取消映射
+	if err := s.close(); err != nil {
+		return err
+	}
+
+	// 将文件映射到内存
+	b, err := syscall.Mmap(int(s.db.file.(*os.File).Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	// 与内核交互, 采用随机访问模式
+	// if err := syscall.Madvise(b, syscall.MADV_RANDOM); err != nil {
+	// 	return fmt.Errorf("madvise error: %s", err)
+	// }
+	// 数据库对于内存的引用
+	s.dataref = b
+	s.data = (*[maxMapSize]byte)(unsafe.Pointer(&b[0]))
+	s.datasz = sz
+	return nil
+}
+
+// 映射中的page总是最新的, 只需要移除解密缓存
+func (s *mmapSource) invalidate(pages pages) {
+	if s.db.cipher != nil {
+		s.db.invalidateDecrypted(pages)
+	}
+}
+
+// 取消数据库文件的内存映射
+func (s *mmapSource) close() error {
+	if s.dataref == nil {
+		return nil
+	}
+	err := syscall.Munmap(s.dataref)
+	s.dataref = nil
+	s.data = nil
+	s.datasz = 0
+	if err != nil {
+		return fmt.Errorf("munmap error: %s", err)
+	}
+	return nil
+}
+
+// 使用pread读取page, 最近使用的page保存在LRU缓存中
+type preadSource struct {
+	file     io.ReaderAt
+	pageSize int
+	cipher   Cipher
+	cache    *pageCache
+}
+
+func newPreadSource(file io.ReaderAt, pageSize int, cipher Cipher, capacity int) *preadSource {
+	return &preadSource{
+		file:     file,
+		pageSize: pageSize,
+		cipher:   cipher,
+		cache:    newPageCache(capacity),
+	}
+}
+
+func (s *preadSource) page(id pgid) *page {
+	p, gen := s.cache.get(id)
+	if p != nil {
+		return p
+	}
+
+	// 读取时不持有锁, 不同的page可以并发读取
+	p, err := s.read(id)
+	if err != nil {
+		panic(fmt.Sprintf("page %d: %s", id, err))
+	}
+	return s.cache.put(id, p, gen)
+}
+
+// 从文件读取page及其overflow
+func (s *preadSource) read(id pgid) (*page, error) {
+	offset := int64(id) * int64(s.pageSize)
+	buf := make([]byte, s.pageSize)
+	if _, err := s.file.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	if overflow := int((*page)(unsafe.Pointer(&buf[0])).overflow); overflow > 0 {
+		full := make([]byte, (overflow+1)*s.pageSize)
+		copy(full, buf)
+		if _, err := s.file.ReadAt(full[s.pageSize:], offset+int64(s.pageSize)); err != nil {
+			return nil, err
+		}
+		buf = full
+	}
+
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if s.cipher == nil || id <= 1 {
+		return p, nil
+	}
+	return decryptPage(s.cipher, p, s.pageSize)
+}
+
+// 按需读取不需要映射, 任何大小都可以直接访问
+func (s *preadSource) size() int {
+	return math.MaxInt
+}
+
+func (s *preadSource) remap(sz int) error {
+	return nil
+}
+
+func (s *preadSource) invalidate(pages pages) {
+	s.cache.invalidate(pages)
+}
+
+func (s *preadSource) close() error {
+	s.cache.reset()
+	return nil
+}
+
+// 有上限的page缓存, 最近使用的page保存在LRU中
+// 被淘汰的page只保留弱引用, 仍被游标或者node引用的page不会被回收, 再次读取时直接复用,
+// 相当于在被引用期间固定在缓存中; page不会被复用, 淘汰不会影响仍在使用的page
+type pageCache struct {
+	// 缓存最多保存的page数量, 包括overflow
+	capacity int
+
+	mu sync.Mutex
+	// 最近使用的page在前面, 元素为*cachedPage
+	lru     *list.List
+	entries map[pgid]*list.Element
+	// 缓存中的page数量, 包括overflow
+	used int
+	// 被淘汰的page
+	evicted map[pgid]weak.Pointer[page]
+	// 每次invalidate递增, 读取期间被丢弃的page不会放入缓存
+	gen uint64
+}
+
+type cachedPage struct {
+	id pgid
+	p  *page
+}
+
+func newPageCache(capacity int) *pageCache {
+	if capacity <= 0 {
+		capacity = DefaultPageCacheSize
+	}
+	return &pageCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[pgid]*list.Element),
+		evicted:  make(map[pgid]weak.Pointer[page]),
+	}
+}
+
+// 返回缓存的page, 不存在时返回nil以及之后调用put需要的版本
+func (c *pageCache) get(id pgid) (*page, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(id), c.gen
+}
+
+// 放入get之后读取的page, 其他读取者已经放入时返回缓存中的page
+// 读取期间page被丢弃时不放入缓存
+func (c *pageCache) put(id pgid, p *page, gen uint64) *page {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached := c.lookup(id); cached != nil {
+		return cached
+	}
+	if gen == c.gen {
+		c.insert(id, p)
+	}
+	return p
+}
+
+// 在缓存和被淘汰但仍被引用的page中查找, 调用者需要持有锁
+func (c *pageCache) lookup(id pgid) *page {
+	if e := c.entries[id]; e != nil {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedPage).p
+	}
+	if w, ok := c.evicted[id]; ok {
+		delete(c.evicted, id)
+		if p := w.Value(); p != nil {
+			c.insert(id, p)
+			return p
+		}
+	}
+	return nil
+}
+
+// 放入缓存并淘汰最久没有使用的page, 调用者需要持有锁
+func (c *pageCache) insert(id pgid, p *page) {
+	c.entries[id] = c.lru.PushFront(&cachedPage{id: id, p: p})
+	c.used += int(p.overflow) + 1
+	for c.used > c.capacity && c.lru.Len() > 1 {
+		e := c.lru.Remove(c.lru.Back()).(*cachedPage)
+		delete(c.entries, e.id)
+		c.used -= int(e.p.overflow) + 1
+		c.evicted[e.id] = weak.Make(e.p)
+	}
+
+	// 清理已经被回收的page
+	if len(c.evicted) > 2*c.capacity {
+		for id, w := range c.evicted {
+			if w.Value() == nil {
+				delete(c.evicted, id)
+			}
+		}
+	}
+}
+
+// page被重新写入后丢弃缓存的内容
+func (c *pageCache) invalidate(pages pages) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, p := range pages {
+		if e := c.entries[p.id]; e != nil {
+			c.lru.Remove(e)
+			delete(c.entries, p.id)
+			c.used -= int(e.Value.(*cachedPage).p.overflow) + 1
+		}
+		delete(c.evicted, p.id)
+	}
+}
+
+// 清空缓存
+func (c *pageCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[pgid]*list.Element)
+	c.evicted = make(map[pgid]weak.Pointer[page])
+	c.used = 0
+}
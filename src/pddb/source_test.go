@@ -0,0 +1,120 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"pddb"
+	"testing"
+)
+
+// 使用pread读取page时数据库可以正常读写和重新打开
+func TestOpen_Pread(t *testing.T) {
+	for name, options := range map[string]*pddb.Options{
+		"default": {Backend: pddb.BackendPread, PageCacheSize: 16},
+		"cipher":  {Backend: pddb.BackendPread, PageCacheSize: 16, Cipher: MustCipher(6)},
+		"wal":     {Backend: pddb.BackendPread, PageCacheSize: 16, WAL: true, CheckpointSize: 64 * 1024},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := tempfile()
+			defer os.Remove(path)
+			defer os.Remove(path + ".wal")
+			db, err := pddb.Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blob := bytes.Repeat([]byte("blob"), 5000)
+			for i := 0; i < 10; i++ {
+				if err := db.Update(func(tx *pddb.Tx) error {
+					b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+					if err != nil {
+						return err
+					}
+					for j := 0; j < 200; j++ {
+						if err := b.Put([]byte(fmt.Sprintf("key%02d%03d", i, j)), []byte(fmt.Sprintf("value%d", i*1000+j))); err != nil {
+							return err
+						}
+					}
+					// 超过一个page的value产生overflow page
+					if err := b.Put([]byte(fmt.Sprintf("large%02d", i)), bytes.Repeat([]byte{byte(i)}, 10000)); err != nil {
+						return err
+					}
+					return b.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob)))
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 读事务期间写事务覆盖的page不影响读取
+			tx, err := db.Begin(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Update(func(tx *pddb.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				for j := 0; j < 200; j++ {
+					if err := b.Delete([]byte(fmt.Sprintf("key00%03d", j))); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if v := tx.Bucket([]byte("widgets")).Get([]byte("key00199")); string(v) != "value199" {
+				t.Fatalf("unexpected value: %q", v)
+			}
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			checkDB(t, db)
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = pddb.Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer MustClose(db)
+			checkDB(t, db)
+
+			if err := db.View(func(tx *pddb.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				if v := b.Get([]byte("key00199")); v != nil {
+					t.Fatalf("unexpected value: %q", v)
+				} else if v := b.Get([]byte("key09123")); string(v) != "value9123" {
+					t.Fatalf("unexpected value: %q", v)
+				} else if v := b.Get([]byte("large05")); !bytes.Equal(v, bytes.Repeat([]byte{5}, 10000)) {
+					t.Fatal("unexpected large value")
+				} else if v := b.Get([]byte("blob")); !bytes.Equal(v, blob) {
+					t.Fatal("unexpected blob")
+				}
+
+				// 遍历时游标引用的page被淘汰后仍然有效
+				n := 0
+				c := b.Cursor()
+				for k, _ := c.First(); k != nil; k, _ = c.Next() {
+					n++
+				}
+				if n != 9*200+10+1 {
+					t.Fatalf("unexpected count: %d", n)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// 未知的Backend返回错误
+func TestOpen_UnknownBackend(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	if _, err := pddb.Open(path, 0666, &pddb.Options{Backend: pddb.Backend(42)}); err != pddb.ErrUnknownBackend {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 语句错误
+var (
+	// 语句不符合语法
+	ErrSyntax = errors.New("syntax error")
+	// 列不存在
+	ErrColumnNotFound = errors.New("column not found")
+	// 主键只能有一个, 并且必须指定类型
+	ErrInvalidPrimaryKey = errors.New("invalid primary key")
+	// 主键已经存在
+	ErrDuplicateKey = errors.New("duplicate key")
+	// NOT NULL列或者主键写入了空值
+	ErrNotNull = errors.New("null value in not null column")
+	// 语句中的参数数量与传入的参数数量不一致
+	ErrArgumentCount = errors.New("argument count mismatch")
+	// 参数类型不支持
+	ErrInvalidArgument = errors.New("invalid argument")
+	// 表达式中不能使用列, 例如INSERT的VALUES和LIMIT
+	ErrNotConstant = errors.New("expression is not constant")
+)
+
+// 带有位置的语法错误
+func syntaxError(pos int, msg string) error {
+	return fmt.Errorf("%w at position %d: %s", ErrSyntax, pos, msg)
+}
@@ -0,0 +1,702 @@
+// sql包在pddb之上提供最小的SQL支持
+//
+// 支持CREATE TABLE, DROP TABLE, INSERT, SELECT ... WHERE ... ORDER BY ... LIMIT, DELETE和EXPLAIN
+// 表结构保存在系统bucket中, 每个表的行保存在与表同名的bucket中, key是编码后的主键
+// 没有主键的表使用自增的行号作为key. WHERE中对主键的比较会转换成游标的范围查找
+package sql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pddb"
+	"pddb/query"
+	"strconv"
+	"strings"
+)
+
+// 保存表结构的系统bucket, 表名 -> JSON编码的tableSchema
+const schemaBucketName = "__pddb_sql"
+
+// 执行结果, 查询语句返回列和行, 其他语句返回影响的行数
+type Result struct {
+	Columns      []query.Column
+	Rows         []*query.Row
+	RowsAffected int
+}
+
+// 解析并执行一条语句, 查询语句使用只读事务, 其他语句使用读写事务
+// 语句中的?按顺序替换为args
+func Exec(db *pddb.DB, s string, args ...interface{}) (*Result, error) {
+	stmt, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	var result *Result
+	fn := func(tx *pddb.Tx) error {
+		var err error
+		result, err = ExecStatement(tx, stmt, args...)
+		return err
+	}
+	if stmt.writeable() {
+		err = db.Update(fn)
+	} else {
+		err = db.View(fn)
+	}
+	return result, err
+}
+
+// 在事务中解析并执行一条语句
+func ExecTx(tx *pddb.Tx, s string, args ...interface{}) (*Result, error) {
+	stmt, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return ExecStatement(tx, stmt, args...)
+}
+
+// 在事务中执行已经解析的语句
+func ExecStatement(tx *pddb.Tx, stmt Statement, args ...interface{}) (*Result, error) {
+	params, err := bindArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	e := &executor{tx: tx, params: params}
+	if n := countParams(stmt); n != len(params) {
+		return nil, ErrArgumentCount
+	}
+
+	switch stmt := stmt.(type) {
+	case *CreateTable:
+		return e.createTable(stmt)
+	case *DropTable:
+		return e.dropTable(stmt)
+	case *Insert:
+		return e.insert(stmt)
+	case *Select:
+		p, err := e.planSelect(stmt)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := query.Collect(p.op)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Columns: rs.Columns, Rows: rs.Rows}, nil
+	case *Delete:
+		return e.delete(stmt)
+	case *Explain:
+		return e.explain(stmt)
+	}
+	return nil, fmt.Errorf("unsupported statement %T", stmt)
+}
+
+// 保存在系统bucket中的表结构, PrimaryKey为主键列的序号, 没有主键时为-1
+type tableSchema struct {
+	Columns    []query.Column `json:"columns"`
+	NotNull    []bool         `json:"not_null"`
+	PrimaryKey int            `json:"primary_key"`
+}
+
+// 打开的表
+type table struct {
+	name string
+	tableSchema
+	bucket *pddb.Bucket
+}
+
+// 执行一条语句的状态
+type executor struct {
+	tx     *pddb.Tx
+	params []query.Cell
+}
+
+// 打开表, 不存在时返回query.ErrTableNotFound
+func (e *executor) table(name string) (*table, error) {
+	schemas := e.tx.Bucket([]byte(schemaBucketName))
+	if schemas == nil {
+		return nil, query.ErrTableNotFound
+	}
+	v := schemas.Get([]byte(name))
+	if v == nil {
+		return nil, query.ErrTableNotFound
+	}
+	t := &table{name: name}
+	if err := json.Unmarshal(v, &t.tableSchema); err != nil {
+		return nil, err
+	}
+	if t.bucket = e.tx.Bucket([]byte(name)); t.bucket == nil {
+		return nil, query.ErrTableNotFound
+	}
+	return t, nil
+}
+
+func (e *executor) createTable(stmt *CreateTable) (*Result, error) {
+	if _, err := e.table(stmt.Name); err == nil {
+		if stmt.IfNotExists {
+			return &Result{}, nil
+		}
+		return nil, query.ErrTableExists
+	}
+
+	schema := tableSchema{PrimaryKey: -1}
+	for i, c := range stmt.Columns {
+		if query.ColumnIndex(schema.Columns, c.Name) >= 0 {
+			return nil, query.ErrInvalidColumn
+		}
+		if c.PrimaryKey {
+			// 主键必须有确定的类型, 保证编码后的key与值的顺序一致
+			if schema.PrimaryKey >= 0 || c.Type == query.TypeNull {
+				return nil, ErrInvalidPrimaryKey
+			}
+			schema.PrimaryKey = i
+		}
+		schema.Columns = append(schema.Columns, query.Column{Name: c.Name, Type: c.Type})
+		schema.NotNull = append(schema.NotNull, c.NotNull || c.PrimaryKey)
+	}
+	v, err := json.Marshal(&schema)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas, err := e.tx.CreateBucketIfNotExists([]byte(schemaBucketName))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.tx.CreateBucket([]byte(stmt.Name)); err == pddb.ErrBucketExists {
+		return nil, query.ErrTableExists
+	} else if err != nil {
+		return nil, err
+	}
+	return &Result{}, schemas.Put([]byte(stmt.Name), v)
+}
+
+func (e *executor) dropTable(stmt *DropTable) (*Result, error) {
+	if _, err := e.table(stmt.Name); err == query.ErrTableNotFound && stmt.IfExists {
+		return &Result{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := e.tx.DeleteBucket([]byte(stmt.Name)); err != nil {
+		return nil, err
+	}
+	return &Result{}, e.tx.Bucket([]byte(schemaBucketName)).Delete([]byte(stmt.Name))
+}
+
+func (e *executor) insert(stmt *Insert) (*Result, error) {
+	t, err := e.table(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	// VALUES中的每一项对应的列序号
+	indexes := make([]int, len(t.Columns))
+	if stmt.Columns == nil {
+		for i := range indexes {
+			indexes[i] = i
+		}
+	} else {
+		indexes = indexes[:0]
+		for _, name := range stmt.Columns {
+			i := query.ColumnIndex(t.Columns, name)
+			if i < 0 {
+				return nil, fmt.Errorf("%w: %s", ErrColumnNotFound, name)
+			}
+			indexes = append(indexes, i)
+		}
+	}
+
+	for _, values := range stmt.Rows {
+		if len(values) != len(indexes) {
+			return nil, query.ErrColumnCount
+		}
+		cells := make([]query.Cell, len(t.Columns))
+		for i, v := range values {
+			c, err := e.constant(v)
+			if err != nil {
+				return nil, err
+			}
+			if cells[indexes[i]], err = c.Convert(t.Columns[indexes[i]].Type); err != nil {
+				return nil, fmt.Errorf("%w: %s", err, t.Columns[indexes[i]].Name)
+			}
+		}
+		for i, c := range cells {
+			if t.NotNull[i] && c.IsNull() {
+				return nil, fmt.Errorf("%w: %s", ErrNotNull, t.Columns[i].Name)
+			}
+		}
+
+		key, err := t.rowKey(cells)
+		if err != nil {
+			return nil, err
+		}
+		if t.bucket.Get(key) != nil {
+			return nil, ErrDuplicateKey
+		}
+		if err := t.bucket.Put(key, query.EncodeRow(cells)); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{RowsAffected: len(stmt.Rows)}, nil
+}
+
+// 行的key, 有主键时使用编码后的主键, 否则使用自增的行号
+func (t *table) rowKey(cells []query.Cell) ([]byte, error) {
+	if t.PrimaryKey >= 0 {
+		return query.EncodeKey(cells[t.PrimaryKey])
+	}
+	id, err := t.bucket.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	return query.EncodeKey(query.Int(int64(id)))
+}
+
+func (e *executor) delete(stmt *Delete) (*Result, error) {
+	t, err := e.table(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	p, err := e.planScan(t, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先收集需要删除的key, 避免删除时游标失效
+	rs, err := query.Collect(p.op)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rs.Rows {
+		if err := t.bucket.Delete(row.Key); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{RowsAffected: len(rs.Rows)}, nil
+}
+
+func (e *executor) explain(stmt *Explain) (*Result, error) {
+	var p *plan
+	var err error
+	switch s := stmt.Statement.(type) {
+	case *Select:
+		p, err = e.planSelect(s)
+	case *Delete:
+		var t *table
+		if t, err = e.table(s.Table); err == nil {
+			if p, err = e.planScan(t, s.Where); err == nil {
+				p.describe("delete")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("cannot explain %T", stmt.Statement)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Columns: []query.Column{{Name: "plan", Type: query.TypeString}}}
+	for i := len(p.steps) - 1; i >= 0; i-- {
+		result.Rows = append(result.Rows, &query.Row{Cells: []query.Cell{query.String(p.steps[i])}})
+	}
+	return result, nil
+}
+
+// 执行计划, steps按照执行顺序记录每个操作符的描述
+type plan struct {
+	op    query.Operator
+	steps []string
+}
+
+func (p *plan) describe(format string, args ...interface{}) {
+	p.steps = append(p.steps, fmt.Sprintf(format, args...))
+}
+
+// 扫描表并按照WHERE筛选, 主键的比较条件转换成范围查找
+func (e *executor) planScan(t *table, where Expr) (*plan, error) {
+	p := &plan{}
+	var rng query.Range
+	if where != nil && t.PrimaryKey >= 0 {
+		var bounds keyBounds
+		if err := e.primaryKeyBounds(t, where, &bounds); err != nil {
+			return nil, err
+		}
+		rng = bounds.rng
+		if desc := bounds.String(t.Columns[t.PrimaryKey].Name); desc != "" {
+			p.describe("range scan %s (%s)", t.name, desc)
+		}
+	}
+	if p.steps == nil {
+		p.describe("scan %s", t.name)
+	}
+	p.op = query.RangeScan(t.bucket, t.Columns, rng)
+
+	if where != nil {
+		pred, err := e.compile(where, t.Columns)
+		if err != nil {
+			return nil, err
+		}
+		p.op = query.Filter(p.op, pred)
+		p.describe("filter %s", where)
+	}
+	return p, nil
+}
+
+func (e *executor) planSelect(stmt *Select) (*plan, error) {
+	t, err := e.table(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	p, err := e.planScan(t, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	// 展开*, 计算每一列的表达式
+	var projections []query.Projection
+	var exprs []Expr
+	for _, c := range stmt.Columns {
+		if c.Star {
+			for i, col := range t.Columns {
+				projections = append(projections, query.Projection{Name: col.Name, Type: col.Type, Expr: query.Col(i)})
+				exprs = append(exprs, &ColumnRef{Name: col.Name})
+			}
+			continue
+		}
+		expr, err := e.compile(c.Expr, t.Columns)
+		if err != nil {
+			return nil, err
+		}
+		proj := query.Projection{Name: c.Alias, Expr: expr}
+		if ref, ok := c.Expr.(*ColumnRef); ok {
+			i := query.ColumnIndex(t.Columns, ref.Name)
+			proj.Type = t.Columns[i].Type
+			if proj.Name == "" {
+				proj.Name = ref.Name
+			}
+		}
+		if proj.Name == "" {
+			proj.Name = "column" + strconv.Itoa(len(projections)+1)
+		}
+		projections = append(projections, proj)
+		exprs = append(exprs, c.Expr)
+	}
+
+	// 在投影之前排序, 排序项可以是表的列, 查询列的别名或者查询列的序号
+	if len(stmt.OrderBy) > 0 {
+		keys := make([]query.SortKey, len(stmt.OrderBy))
+		var desc []string
+		for i, o := range stmt.OrderBy {
+			expr := o.Expr
+			if lit, ok := expr.(*Literal); ok && lit.Value.Type == query.TypeInt {
+				n := int(lit.Value.Int)
+				if n < 1 || n > len(exprs) {
+					return nil, fmt.Errorf("%w: ORDER BY position %d", ErrColumnNotFound, n)
+				}
+				expr = exprs[n-1]
+			} else if ref, ok := expr.(*ColumnRef); ok && query.ColumnIndex(t.Columns, ref.Name) < 0 {
+				for j, proj := range projections {
+					if proj.Name == ref.Name {
+						expr = exprs[j]
+					}
+				}
+			}
+			compiled, err := e.compile(expr, t.Columns)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = query.SortKey{Expr: compiled, Desc: o.Desc}
+			if o.Desc {
+				desc = append(desc, expr.String()+" DESC")
+			} else {
+				desc = append(desc, expr.String())
+			}
+		}
+		p.op = query.Sort(p.op, keys...)
+		p.describe("sort %s", strings.Join(desc, ", "))
+	}
+
+	p.op = query.Project(p.op, projections...)
+	var names []string
+	for _, proj := range projections {
+		names = append(names, proj.Name)
+	}
+	p.describe("project %s", strings.Join(names, ", "))
+
+	if stmt.Limit != nil {
+		limit, err := e.integer(stmt.Limit)
+		if err != nil {
+			return nil, err
+		}
+		offset := 0
+		if stmt.Offset != nil {
+			if offset, err = e.integer(stmt.Offset); err != nil {
+				return nil, err
+			}
+		}
+		p.op = query.Limit(p.op, offset, limit)
+		p.describe("limit %d offset %d", limit, offset)
+	}
+	return p, nil
+}
+
+// 主键的范围, 同时记录用于EXPLAIN的边界值
+type keyBounds struct {
+	rng          query.Range
+	lower, upper *query.Cell
+	lowerOpen    bool
+	upperOpen    bool
+}
+
+func (b *keyBounds) String(name string) string {
+	var parts []string
+	if b.lower != nil {
+		op := ">="
+		if b.lowerOpen {
+			op = ">"
+		}
+		parts = append(parts, name+" "+op+" "+(&Literal{Value: *b.lower}).String())
+	}
+	if b.upper != nil {
+		op := "<="
+		if b.upperOpen {
+			op = "<"
+		}
+		parts = append(parts, name+" "+op+" "+(&Literal{Value: *b.upper}).String())
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// 收紧下界, key包含在范围内
+func (b *keyBounds) setLower(c query.Cell, key []byte, open bool) {
+	if open {
+		key = append(key, 0)
+	}
+	if b.rng.Start == nil || bytes.Compare(key, b.rng.Start) > 0 {
+		b.rng.Start, b.lower, b.lowerOpen = key, &c, open
+	}
+}
+
+// 收紧上界, key不包含在范围内
+func (b *keyBounds) setUpper(c query.Cell, key []byte, open bool) {
+	if !open {
+		key = append(key, 0)
+	}
+	if b.rng.End == nil || bytes.Compare(key, b.rng.End) < 0 {
+		b.rng.End, b.upper, b.upperOpen = key, &c, open
+	}
+}
+
+// 从AND连接的条件中找出主键与常量的比较, 计算主键的范围
+// 其他条件和不能转换成主键类型的常量不影响范围, 之后仍然由筛选检查
+func (e *executor) primaryKeyBounds(t *table, where Expr, b *keyBounds) error {
+	be, ok := where.(*BinaryExpr)
+	if !ok {
+		return nil
+	}
+	if be.Op == query.OpAnd {
+		if err := e.primaryKeyBounds(t, be.L, b); err != nil {
+			return err
+		}
+		return e.primaryKeyBounds(t, be.R, b)
+	}
+
+	// 常量在左边时交换两边
+	op, ref, value := be.Op, be.L, be.R
+	if _, ok := ref.(*ColumnRef); !ok {
+		ref, value = value, ref
+		switch op {
+		case query.OpLt:
+			op = query.OpGt
+		case query.OpLe:
+			op = query.OpGe
+		case query.OpGt:
+			op = query.OpLt
+		case query.OpGe:
+			op = query.OpLe
+		}
+	}
+	if r, ok := ref.(*ColumnRef); !ok || r.Name != t.Columns[t.PrimaryKey].Name {
+		return nil
+	}
+	if _, ok := value.(*Literal); !ok {
+		if _, ok := value.(*Param); !ok {
+			return nil
+		}
+	}
+
+	c, err := e.constant(value)
+	if err != nil {
+		return err
+	}
+	if c, err = c.Convert(t.Columns[t.PrimaryKey].Type); err != nil || c.IsNull() {
+		return nil
+	}
+	key, err := query.EncodeKey(c)
+	if err != nil {
+		return nil
+	}
+
+	switch op {
+	case query.OpEq:
+		b.setLower(c, key, false)
+		b.setUpper(c, key, false)
+	case query.OpGt:
+		b.setLower(c, key, true)
+	case query.OpGe:
+		b.setLower(c, key, false)
+	case query.OpLt:
+		b.setUpper(c, key, true)
+	case query.OpLe:
+		b.setUpper(c, key, false)
+	}
+	return nil
+}
+
+// 将表达式编译成query表达式, 列名按照columns解析
+func (e *executor) compile(expr Expr, columns []query.Column) (query.Expr, error) {
+	switch x := expr.(type) {
+	case *Literal:
+		return query.Const(x.Value), nil
+	case *Param:
+		return query.Const(e.params[x.Index]), nil
+	case *ColumnRef:
+		i := query.ColumnIndex(columns, x.Name)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrColumnNotFound, x.Name)
+		}
+		return query.Col(i), nil
+	case *BinaryExpr:
+		l, err := e.compile(x.L, columns)
+		if err != nil {
+			return nil, err
+		}
+		r, err := e.compile(x.R, columns)
+		if err != nil {
+			return nil, err
+		}
+		return query.Binary(x.Op, l, r), nil
+	case *UnaryExpr:
+		inner, err := e.compile(x.X, columns)
+		if err != nil {
+			return nil, err
+		}
+		if x.Op == "NOT" {
+			return query.Not(inner), nil
+		}
+		return query.Neg(inner), nil
+	case *IsNullExpr:
+		inner, err := e.compile(x.X, columns)
+		if err != nil {
+			return nil, err
+		}
+		if x.Not {
+			return query.Not(query.IsNull(inner)), nil
+		}
+		return query.IsNull(inner), nil
+	}
+	return nil, fmt.Errorf("unsupported expression %T", expr)
+}
+
+// 计算不引用列的表达式
+func (e *executor) constant(expr Expr) (query.Cell, error) {
+	compiled, err := e.compile(expr, nil)
+	if err != nil {
+		if errors.Is(err, ErrColumnNotFound) {
+			return query.Cell{}, ErrNotConstant
+		}
+		return query.Cell{}, err
+	}
+	return compiled.Eval(&query.Row{})
+}
+
+// 计算LIMIT和OFFSET, 必须是非负整数
+func (e *executor) integer(expr Expr) (int, error) {
+	c, err := e.constant(expr)
+	if err != nil {
+		return 0, err
+	} else if c.Type != query.TypeInt || c.Int < 0 {
+		return 0, query.ErrTypeMismatch
+	}
+	return int(c.Int), nil
+}
+
+// 将参数转换成单元格
+func bindArgs(args []interface{}) ([]query.Cell, error) {
+	cells := make([]query.Cell, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			cells[i] = query.Null()
+		case query.Cell:
+			cells[i] = v
+		case int:
+			cells[i] = query.Int(int64(v))
+		case int32:
+			cells[i] = query.Int(int64(v))
+		case int64:
+			cells[i] = query.Int(v)
+		case uint32:
+			cells[i] = query.Int(int64(v))
+		case float32:
+			cells[i] = query.Float(float64(v))
+		case float64:
+			cells[i] = query.Float(v)
+		case string:
+			cells[i] = query.String(v)
+		case []byte:
+			cells[i] = query.Bytes(v)
+		case bool:
+			cells[i] = query.Bool(v)
+		default:
+			return nil, fmt.Errorf("%w: %T", ErrInvalidArgument, arg)
+		}
+	}
+	return cells, nil
+}
+
+// 语句中参数的数量
+func countParams(stmt Statement) int {
+	n := 0
+	var walk func(Expr)
+	walk = func(expr Expr) {
+		switch x := expr.(type) {
+		case *Param:
+			n++
+		case *BinaryExpr:
+			walk(x.L)
+			walk(x.R)
+		case *UnaryExpr:
+			walk(x.X)
+		case *IsNullExpr:
+			walk(x.X)
+		}
+	}
+
+	switch s := stmt.(type) {
+	case *Insert:
+		for _, row := range s.Rows {
+			for _, v := range row {
+				walk(v)
+			}
+		}
+	case *Select:
+		for _, c := range s.Columns {
+			if !c.Star {
+				walk(c.Expr)
+			}
+		}
+		walk(s.Where)
+		for _, o := range s.OrderBy {
+			walk(o.Expr)
+		}
+		walk(s.Limit)
+		walk(s.Offset)
+	case *Delete:
+		walk(s.Where)
+	case *Explain:
+		return countParams(s.Statement)
+	}
+	return n
+}
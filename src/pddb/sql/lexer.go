@@ -0,0 +1,135 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 词法单元类型
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenString
+	tokenParam
+	tokenSymbol
+)
+
+// 词法单元, pos是在语句中的字节偏移, quoted表示标识符由双引号包围
+type token struct {
+	kind   tokenKind
+	text   string
+	pos    int
+	quoted bool
+}
+
+// 是否是指定的关键字, 不区分大小写
+func (t token) is(keyword string) bool {
+	return t.kind == tokenIdent && !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+// 多字符的符号, 需要先于单字符匹配
+var symbols = []string{"<=", ">=", "!=", "<>", "(", ")", ",", ";", "*", "=", "<", ">", "+", "-", "/", "%"}
+
+// 将语句拆分成词法单元, 最后一个单元为tokenEOF
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '-' && strings.HasPrefix(s[i:], "--"):
+			// 注释到行尾
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case isIdentStart(c):
+			start := i
+			for i < len(s) && (isIdentStart(s[i]) || isDigit(s[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[start:i], pos: start})
+		case c == '"':
+			text, n, err := lexQuoted(s, i, '"')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: text, pos: i, quoted: true})
+			i += n
+		case c == '\'':
+			text, n, err := lexQuoted(s, i, '\'')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: i})
+			i += n
+		case isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])):
+			start, kind := i, tokenInt
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+			if i < len(s) && s[i] == '.' {
+				kind = tokenFloat
+				for i++; i < len(s) && isDigit(s[i]); i++ {
+				}
+			}
+			if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+				kind = tokenFloat
+				i++
+				if i < len(s) && (s[i] == '+' || s[i] == '-') {
+					i++
+				}
+				for ; i < len(s) && isDigit(s[i]); i++ {
+				}
+			}
+			tokens = append(tokens, token{kind: kind, text: s[start:i], pos: start})
+		case c == '?':
+			tokens = append(tokens, token{kind: tokenParam, text: "?", pos: i})
+			i++
+		default:
+			matched := false
+			for _, sym := range symbols {
+				if strings.HasPrefix(s[i:], sym) {
+					tokens = append(tokens, token{kind: tokenSymbol, text: sym, pos: i})
+					i += len(sym)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, syntaxError(i, fmt.Sprintf("unexpected character %q", c))
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s)}), nil
+}
+
+// 读取引号中的内容, 连续两个引号表示引号本身, 返回内容和消耗的字节数
+func lexQuoted(s string, start int, quote byte) (string, int, error) {
+	var b strings.Builder
+	for i := start + 1; i < len(s); i++ {
+		if s[i] != quote {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == quote {
+			b.WriteByte(quote)
+			i++
+			continue
+		}
+		return b.String(), i + 1 - start, nil
+	}
+	return "", 0, syntaxError(start, "unterminated quoted string")
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
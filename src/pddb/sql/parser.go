@@ -0,0 +1,656 @@
+package sql
+
+import (
+	"fmt"
+	"pddb/query"
+	"strconv"
+	"strings"
+)
+
+// 语句
+type Statement interface {
+	// 语句是否需要读写事务
+	writeable() bool
+}
+
+// CREATE TABLE [IF NOT EXISTS] name (column type [PRIMARY KEY] [NOT NULL], ...)
+type CreateTable struct {
+	Name        string
+	Columns     []ColumnDef
+	IfNotExists bool
+}
+
+// 列定义
+type ColumnDef struct {
+	Name       string
+	Type       query.Type
+	PrimaryKey bool
+	NotNull    bool
+}
+
+// DROP TABLE [IF EXISTS] name
+type DropTable struct {
+	Name     string
+	IfExists bool
+}
+
+// INSERT INTO name [(column, ...)] VALUES (expr, ...), ...
+type Insert struct {
+	Table   string
+	Columns []string
+	Rows    [][]Expr
+}
+
+// SELECT expr [AS alias], ... FROM name [WHERE expr] [ORDER BY expr [ASC|DESC], ...] [LIMIT expr [OFFSET expr]]
+type Select struct {
+	Columns []SelectColumn
+	Table   string
+	Where   Expr
+	OrderBy []OrderBy
+	Limit   Expr
+	Offset  Expr
+}
+
+// 查询的一列, Star为true时表示所有列
+type SelectColumn struct {
+	Expr  Expr
+	Alias string
+	Star  bool
+}
+
+// 排序项
+type OrderBy struct {
+	Expr Expr
+	Desc bool
+}
+
+// DELETE FROM name [WHERE expr]
+type Delete struct {
+	Table string
+	Where Expr
+}
+
+// EXPLAIN statement, 返回语句的执行计划
+type Explain struct {
+	Statement Statement
+}
+
+func (*CreateTable) writeable() bool { return true }
+func (*DropTable) writeable() bool   { return true }
+func (*Insert) writeable() bool      { return true }
+func (*Select) writeable() bool      { return false }
+func (*Delete) writeable() bool      { return true }
+func (*Explain) writeable() bool     { return false }
+
+// 表达式
+type Expr interface {
+	String() string
+}
+
+// 常量
+type Literal struct {
+	Value query.Cell
+}
+
+// 参数, Index从0开始
+type Param struct {
+	Index int
+}
+
+// 列引用
+type ColumnRef struct {
+	Name string
+}
+
+// 二元运算
+type BinaryExpr struct {
+	Op   query.Op
+	L, R Expr
+}
+
+// 一元运算, Op为"NOT"或者"-"
+type UnaryExpr struct {
+	Op string
+	X  Expr
+}
+
+// X IS [NOT] NULL
+type IsNullExpr struct {
+	X   Expr
+	Not bool
+}
+
+func (e *Literal) String() string {
+	switch e.Value.Type {
+	case query.TypeString:
+		return "'" + strings.ReplaceAll(e.Value.String(), "'", "''") + "'"
+	case query.TypeBool:
+		return strings.ToUpper(e.Value.String())
+	}
+	return e.Value.String()
+}
+func (e *Param) String() string     { return "?" }
+func (e *ColumnRef) String() string { return e.Name }
+func (e *BinaryExpr) String() string {
+	return "(" + e.L.String() + " " + e.Op.String() + " " + e.R.String() + ")"
+}
+func (e *UnaryExpr) String() string {
+	if e.Op == "NOT" {
+		return "NOT " + e.X.String()
+	}
+	return e.Op + e.X.String()
+}
+func (e *IsNullExpr) String() string {
+	if e.Not {
+		return e.X.String() + " IS NOT NULL"
+	}
+	return e.X.String() + " IS NULL"
+}
+
+// 保留字不能直接作为表名和列名, 需要使用双引号
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "ORDER": true, "BY": true,
+	"LIMIT": true, "OFFSET": true, "AND": true, "OR": true, "NOT": true,
+	"IS": true, "NULL": true, "TRUE": true, "FALSE": true, "AS": true,
+	"ASC": true, "DESC": true, "INSERT": true, "INTO": true, "VALUES": true,
+	"DELETE": true, "CREATE": true, "TABLE": true, "DROP": true, "PRIMARY": true,
+	"KEY": true, "EXPLAIN": true, "IF": true, "EXISTS": true,
+}
+
+// 解析一条语句, 结尾的分号可以省略
+func Parse(s string) (Statement, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptSymbol(";")
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+	return stmt, nil
+}
+
+// 递归下降解析器
+type parser struct {
+	tokens []token
+	pos    int
+	params int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokenEOF {
+		return syntaxError(t.pos, "unexpected end of statement")
+	}
+	return syntaxError(t.pos, fmt.Sprintf("unexpected %q", t.text))
+}
+
+// 下一个单元是关键字时消耗它
+func (p *parser) accept(keyword string) bool {
+	if p.peek().is(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(keywords ...string) error {
+	for _, k := range keywords {
+		if t := p.peek(); !p.accept(k) {
+			return p.unexpected(t)
+		}
+	}
+	return nil
+}
+
+func (p *parser) acceptSymbol(sym string) bool {
+	if t := p.peek(); t.kind == tokenSymbol && t.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if t := p.peek(); !p.acceptSymbol(sym) {
+		return p.unexpected(t)
+	}
+	return nil
+}
+
+// 读取表名或者列名, 保留字需要使用双引号
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdent || (!t.quoted && keywords[strings.ToUpper(t.text)]) {
+		return "", p.unexpected(t)
+	}
+	return t.text, nil
+}
+
+func (p *parser) parseStatement() (Statement, error) {
+	t := p.peek()
+	switch {
+	case t.is("SELECT"):
+		return p.parseSelect()
+	case t.is("INSERT"):
+		return p.parseInsert()
+	case t.is("DELETE"):
+		return p.parseDelete()
+	case t.is("CREATE"):
+		return p.parseCreateTable()
+	case t.is("DROP"):
+		return p.parseDropTable()
+	case t.is("EXPLAIN"):
+		p.next()
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		} else if _, ok := stmt.(*Explain); ok {
+			return nil, p.unexpected(t)
+		}
+		return &Explain{Statement: stmt}, nil
+	}
+	return nil, p.unexpected(t)
+}
+
+func (p *parser) parseCreateTable() (*CreateTable, error) {
+	if err := p.expect("CREATE", "TABLE"); err != nil {
+		return nil, err
+	}
+	stmt := &CreateTable{}
+	if p.accept("IF") {
+		if err := p.expect("NOT", "EXISTS"); err != nil {
+			return nil, err
+		}
+		stmt.IfNotExists = true
+	}
+	var err error
+	if stmt.Name, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		var col ColumnDef
+		if col.Name, err = p.ident(); err != nil {
+			return nil, err
+		}
+		// 类型可以省略, 表示任意类型
+		if t := p.peek(); t.kind == tokenIdent && !t.quoted && !keywords[strings.ToUpper(t.text)] {
+			p.next()
+			if col.Type, err = query.ParseType(t.text); err != nil {
+				return nil, syntaxError(t.pos, fmt.Sprintf("unknown type %q", t.text))
+			}
+		}
+		for {
+			if p.accept("PRIMARY") {
+				if err := p.expect("KEY"); err != nil {
+					return nil, err
+				}
+				col.PrimaryKey = true
+			} else if p.accept("NOT") {
+				if err := p.expect("NULL"); err != nil {
+					return nil, err
+				}
+				col.NotNull = true
+			} else {
+				break
+			}
+		}
+		stmt.Columns = append(stmt.Columns, col)
+
+		if p.acceptSymbol(")") {
+			return stmt, nil
+		} else if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseDropTable() (*DropTable, error) {
+	if err := p.expect("DROP", "TABLE"); err != nil {
+		return nil, err
+	}
+	stmt := &DropTable{}
+	if p.accept("IF") {
+		if err := p.expect("EXISTS"); err != nil {
+			return nil, err
+		}
+		stmt.IfExists = true
+	}
+	var err error
+	stmt.Name, err = p.ident()
+	return stmt, err
+}
+
+func (p *parser) parseInsert() (*Insert, error) {
+	if err := p.expect("INSERT", "INTO"); err != nil {
+		return nil, err
+	}
+	stmt := &Insert{}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if p.acceptSymbol("(") {
+		for {
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, name)
+			if p.acceptSymbol(")") {
+				break
+			} else if err := p.expectSymbol(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.expect("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var row []Expr
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if p.acceptSymbol(")") {
+				break
+			} else if err := p.expectSymbol(","); err != nil {
+				return nil, err
+			}
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.acceptSymbol(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) parseSelect() (*Select, error) {
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	stmt := &Select{}
+	for {
+		if p.acceptSymbol("*") {
+			stmt.Columns = append(stmt.Columns, SelectColumn{Star: true})
+		} else {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			col := SelectColumn{Expr: e}
+			if p.accept("AS") {
+				if col.Alias, err = p.ident(); err != nil {
+					return nil, err
+				}
+			}
+			stmt.Columns = append(stmt.Columns, col)
+		}
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+
+	if p.accept("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			o := OrderBy{Expr: e}
+			if p.accept("DESC") {
+				o.Desc = true
+			} else {
+				p.accept("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, o)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.accept("LIMIT") {
+		if stmt.Limit, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		if p.accept("OFFSET") {
+			if stmt.Offset, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseDelete() (*Delete, error) {
+	if err := p.expect("DELETE", "FROM"); err != nil {
+		return nil, err
+	}
+	stmt := &Delete{}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	stmt.Where, err = p.parseWhere()
+	return stmt, err
+}
+
+func (p *parser) parseWhere() (Expr, error) {
+	if !p.accept("WHERE") {
+		return nil, nil
+	}
+	return p.parseExpr()
+}
+
+// 表达式按照优先级从低到高解析: OR, AND, NOT, 比较, 加减, 乘除, 负号
+func (p *parser) parseExpr() (Expr, error) {
+	return p.parseOr()
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.accept("OR") {
+		var r Expr
+		if r, err = p.parseAnd(); err == nil {
+			l = &BinaryExpr{Op: query.OpOr, L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	l, err := p.parseNot()
+	for err == nil && p.accept("AND") {
+		var r Expr
+		if r, err = p.parseNot(); err == nil {
+			l = &BinaryExpr{Op: query.OpAnd, L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.accept("NOT") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "NOT", X: x}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = map[string]query.Op{
+	"=": query.OpEq, "!=": query.OpNe, "<>": query.OpNe,
+	"<": query.OpLt, "<=": query.OpLe, ">": query.OpGt, ">=": query.OpGe,
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	l, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("IS") {
+		not := p.accept("NOT")
+		if err := p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		return &IsNullExpr{X: l, Not: not}, nil
+	}
+	if t := p.peek(); t.kind == tokenSymbol {
+		if op, ok := comparisonOps[t.text]; ok {
+			p.next()
+			r, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			return &BinaryExpr{Op: op, L: l, R: r}, nil
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAdditive() (Expr, error) {
+	l, err := p.parseMultiplicative()
+	for err == nil {
+		var op query.Op
+		if p.acceptSymbol("+") {
+			op = query.OpAdd
+		} else if p.acceptSymbol("-") {
+			op = query.OpSub
+		} else {
+			break
+		}
+		var r Expr
+		if r, err = p.parseMultiplicative(); err == nil {
+			l = &BinaryExpr{Op: op, L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseMultiplicative() (Expr, error) {
+	l, err := p.parseUnary()
+	for err == nil {
+		var op query.Op
+		if p.acceptSymbol("*") {
+			op = query.OpMul
+		} else if p.acceptSymbol("/") {
+			op = query.OpDiv
+		} else if p.acceptSymbol("%") {
+			op = query.OpMod
+		} else {
+			break
+		}
+		var r Expr
+		if r, err = p.parseUnary(); err == nil {
+			l = &BinaryExpr{Op: op, L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.acceptSymbol("-") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		// 负数常量直接计算, 便于主键范围查询
+		if lit, ok := x.(*Literal); ok {
+			switch lit.Value.Type {
+			case query.TypeInt:
+				return &Literal{Value: query.Int(-lit.Value.Int)}, nil
+			case query.TypeFloat:
+				return &Literal{Value: query.Float(-lit.Value.Float)}, nil
+			}
+		}
+		return &UnaryExpr{Op: "-", X: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenInt:
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, syntaxError(t.pos, fmt.Sprintf("invalid integer %q", t.text))
+		}
+		return &Literal{Value: query.Int(n)}, nil
+	case tokenFloat:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, syntaxError(t.pos, fmt.Sprintf("invalid number %q", t.text))
+		}
+		return &Literal{Value: query.Float(f)}, nil
+	case tokenString:
+		return &Literal{Value: query.String(t.text)}, nil
+	case tokenParam:
+		p.params++
+		return &Param{Index: p.params - 1}, nil
+	case tokenSymbol:
+		if t.text == "(" {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expectSymbol(")")
+		}
+	case tokenIdent:
+		switch {
+		case t.is("NULL"):
+			return &Literal{Value: query.Null()}, nil
+		case t.is("TRUE"):
+			return &Literal{Value: query.Bool(true)}, nil
+		case t.is("FALSE"):
+			return &Literal{Value: query.Bool(false)}, nil
+		}
+		p.pos--
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		return &ColumnRef{Name: name}, nil
+	}
+	return nil, p.unexpected(t)
+}
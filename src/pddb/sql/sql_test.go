@@ -0,0 +1,277 @@
+package sql_test
+
+import (
+	"errors"
+	"path/filepath"
+	"pddb"
+	"pddb/query"
+	"pddb/sql"
+	"reflect"
+	"testing"
+)
+
+// 在临时目录中打开数据库
+func openDB(t *testing.T) *pddb.DB {
+	db, err := pddb.Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// 执行语句, 出错时终止测试
+func mustExec(t *testing.T, db *pddb.DB, s string, args ...interface{}) *sql.Result {
+	t.Helper()
+	result, err := sql.Exec(db, s, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return result
+}
+
+// 将结果转换成字符串, 方便比较
+func rowStrings(result *sql.Result) [][]string {
+	out := make([][]string, len(result.Rows))
+	for i, row := range result.Rows {
+		for _, c := range row.Cells {
+			out[i] = append(out[i], c.String())
+		}
+	}
+	return out
+}
+
+// 创建users表并写入测试数据
+func createUsers(t *testing.T, db *pddb.DB) {
+	mustExec(t, db, `CREATE TABLE users (id INT PRIMARY KEY, name TEXT NOT NULL, age INT, score REAL)`)
+	result := mustExec(t, db, `INSERT INTO users VALUES
+		(1, 'alice', 31, 88.5),
+		(2, 'bob', 25, 72),
+		(3, 'carol', 42, 91),
+		(4, 'dave', NULL, 60),
+		(5, 'erin', 25, 95),
+		(6, 'frank', 50, 40),
+		(7, 'grace', 19, 77),
+		(8, 'heidi', 33, 81)`)
+	if result.RowsAffected != 8 {
+		t.Fatalf("unexpected rows affected: %d", result.RowsAffected)
+	}
+}
+
+// 测试建表, 写入和查询
+func TestExec(t *testing.T) {
+	db := openDB(t)
+	createUsers(t, db)
+
+	for _, tt := range []struct {
+		sql  string
+		cols []string
+		rows [][]string
+	}{
+		{
+			`SELECT name, age FROM users WHERE age >= 25 AND score > 70 ORDER BY age DESC, name LIMIT 3`,
+			[]string{"name", "age"},
+			[][]string{{"carol", "42"}, {"heidi", "33"}, {"alice", "31"}},
+		},
+		{
+			`SELECT id, score * 2 AS double, age + 1 FROM users WHERE age IS NULL OR name = 'grace' ORDER BY 2`,
+			[]string{"id", "double", "column3"},
+			[][]string{{"4", "120", "NULL"}, {"7", "154", "20"}},
+		},
+		{
+			`SELECT name FROM users WHERE NOT age < 40 ORDER BY name LIMIT 5 OFFSET 1`,
+			[]string{"name"},
+			[][]string{{"frank"}},
+		},
+		{
+			`SELECT name FROM users WHERE id > 2 AND id <= 5`,
+			[]string{"name"},
+			[][]string{{"carol"}, {"dave"}, {"erin"}},
+		},
+		{
+			`SELECT name AS n FROM users WHERE 6 < id ORDER BY n DESC`,
+			[]string{"n"},
+			[][]string{{"heidi"}, {"grace"}},
+		},
+	} {
+		result := mustExec(t, db, tt.sql)
+		var cols []string
+		for _, c := range result.Columns {
+			cols = append(cols, c.Name)
+		}
+		if !reflect.DeepEqual(cols, tt.cols) {
+			t.Fatalf("%s: unexpected columns: %v", tt.sql, cols)
+		}
+		if got := rowStrings(result); !reflect.DeepEqual(got, tt.rows) {
+			t.Fatalf("%s: unexpected rows: %v", tt.sql, got)
+		}
+	}
+
+	// 参数按照顺序绑定
+	result := mustExec(t, db, `SELECT name FROM users WHERE id = ? OR name = ?`, 8, "bob")
+	if got := rowStrings(result); !reflect.DeepEqual(got, [][]string{{"bob"}, {"heidi"}}) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+
+	// 删除后行不再可见, 其他表不受影响
+	if result := mustExec(t, db, `DELETE FROM users WHERE age < 30`); result.RowsAffected != 3 {
+		t.Fatalf("unexpected rows affected: %d", result.RowsAffected)
+	}
+	result = mustExec(t, db, `SELECT id FROM users`)
+	if got := rowStrings(result); !reflect.DeepEqual(got, [][]string{{"1"}, {"3"}, {"4"}, {"6"}, {"8"}}) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+
+	mustExec(t, db, `DROP TABLE users`)
+	mustExec(t, db, `DROP TABLE IF EXISTS users`)
+	if _, err := sql.Exec(db, `SELECT * FROM users`); err != query.ErrTableNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 测试主键条件转换成范围查找
+func TestExec_Explain(t *testing.T) {
+	db := openDB(t)
+	createUsers(t, db)
+
+	// 计划从最外层的操作符开始
+	for _, tt := range []struct {
+		sql  string
+		plan []string
+	}{
+		{
+			`EXPLAIN SELECT name FROM users WHERE id >= 3 AND id < 7 AND age > 30 LIMIT 2`,
+			[]string{
+				"limit 2 offset 0",
+				"project name",
+				"filter (((id >= 3) AND (id < 7)) AND (age > 30))",
+				"range scan users (id >= 3 AND id < 7)",
+			},
+		},
+		{
+			`EXPLAIN SELECT * FROM users WHERE 5 = id`,
+			[]string{
+				"project id, name, age, score",
+				"filter (5 = id)",
+				"range scan users (id >= 5 AND id <= 5)",
+			},
+		},
+		{
+			`EXPLAIN SELECT name FROM users WHERE id > 1 OR age > 1 ORDER BY age`,
+			[]string{
+				"project name",
+				"sort age",
+				"filter ((id > 1) OR (age > 1))",
+				"scan users",
+			},
+		},
+		{
+			`EXPLAIN DELETE FROM users WHERE id > 6`,
+			[]string{
+				"delete",
+				"filter (id > 6)",
+				"range scan users (id > 6)",
+			},
+		},
+	} {
+		result := mustExec(t, db, tt.sql)
+		var plan []string
+		for _, row := range result.Rows {
+			plan = append(plan, row.Cells[0].String())
+		}
+		if !reflect.DeepEqual(plan, tt.plan) {
+			t.Fatalf("%s: unexpected plan: %q", tt.sql, plan)
+		}
+	}
+
+	// 范围查找的结果与全表扫描一致
+	result := mustExec(t, db, `SELECT id FROM users WHERE id >= 3 AND id < 7 AND id > 3 AND id <= 9`)
+	if got := rowStrings(result); !reflect.DeepEqual(got, [][]string{{"4"}, {"5"}, {"6"}}) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+	result = mustExec(t, db, `SELECT id FROM users WHERE id = 2.5 OR id = 3`)
+	if got := rowStrings(result); !reflect.DeepEqual(got, [][]string{{"3"}}) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+}
+
+// 测试字符串主键和没有主键的表
+func TestExec_Keys(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, `CREATE TABLE kv (k TEXT PRIMARY KEY, v BLOB)`)
+	mustExec(t, db, `INSERT INTO kv (v, k) VALUES (?, 'b'), (?, 'a'), (NULL, 'c')`, []byte("2"), []byte("1"))
+	result := mustExec(t, db, `SELECT k FROM kv WHERE k >= 'b'`)
+	if got := rowStrings(result); !reflect.DeepEqual(got, [][]string{{"b"}, {"c"}}) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+
+	// 没有主键时按照写入顺序保存
+	mustExec(t, db, `CREATE TABLE log (msg TEXT)`)
+	mustExec(t, db, `INSERT INTO log VALUES ('z'), ('y')`)
+	mustExec(t, db, `INSERT INTO log VALUES ('x')`)
+	result = mustExec(t, db, `SELECT msg FROM log`)
+	if got := rowStrings(result); !reflect.DeepEqual(got, [][]string{{"z"}, {"y"}, {"x"}}) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+
+	// 在已有的事务中执行, 字节串按照十六进制显示
+	if err := db.View(func(tx *pddb.Tx) error {
+		result, err := sql.ExecTx(tx, `SELECT v FROM kv WHERE k = 'a'`)
+		if err != nil {
+			return err
+		} else if got := rowStrings(result); !reflect.DeepEqual(got, [][]string{{"31"}}) {
+			t.Fatalf("unexpected rows: %v", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试错误处理
+func TestExec_Errors(t *testing.T) {
+	db := openDB(t)
+	createUsers(t, db)
+
+	for _, tt := range []struct {
+		sql  string
+		args []interface{}
+		err  error
+	}{
+		{`SELEC * FROM users`, nil, sql.ErrSyntax},
+		{`SELECT * FROM users WHERE`, nil, sql.ErrSyntax},
+		{`SELECT * FROM users; SELECT 1`, nil, sql.ErrSyntax},
+		{`SELECT 'abc FROM users`, nil, sql.ErrSyntax},
+		{`SELECT nope FROM users`, nil, sql.ErrColumnNotFound},
+		{`SELECT * FROM users ORDER BY 9`, nil, sql.ErrColumnNotFound},
+		{`SELECT * FROM missing`, nil, query.ErrTableNotFound},
+		{`CREATE TABLE users (id INT)`, nil, query.ErrTableExists},
+		{`CREATE TABLE t (a INT PRIMARY KEY, b INT PRIMARY KEY)`, nil, sql.ErrInvalidPrimaryKey},
+		{`CREATE TABLE t (a ANY PRIMARY KEY)`, nil, sql.ErrInvalidPrimaryKey},
+		{`CREATE TABLE t (a INT, a TEXT)`, nil, query.ErrInvalidColumn},
+		{`INSERT INTO users VALUES (1, 'x', 1, 1)`, nil, sql.ErrDuplicateKey},
+		{`INSERT INTO users VALUES (NULL, 'x', 1, 1)`, nil, sql.ErrNotNull},
+		{`INSERT INTO users (id) VALUES (9)`, nil, sql.ErrNotNull},
+		{`INSERT INTO users (id, name) VALUES (9, name)`, nil, sql.ErrNotConstant},
+		{`INSERT INTO users (id, name) VALUES (9)`, nil, query.ErrColumnCount},
+		{`INSERT INTO users (id, nope) VALUES (9, 1)`, nil, sql.ErrColumnNotFound},
+		{`INSERT INTO users (id, name) VALUES ('x', 'y')`, nil, query.ErrTypeMismatch},
+		{`SELECT * FROM users WHERE id = ?`, nil, sql.ErrArgumentCount},
+		{`SELECT * FROM users WHERE id = ?`, []interface{}{struct{}{}}, sql.ErrInvalidArgument},
+		{`SELECT * FROM users LIMIT 'x'`, nil, query.ErrTypeMismatch},
+		{`SELECT id / 0 FROM users`, nil, query.ErrDivideByZero},
+	} {
+		if _, err := sql.Exec(db, tt.sql, tt.args...); !errors.Is(err, tt.err) {
+			t.Fatalf("%s: unexpected error: %v", tt.sql, err)
+		}
+	}
+
+	// 失败的写入不影响已有的数据
+	if _, err := sql.Exec(db, `INSERT INTO users VALUES (9, 'ivan', 1, 1), (1, 'x', 1, 1)`); !errors.Is(err, sql.ErrDuplicateKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result := mustExec(t, db, `SELECT name FROM users WHERE id = 9`)
+	if len(result.Rows) != 0 {
+		t.Fatalf("unexpected rows: %v", rowStrings(result))
+	}
+}
@@ -0,0 +1,270 @@
+package pddb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// 过期索引所在的系统bucket
+// deadline子bucket: 过期时间(8字节大端) + 条目 -> 空, 按过期时间排序
+// key子bucket: 条目 -> 过期时间, 条目由bucket路径和key编码而成
+const ttlBucketName = "__pddb_ttl"
+
+var (
+	ttlDeadlineBucket = []byte("deadline")
+	ttlKeyBucket      = []byte("key")
+)
+
+// 后台清理单个事务默认删除的key数量
+const DefaultSweepBatchSize = 1000
+
+// 写入k/v并设置过期时间, 过期后Get不再返回该key, 并由后台清理删除
+// 再次调用Put会清除过期时间
+func (b *Bucket) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	if err := b.Put(key, value); err != nil {
+		return err
+	}
+	return b.setExpiry(key, time.Now().Add(ttl))
+}
+
+// 记录key的过期时间
+func (b *Bucket) setExpiry(key []byte, deadline time.Time) error {
+	if b.isSystem() {
+		return nil
+	}
+
+	ttl, err := b.tx.root.CreateBucketIfNotExists([]byte(ttlBucketName))
+	if err != nil {
+		return err
+	}
+	deadlines, err := ttl.CreateBucketIfNotExists(ttlDeadlineBucket)
+	if err != nil {
+		return err
+	}
+	keys, err := ttl.CreateBucketIfNotExists(ttlKeyBucket)
+	if err != nil {
+		return err
+	}
+
+	entry := expiryEntry(b.path, key)
+	if old := keys.Get(entry); old != nil {
+		if err := deadlines.Delete(append(cloneBytes(old), entry...)); err != nil {
+			return err
+		}
+	}
+
+	var d [8]byte
+	binary.BigEndian.PutUint64(d[:], uint64(deadline.UnixNano()))
+	if err := deadlines.Put(append(d[:], entry...), []byte{}); err != nil {
+		return err
+	}
+	return keys.Put(entry, d[:])
+}
+
+// 清除key的过期时间
+func (b *Bucket) clearExpiry(key []byte) error {
+	if b.isSystem() {
+		return nil
+	}
+	deadlines, keys := b.tx.expiryBuckets()
+	if keys == nil {
+		return nil
+	}
+
+	entry := expiryEntry(b.path, key)
+	old := keys.Get(entry)
+	if old == nil {
+		return nil
+	}
+	if err := deadlines.Delete(append(cloneBytes(old), entry...)); err != nil {
+		return err
+	}
+	return keys.Delete(entry)
+}
+
+// 清除path下所有key的过期时间, 用于删除bucket
+func (tx *Tx) clearExpiries(path [][]byte) error {
+	deadlines, keys := tx.expiryBuckets()
+	if keys == nil {
+		return nil
+	}
+
+	// 先收集条目, 避免删除过程中游标失效
+	prefix := expiryEntry(path, nil)
+	var entries, olds [][]byte
+	c := keys.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		entries = append(entries, cloneBytes(k))
+		olds = append(olds, cloneBytes(v))
+	}
+	for i, entry := range entries {
+		if err := deadlines.Delete(append(olds[i], entry...)); err != nil {
+			return err
+		} else if err := keys.Delete(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// key是否已经过期
+func (b *Bucket) expired(key []byte) bool {
+	if b.isSystem() {
+		return false
+	}
+	_, keys := b.tx.expiryBuckets()
+	return expiredIn(keys, b.path, key)
+}
+
+// 在过期索引的key子bucket中检查path下的key是否已经过期
+func expiredIn(keys *Bucket, path [][]byte, key []byte) bool {
+	if keys == nil {
+		return false
+	}
+
+	d := keys.Get(expiryEntry(path, key))
+	if len(d) != 8 {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(d)) <= time.Now().UnixNano()
+}
+
+// 返回过期索引的两个子bucket, 不存在时返回nil
+func (tx *Tx) expiryBuckets() (deadlines *Bucket, keys *Bucket) {
+	ttl := tx.root.Bucket([]byte(ttlBucketName))
+	if ttl == nil {
+		return nil, nil
+	}
+	deadlines, keys = ttl.Bucket(ttlDeadlineBucket), ttl.Bucket(ttlKeyBucket)
+	if deadlines == nil || keys == nil {
+		return nil, nil
+	}
+	return deadlines, keys
+}
+
+// 删除最多n个已经过期的key, 返回删除的数量
+func (tx *Tx) sweep(n int, now time.Time) (int, error) {
+	deadlines, keys := tx.expiryBuckets()
+	if deadlines == nil {
+		return 0, nil
+	}
+
+	var limit [8]byte
+	binary.BigEndian.PutUint64(limit[:], uint64(now.UnixNano()))
+
+	// 先收集过期的条目, 避免删除过程中游标失效
+	var expired [][]byte
+	c := deadlines.Cursor()
+	for k, _ := c.First(); k != nil && len(expired) < n; k, _ = c.Next() {
+		if bytes.Compare(k[:8], limit[:]) > 0 {
+			break
+		}
+		expired = append(expired, cloneBytes(k))
+	}
+
+	for _, k := range expired {
+		entry := k[8:]
+		if err := deadlines.Delete(k); err != nil {
+			return 0, err
+		}
+		if err := keys.Delete(entry); err != nil {
+			return 0, err
+		}
+
+		path, key, err := decodeBucketPath(entry)
+		if err != nil {
+			return 0, err
+		}
+		// 所在的bucket可能已经被删除
+		b := tx.bucketAt(path)
+		if b == nil {
+			continue
+		}
+		if err := b.Delete(key); err != nil && err != ErrIncompatibleValue {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// 清理所有已经过期的key, 返回删除的key数量
+// 每个写事务最多删除SweepBatchSize个key
+func (db *DB) Sweep() (int, error) {
+	var total int
+	for {
+		now := time.Now()
+
+		// 先用只读事务检查, 没有过期key时不开启写事务
+		var pending bool
+		if err := db.View(func(tx *Tx) error {
+			deadlines, _ := tx.expiryBuckets()
+			if deadlines == nil {
+				return nil
+			}
+			k, _ := deadlines.Cursor().First()
+			pending = k != nil && int64(binary.BigEndian.Uint64(k[:8])) <= now.UnixNano()
+			return nil
+		}); err != nil {
+			return total, err
+		}
+		if !pending {
+			return total, nil
+		}
+
+		var n int
+		if err := db.Update(func(tx *Tx) error {
+			var err error
+			n, err = tx.sweep(db.sweepBatchSize, now)
+			return err
+		}); err != nil {
+			return total, err
+		}
+		total += n
+		if n < db.sweepBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// 启动后台清理
+func (db *DB) startSweeper(interval time.Duration) {
+	db.sweepStop = make(chan struct{})
+	db.sweepDone = make(chan struct{})
+	go func() {
+		defer close(db.sweepDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := db.Sweep(); err != nil {
+					log.Printf("Database sweep error: %s", err)
+				}
+			case <-db.sweepStop:
+				return
+			}
+		}
+	}()
+}
+
+// 停止后台清理并等待正在执行的清理结束
+func (db *DB) stopSweeper() {
+	if db.sweepStop == nil {
+		return
+	}
+	close(db.sweepStop)
+	<-db.sweepDone
+	db.sweepStop = nil
+	db.sweepDone = nil
+}
+
+// 过期索引中的条目, 由bucket路径和key组成
+func expiryEntry(path [][]byte, key []byte) []byte {
+	return append(encodeBucketPath(path), key...)
+}
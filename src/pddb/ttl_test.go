@@ -0,0 +1,373 @@
+package pddb_test
+
+import (
+	"bytes"
+	"fmt"
+	"pddb"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 过期的key在清理前也不能被读取
+func TestBucket_PutWithTTL(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("short"), []byte("1"), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("long"), []byte("2"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("short")); !bytes.Equal(v, []byte("1")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("sessions"))
+		if v := b.Get([]byte("short")); v != nil {
+			t.Fatalf("expected expired key, got: %v", v)
+		}
+		if v := b.Get([]byte("long")); !bytes.Equal(v, []byte("2")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 过期时间必须大于0
+func TestBucket_PutWithTTL_ErrInvalidTTL(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("foo"), []byte("bar"), 0); err != pddb.ErrInvalidTTL {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 普通写入会清除过期时间
+func TestBucket_Put_ClearsTTL(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("foo"), []byte("1"), 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("foo"), []byte("2"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if n, err := db.Sweep(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("unexpected sweep count: %d", n)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("sessions")).Get([]byte("foo")); !bytes.Equal(v, []byte("2")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 遍历时与Get一样跳过已经过期的key
+func TestCursor_SkipsExpired(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			k := []byte(fmt.Sprintf("%02d", i))
+			if i%3 == 0 {
+				err = b.PutWithTTL(k, []byte("old"), 10*time.Millisecond)
+			} else {
+				err = b.PutWithTTL(k, []byte("new"), time.Hour)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("sessions"))
+		var keys []string
+		if err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if exp := "01,02,04,05,07,08"; strings.Join(keys, ",") != exp {
+			t.Fatalf("exp=%s; got=%v", exp, keys)
+		}
+
+		c := b.Cursor()
+		keys = keys[:0]
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			keys = append(keys, string(k))
+		}
+		if exp := "08,07,05,04,02,01"; strings.Join(keys, ",") != exp {
+			t.Fatalf("exp=%s; got=%v", exp, keys)
+		}
+		if k, _ := c.Seek([]byte("03")); string(k) != "04" {
+			t.Fatalf("unexpected seek: %s", k)
+		} else if k, _ := c.Seek([]byte("09")); k != nil {
+			t.Fatalf("unexpected seek: %s", k)
+		} else if k, _ := c.First(); string(k) != "01" {
+			t.Fatalf("unexpected first: %s", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 通过游标删除key同样清除过期时间
+func TestCursor_Delete_ClearsTTL(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.PutWithTTL([]byte("foo"), []byte("1"), time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		c := tx.Bucket([]byte("sessions")).Cursor()
+		if k, _ := c.First(); string(k) != "foo" {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		return c.Delete()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		for _, name := range [][]byte{[]byte("deadline"), []byte("key")} {
+			if k, _ := tx.Bucket([]byte("__pddb_ttl")).Bucket(name).Cursor().First(); k != nil {
+				t.Fatalf("unexpected expiry entry in %s: %x", name, k)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 清理会分批删除所有过期的key, 过期索引在重新打开数据库后仍然有效
+func TestDB_Sweep(t *testing.T) {
+	path := tempfile()
+	db, err := pddb.Open(path, 0666, &pddb.Options{SweepBatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := b.CreateBucket([]byte("nested"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "b", "c", "d"} {
+			if err := b.PutWithTTL([]byte(k), []byte(k), 10*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := child.PutWithTTL([]byte("a"), []byte("a"), 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("e"), []byte("e"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	db, err = pddb.Open(path, 0666, &pddb.Options{SweepBatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	if n, err := db.Sweep(); err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Fatalf("unexpected sweep count: %d", n)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		var keys []string
+		if err := tx.Bucket([]byte("sessions")).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 || keys[0] != "e" || keys[1] != "nested" {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+		if k, _ := tx.Bucket([]byte("sessions")).Bucket([]byte("nested")).Cursor().First(); k != nil {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 后台清理按照配置的时间间隔删除过期key
+func TestDB_Sweeper(t *testing.T) {
+	db, err := pddb.Open(tempfile(), 0666, &pddb.Options{SweepInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.PutWithTTL([]byte("foo"), []byte("bar"), time.Millisecond)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		var found bool
+		if err := db.View(func(tx *pddb.Tx) error {
+			k, _ := tx.Bucket([]byte("sessions")).Cursor().First()
+			found = k != nil
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("expired key was not swept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 删除bucket时清除其中key的过期时间, 不会影响之后在同一路径创建的bucket
+func TestBucket_DeleteBucket_ClearsTTL(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := b.CreateBucket([]byte("nested"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("foo"), []byte("1"), 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.PutWithTTL([]byte("bar"), []byte("1"), 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		other, err := tx.CreateBucket([]byte("sessions2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return other.PutWithTTL([]byte("foo"), []byte("1"), time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		if err := tx.DeleteBucket([]byte("sessions")); err != nil {
+			t.Fatal(err)
+		}
+		// 重新创建的bucket中导入的key没有过期时间
+		b, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("foo"), []byte("2"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *pddb.Tx) error {
+		var n int
+		if err := tx.Bucket([]byte("__pddb_ttl")).Bucket([]byte("key")).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("unexpected expiry entries: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if n, err := db.Sweep(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("unexpected sweep count: %d", n)
+	}
+}
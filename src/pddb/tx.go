@@ -1,9 +1,12 @@
 package pddb
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
 	"sort"
 	"unsafe"
-	"fmt"
 )
 
 type txid uint64
@@ -13,9 +16,25 @@ type Tx struct {
 	writeable bool
 	managed   bool
 	db        *DB
+	ctx       context.Context
 	meta      *meta
 	root      Bucket
 	pages     map[pgid]*page
+	// 提交成功后发送给副本的数据
+	replication []byte
+	// 事务对用户bucket的修改
+	changes []*Change
+	// 操作因为ctx取消而中断时返回的错误
+	interrupted error
+	// 提交成功和回滚后执行的函数
+	commitHandlers   []func()
+	rollbackHandlers []func()
+	// 按照创建顺序排列的有效保存点
+	savepoints []*Savepoint
+	// 已经直接写入文件的blob page
+	blobs []pgid
+	// 提交时截断文件末尾的空闲page
+	shrink bool
 }
 
 func (tx *Tx) init(db *DB) {
@@ -35,6 +54,16 @@ func (tx *Tx) init(db *DB) {
 	}
 }
 
+// 返回事务id, 只读事务返回最后一次提交的事务id
+func (tx *Tx) ID() int {
+	return int(tx.meta.txid)
+}
+
+// 返回事务可见的数据库大小
+func (tx *Tx) Size() int64 {
+	return int64(tx.meta.pgid) * int64(tx.db.pageSize)
+}
+
 func (tx *Tx) DB() *DB {
 	return tx.db
 }
@@ -43,6 +72,50 @@ func (tx *Tx) Writeable() bool {
 	return tx.writeable
 }
 
+// 返回事务关联的context, 没有关联时返回context.Background()
+func (tx *Tx) Context() context.Context {
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
+// 事务关联的context取消后返回ctx.Err(), 并记录事务被中断
+func (tx *Tx) checkContext() error {
+	if tx.ctx == nil {
+		return nil
+	}
+	if err := tx.ctx.Err(); err != nil {
+		tx.interrupted = err
+		return err
+	}
+	return nil
+}
+
+// 注册事务提交成功后执行的函数, 在元数据写入磁盘并释放写锁之后按注册顺序执行
+func (tx *Tx) OnCommit(fn func()) {
+	tx.commitHandlers = append(tx.commitHandlers, fn)
+}
+
+// 注册事务回滚后执行的函数, 提交失败同样会执行
+func (tx *Tx) OnRollback(fn func()) {
+	tx.rollbackHandlers = append(tx.rollbackHandlers, fn)
+}
+
+// 执行注册的函数, 函数中的panic不会影响数据库状态和其他函数
+func runHandlers(handlers []func()) {
+	for _, fn := range handlers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Database tx handler panic: %v", r)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
 // 提交事务
 func (tx *Tx) Commit() error {
 	if tx.managed {
@@ -52,6 +125,19 @@ func (tx *Tx) Commit() error {
 	} else if !tx.writeable {
 		return ErrTxNotWriteable
 	}
+
+	// context取消后不再提交
+	if err := tx.checkContext(); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	// 变更写入变更日志
+	if err := tx.writeChangeLog(); err != nil {
+		tx.rollback()
+		return err
+	}
+
 	// 删除过节点需要重新平衡
 	tx.root.rebalance()
 
@@ -64,10 +150,16 @@ func (tx *Tx) Commit() error {
 	// 释放旧根bucket
 	tx.meta.root.root = tx.root.root
 
+	// 降低高水位, 移除文件末尾的空闲page, 新的freelist page不会分配到被移除的page
+	hwm := tx.meta.pgid
+	if tx.shrink || tx.db.autoShrink {
+		tx.meta.pgid = tx.db.freelist.trim(tx.meta.pgid)
+	}
+
 	opgid := tx.meta.pgid
 	// 释放freelist并分配新的page
 	tx.db.freelist.free(tx.meta.txid, tx.db.page(tx.meta.freelist))
-	p, err := tx.allocate((tx.db.freelist.size() / tx.db.pageSize) + 1)
+	p, err := tx.allocate(tx.db.pageCount(tx.db.freelist.size()))
 	if err != nil {
 		tx.rollback()
 		return err
@@ -86,6 +178,30 @@ func (tx *Tx) Commit() error {
 		}
 	}
 
+	// blob page分配时不重新映射, 提交前确保所有page都在映射范围内
+	if minsz := int(tx.meta.pgid+1) * tx.db.pageSize; minsz > tx.db.source.size() {
+		if err := tx.db.mmap(minsz); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+
+	// 开启预写日志时, 脏页和元数据作为一条记录追加到日志
+	if tx.db.wal != nil {
+		if err := tx.writeWAL(); err != nil {
+			tx.rollback()
+			return err
+		}
+		db := tx.db
+		db.ship(tx.replication)
+		db.advanceChangeLog(tx.meta.txid)
+		db.publish(tx.changes)
+		tx.close()
+		db.notifyCheckpoint()
+		runHandlers(tx.commitHandlers)
+		return nil
+	}
+
 	// 脏页写入磁盘
 	if err := tx.write(); err != nil {
 		tx.rollback()
@@ -98,9 +214,25 @@ func (tx *Tx) Commit() error {
 		return err
 	}
 
+	// 元数据已经写入, 截断失败只会保留多余的空间
+	if tx.meta.pgid < hwm {
+		if err := tx.db.truncate(int(tx.meta.pgid) * tx.db.pageSize); err != nil {
+			log.Printf("Database shrink; truncate error %s", err)
+		}
+	}
+
+	// 将提交的数据发送给副本
+	tx.db.ship(tx.replication)
+
+	// 通知订阅者提交的变更
+	tx.db.advanceChangeLog(tx.meta.txid)
+	tx.db.publish(tx.changes)
+
 	// 最终关闭事务
 	tx.close()
 
+	runHandlers(tx.commitHandlers)
+
 	return nil
 }
 
@@ -120,6 +252,16 @@ func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
 	return tx.root.CreateBucket(name)
 }
 
+// 创建bucket, 如果bucket已经存在则直接返回
+func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	return tx.root.CreateBucketIfNotExists(name)
+}
+
+// 删除bucket
+func (tx *Tx) DeleteBucket(name []byte) error {
+	return tx.root.DeleteBucket(name)
+}
+
 // 获取bucket
 func (tx *Tx) Bucket(name []byte) *Bucket {
 	return tx.root.Bucket(name)
@@ -129,9 +271,28 @@ func (tx *Tx) Cursor() *Cursor {
 	return tx.root.Cursor()
 }
 
+// 遍历根bucket下的所有bucket
+func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
+	return tx.root.ForEach(func(k, v []byte) error {
+		return fn(k, tx.root.Bucket(k))
+	})
+}
+
 func (tx *Tx) rollback() {
-	// TODO 回滚事务
-	return
+	if tx.db == nil {
+		return
+	}
+	// 撤销事务对freelist的修改
+	if tx.writeable {
+		tx.db.freelist.rollback(tx.meta.txid)
+		tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
+		// 丢弃写入预写日志的blob page
+		if tx.db.wal != nil {
+			tx.db.wal.rollback()
+		}
+	}
+	tx.close()
+	runHandlers(tx.rollbackHandlers)
 }
 
 func (tx *Tx) page(id pgid) *page {
@@ -147,45 +308,28 @@ func (tx *Tx) page(id pgid) *page {
 }
 
 func (tx *Tx) write() error {
-	// 对于page进行排序
-	pages := make(pages, 0, len(tx.pages))
-	for _, p := range tx.pages {
-		pages = append(pages, p)
+	pages := tx.dirtyPages()
+	tx.replication = tx.replicationFrame(pages)
+
+	// 记录本次提交写入的page, 用于增量备份
+	if tx.db.pagelog != nil {
+		if err := tx.db.pagelog.append(tx.meta.txid, tx.writtenIDs(pages)); err != nil {
+			return err
+		}
 	}
-	tx.pages = make(map[pgid]*page)
-	sort.Sort(pages)
 
 	// 将page按序写入磁盘
-	for _, p := range pages {
-		size := (int(p.overflow) + 1) * tx.db.pageSize
-		offset := int64(p.id) * int64(tx.db.pageSize)
-
-		// 将page按照chunk大小写
-		ptr := (*[maxAllocSize]byte)(unsafe.Pointer(p))
-		for {
-			sz := size
-			if sz > maxAllocSize-1 {
-				sz = maxAllocSize - 1
-			}
-
-			// 写入磁盘
-			buf := ptr[:sz]
-			if _, err := tx.db.file.WriteAt(buf, offset); err != nil {
-				return err
-			}
-			size -= sz
-			if size == 0 {
-				break
-			}
-			offset += int64(sz)
-			ptr = (*[maxAllocSize]byte)(unsafe.Pointer(&ptr[sz]))
-		}
+	if err := tx.db.writePages(pages); err != nil {
+		return err
 	}
 
 	if err := fdatasync(tx.db); err != nil {
 		return err
 	}
 
+	// 丢弃被覆盖的page的缓存
+	tx.db.invalidatePages(pages)
+
 	// 将小page放回page pool
 	for _, p := range pages {
 		if int(p.overflow) != 0 {
@@ -202,6 +346,17 @@ func (tx *Tx) write() error {
 	return nil
 }
 
+// 返回按照id排序的脏页, 并清空事务的脏页缓存
+func (tx *Tx) dirtyPages() pages {
+	pages := make(pages, 0, len(tx.pages))
+	for _, p := range tx.pages {
+		pages = append(pages, p)
+	}
+	tx.pages = make(map[pgid]*page)
+	sort.Sort(pages)
+	return pages
+}
+
 func (tx *Tx) writeMeta() error {
 	// 为元数据页创建临时buffer
 	buf := make([]byte, tx.db.pageSize)
@@ -216,6 +371,114 @@ func (tx *Tx) writeMeta() error {
 		return err
 	}
 
+	tx.db.metalock.Lock()
+	defer tx.db.metalock.Unlock()
+	return tx.db.reloadMeta()
+}
+
+// 从指定page开始递归遍历所有page
+func (tx *Tx) forEachPage(pgid pgid, depth int, fn func(*page, int)) {
+	p := tx.page(pgid)
+
+	fn(p, depth)
+
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			elem := p.branchPageElement(uint16(i))
+			tx.forEachPage(elem.pgid, depth+1, fn)
+		}
+	}
+}
+
+// 递归遍历bucket及其所有子bucket使用的page, 行内bucket没有独立的page
+func (tx *Tx) forEachBucketPage(b *Bucket, fn func(p *page, b *Bucket)) {
+	if b.root != 0 {
+		tx.forEachPage(b.root, 0, func(p *page, _ int) {
+			fn(p, b)
+		})
+	}
+
+	// 遍历子bucket和blob, 不需要读取完整的value
+	c := b.Cursor()
+	for k, v, flags := c.rawFirst(); k != nil; k, v, flags = c.next() {
+		if (flags & bucketLeafFlag) != 0 {
+			tx.forEachBucketPage(b.Bucket(k), fn)
+		} else if (flags & blobValueFlag) != 0 {
+			tx.forEachBlobPage(v, func(p *page) { fn(p, b) })
+		}
+	}
+}
+
+// 检查事务开始时已经提交的数据是否一致, 返回发现的第一个错误, 应在只读事务中调用
+// 每个page最多被引用一次, 可见的page不能被释放, 其余page都必须在freelist中
+func (tx *Tx) Check() error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	// 使用事务对应的freelist page, 不受并发写事务的影响
+	f := newFreelist()
+	f.read(tx.page(tx.meta.freelist))
+
+	reachable := make(map[pgid]bool)
+	var err error
+	check := func(id pgid, p *page) error {
+		if p.id != id {
+			return fmt.Errorf("page %d: unexpected id: %d", id, p.id)
+		}
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			if id+i >= tx.meta.pgid {
+				return fmt.Errorf("page %d: out of bounds: %d", id+i, tx.meta.pgid)
+			} else if reachable[id+i] {
+				return fmt.Errorf("page %d: multiple references", id+i)
+			} else if f.freed(id + i) {
+				return fmt.Errorf("page %d: reachable freed", id+i)
+			}
+			reachable[id+i] = true
+		}
+		return nil
+	}
+	if err := check(tx.meta.freelist, tx.page(tx.meta.freelist)); err != nil {
+		return err
+	}
+
+	tx.forEachBucketPage(&tx.root, func(p *page, _ *Bucket) {
+		if err != nil {
+			return
+		}
+		if err = check(p.id, p); err != nil {
+			return
+		}
+
+		// 页内的key必须有序
+		var prev []byte
+		for i := 0; i < int(p.count); i++ {
+			var key []byte
+			switch {
+			case (p.flags & branchPageFlag) != 0:
+				key = p.branchPageElement(uint16(i)).key()
+			case (p.flags & leafPageFlag) != 0:
+				key = p.leafPageElement(uint16(i)).key()
+			default:
+				err = fmt.Errorf("page %d: invalid type: %d", p.id, p.flags)
+				return
+			}
+			if i > 0 && bytes.Compare(prev, key) >= 0 {
+				err = fmt.Errorf("page %d: keys out of order: %x >= %x", p.id, prev, key)
+				return
+			}
+			prev = key
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for id := pgid(2); id < tx.meta.pgid; id++ {
+		if !reachable[id] && !f.freed(id) {
+			return fmt.Errorf("page %d: unreachable unfreed", id)
+		}
+	}
 	return nil
 }
 
@@ -235,9 +498,21 @@ func (tx *Tx) close() {
 		return
 	}
 	if tx.writeable {
+		// 记录freelist状态
+		freeN := tx.db.freelist.free_count()
+		pendingN := tx.db.freelist.pending_count()
+		alloc := tx.db.freelist.size()
+
 		// 移除db对事务的引用和写锁
 		tx.db.rwtx = nil
 		tx.db.rwlock.Unlock()
+
+		tx.db.statlock.Lock()
+		tx.db.stats.FreePageN = freeN
+		tx.db.stats.PendingPageN = pendingN
+		tx.db.stats.FreeAlloc = (freeN + pendingN) * tx.db.pageSize
+		tx.db.stats.FreelistInuse = alloc
+		tx.db.statlock.Unlock()
 	} else {
 		tx.db.removeTx(tx)
 	}
@@ -246,4 +521,7 @@ func (tx *Tx) close() {
 	tx.meta = nil
 	tx.root = Bucket{tx: tx}
 	tx.pages = nil
+	tx.changes = nil
+	tx.savepoints = nil
+	tx.blobs = nil
 }
@@ -1,6 +1,9 @@
 package pddb_test
 
 import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
 	"testing"
 	"pddb"
 )
@@ -106,3 +109,97 @@ func TestTx_CreateBucket_ErrBucketNameRequired(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// 提交成功后执行OnCommit, 回滚或者提交失败后执行OnRollback, 函数中的panic被隔离
+func TestTx_OnCommit(t *testing.T) {
+	db := MustOpenDB()
+	defer MustClose(db)
+
+	var x []string
+	if err := db.Update(func(tx *pddb.Tx) error {
+		tx.OnCommit(func() { panic("boom") })
+		tx.OnCommit(func() {
+			// 执行时已经释放写锁
+			if err := db.Update(func(tx *pddb.Tx) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+			x = append(x, "commit")
+		})
+		tx.OnRollback(func() { x = append(x, "unexpected") })
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *pddb.Tx) error {
+		tx.OnCommit(func() { x = append(x, "unexpected") })
+		tx.OnRollback(func() { x = append(x, "rollback") })
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// 手动回滚
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.OnRollback(func() { x = append(x, "manual") })
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(x) != 3 || x[0] != "commit" || x[1] != "rollback" || x[2] != "manual" {
+		t.Fatalf("unexpected handlers: %v", x)
+	}
+	if err := db.View(func(tx *pddb.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkTx_Commit10(b *testing.B)    { benchmarkTxCommit(b, 10) }
+func BenchmarkTx_Commit100(b *testing.B)   { benchmarkTxCommit(b, 100) }
+func BenchmarkTx_Commit1000(b *testing.B)  { benchmarkTxCommit(b, 1000) }
+func BenchmarkTx_Commit10000(b *testing.B) { benchmarkTxCommit(b, 10000) }
+
+// 每个事务写入size个随机key, 只统计提交的时间
+// key在固定的范围内随机选择, 数据库大小不会随着迭代次数无限增长
+func benchmarkTxCommit(b *testing.B, size int) {
+	db := MustOpenDB()
+	defer MustClose(db)
+	if err := db.Update(func(tx *pddb.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		b.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(42))
+	key, value := make([]byte, 8), make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tx, err := db.Begin(true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bucket := tx.Bucket([]byte("widgets"))
+		for j := 0; j < size; j++ {
+			binary.BigEndian.PutUint64(key, uint64(r.Intn(1<<18)))
+			if err := bucket.Put(key, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package pddb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// 预写日志文件的后缀, 与数据库文件位于同一目录
+const walSuffix = ".wal"
+
+// 预写日志达到该大小后触发检查点
+const DefaultCheckpointSize = 4 * 1024 * 1024
+
+// 日志记录的魔法数
+const walMagic uint32 = 0x57414C31
+
+// blob page记录的魔法数
+const walBlobMagic uint32 = 0x57414C42
+
+// 日志记录头: 魔法数 + page数量 + 事务id
+const walFrameHeaderSize = 16
+
+// 一条blob page记录最多包含的page数量
+const walBlobFramePages = 64
+
+// 预写日志
+// 每次提交追加一条记录: 记录头 + 事务写入的page + meta page + 校验和
+// 日志中的page在检查点之前都保存在内存中, 读取时优先于数据库文件
+// blob page在提交之前按批写入blob page记录: 记录头 + page + 校验和, 只保存在日志文件中
+type wal struct {
+	file dbFile
+	// 日志文件中有效数据的大小
+	size int64
+	// 未提交的blob page记录写入的位置, 没有未提交的记录时与size相同
+	tail int64
+	// 日志中最新版本的page, 已经解密
+	pages map[pgid]*page
+	// 只保存在日志文件中的blob page在日志中的偏移
+	blobs map[pgid]int64
+	// 未提交的blob page, 回滚时移除
+	uncommitted []pgid
+	// 日志中最新的元数据, 为nil表示日志为空
+	meta *meta
+	lock sync.RWMutex
+}
+
+func newWAL(file dbFile) *wal {
+	return &wal{file: file, pages: make(map[pgid]*page), blobs: make(map[pgid]int64)}
+}
+
+// 返回日志中的page, 不存在时返回nil
+// 只保存在日志文件中的blob page持有读锁从日志文件读取, 避免检查点同时清空日志
+func (db *DB) walPage(id pgid) *page {
+	w := db.wal
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if p := w.pages[id]; p != nil {
+		return p
+	} else if off, ok := w.blobs[id]; ok {
+		return db.readWALPage(id, off)
+	}
+	return nil
+}
+
+// 返回日志中最新的元数据
+func (w *wal) latest() *meta {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.meta
+}
+
+// 将记录追加到日志并同步到磁盘, 成功后更新内存中的page
+// 之前写入的blob page记录与提交记录一起同步
+func (w *wal) append(frame []byte, pages pages, m *meta) error {
+	if _, err := w.file.WriteAt(frame, w.tail); err != nil {
+		_ = w.file.Truncate(w.tail)
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		_ = w.file.Truncate(w.tail)
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, p := range pages {
+		w.put(p)
+	}
+	w.meta = m
+	w.size = w.tail + int64(len(frame))
+	w.tail = w.size
+	w.uncommitted = nil
+	return nil
+}
+
+// 将blob page记录追加到日志, 不同步到磁盘, 提交之前对其他事务不可见
+// 记录中的page是新分配的page, 旧版本已经失效
+func (w *wal) appendBlobs(frame []byte, pageSize int) error {
+	count := (len(frame) - walFrameHeaderSize) / pageSize
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(count))
+	frame = binary.LittleEndian.AppendUint64(frame, walChecksum(frame))
+	if _, err := w.file.WriteAt(frame, w.tail); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for i := 0; i < count; i++ {
+		off := walFrameHeaderSize + i*pageSize
+		id := (*page)(unsafe.Pointer(&frame[off])).id
+		delete(w.pages, id)
+		w.blobs[id] = w.tail + int64(off)
+		w.uncommitted = append(w.uncommitted, id)
+	}
+	w.tail += int64(len(frame))
+	return nil
+}
+
+// 丢弃未提交的blob page记录
+func (w *wal) rollback() {
+	if w.tail == w.size {
+		return
+	}
+	_ = w.file.Truncate(w.size)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, id := range w.uncommitted {
+		delete(w.blobs, id)
+	}
+	w.uncommitted = nil
+	w.tail = w.size
+}
+
+// 保存page的最新版本, 调用者需要持有锁
+// overflow覆盖的page之前的版本已经失效, 检查点按id顺序写回时会覆盖overflow的数据
+func (w *wal) put(p *page) {
+	w.pages[p.id] = p
+	delete(w.blobs, p.id)
+	for id := p.id + 1; id <= p.id+pgid(p.overflow); id++ {
+		delete(w.pages, id)
+		delete(w.blobs, id)
+	}
+}
+
+// 清空日志, 持有写锁等待正在从日志文件读取的事务
+func (w *wal) reset() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.pages = make(map[pgid]*page)
+	w.blobs = make(map[pgid]int64)
+	w.uncommitted = nil
+	w.meta = nil
+	w.size, w.tail = 0, 0
+	return nil
+}
+
+// 打开预写日志并恢复日志中的事务
+// 没有开启预写日志时, 如果存在上次遗留的日志, 恢复后写回数据库文件并删除日志
+func (db *DB) openWAL(enabled bool, mode os.FileMode) error {
+	// 内存数据库的日志也保存在内存中
+	if db.memory {
+		if enabled {
+			db.wal = newWAL(&memFile{})
+		}
+		return nil
+	}
+
+	path := db.path + walSuffix
+	if info, err := os.Stat(path); os.IsNotExist(err) {
+		if !enabled || db.readOnly {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	} else if !enabled && info.Size() == 0 {
+		return os.Remove(path)
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if db.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, mode)
+	if err != nil {
+		return err
+	}
+	db.wal = newWAL(f)
+
+	if err := db.recoverWAL(); err != nil {
+		return err
+	}
+
+	// 日志中的page可能超出当前的映射范围
+	if m := db.wal.latest(); m != nil {
+		if err := db.mmap(int(m.pgid+1) * db.pageSize); err != nil {
+			return err
+		}
+	}
+
+	// 只读模式下日志保留在内存中
+	if db.readOnly {
+		return nil
+	}
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	if !enabled {
+		db.wal = nil
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// 按顺序重放日志中的记录, 跳过已经写回数据库文件的事务
+// blob page记录在同一事务的提交记录之后才生效
+// 遇到不完整或者校验失败的记录时停止, 并丢弃之后的数据
+func (db *DB) recoverWAL() error {
+	w := db.wal
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, info.Size())
+	if _, err := w.file.ReadAt(data, 0); err != nil {
+		return err
+	}
+
+	// 等待提交记录的blob page及其在日志中的偏移
+	var pending []pgid
+	var offsets []int64
+	var pendingTxid txid
+
+	txid := db.meta().txid
+	var off, committed int
+	for off < len(data) {
+		if n, id, ids, ok := db.readWALBlobFrame(data[off:]); ok {
+			if len(pending) > 0 && id != pendingTxid {
+				break
+			}
+			for i, pid := range ids {
+				pending = append(pending, pid)
+				offsets = append(offsets, int64(off+walFrameHeaderSize+i*db.pageSize))
+			}
+			pendingTxid = id
+			off += n
+			continue
+		}
+
+		n, pages, m, ok := db.readWALFrame(data[off:])
+		if !ok || (len(pending) > 0 && m.txid != pendingTxid) {
+			break
+		}
+		off += n
+		committed = off
+		if m.txid > txid {
+			for i, id := range pending {
+				delete(w.pages, id)
+				w.blobs[id] = offsets[i]
+			}
+			for _, p := range pages {
+				w.put(p)
+			}
+			w.meta, txid = m, m.txid
+		}
+		pending, offsets = pending[:0], offsets[:0]
+	}
+	w.size, w.tail = int64(committed), int64(committed)
+
+	if committed < len(data) && !db.readOnly {
+		log.Printf("Database wal recover; discard %d bytes", len(data)-committed)
+		return w.file.Truncate(w.size)
+	}
+	return nil
+}
+
+// 解析一条日志记录, 返回记录长度, 记录中的page和元数据
+func (db *DB) readWALFrame(b []byte) (int, pages, *meta, bool) {
+	if len(b) < walFrameHeaderSize || binary.LittleEndian.Uint32(b[0:4]) != walMagic {
+		return 0, nil, nil, false
+	}
+	count := int(binary.LittleEndian.Uint32(b[4:8]))
+	id := txid(binary.LittleEndian.Uint64(b[8:16]))
+
+	off := walFrameHeaderSize
+	pages := make(pages, 0, count)
+	for i := 0; i < count; i++ {
+		if len(b) < off+pageHeaderSize {
+			return 0, nil, nil, false
+		}
+		hdr := make([]byte, pageHeaderSize)
+		copy(hdr, b[off:])
+		size := (int((*page)(unsafe.Pointer(&hdr[0])).overflow) + 1) * db.pageSize
+		if len(b) < off+size {
+			return 0, nil, nil, false
+		}
+
+		buf := make([]byte, size)
+		copy(buf, b[off:off+size])
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		if db.cipher != nil {
+			var err error
+			if p, err = decryptPage(db.cipher, p, db.pageSize); err != nil {
+				return 0, nil, nil, false
+			}
+		}
+		pages = append(pages, p)
+		off += size
+	}
+
+	// meta page和校验和
+	if len(b) < off+db.pageSize+8 {
+		return 0, nil, nil, false
+	}
+	buf := make([]byte, db.pageSize)
+	copy(buf, b[off:off+db.pageSize])
+	m := &meta{}
+	db.pageInBuffer(buf, 0).meta().copy(m)
+	off += db.pageSize
+
+	if binary.LittleEndian.Uint64(b[off:off+8]) != walChecksum(b[:off]) {
+		return 0, nil, nil, false
+	} else if m.validate() != nil || m.txid != id {
+		return 0, nil, nil, false
+	}
+	return off + 8, pages, m, true
+}
+
+// 解析一条blob page记录, 返回记录长度, 事务id和记录中的page id
+func (db *DB) readWALBlobFrame(b []byte) (int, txid, []pgid, bool) {
+	if len(b) < walFrameHeaderSize || binary.LittleEndian.Uint32(b[0:4]) != walBlobMagic {
+		return 0, 0, nil, false
+	}
+	count := int(binary.LittleEndian.Uint32(b[4:8]))
+	id := txid(binary.LittleEndian.Uint64(b[8:16]))
+
+	end := walFrameHeaderSize + count*db.pageSize
+	if count <= 0 || count > walBlobFramePages || len(b) < end+8 {
+		return 0, 0, nil, false
+	} else if binary.LittleEndian.Uint64(b[end:end+8]) != walChecksum(b[:end]) {
+		return 0, 0, nil, false
+	}
+
+	// 加密时page头不加密, 可以直接读取page id
+	ids := make([]pgid, count)
+	for i := range ids {
+		hdr := make([]byte, pageHeaderSize)
+		copy(hdr, b[walFrameHeaderSize+i*db.pageSize:])
+		ids[i] = (*page)(unsafe.Pointer(&hdr[0])).id
+	}
+	return end + 8, id, ids, true
+}
+
+// 读取只保存在日志文件中的blob page, 开启加密时返回解密后的page
+func (db *DB) readWALPage(id pgid, off int64) *page {
+	return db.readPageAt(db.wal.file, id, off)
+}
+
+// 日志记录的校验和
+func walChecksum(b []byte) uint64 {
+	h := fnv.New64()
+	_, _ = h.Write(b)
+	return h.Sum64()
+}
+
+// 将脏页和元数据作为一条记录写入预写日志, 只需要一次fsync
+func (tx *Tx) writeWAL() error {
+	db := tx.db
+	pages := tx.dirtyPages()
+	tx.replication = tx.replicationFrame(pages)
+
+	// 记录本次提交写入的page, 用于增量备份
+	if db.pagelog != nil {
+		if err := db.pagelog.append(tx.meta.txid, tx.writtenIDs(pages)); err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, walFrameHeaderSize)
+	binary.LittleEndian.PutUint32(frame[0:4], walMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(pages)))
+	binary.LittleEndian.PutUint64(frame[8:16], uint64(tx.meta.txid))
+
+	// 日志中的page与数据库文件中的格式相同, 开启加密时同样加密
+	for _, p := range pages {
+		frame = append(frame, encodePage(db.cipher, p, db.pageSize)...)
+	}
+
+	buf := make([]byte, db.pageSize)
+	tx.meta.write(db.pageInBuffer(buf, 0))
+	frame = append(frame, buf...)
+	frame = binary.LittleEndian.AppendUint64(frame, walChecksum(frame))
+
+	m := &meta{}
+	tx.meta.copy(m)
+	if err := db.wal.append(frame, pages, m); err != nil {
+		return err
+	}
+
+	// 丢弃被覆盖的page的缓存
+	db.invalidatePages(pages)
+	return nil
+}
+
+// 将预写日志中的事务写回数据库文件, 然后清空日志
+// 检查点期间不能提交写事务, 读事务不受影响
+func (db *DB) Checkpoint() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	} else if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	return db.checkpoint()
+}
+
+func (db *DB) checkpoint() error {
+	w := db.wal
+	if w == nil || w.latest() == nil {
+		return nil
+	}
+
+	// 日志中的page只会被持有写锁的事务修改, 不需要加锁
+	// 高水位之上的page已经被截断, 不需要写回
+	pages := make(pages, 0, len(w.pages))
+	for _, p := range w.pages {
+		if p.id < w.meta.pgid {
+			pages = append(pages, p)
+		}
+	}
+	sort.Sort(pages)
+
+	// 先写入page, 再写入元数据, 崩溃时可以从日志重新恢复
+	if err := db.writePages(pages); err != nil {
+		return err
+	}
+
+	// 只保存在日志文件中的blob page不会被其他page的overflow覆盖, 最后从日志复制
+	if err := db.copyWALBlobs(); err != nil {
+		return err
+	}
+	if err := fdatasync(db); err != nil {
+		return err
+	}
+
+	buf := make([]byte, db.pageSize)
+	p := db.pageInBuffer(buf, 0)
+	m := *w.meta
+	m.write(p)
+	if _, err := db.file.WriteAt(buf, int64(p.id)*int64(db.pageSize)); err != nil {
+		return err
+	}
+	if err := fdatasync(db); err != nil {
+		return err
+	}
+	db.metalock.Lock()
+	err := db.reloadMeta()
+	db.metalock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := db.truncate(int(m.pgid) * db.pageSize); err != nil {
+		return err
+	}
+
+	return w.reset()
+}
+
+// 将只保存在日志文件中的blob page按id顺序复制到数据库文件, 日志中的page格式与数据库文件相同
+func (db *DB) copyWALBlobs() error {
+	w := db.wal
+	ids := make([]pgid, 0, len(w.blobs))
+	for id := range w.blobs {
+		if id < w.meta.pgid {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(pgids(ids))
+
+	buf := make([]byte, db.pageSize)
+	for _, id := range ids {
+		if _, err := w.file.ReadAt(buf, w.blobs[id]); err != nil {
+			return err
+		} else if _, err := db.file.WriteAt(buf, int64(id)*int64(db.pageSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 提交后日志超过大小限制时通知后台检查点
+func (db *DB) notifyCheckpoint() {
+	if db.checkpointC == nil {
+		return
+	}
+	db.wal.lock.RLock()
+	size := db.wal.size
+	db.wal.lock.RUnlock()
+	if size < int64(db.checkpointSize) {
+		return
+	}
+	select {
+	case db.checkpointC <- struct{}{}:
+	default:
+	}
+}
+
+// 启动后台检查点, interval<=0时只在日志超过大小限制时执行
+func (db *DB) startCheckpointer(interval time.Duration) {
+	db.checkpointC = make(chan struct{}, 1)
+	db.checkpointStop = make(chan struct{})
+	db.checkpointDone = make(chan struct{})
+	go func() {
+		defer close(db.checkpointDone)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+			case <-db.checkpointC:
+			case <-db.checkpointStop:
+				return
+			}
+			if err := db.Checkpoint(); err != nil {
+				log.Printf("Database checkpoint error: %s", err)
+			}
+		}
+	}()
+}
+
+// 停止后台检查点并等待正在执行的检查点结束
+func (db *DB) stopCheckpointer() {
+	if db.checkpointStop == nil {
+		return
+	}
+	close(db.checkpointStop)
+	<-db.checkpointDone
+	db.checkpointStop = nil
+	db.checkpointDone = nil
+}
@@ -0,0 +1,412 @@
+package pddb_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"pddb"
+	"testing"
+)
+
+// 写入n个key
+func putKeys(t *testing.T, db *pddb.DB, from, to int) {
+	for i := from; i < to; i++ {
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 检查key的数量和内容
+func checkKeys(t *testing.T, db *pddb.DB, n int) {
+	if err := db.View(func(tx *pddb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			t.Fatal("expected bucket")
+		}
+		var count int
+		if err := b.ForEach(func(k, v []byte) error {
+			if string(v) != fmt.Sprintf("value-%d", count) {
+				t.Fatalf("unexpected value: %s=%s", k, v)
+			}
+			count++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if count != n {
+			t.Fatalf("unexpected count: %d", count)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 返回文件大小
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// 复制文件, 模拟数据库进程崩溃时磁盘上的状态
+func copyFile(t *testing.T, src, dst string) {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 预写日志模式下提交写入日志, 检查点后写回数据库文件
+func TestOpen_WAL(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{WAL: true, CheckpointSize: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fileSize(t, path)
+
+	putKeys(t, db, 0, 100)
+	checkKeys(t, db, 100)
+	if fileSize(t, path+".wal") == 0 {
+		t.Fatal("expected wal data")
+	} else if fileSize(t, path) != size {
+		t.Fatal("unexpected database file write")
+	}
+
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, path+".wal"); n != 0 {
+		t.Fatalf("unexpected wal size: %d", n)
+	}
+	checkKeys(t, db, 100)
+
+	// 检查点之后继续写入
+	putKeys(t, db, 100, 200)
+	checkKeys(t, db, 200)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭时执行检查点, 不使用预写日志也可以读取
+	db, err = pddb.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	checkKeys(t, db, 200)
+}
+
+// 日志中被overflow覆盖的旧page在检查点时不能写回
+func TestOpen_WAL_Overflow(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{WAL: true, CheckpointSize: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	// 删除bucket释放连续的page, 之后的大value使用这些page作为overflow
+	if err := db.Update(func(tx *pddb.Tx) error {
+		b, err := tx.CreateBucket([]byte("tmp"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *pddb.Tx) error {
+		return tx.DeleteBucket([]byte("tmp"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	value := make([]byte, 20000)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Update(func(tx *pddb.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("large"), value)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	checkDB(t, db)
+	if err := db.View(func(tx *pddb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("large")); !bytes.Equal(v, value) {
+			t.Fatal("unexpected value")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 打开数据库时重放日志, 丢弃末尾不完整的记录
+func TestOpen_WAL_Recover(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	db, err := pddb.Open(path, 0666, &pddb.Options{WAL: true, CheckpointSize: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+
+	putKeys(t, db, 0, 50)
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 50, 120)
+
+	// 在数据库仍然打开时复制文件, 模拟崩溃
+	crashed := tempfile()
+	defer os.Remove(crashed)
+	defer os.Remove(crashed + ".wal")
+	copyFile(t, path, crashed)
+	copyFile(t, path+".wal", crashed+".wal")
+
+	// 日志末尾写入了一半的记录
+	f, err := os.OpenFile(crashed+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("1LAW\x03\x00\x00\x00partial")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只读打开时日志保留在内存中
+	ro, err := pddb.Open(crashed, 0666, &pddb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, ro, 120)
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不使用预写日志打开时, 恢复后删除日志
+	other, err := pddb.Open(crashed, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, other, 120)
+	putKeys(t, other, 120, 130)
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(crashed + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("expected wal removed: %v", err)
+	}
+
+	other, err = pddb.Open(crashed, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(other)
+	checkKeys(t, other, 130)
+}
+
+// 日志中的page同样加密, 超过大小限制时后台执行检查点
+func TestOpen_WAL_Cipher(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	options := &pddb.Options{WAL: true, CheckpointSize: 64 * 1024, Cipher: MustCipher(4)}
+	db, err := pddb.Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 300)
+	checkKeys(t, db, 300)
+
+	crashed := tempfile()
+	defer os.Remove(crashed)
+	defer os.Remove(crashed + ".wal")
+	copyFile(t, path, crashed)
+	copyFile(t, path+".wal", crashed+".wal")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = pddb.Open(crashed, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClose(db)
+	checkKeys(t, db, 300)
+}
+
+// 读取blobs中的blob, 不存在时返回nil
+func readBlob(t *testing.T, db *pddb.DB, key string) []byte {
+	var v []byte
+	if err := db.View(func(tx *pddb.Tx) error {
+		if b := tx.Bucket([]byte("blobs")); b != nil {
+			v = b.Get([]byte(key))
+		}
+		return tx.Check()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// 预写日志模式下blob page在提交之前按批写入日志, 回滚或者没有提交记录时丢弃
+func TestOpen_WAL_PutReader(t *testing.T) {
+	for name, options := range map[string]*pddb.Options{
+		"default": {WAL: true, CheckpointSize: 1 << 30},
+		"cipher":  {WAL: true, CheckpointSize: 1 << 30, Cipher: MustCipher(6)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := tempfile()
+			defer os.Remove(path)
+			defer os.Remove(path + ".wal")
+			db, err := pddb.Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			putKeys(t, db, 0, 10)
+
+			// 释放日志中的page, blob page重新分配时覆盖日志中的旧版本
+			for _, fn := range []func(tx *pddb.Tx) error{
+				func(tx *pddb.Tx) error {
+					b, err := tx.CreateBucket([]byte("tmp"))
+					if err != nil {
+						return err
+					}
+					for i := 0; i < 200; i++ {
+						if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1000)); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				func(tx *pddb.Tx) error { return tx.DeleteBucket([]byte("tmp")) },
+			} {
+				if err := db.Update(fn); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			blob := make([]byte, 1<<20+123)
+			rand.New(rand.NewSource(3)).Read(blob)
+			uncommitted := tempfile()
+			defer os.Remove(uncommitted)
+			defer os.Remove(uncommitted + ".wal")
+			if err := db.Update(func(tx *pddb.Tx) error {
+				b, err := tx.CreateBucket([]byte("blobs"))
+				if err != nil {
+					return err
+				}
+				size := fileSize(t, path+".wal")
+				if err := b.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob))); err != nil {
+					return err
+				}
+				// 提交之前blob已经写入日志
+				if fileSize(t, path+".wal") < size+int64(len(blob)) {
+					t.Fatal("expected blob pages in wal")
+				}
+				copyFile(t, path, uncommitted)
+				copyFile(t, path+".wal", uncommitted+".wal")
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			committed := tempfile()
+			defer os.Remove(committed)
+			defer os.Remove(committed + ".wal")
+			copyFile(t, path, committed)
+			copyFile(t, path+".wal", committed+".wal")
+
+			// 回滚时丢弃写入日志的blob page
+			size := fileSize(t, path+".wal")
+			if err := db.Update(func(tx *pddb.Tx) error {
+				if err := tx.Bucket([]byte("blobs")).PutReader([]byte("other"), bytes.NewReader(blob), int64(len(blob))); err != nil {
+					return err
+				}
+				return errors.New("rollback")
+			}); err == nil {
+				t.Fatal("expected error")
+			}
+			if fileSize(t, path+".wal") != size {
+				t.Fatal("expected wal truncated")
+			}
+			if v := readBlob(t, db, "blob"); !bytes.Equal(v, blob) {
+				t.Fatal("unexpected blob")
+			}
+
+			// 检查点后从数据库文件读取
+			if err := db.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			if v := readBlob(t, db, "blob"); !bytes.Equal(v, blob) {
+				t.Fatal("unexpected blob after checkpoint")
+			}
+
+			// 只有blob page记录的事务在恢复时被丢弃
+			other, err := pddb.Open(uncommitted, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkKeys(t, other, 10)
+			if readBlob(t, other, "blob") != nil {
+				t.Fatal("unexpected blob")
+			}
+			if err := other.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			other, err = pddb.Open(committed, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Close()
+			if v := readBlob(t, other, "blob"); !bytes.Equal(v, blob) {
+				t.Fatal("unexpected recovered blob")
+			}
+		})
+	}
+}